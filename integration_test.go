@@ -20,7 +20,6 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
-	"github.com/libp2p/go-libp2p/p2p/net/swarm"
 	ma "github.com/multiformats/go-multiaddr"
 
 	nymtransport "banyan/transports/nym/transport"
@@ -411,50 +410,13 @@ func TestNymTransportMultipleStreams(t *testing.T) {
 
 // createNymHost creates a libp2p host with Nym transport
 func createNymHost(ctx context.Context, nymURI string) (host.Host, error) {
-	// Generate a new identity for this host
-	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate identity: %w", err)
-	}
-
-	// Create the Nym transport directly
-	transport, err := nymtransport.New(ctx, nymURI, privKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Nym transport: %w", err)
-	}
-
-	// Create a basic host with no transports
-	// We'll add the Nym transport manually
 	h, err := libp2p.New(
-		libp2p.Identity(privKey),
-		libp2p.NoTransports,
 		libp2p.NoListenAddrs,
+		libp2p.Transport(nymtransport.NewConstructor(ctx, nymURI)),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
 	}
-
-	// Add the Nym transport to the swarm
-	swarmInst := h.Network().(*swarm.Swarm)
-	err = swarmInst.AddTransport(transport)
-	if err != nil {
-		h.Close()
-		return nil, fmt.Errorf("failed to add Nym transport: %w", err)
-	}
-
-	// Now start listening on the Nym address
-	// The transport knows its own listen address
-	listenAddrs := transport.Protocols()
-	for _, proto := range listenAddrs {
-		if proto == 999 { // Nym protocol code
-			// Build the multiaddr for this transport
-			// We need to get the actual listen address from the transport
-			// For now, we'll skip explicit listening since the transport
-			// is already set up to receive connections
-			break
-		}
-	}
-
 	return h, nil
 }
 
@@ -0,0 +1,284 @@
+package testutil
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"banyan/transports/nym/message"
+)
+
+const (
+	nymRequestSend          = 0x00
+	nymRequestSendAnonymous = 0x01
+	nymRequestReply         = 0x02
+	nymRequestSelfAddress   = 0x03
+
+	nymResponseReceived    = 0x01
+	nymResponseSelfAddress = 0x02
+
+	nymSenderTagSize = 32
+)
+
+// NymServer is an in-process stand-in for the Nym native client websocket API.
+// Every URL path is treated as a separate client whose recipient is derived
+// from the path, so reconnecting to the same URL yields the same address.
+// Send, anonymous send and reply requests are routed between connected clients.
+type NymServer struct {
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+	done     chan struct{}
+
+	mu         sync.Mutex
+	recipients map[string]message.Recipient
+	conns      map[string]*nymServerConn
+	stalled    map[string]bool
+	connects   map[string]int
+}
+
+type nymServerConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (c *nymServerConn) write(frame []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// NewNymServer starts a fake Nym client websocket server.
+func NewNymServer() *NymServer {
+	s := &NymServer{
+		done:       make(chan struct{}),
+		recipients: make(map[string]message.Recipient),
+		conns:      make(map[string]*nymServerConn),
+		stalled:    make(map[string]bool),
+		connects:   make(map[string]int),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// URL returns the websocket URI for the client called name.
+func (s *NymServer) URL(name string) string {
+	return "ws" + strings.TrimPrefix(s.srv.URL, "http") + "/" + name
+}
+
+// Recipient returns the address assigned to the client called name.
+func (s *NymServer) Recipient(name string) message.Recipient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.recipientLocked(name)
+}
+
+// SetRecipient overrides the address assigned to the client called name, as
+// when the Nym client re-registers with a gateway.
+func (s *NymServer) SetRecipient(name string, r message.Recipient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recipients[name] = r
+}
+
+// Reregister assigns the client called name the address r and, if it is
+// connected, tells it with an unsolicited self address response, as the Nym
+// client does after re-registering with a gateway mid-session.
+func (s *NymServer) Reregister(name string, r message.Recipient) error {
+	s.mu.Lock()
+	s.recipients[name] = r
+	conn := s.conns[name]
+	s.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.write(append([]byte{nymResponseSelfAddress}, r.Bytes()...))
+}
+
+// Disconnect drops the current websocket of the client called name.
+func (s *NymServer) Disconnect(name string) {
+	s.mu.Lock()
+	conn := s.conns[name]
+	delete(s.conns, name)
+	s.mu.Unlock()
+	if conn != nil {
+		conn.ws.Close()
+	}
+}
+
+// Connects returns how many websocket sessions the client called name has
+// opened, including reconnects.
+func (s *NymServer) Connects(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connects[name]
+}
+
+// StallReads stops reading requests from the client called name, so its
+// writes eventually block once the socket buffers fill up.
+func (s *NymServer) StallReads(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stalled[name] = true
+}
+
+// Close shuts the server down and drops all clients.
+func (s *NymServer) Close() {
+	close(s.done)
+	s.mu.Lock()
+	for name, conn := range s.conns {
+		conn.ws.Close()
+		delete(s.conns, name)
+	}
+	s.mu.Unlock()
+	s.srv.Close()
+}
+
+func (s *NymServer) recipientLocked(name string) message.Recipient {
+	if r, ok := s.recipients[name]; ok {
+		return r
+	}
+	var r message.Recipient
+	ident := sha256.Sum256([]byte("identity/" + name))
+	enc := sha256.Sum256([]byte("encryption/" + name))
+	gateway := sha256.Sum256([]byte("gateway/" + name))
+	copy(r.ClientIdentity[:], ident[:])
+	copy(r.ClientEncryptionKey[:], enc[:])
+	copy(r.Gateway[:], gateway[:])
+	s.recipients[name] = r
+	return r
+}
+
+func nymSenderTagFor(name string) [nymSenderTagSize]byte {
+	return sha256.Sum256([]byte("sender-tag/" + name))
+}
+
+func (s *NymServer) handle(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &nymServerConn{ws: ws}
+
+	s.mu.Lock()
+	if old := s.conns[name]; old != nil {
+		old.ws.Close()
+	}
+	s.conns[name] = conn
+	s.connects[name]++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		if s.conns[name] == conn {
+			delete(s.conns, name)
+		}
+		s.mu.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		stalled := s.stalled[name]
+		s.mu.Unlock()
+		if stalled {
+			<-s.done
+			return
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case nymRequestSelfAddress:
+			s.mu.Lock()
+			self := s.recipientLocked(name)
+			s.mu.Unlock()
+			if err := conn.write(append([]byte{nymResponseSelfAddress}, self.Bytes()...)); err != nil {
+				return
+			}
+		case nymRequestSend:
+			s.routeSend(data[1:], nil)
+		case nymRequestSendAnonymous:
+			tag := nymSenderTagFor(name)
+			s.routeSend(data[1:], &tag)
+		case nymRequestReply:
+			s.routeReply(data[1:])
+		}
+	}
+}
+
+// routeSend handles send and anonymous send requests. body starts at the
+// recipient and anonymous sends carry an extra reply SURB count.
+func (s *NymServer) routeSend(body []byte, tag *[nymSenderTagSize]byte) {
+	header := message.RecipientLength + 8
+	if tag != nil {
+		header += 4
+	}
+	if len(body) < header+8 {
+		return
+	}
+	recipient, err := message.RecipientFromBytes(body[:message.RecipientLength])
+	if err != nil {
+		return
+	}
+	payload := body[header+8:]
+	if binary.BigEndian.Uint64(body[header:header+8]) != uint64(len(payload)) {
+		return
+	}
+
+	s.mu.Lock()
+	var target *nymServerConn
+	for name, conn := range s.conns {
+		if s.recipientLocked(name).Equal(recipient) {
+			target = conn
+			break
+		}
+	}
+	s.mu.Unlock()
+	if target != nil {
+		target.write(receivedFrame(payload, tag))
+	}
+}
+
+func (s *NymServer) routeReply(body []byte) {
+	if len(body) < nymSenderTagSize+8+8 {
+		return
+	}
+	var tag [nymSenderTagSize]byte
+	copy(tag[:], body[:nymSenderTagSize])
+	payload := body[nymSenderTagSize+16:]
+
+	s.mu.Lock()
+	var target *nymServerConn
+	for name, conn := range s.conns {
+		if nymSenderTagFor(name) == tag {
+			target = conn
+			break
+		}
+	}
+	s.mu.Unlock()
+	if target != nil {
+		target.write(receivedFrame(payload, nil))
+	}
+}
+
+func receivedFrame(payload []byte, tag *[nymSenderTagSize]byte) []byte {
+	frame := []byte{nymResponseReceived, 0}
+	if tag != nil {
+		frame[1] = 1
+		frame = append(frame, tag[:]...)
+	}
+	frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	return append(frame, payload...)
+}
@@ -2,71 +2,157 @@ package testutil
 
 import (
 	"context"
+	"fmt"
+	"reflect"
 	"sync"
 
 	"banyan/transports/nym/message"
 	"banyan/transports/nym/mixnet"
 )
 
+// Interceptor is consulted for every message routed by a pipe network. It runs
+// on the routing goroutine, so blocking delays all traffic; returning false
+// drops the message.
+type Interceptor func(msg mixnet.OutboundMessage) bool
+
+// PipeEndpoint is one participant of a pipe network, shaped like the channels
+// returned by mixnet.Initialize.
+type PipeEndpoint struct {
+	Recipient message.Recipient
+	Inbound   <-chan mixnet.InboundMessage
+	Outbound  chan<- mixnet.OutboundMessage
+}
+
 // PipeNetwork creates two mixnet endpoints connected via in-memory channels.
-// Messages are routed based on recipient strings.
+// Messages are routed by recipient. Anonymous sends (those carrying reply
+// SURBs) are delivered with the sending endpoint's sender tag, and replies
+// addressed to a sender tag are routed back to that endpoint.
+// It panics if both recipients are equal.
 func PipeNetwork(ctx context.Context, aRecipient, bRecipient message.Recipient) (inboundA <-chan mixnet.InboundMessage, outboundA chan<- mixnet.OutboundMessage, inboundB <-chan mixnet.InboundMessage, outboundB chan<- mixnet.OutboundMessage) {
-	aIn := make(chan mixnet.InboundMessage, 64)
-	bIn := make(chan mixnet.InboundMessage, 64)
-	aOut := make(chan mixnet.OutboundMessage, 64)
-	bOut := make(chan mixnet.OutboundMessage, 64)
-
-	recipients := map[string]chan<- mixnet.InboundMessage{
-		aRecipient.String(): aIn,
-		bRecipient.String(): bIn,
+	return PipeNetworkWithInterceptor(ctx, aRecipient, bRecipient, nil)
+}
+
+// PipeNetworkWithInterceptor is PipeNetwork with every routed message passed
+// through intercept first, allowing tests to delay or drop traffic.
+func PipeNetworkWithInterceptor(ctx context.Context, aRecipient, bRecipient message.Recipient, intercept Interceptor) (inboundA <-chan mixnet.InboundMessage, outboundA chan<- mixnet.OutboundMessage, inboundB <-chan mixnet.InboundMessage, outboundB chan<- mixnet.OutboundMessage) {
+	endpoints, err := newPipeNetwork(ctx, intercept, []message.Recipient{aRecipient, bRecipient})
+	if err != nil {
+		panic(err)
+	}
+	return endpoints[0].Inbound, endpoints[0].Outbound, endpoints[1].Inbound, endpoints[1].Outbound
+}
+
+// PipeNetworkN connects any number of endpoints, routing like PipeNetwork.
+// Messages for unknown recipients are dropped. Inbound channels are closed
+// once ctx is done; outbound channels are left open, as closing them would
+// panic senders still blocked on them. Recipients must be distinct.
+func PipeNetworkN(ctx context.Context, recipients ...message.Recipient) ([]PipeEndpoint, error) {
+	return newPipeNetwork(ctx, nil, recipients)
+}
+
+func newPipeNetwork(ctx context.Context, intercept Interceptor, recipients []message.Recipient) ([]PipeEndpoint, error) {
+	if len(recipients) > 0xff-0xa {
+		return nil, fmt.Errorf("testutil: pipe network supports at most %d endpoints", 0xff-0xa)
+	}
+
+	var (
+		endpoints = make([]PipeEndpoint, len(recipients))
+		inbound   = make([]chan mixnet.InboundMessage, len(recipients))
+		outbound  = make([]chan mixnet.OutboundMessage, len(recipients))
+		senders   = make([]mixnet.SenderTag, len(recipients))
+		byAddress = make(map[message.Recipient]chan<- mixnet.InboundMessage, len(recipients))
+		byTag     = make(map[mixnet.SenderTag]chan<- mixnet.InboundMessage, len(recipients))
+	)
+	for i, r := range recipients {
+		if _, dup := byAddress[r]; dup {
+			return nil, fmt.Errorf("testutil: pipe network endpoints %d and %d share recipient %s", indexOf(recipients, r), i, r)
+		}
+		inbound[i] = make(chan mixnet.InboundMessage, 64)
+		outbound[i] = make(chan mixnet.OutboundMessage, 64)
+		senders[i] = pipeSenderTag(byte(0xa + i))
+		byAddress[r] = inbound[i]
+		byTag[senders[i]] = inbound[i]
+		endpoints[i] = PipeEndpoint{Recipient: r, Inbound: inbound[i], Outbound: outbound[i]}
 	}
 
 	var once sync.Once
 	closeAll := func() {
 		once.Do(func() {
-			close(aIn)
-			close(bIn)
-			close(aOut)
-			close(bOut)
+			for i := range recipients {
+				close(inbound[i])
+			}
 		})
 	}
 
+	// route delivers msg and reports whether the pipe should keep running.
+	route := func(msg mixnet.OutboundMessage, from int) bool {
+		if intercept != nil && !intercept(msg) {
+			return true
+		}
+		var target chan<- mixnet.InboundMessage
+		in := mixnet.InboundMessage{Message: msg.Message}
+		if msg.SenderTag != nil {
+			target = byTag[*msg.SenderTag]
+		} else {
+			target = byAddress[msg.Recipient]
+			if msg.ReplySURBs > 0 {
+				tag := senders[from]
+				in.SenderTag = &tag
+			}
+		}
+		// Like the Nym client, name only the address a connection request
+		// claims, never the endpoint that actually sent it.
+		if msg.Message != nil && msg.Message.Type == message.MessageTypeConnectionRequest && msg.Message.Connection != nil {
+			in.Sender = msg.Message.Connection.Recipient
+		}
+		if target == nil {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case target <- in:
+			return true
+		}
+	}
+
+	// Select over ctx and every outbound channel from a single goroutine so
+	// that a blocking interceptor holds up the whole network.
+	cases := make([]reflect.SelectCase, len(recipients)+1)
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+	for i := range recipients {
+		cases[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(outbound[i])}
+	}
+
 	go func() {
 		defer closeAll()
 		for {
-			select {
-			case <-ctx.Done():
+			chosen, value, ok := reflect.Select(cases)
+			if chosen == 0 || !ok {
+				return
+			}
+			if !route(value.Interface().(mixnet.OutboundMessage), chosen-1) {
 				return
-			case msg, ok := <-aOut:
-				if !ok {
-					return
-				}
-				target := recipients[msg.Recipient.String()]
-				if target == nil {
-					continue
-				}
-				select {
-				case <-ctx.Done():
-					return
-				case target <- mixnet.InboundMessage{Message: msg.Message}:
-				}
-			case msg, ok := <-bOut:
-				if !ok {
-					return
-				}
-				target := recipients[msg.Recipient.String()]
-				if target == nil {
-					continue
-				}
-				select {
-				case <-ctx.Done():
-					return
-				case target <- mixnet.InboundMessage{Message: msg.Message}:
-				}
 			}
 		}
 	}()
 
-	return aIn, aOut, bIn, bOut
+	return endpoints, nil
+}
+
+func indexOf(recipients []message.Recipient, r message.Recipient) int {
+	for i := range recipients {
+		if recipients[i].Equal(r) {
+			return i
+		}
+	}
+	return -1
 }
 
+func pipeSenderTag(seed byte) mixnet.SenderTag {
+	var tag mixnet.SenderTag
+	for i := range tag {
+		tag[i] = seed
+	}
+	return tag
+}
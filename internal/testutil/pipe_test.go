@@ -0,0 +1,109 @@
+package testutil
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+func pipeRecipient(seed byte) message.Recipient {
+	var r message.Recipient
+	for i := range r.ClientIdentity {
+		r.ClientIdentity[i] = seed
+	}
+	return r
+}
+
+func TestPipeNetworkRejectsDuplicateRecipients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := PipeNetworkN(ctx, pipeRecipient(1), pipeRecipient(2), pipeRecipient(1)); err == nil ||
+		!strings.Contains(err.Error(), "share recipient") {
+		t.Fatalf("expected a duplicate recipient error, got %v", err)
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatalf("PipeNetwork accepted identical recipients")
+		}
+		if err, ok := r.(error); !ok || !strings.Contains(err.Error(), "share recipient") {
+			t.Fatalf("unclear panic for identical recipients: %v", r)
+		}
+	}()
+	PipeNetwork(ctx, pipeRecipient(1), pipeRecipient(1))
+}
+
+func TestPipeNetworkNRoutesAmongEndpoints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	endpoints, err := PipeNetworkN(ctx, pipeRecipient(1), pipeRecipient(2), pipeRecipient(3))
+	if err != nil {
+		t.Fatalf("PipeNetworkN: %v", err)
+	}
+
+	send := func(from int, to message.Recipient, nonce uint64) {
+		endpoints[from].Outbound <- mixnet.OutboundMessage{
+			Recipient: to,
+			Message: &message.Message{
+				Type:      message.MessageTypeTransport,
+				Transport: &message.TransportMessage{Nonce: nonce},
+			},
+		}
+	}
+	expect := func(at int, nonce uint64) {
+		t.Helper()
+		select {
+		case in := <-endpoints[at].Inbound:
+			if got := in.Message.Transport.Nonce; got != nonce {
+				t.Fatalf("endpoint %d got nonce %d, want %d", at, got, nonce)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("endpoint %d received nothing", at)
+		}
+	}
+
+	send(0, endpoints[2].Recipient, 1)
+	expect(2, 1)
+	send(2, endpoints[1].Recipient, 2)
+	expect(1, 2)
+	// Unknown recipients are dropped without disturbing later traffic.
+	send(1, pipeRecipient(9), 3)
+	send(1, endpoints[0].Recipient, 4)
+	expect(0, 4)
+
+	// Anonymous sends carry the sender's tag and replies route back by it.
+	endpoints[1].Outbound <- mixnet.OutboundMessage{
+		Recipient:  endpoints[2].Recipient,
+		ReplySURBs: 1,
+		Message:    &message.Message{Type: message.MessageTypeTransport, Transport: &message.TransportMessage{Nonce: 5}},
+	}
+	var tag *mixnet.SenderTag
+	select {
+	case in := <-endpoints[2].Inbound:
+		tag = in.SenderTag
+	case <-time.After(time.Second):
+		t.Fatalf("anonymous send not delivered")
+	}
+	if tag == nil {
+		t.Fatalf("anonymous send delivered without a sender tag")
+	}
+	endpoints[2].Outbound <- mixnet.OutboundMessage{
+		SenderTag: tag,
+		Message:   &message.Message{Type: message.MessageTypeTransport, Transport: &message.TransportMessage{Nonce: 6}},
+	}
+	expect(1, 6)
+
+	cancel()
+	// Every inbound channel is closed once the context is done.
+	for _, ep := range endpoints {
+		for range ep.Inbound {
+		}
+	}
+}
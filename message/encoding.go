@@ -2,43 +2,243 @@ package message
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// WireVersion selects the layout messages are encoded in.
+type WireVersion byte
+
+const (
+	// WireUnversioned is the layout used by rust-libp2p-nym, which starts
+	// directly with the message type.
+	WireUnversioned WireVersion = 0
+	// WireV1 is the unversioned layout behind a version byte.
+	WireV1 WireVersion = 1
+)
+
+// versionMarker is set in a leading version byte. Message types stay below
+// it, so Decode can tell the layouts apart.
+const versionMarker = 0x80
+
+// checksumFlag is set in the version byte of a transport message followed by
+// a CRC-32C of its nonce, connection ID and substream bytes.
+const checksumFlag = 0x40
+
+// checksumLength is the size of the trailing checksum.
+const checksumLength = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrUnsupportedVersion is returned for a wire version this package does
+	// not know.
+	ErrUnsupportedVersion = errors.New("message: unsupported wire version")
+	// ErrChecksumMismatch is returned when a transport message does not
+	// match its checksum, meaning it was corrupted or truncated in transit.
+	ErrChecksumMismatch = errors.New("message: checksum mismatch")
+	// ErrMessageTooLarge is returned for a message larger than the decoding
+	// limit.
+	ErrMessageTooLarge = errors.New("message: message too large")
+)
+
+// DefaultMaxMessageSize is the largest transport message Decode accepts, far
+// above the fragments this module sends.
+const DefaultMaxMessageSize = 4 << 20
+
 // Encode serialises the message to the on-wire representation used by rust-libp2p-nym.
 func Encode(msg *Message) ([]byte, error) {
 	if msg == nil {
 		return nil, fmt.Errorf("message: encode nil message")
 	}
+	return AppendEncode(make([]byte, 0, EncodedLen(msg)), msg)
+}
+
+// AppendEncode appends the encoding of msg to dst and returns the extended
+// buffer, letting hot paths reuse one buffer across messages.
+func AppendEncode(dst []byte, msg *Message) ([]byte, error) {
+	if msg == nil {
+		return dst, fmt.Errorf("message: encode nil message")
+	}
 
-	var payload []byte
 	switch msg.Type {
-	case MessageTypeConnectionRequest, MessageTypeConnectionResponse:
+	case MessageTypeConnectionRequest, MessageTypeConnectionResponse, MessageTypeConnectionReject, MessageTypeConnectionAck,
+		MessageTypePing, MessageTypePong, MessageTypeConnectionClose, MessageTypeConnectionPing, MessageTypeConnectionPong:
 		cm := msg.Connection
 		if cm == nil {
-			return nil, fmt.Errorf("message: missing connection payload")
+			return dst, fmt.Errorf("message: missing connection payload")
 		}
-		payload = encodeConnectionMessage(cm)
+		dst = append(dst, byte(msg.Type))
+		return appendConnectionMessage(dst, cm), nil
 	case MessageTypeTransport:
 		tm := msg.Transport
 		if tm == nil {
-			return nil, fmt.Errorf("message: missing transport payload")
+			return dst, fmt.Errorf("message: missing transport payload")
 		}
-		payload = encodeTransportMessage(tm)
+		dst = append(dst, byte(msg.Type))
+		return appendTransportMessage(dst, tm), nil
+	default:
+		return dst, fmt.Errorf("message: unknown type %d", msg.Type)
+	}
+}
+
+// AppendEncodeVersion is AppendEncode in the layout of version v.
+func AppendEncodeVersion(dst []byte, msg *Message, v WireVersion) ([]byte, error) {
+	switch v {
+	case WireUnversioned:
+	case WireV1:
+		dst = append(dst, versionMarker|byte(v))
+	default:
+		return dst, fmt.Errorf("%w %d", ErrUnsupportedVersion, v)
+	}
+	return AppendEncode(dst, msg)
+}
+
+// AppendEncodeChecksum is AppendEncodeVersion that also appends a checksum to
+// transport messages, which Decode verifies. Other messages are encoded
+// without one. The checksum is flagged in the version byte, so
+// WireUnversioned is encoded as WireV1.
+func AppendEncodeChecksum(dst []byte, msg *Message, v WireVersion) ([]byte, error) {
+	if msg == nil || msg.Type != MessageTypeTransport {
+		return AppendEncodeVersion(dst, msg, v)
+	}
+	if v == WireUnversioned {
+		v = WireV1
+	}
+	start := len(dst)
+	dst, err := AppendEncodeVersion(dst, msg, v)
+	if err != nil {
+		return dst, err
+	}
+	dst[start] |= checksumFlag
+	sum := crc32.Checksum(dst[start+2:], castagnoli)
+	return binary.BigEndian.AppendUint32(dst, sum), nil
+}
+
+// HasChecksum reports whether the encoded message in data carries a checksum.
+func HasChecksum(data []byte) bool {
+	return len(data) > 0 && data[0]&(versionMarker|checksumFlag) == versionMarker|checksumFlag
+}
+
+// TransportOverheadFor is TransportOverhead for transport messages encoded by
+// AppendEncodeVersion with v, or by AppendEncodeChecksum if checksum is set.
+func TransportOverheadFor(v WireVersion, checksum bool) int {
+	switch {
+	case checksum:
+		return 1 + TransportOverhead + checksumLength
+	case v != WireUnversioned:
+		return 1 + TransportOverhead
 	default:
-		return nil, fmt.Errorf("message: unknown type %d", msg.Type)
+		return TransportOverhead
 	}
+}
 
-	out := make([]byte, 1+len(payload))
-	out[0] = byte(msg.Type)
-	copy(out[1:], payload)
-	return out, nil
+// EncodedLen returns the size of msg's encoding, or 0 if it cannot be encoded.
+func EncodedLen(msg *Message) int {
+	switch {
+	case msg == nil:
+		return 0
+	case msg.Connection != nil && msg.Type != MessageTypeTransport:
+		n := 1 + ConnectionIDLength + 1 + len(msg.Connection.PeerID)
+		if msg.Connection.Recipient != nil {
+			n += RecipientLength
+		}
+		if k := len(msg.Connection.PublicKey); k > 0 {
+			n += uvarintLen(uint64(k)) + k
+		}
+		if msg.Connection.StreamWindow > 0 {
+			n += streamWindowLength
+		}
+		return n
+	case msg.Transport != nil && msg.Type == MessageTypeTransport:
+		return TransportOverhead + len(msg.Transport.Message.Data)
+	default:
+		return 0
+	}
 }
 
-// Decode parses a binary message emitted by rust-libp2p-nym.
+// Decode parses a binary message emitted by rust-libp2p-nym, or by this
+// package in any supported wire version.
 func Decode(data []byte) (*Message, error) {
+	msg, _, err := DecodeVersion(data)
+	return msg, err
+}
+
+// PeekType returns the type of the encoded message in data without decoding
+// the rest of it.
+func PeekType(data []byte) (MessageType, error) {
+	payload, _, err := stripVersion(data)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) < 1 {
+		return 0, fmt.Errorf("message: decode short buffer")
+	}
+	return MessageType(payload[0]), nil
+}
+
+// stripVersion removes a leading version byte from data, returning the
+// unversioned encoding and the version it was in.
+func stripVersion(data []byte) ([]byte, WireVersion, error) {
+	if len(data) == 0 || data[0]&versionMarker == 0 {
+		return data, WireUnversioned, nil
+	}
+	if v := WireVersion(data[0] &^ (versionMarker | checksumFlag)); v != WireV1 {
+		return nil, 0, fmt.Errorf("%w %d", ErrUnsupportedVersion, v)
+	}
+	return data[1:], WireV1, nil
+}
+
+// DecodeVersion is Decode that also reports the wire version data was in.
+func DecodeVersion(data []byte) (*Message, WireVersion, error) {
+	return DecodeLimit(data, DefaultMaxMessageSize)
+}
+
+// DecodeLimit is DecodeVersion that refuses transport messages larger than
+// maxSize bytes with ErrMessageTooLarge. Zero or a negative maxSize means
+// DefaultMaxMessageSize.
+func DecodeLimit(data []byte, maxSize int) (*Message, WireVersion, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	checksummed := HasChecksum(data)
+	data, version, err := stripVersion(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if checksummed {
+		if data, err = verifyChecksum(data); err != nil {
+			return nil, 0, err
+		}
+	}
+	msg, err := decodeUnversioned(data, maxSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return msg, version, nil
+}
+
+// verifyChecksum checks the trailing checksum of the transport message in
+// data and returns data without it.
+func verifyChecksum(data []byte) ([]byte, error) {
+	if len(data) < 1+checksumLength {
+		return nil, fmt.Errorf("message: decode short buffer")
+	}
+	if MessageType(data[0]) != MessageTypeTransport {
+		return nil, fmt.Errorf("message: checksum on type %d message", data[0])
+	}
+	body := data[:len(data)-checksumLength]
+	want := binary.BigEndian.Uint32(data[len(body):])
+	if crc32.Checksum(body[1:], castagnoli) != want {
+		return nil, ErrChecksumMismatch
+	}
+	return body, nil
+}
+
+func decodeUnversioned(data []byte, maxSize int) (*Message, error) {
 	if len(data) < 1 {
 		return nil, fmt.Errorf("message: decode short buffer")
 	}
@@ -46,42 +246,85 @@ func Decode(data []byte) (*Message, error) {
 	msgType := MessageType(data[0])
 	payload := data[1:]
 	switch msgType {
-	case MessageTypeConnectionRequest, MessageTypeConnectionResponse:
+	case MessageTypeConnectionRequest, MessageTypeConnectionResponse, MessageTypeConnectionReject, MessageTypeConnectionAck,
+		MessageTypePing, MessageTypePong, MessageTypeConnectionClose, MessageTypeConnectionPing, MessageTypeConnectionPong:
 		cm, err := decodeConnectionMessage(payload)
 		if err != nil {
 			return nil, err
 		}
 		return &Message{Type: msgType, Connection: cm}, nil
 	case MessageTypeTransport:
-		tm, err := decodeTransportMessage(payload)
-		if err != nil {
+		// Allocate the message and its transport payload together.
+		m := &struct {
+			Message
+			tm TransportMessage
+		}{}
+		if err := decodeTransportMessage(&m.tm, payload, maxSize); err != nil {
 			return nil, err
 		}
-		return &Message{Type: msgType, Transport: tm}, nil
+		m.Type, m.Transport = msgType, &m.tm
+		return &m.Message, nil
 	default:
 		return nil, fmt.Errorf("message: unknown type %d", msgType)
 	}
 }
 
-func encodeConnectionMessage(cm *ConnectionMessage) []byte {
-	peerBytes := []byte(cm.PeerID)
+// Bits of the flag byte following the connection ID. rust-libp2p-nym only
+// knows the recipient bit, so the others are set only when needed.
+const (
+	connFlagRecipient byte = 1 << iota
+	connFlagPublicKey
+	connFlagStreamWindow
+	connFlagCloseControl
+)
+
+// streamWindowLength is the size of an encoded stream window.
+const streamWindowLength = 4
+
+func appendConnectionMessage(dst []byte, cm *ConnectionMessage) []byte {
+	dst = append(dst, cm.ID[:]...)
 	var flag byte
-	var recipientBytes []byte
 	if cm.Recipient != nil {
-		flag = 1
-		recipientBytes = cm.Recipient.Bytes()
+		flag |= connFlagRecipient
+	}
+	if len(cm.PublicKey) > 0 {
+		flag |= connFlagPublicKey
+	}
+	if cm.StreamWindow > 0 {
+		flag |= connFlagStreamWindow
+	}
+	if cm.CloseControl {
+		flag |= connFlagCloseControl
+	}
+	dst = append(dst, flag)
+	if cm.Recipient != nil {
+		dst = append(dst, cm.Recipient.ClientIdentity[:]...)
+		dst = append(dst, cm.Recipient.ClientEncryptionKey[:]...)
+		dst = append(dst, cm.Recipient.Gateway[:]...)
+	}
+	if len(cm.PublicKey) > 0 {
+		dst = binary.AppendUvarint(dst, uint64(len(cm.PublicKey)))
+		dst = append(dst, cm.PublicKey...)
+	}
+	if cm.StreamWindow > 0 {
+		dst = binary.BigEndian.AppendUint32(dst, cm.StreamWindow)
 	}
+	return append(dst, cm.PeerID...)
+}
 
-	out := make([]byte, ConnectionIDLength+1+len(recipientBytes)+len(peerBytes))
-	copy(out[:ConnectionIDLength], cm.ID[:])
-	out[ConnectionIDLength] = flag
-	offset := ConnectionIDLength + 1
-	copy(out[offset:], recipientBytes)
-	offset += len(recipientBytes)
-	copy(out[offset:], peerBytes)
-	return out
+func uvarintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
 }
 
+// maxPeerIDLength bounds the peer ID of a connection message. Peer IDs are
+// multihashes of at most a SHA-512 digest or an inlined Ed25519 key, far
+// below it.
+const maxPeerIDLength = 128
+
 func decodeConnectionMessage(data []byte) (*ConnectionMessage, error) {
 	minLen := ConnectionIDLength + 1
 	if len(data) < minLen {
@@ -92,8 +335,12 @@ func decodeConnectionMessage(data []byte) (*ConnectionMessage, error) {
 	flag := data[ConnectionIDLength]
 	cursor := ConnectionIDLength + 1
 
+	if flag&^(connFlagRecipient|connFlagPublicKey|connFlagStreamWindow|connFlagCloseControl) != 0 {
+		return nil, fmt.Errorf("message: invalid recipient flag %d", flag)
+	}
+
 	var recipient *Recipient
-	if flag == 1 {
+	if flag&connFlagRecipient != 0 {
 		if len(data) < cursor+RecipientLength {
 			return nil, fmt.Errorf("message: connection recipient truncated")
 		}
@@ -103,86 +350,110 @@ func decodeConnectionMessage(data []byte) (*ConnectionMessage, error) {
 		}
 		recipient = &rec
 		cursor += RecipientLength
-	} else if flag != 0 {
-		return nil, fmt.Errorf("message: invalid recipient flag %d", flag)
 	}
 
-	if len(data) <= cursor {
+	var publicKey []byte
+	if flag&connFlagPublicKey != 0 {
+		size, n := binary.Uvarint(data[cursor:])
+		// Only the minimal length encoding is accepted, so that decoding
+		// and re-encoding a message is lossless. The size is compared before
+		// converting it, so a huge declared length cannot wrap around.
+		if n <= 0 || n != uvarintLen(size) || size == 0 || size > uint64(len(data)-cursor-n) {
+			return nil, fmt.Errorf("message: connection public key truncated")
+		}
+		cursor += n
+		publicKey = append([]byte(nil), data[cursor:cursor+int(size)]...)
+		cursor += int(size)
+	}
+
+	var streamWindow uint32
+	if flag&connFlagStreamWindow != 0 {
+		if len(data) < cursor+streamWindowLength {
+			return nil, fmt.Errorf("message: connection stream window truncated")
+		}
+		streamWindow = binary.BigEndian.Uint32(data[cursor:])
+		// Zero is encoded by leaving the flag out, keeping decoding lossless.
+		if streamWindow == 0 {
+			return nil, fmt.Errorf("message: zero connection stream window")
+		}
+		cursor += streamWindowLength
+	}
+
+	// The peer ID takes the rest of the message.
+	tail := data[cursor:]
+	if len(tail) == 0 {
 		return nil, fmt.Errorf("message: missing peer id bytes")
 	}
+	if len(tail) > maxPeerIDLength {
+		return nil, fmt.Errorf("message: peer id of %d bytes exceeds %d", len(tail), maxPeerIDLength)
+	}
 
-	peerID, err := peer.IDFromBytes(data[cursor:])
+	peerID, err := peer.IDFromBytes(tail)
 	if err != nil {
 		return nil, fmt.Errorf("message: parse peer id: %w", err)
 	}
 
 	return &ConnectionMessage{
-		PeerID:    peerID,
-		Recipient: recipient,
-		ID:        id,
+		PeerID:       peerID,
+		Recipient:    recipient,
+		ID:           id,
+		PublicKey:    publicKey,
+		StreamWindow: streamWindow,
+		CloseControl: flag&connFlagCloseControl != 0,
 	}, nil
 }
 
-func encodeTransportMessage(tm *TransportMessage) []byte {
-	substreamBytes := encodeSubstreamMessage(&tm.Message)
-
-	out := make([]byte, 8+ConnectionIDLength+len(substreamBytes))
-	binary.BigEndian.PutUint64(out[:8], tm.Nonce)
-	copy(out[8:8+ConnectionIDLength], tm.ID[:])
-	copy(out[8+ConnectionIDLength:], substreamBytes)
-	return out
+func appendTransportMessage(dst []byte, tm *TransportMessage) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, tm.Nonce)
+	dst = append(dst, tm.ID[:]...)
+	return appendSubstreamMessage(dst, &tm.Message)
 }
 
-func decodeTransportMessage(data []byte) (*TransportMessage, error) {
+func decodeTransportMessage(tm *TransportMessage, data []byte, maxSize int) error {
 	minLen := 8 + ConnectionIDLength + SubstreamIDLength + 1
 	if len(data) < minLen {
-		return nil, fmt.Errorf("message: transport payload too short")
+		return fmt.Errorf("message: transport payload too short")
 	}
-
-	nonce := binary.BigEndian.Uint64(data[:8])
-	var id ConnectionID
-	copy(id[:], data[8:8+ConnectionIDLength])
-
-	substream, err := decodeSubstreamMessage(data[8+ConnectionIDLength:])
-	if err != nil {
-		return nil, err
+	if len(data) > maxSize {
+		return fmt.Errorf("%w: %d byte transport payload exceeds %d", ErrMessageTooLarge, len(data), maxSize)
 	}
 
-	return &TransportMessage{
-		Nonce:   nonce,
-		Message: *substream,
-		ID:      id,
-	}, nil
+	tm.Nonce = binary.BigEndian.Uint64(data[:8])
+	copy(tm.ID[:], data[8:8+ConnectionIDLength])
+	return decodeSubstreamMessage(&tm.Message, data[8+ConnectionIDLength:])
 }
 
-func encodeSubstreamMessage(sm *SubstreamMessage) []byte {
-	out := make([]byte, SubstreamIDLength+1+len(sm.Data))
-	copy(out[:SubstreamIDLength], sm.ID[:])
-	out[SubstreamIDLength] = byte(sm.Type)
-	copy(out[SubstreamIDLength+1:], sm.Data)
-	return out
+func appendSubstreamMessage(dst []byte, sm *SubstreamMessage) []byte {
+	dst = append(dst, sm.ID[:]...)
+	dst = append(dst, byte(sm.Type))
+	return append(dst, sm.Data...)
 }
 
-func decodeSubstreamMessage(data []byte) (*SubstreamMessage, error) {
+func decodeSubstreamMessage(sm *SubstreamMessage, data []byte) error {
 	if len(data) < SubstreamIDLength+1 {
-		return nil, fmt.Errorf("message: substream payload too short")
+		return fmt.Errorf("message: substream payload too short")
 	}
-	var id SubstreamID
-	copy(id[:], data[:SubstreamIDLength])
-	msgType := SubstreamMessageType(data[SubstreamIDLength])
+	copy(sm.ID[:], data[:SubstreamIDLength])
+	sm.Type = SubstreamMessageType(data[SubstreamIDLength])
 
 	payload := data[SubstreamIDLength+1:]
-	switch msgType {
-	case SubstreamMessageOpenRequest, SubstreamMessageOpenResponse, SubstreamMessageClose:
+	switch sm.Type {
+	case SubstreamMessageOpenResponse, SubstreamMessageClose, SubstreamMessageCloseAck, SubstreamMessageCloseWrite:
 		if len(payload) != 0 {
-			return nil, fmt.Errorf("message: unexpected payload for substream control message")
+			return fmt.Errorf("message: unexpected payload for substream control message")
+		}
+	case SubstreamMessageWindowUpdate:
+		if len(payload) != WindowUpdateLength {
+			return fmt.Errorf("message: window update payload must be %d bytes", WindowUpdateLength)
+		}
+		sm.Data = append([]byte(nil), payload...)
+	case SubstreamMessageOpenRequest, SubstreamMessageData:
+		// An open request may carry the stream's first data.
+		if len(payload) > 0 {
+			sm.Data = append([]byte(nil), payload...)
 		}
-		return &SubstreamMessage{ID: id, Type: msgType}, nil
-	case SubstreamMessageData:
-		buf := make([]byte, len(payload))
-		copy(buf, payload)
-		return &SubstreamMessage{ID: id, Type: msgType, Data: buf}, nil
 	default:
-		return nil, fmt.Errorf("message: unknown substream type %d", msgType)
+		return fmt.Errorf("message: unknown substream type %d", sm.Type)
 	}
+	return nil
 }
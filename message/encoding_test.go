@@ -1,6 +1,8 @@
 package message
 
 import (
+	"encoding/binary"
+	"errors"
 	"testing"
 
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -63,6 +65,149 @@ func TestConnectionMessageEncoding(t *testing.T) {
 	}
 }
 
+func TestConnectionMessagePublicKeyEncoding(t *testing.T) {
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("Failed to decode peer ID: %v", err)
+	}
+	recipient := Recipient{ClientIdentity: [32]byte{1}, ClientEncryptionKey: [32]byte{2}, Gateway: [32]byte{3}}
+	key := make([]byte, 300)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	for _, rec := range []*Recipient{nil, &recipient} {
+		msg := &Message{
+			Type:       MessageTypeConnectionRequest,
+			Connection: &ConnectionMessage{PeerID: peerID, Recipient: rec, ID: ConnectionID{7}, PublicKey: key},
+		}
+		encoded, err := Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if len(encoded) != EncodedLen(msg) {
+			t.Fatalf("EncodedLen = %d, encoding is %d bytes", EncodedLen(msg), len(encoded))
+		}
+		decoded, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		cm := decoded.Connection
+		if string(cm.PublicKey) != string(key) || cm.PeerID != peerID || (cm.Recipient == nil) != (rec == nil) {
+			t.Fatalf("round trip changed connection message: %+v", cm)
+		}
+
+		// Without a key the encoding stays what rust-libp2p-nym expects.
+		msg.Connection.PublicKey = nil
+		plain, err := Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if flag := plain[1+ConnectionIDLength]; flag > 1 {
+			t.Fatalf("keyless message has flag %d", flag)
+		}
+	}
+}
+
+func TestConnectionMessageStreamWindowEncoding(t *testing.T) {
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("Failed to decode peer ID: %v", err)
+	}
+	recipient := Recipient{ClientIdentity: [32]byte{1}, ClientEncryptionKey: [32]byte{2}, Gateway: [32]byte{3}}
+
+	for _, key := range [][]byte{nil, {4, 5, 6}} {
+		msg := &Message{
+			Type:       MessageTypeConnectionResponse,
+			Connection: &ConnectionMessage{PeerID: peerID, Recipient: &recipient, ID: ConnectionID{8}, PublicKey: key, StreamWindow: 1 << 16},
+		}
+		encoded, err := Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if len(encoded) != EncodedLen(msg) {
+			t.Fatalf("EncodedLen = %d, encoding is %d bytes", EncodedLen(msg), len(encoded))
+		}
+		decoded, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		cm := decoded.Connection
+		if cm.StreamWindow != 1<<16 || string(cm.PublicKey) != string(key) || cm.PeerID != peerID {
+			t.Fatalf("round trip changed connection message: %+v", cm)
+		}
+	}
+
+	// A flagged window of zero has a shorter encoding and is refused.
+	msg := &Message{
+		Type:       MessageTypeConnectionResponse,
+		Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{8}, StreamWindow: 1},
+	}
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	binary.BigEndian.PutUint32(encoded[1+ConnectionIDLength+1:], 0)
+	if _, err := Decode(encoded); err == nil {
+		t.Fatalf("Decode accepted a zero stream window")
+	}
+}
+
+func TestConnectionMessageCloseControlEncoding(t *testing.T) {
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("Failed to decode peer ID: %v", err)
+	}
+	recipient := Recipient{ClientIdentity: [32]byte{1}, ClientEncryptionKey: [32]byte{2}, Gateway: [32]byte{3}}
+
+	for _, closeControl := range []bool{false, true} {
+		msg := &Message{
+			Type:       MessageTypeConnectionRequest,
+			Connection: &ConnectionMessage{PeerID: peerID, Recipient: &recipient, ID: ConnectionID{9}, CloseControl: closeControl},
+		}
+		encoded, err := Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if len(encoded) != EncodedLen(msg) {
+			t.Fatalf("EncodedLen = %d, encoding is %d bytes", EncodedLen(msg), len(encoded))
+		}
+		// Without the flag the message stays readable by rust-libp2p-nym.
+		if flag := encoded[1+ConnectionIDLength]; !closeControl && flag != 1 {
+			t.Fatalf("message without close control flagged %d", flag)
+		}
+		decoded, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if cm := decoded.Connection; cm.CloseControl != closeControl || cm.PeerID != peerID {
+			t.Fatalf("round trip changed connection message: %+v", cm)
+		}
+	}
+}
+
+func TestConnectionRejectEncoding(t *testing.T) {
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("Failed to decode peer ID: %v", err)
+	}
+	msg := &Message{
+		Type:       MessageTypeConnectionReject,
+		Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{3}},
+	}
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.Type != MessageTypeConnectionReject || decoded.Connection.ID != msg.Connection.ID {
+		t.Errorf("Reject mismatch: got type %d id %s", decoded.Type, decoded.Connection.ID)
+	}
+}
+
 func TestTransportMessageEncoding(t *testing.T) {
 	// Create test IDs
 	connID, err := GenerateConnectionID()
@@ -123,6 +268,274 @@ func TestTransportMessageEncoding(t *testing.T) {
 	}
 }
 
+func TestCloseAckEncoding(t *testing.T) {
+	msg := &Message{
+		Type: MessageTypeTransport,
+		Transport: &TransportMessage{
+			Nonce:   7,
+			Message: SubstreamMessage{ID: SubstreamID{1}, Type: SubstreamMessageCloseAck},
+		},
+	}
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.Transport.Message.Type != SubstreamMessageCloseAck {
+		t.Errorf("Substream type mismatch: got %d, want %d", decoded.Transport.Message.Type, SubstreamMessageCloseAck)
+	}
+}
+
+func TestCloseWriteEncoding(t *testing.T) {
+	msg := &Message{
+		Type: MessageTypeTransport,
+		Transport: &TransportMessage{
+			Nonce:   8,
+			Message: SubstreamMessage{ID: SubstreamID{1}, Type: SubstreamMessageCloseWrite},
+		},
+	}
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.Transport.Message.Type != SubstreamMessageCloseWrite {
+		t.Errorf("Substream type mismatch: got %d, want %d", decoded.Transport.Message.Type, SubstreamMessageCloseWrite)
+	}
+
+	// Like the other control messages it carries no payload.
+	if _, err := Decode(append(encoded, 'x')); err == nil {
+		t.Errorf("Decode accepted a close-write with a payload")
+	}
+}
+
+func TestWindowUpdateEncoding(t *testing.T) {
+	msg := &Message{
+		Type: MessageTypeTransport,
+		Transport: &TransportMessage{
+			Nonce:   9,
+			Message: NewWindowUpdate(SubstreamID{1}, 70000),
+		},
+	}
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if got := decoded.Transport.Message.WindowCredit(); got != 70000 {
+		t.Errorf("WindowCredit mismatch: got %d, want 70000", got)
+	}
+
+	// The credit is exactly four bytes.
+	if _, err := Decode(append(encoded, 'x')); err == nil {
+		t.Errorf("Decode accepted a window update with a long payload")
+	}
+	if _, err := Decode(encoded[:len(encoded)-1]); err == nil {
+		t.Errorf("Decode accepted a window update with a short payload")
+	}
+}
+
+func TestOpenRequestCarriesInitialData(t *testing.T) {
+	msg := &Message{
+		Type: MessageTypeTransport,
+		Transport: &TransportMessage{
+			Nonce:   1,
+			Message: SubstreamMessage{ID: SubstreamID{2}, Type: SubstreamMessageOpenRequest, Data: []byte("early")},
+		},
+	}
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if string(decoded.Transport.Message.Data) != "early" {
+		t.Errorf("Data mismatch: got %q, want %q", decoded.Transport.Message.Data, "early")
+	}
+}
+
+func TestAppendEncodeMatchesEncode(t *testing.T) {
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("Failed to decode peer ID: %v", err)
+	}
+	recipient := Recipient{ClientIdentity: [32]byte{1}, ClientEncryptionKey: [32]byte{2}, Gateway: [32]byte{3}}
+	msgs := []*Message{
+		benchmarkTransportMessage(),
+		{Type: MessageTypeConnectionRequest, Connection: &ConnectionMessage{PeerID: peerID, Recipient: &recipient, ID: ConnectionID{4}}},
+		{Type: MessageTypeConnectionResponse, Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{5}}},
+		{Type: MessageTypeConnectionClose, Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{6}}},
+		{Type: MessageTypeConnectionPing, Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{7}}},
+		{Type: MessageTypeConnectionPong, Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{8}}},
+	}
+	for _, msg := range msgs {
+		encoded, err := Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if len(encoded) != EncodedLen(msg) {
+			t.Errorf("EncodedLen = %d, encoding is %d bytes", EncodedLen(msg), len(encoded))
+		}
+		appended, err := AppendEncode([]byte("prefix"), msg)
+		if err != nil {
+			t.Fatalf("AppendEncode failed: %v", err)
+		}
+		if string(appended[:6]) != "prefix" || string(appended[6:]) != string(encoded) {
+			t.Errorf("AppendEncode produced %x, want prefix followed by %x", appended, encoded)
+		}
+	}
+}
+
+func TestWireVersionRoundTrip(t *testing.T) {
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("Failed to decode peer ID: %v", err)
+	}
+	msgs := []*Message{
+		benchmarkTransportMessage(),
+		{Type: MessageTypeConnectionPong, Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{9}}},
+	}
+	for _, msg := range msgs {
+		unversioned, err := Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		for _, v := range []WireVersion{WireUnversioned, WireV1} {
+			encoded, err := AppendEncodeVersion(nil, msg, v)
+			if err != nil {
+				t.Fatalf("encode version %d: %v", v, err)
+			}
+			if v == WireUnversioned && string(encoded) != string(unversioned) {
+				t.Fatalf("unversioned encoding differs from Encode")
+			}
+			if v == WireV1 && (encoded[0] != 0x81 || string(encoded[1:]) != string(unversioned)) {
+				t.Fatalf("version 1 encoding %x does not wrap %x", encoded, unversioned)
+			}
+
+			decoded, got, err := DecodeVersion(encoded)
+			if err != nil {
+				t.Fatalf("decode version %d: %v", v, err)
+			}
+			if got != v {
+				t.Fatalf("decoded version %d, want %d", got, v)
+			}
+			if typ, err := PeekType(encoded); err != nil || typ != msg.Type {
+				t.Fatalf("PeekType = %d, %v; want %d", typ, err, msg.Type)
+			}
+			reencoded, err := Encode(decoded)
+			if err != nil || string(reencoded) != string(unversioned) {
+				t.Fatalf("version %d round trip changed the message", v)
+			}
+		}
+	}
+}
+
+func TestDecodeRejectsUnknownWireVersion(t *testing.T) {
+	encoded, err := AppendEncodeVersion(nil, benchmarkTransportMessage(), WireV1)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	encoded[0] = 0x80 | 2
+	if _, err := Decode(encoded); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("Decode of version 2 returned %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := AppendEncodeVersion(nil, benchmarkTransportMessage(), 2); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("encoding version 2 returned %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := Decode([]byte{0x81}); err == nil {
+		t.Fatalf("Decode accepted a bare version byte")
+	}
+}
+
+func TestChecksumDetectsCorruption(t *testing.T) {
+	msg := benchmarkTransportMessage()
+	msg.Transport.Message.Data = []byte("checksummed payload")
+	encoded, err := AppendEncodeChecksum(nil, msg, WireUnversioned)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if !HasChecksum(encoded) {
+		t.Fatalf("encoding %x is not flagged as checksummed", encoded)
+	}
+	decoded, version, err := DecodeVersion(encoded)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if version != WireV1 || string(decoded.Transport.Message.Data) != "checksummed payload" {
+		t.Fatalf("decoded version %d with data %q", version, decoded.Transport.Message.Data)
+	}
+
+	// Flip a bit in the nonce, connection ID, substream ID, substream type,
+	// data and checksum in turn.
+	for _, offset := range []int{2, 2 + 8, 2 + 8 + ConnectionIDLength, TransportOverhead, TransportOverhead + 1, len(encoded) - 1} {
+		corrupted := append([]byte(nil), encoded...)
+		corrupted[offset] ^= 0x01
+		if _, err := Decode(corrupted); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("flipping byte %d: Decode returned %v, want ErrChecksumMismatch", offset, err)
+		}
+	}
+	if _, err := Decode(encoded[:len(encoded)-3]); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("truncated message: Decode returned %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestChecksumOnlyCoversTransportMessages(t *testing.T) {
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("Failed to decode peer ID: %v", err)
+	}
+	msg := &Message{Type: MessageTypeConnectionClose, Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{3}}}
+	plain, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	encoded, err := AppendEncodeChecksum(nil, msg, WireUnversioned)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if string(encoded) != string(plain) {
+		t.Fatalf("connection message encoding changed to %x", encoded)
+	}
+
+	flagged := append([]byte{versionMarker | checksumFlag | byte(WireV1)}, plain...)
+	if _, err := Decode(flagged); err == nil {
+		t.Fatalf("Decode accepted a checksum flag on a connection message")
+	}
+}
+
+func TestTransportOverheadFor(t *testing.T) {
+	msg := benchmarkTransportMessage()
+	data := len(msg.Transport.Message.Data)
+	for _, checksum := range []bool{false, true} {
+		for _, v := range []WireVersion{WireUnversioned, WireV1} {
+			var encoded []byte
+			var err error
+			if checksum {
+				encoded, err = AppendEncodeChecksum(nil, msg, v)
+			} else {
+				encoded, err = AppendEncodeVersion(nil, msg, v)
+			}
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			if got, want := TransportOverheadFor(v, checksum), len(encoded)-data; got != want {
+				t.Errorf("TransportOverheadFor(%d, %t) = %d, encoding adds %d", v, checksum, got, want)
+			}
+		}
+	}
+}
+
 func TestConnectionIDGeneration(t *testing.T) {
 	// Generate multiple connection IDs and ensure they're unique
 	ids := make(map[ConnectionID]bool)
@@ -229,3 +642,164 @@ func BenchmarkDecodeConnectionMessage(b *testing.B) {
 		}
 	}
 }
+
+func benchmarkTransportMessage() *Message {
+	return &Message{
+		Type: MessageTypeTransport,
+		Transport: &TransportMessage{
+			ID:    ConnectionID{1},
+			Nonce: 42,
+			Message: SubstreamMessage{
+				ID:   SubstreamID{2},
+				Type: SubstreamMessageData,
+				Data: make([]byte, 1024),
+			},
+		},
+	}
+}
+
+func BenchmarkEncodeTransportMessage(b *testing.B) {
+	msg := benchmarkTransportMessage()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Encode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeTransportMessage(b *testing.B) {
+	encoded, err := Encode(benchmarkTransportMessage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	msg := benchmarkTransportMessage()
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if _, _, err := DecodeLimit(encoded, len(encoded)/2); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("DecodeLimit over the limit returned %v, want ErrMessageTooLarge", err)
+	}
+	if _, _, err := DecodeLimit(encoded, len(encoded)); err != nil {
+		t.Fatalf("DecodeLimit within the limit: %v", err)
+	}
+	if _, err := Decode(encoded); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+}
+
+// decodeSeeds returns valid encodings of every message shape: connection
+// messages with and without a recipient and public key, and transport
+// messages in each wire version, with and without a checksum.
+func decodeSeeds(tb testing.TB) [][]byte {
+	tb.Helper()
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		tb.Fatalf("Failed to decode peer ID: %v", err)
+	}
+	recipient := Recipient{ClientIdentity: [32]byte{1}, ClientEncryptionKey: [32]byte{2}, Gateway: [32]byte{3}}
+	var seeds [][]byte
+	for _, msg := range []*Message{
+		benchmarkTransportMessage(),
+		{Type: MessageTypeTransport, Transport: &TransportMessage{Nonce: 1, Message: SubstreamMessage{Type: SubstreamMessageCloseWrite}}},
+		{Type: MessageTypeTransport, Transport: &TransportMessage{Nonce: 2, Message: NewWindowUpdate(SubstreamID{3}, 1<<16)}},
+		{Type: MessageTypeConnectionRequest, Connection: &ConnectionMessage{PeerID: peerID, Recipient: &recipient, ID: ConnectionID{4}}},
+		{Type: MessageTypeConnectionClose, Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{5}}},
+		{Type: MessageTypeConnectionResponse, Connection: &ConnectionMessage{PeerID: peerID, Recipient: &recipient, ID: ConnectionID{6}, PublicKey: []byte{7, 8, 9}}},
+		{Type: MessageTypeConnectionRequest, Connection: &ConnectionMessage{PeerID: peerID, ID: ConnectionID{7}, StreamWindow: 1 << 16}},
+	} {
+		for _, v := range []WireVersion{WireUnversioned, WireV1} {
+			encoded, err := AppendEncodeVersion(nil, msg, v)
+			if err != nil {
+				tb.Fatalf("Encode failed: %v", err)
+			}
+			seeds = append(seeds, encoded)
+		}
+	}
+	checksummed, err := AppendEncodeChecksum(nil, benchmarkTransportMessage(), WireV1)
+	if err != nil {
+		tb.Fatalf("Encode failed: %v", err)
+	}
+	return append(seeds, checksummed)
+}
+
+func TestDecodeRejectsTruncations(t *testing.T) {
+	for _, seed := range decodeSeeds(t) {
+		// A transport message cut inside its data is still a valid, shorter
+		// message unless a checksum covers it.
+		msg, err := Decode(seed)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if msg.Transport != nil && !HasChecksum(seed) {
+			seed = seed[:len(seed)-len(msg.Transport.Message.Data)]
+		}
+		for n := 0; n < len(seed); n++ {
+			if msg, err := Decode(seed[:n]); err == nil {
+				t.Fatalf("Decode accepted %d of %d bytes of %x as %+v", n, len(seed), seed, msg)
+			}
+		}
+	}
+}
+
+func TestDecodeRejectsOversizedPeerID(t *testing.T) {
+	// An identity multihash of 200 bytes parses as a peer ID but is larger
+	// than any real one.
+	tail := append([]byte{0x00, 0xC8, 0x01}, make([]byte, 200)...)
+	data := append([]byte{byte(MessageTypeConnectionRequest)}, make([]byte, ConnectionIDLength+1)...)
+	data = append(data, tail...)
+	if _, err := Decode(data); err == nil {
+		t.Fatalf("Decode accepted a %d byte peer id", len(tail))
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range decodeSeeds(f) {
+		f.Add(seed)
+		// Truncations exercise every length check.
+		for _, n := range []int{1, 2, ConnectionIDLength + 1, ConnectionIDLength + 2, len(seed) / 2, len(seed) - 1} {
+			if n < len(seed) {
+				f.Add(seed[:n])
+			}
+		}
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0xFF})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, version, err := DecodeVersion(data)
+		if err != nil {
+			if msg != nil {
+				t.Fatalf("DecodeVersion returned a message with error %v", err)
+			}
+			return
+		}
+		if msg.Transport != nil && len(msg.Transport.Message.Data) > len(data) {
+			t.Fatalf("decoded %d bytes of data from a %d byte message", len(msg.Transport.Message.Data), len(data))
+		}
+		// Anything Decode accepts must survive a round trip unchanged.
+		encode := AppendEncodeVersion
+		if HasChecksum(data) {
+			encode = AppendEncodeChecksum
+		}
+		encoded, err := encode(nil, msg, version)
+		if err != nil {
+			t.Fatalf("Encode of decoded message failed: %v", err)
+		}
+		if string(encoded) != string(data) {
+			t.Fatalf("round trip changed message: got %x, want %x", encoded, data)
+		}
+	})
+}
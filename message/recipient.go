@@ -2,8 +2,10 @@ package message
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	"github.com/mr-tron/base58"
 )
@@ -11,6 +13,19 @@ import (
 // RecipientLength is the fixed byte length of a Recipient serialization.
 const RecipientLength = 96
 
+// Errors returned, wrapped, when a recipient fails to parse.
+var (
+	ErrRecipientLength           = errors.New("recipient: invalid length")
+	ErrRecipientMissingAt        = errors.New("recipient: expected single '@'")
+	ErrRecipientMissingDot       = errors.New("recipient: expected single '.' in client half")
+	ErrRecipientBadIdentity      = errors.New("recipient: bad identity key")
+	ErrRecipientBadEncryptionKey = errors.New("recipient: bad encryption key")
+	ErrRecipientBadGateway       = errors.New("recipient: bad gateway key")
+	// ErrRecipientKeyLength accompanies a bad key error when the key decoded
+	// to the wrong number of bytes.
+	ErrRecipientKeyLength = errors.New("recipient: key is not 32 bytes")
+)
+
 // Recipient mirrors the Rust struct containing three public keys.
 type Recipient struct {
 	ClientIdentity      [32]byte
@@ -21,7 +36,7 @@ type Recipient struct {
 // RecipientFromBytes constructs a Recipient from the raw 96 byte layout.
 func RecipientFromBytes(b []byte) (Recipient, error) {
 	if len(b) != RecipientLength {
-		return Recipient{}, fmt.Errorf("recipient: invalid length %d", len(b))
+		return Recipient{}, fmt.Errorf("%w %d", ErrRecipientLength, len(b))
 	}
 	var r Recipient
 	copy(r.ClientIdentity[:], b[:32])
@@ -39,40 +54,110 @@ func (r Recipient) Bytes() []byte {
 	return out
 }
 
-// String renders the recipient as base58 encoded triple matching Rust formatting.
+// Equal reports whether r and other hold the same three keys. It compares the
+// keys directly, avoiding the allocations of comparing String forms.
+func (r Recipient) Equal(other Recipient) bool {
+	return r.ClientIdentity == other.ClientIdentity &&
+		r.ClientEncryptionKey == other.ClientEncryptionKey &&
+		r.Gateway == other.Gateway
+}
+
+// IsZero reports whether r is the zero Recipient, which no client uses.
+func (r Recipient) IsZero() bool {
+	return r.Equal(Recipient{})
+}
+
+// IdentityString returns the base58 client identity key, the part before the
+// '.' in the default address form.
+func (r Recipient) IdentityString() string {
+	return base58.Encode(r.ClientIdentity[:])
+}
+
+// EncryptionKeyString returns the base58 client encryption key, the part
+// between '.' and '@' in the default address form.
+func (r Recipient) EncryptionKeyString() string {
+	return base58.Encode(r.ClientEncryptionKey[:])
+}
+
+// GatewayString returns the base58 gateway identity key, the part after '@'
+// in the default address form. The raw key is the Gateway field.
+func (r Recipient) GatewayString() string {
+	return base58.Encode(r.Gateway[:])
+}
+
+// RecipientCodec converts recipients to and from their textual address form.
+type RecipientCodec interface {
+	Encode(r Recipient) string
+	Decode(s string) (Recipient, error)
+}
+
+// Base58Codec is the default codec, rendering the three keys in base58 as
+// identity.encryption@gateway like the Nym client does.
+type Base58Codec struct{}
+
+var recipientCodec atomic.Pointer[RecipientCodec]
+
+// SetRecipientCodec replaces the codec used by Recipient.String and
+// ParseRecipient for the whole process. A nil codec restores Base58Codec.
+func SetRecipientCodec(c RecipientCodec) {
+	if c == nil {
+		recipientCodec.Store(nil)
+		return
+	}
+	recipientCodec.Store(&c)
+}
+
+func currentRecipientCodec() RecipientCodec {
+	if c := recipientCodec.Load(); c != nil {
+		return *c
+	}
+	return Base58Codec{}
+}
+
+// String renders the recipient with the configured RecipientCodec.
 func (r Recipient) String() string {
+	return currentRecipientCodec().Encode(r)
+}
+
+// ParseRecipient parses an address produced by the configured RecipientCodec.
+func ParseRecipient(s string) (Recipient, error) {
+	return currentRecipientCodec().Decode(s)
+}
+
+// Encode renders the recipient as base58 encoded triple matching Rust formatting.
+func (Base58Codec) Encode(r Recipient) string {
 	var sb strings.Builder
 	sb.Grow(120)
-	sb.WriteString(base58.Encode(r.ClientIdentity[:]))
+	sb.WriteString(r.IdentityString())
 	sb.WriteByte('.')
-	sb.WriteString(base58.Encode(r.ClientEncryptionKey[:]))
+	sb.WriteString(r.EncryptionKeyString())
 	sb.WriteByte('@')
-	sb.WriteString(base58.Encode(r.Gateway[:]))
+	sb.WriteString(r.GatewayString())
 	return sb.String()
 }
 
-// ParseRecipient parses a base58 string (identity.encryption@gateway) into a Recipient.
-func ParseRecipient(s string) (Recipient, error) {
+// Decode parses a base58 string (identity.encryption@gateway) into a Recipient.
+func (Base58Codec) Decode(s string) (Recipient, error) {
 	parts := strings.Split(s, "@")
 	if len(parts) != 2 {
-		return Recipient{}, fmt.Errorf("recipient: expected single '@'")
+		return Recipient{}, ErrRecipientMissingAt
 	}
 	clientParts := strings.Split(parts[0], ".")
 	if len(clientParts) != 2 {
-		return Recipient{}, fmt.Errorf("recipient: expected single '.' in client half")
+		return Recipient{}, ErrRecipientMissingDot
 	}
 
 	ident, err := decodeBase58To32(clientParts[0])
 	if err != nil {
-		return Recipient{}, fmt.Errorf("recipient: decode identity: %w", err)
+		return Recipient{}, fmt.Errorf("%w: %w", ErrRecipientBadIdentity, err)
 	}
 	enc, err := decodeBase58To32(clientParts[1])
 	if err != nil {
-		return Recipient{}, fmt.Errorf("recipient: decode enc key: %w", err)
+		return Recipient{}, fmt.Errorf("%w: %w", ErrRecipientBadEncryptionKey, err)
 	}
 	gateway, err := decodeBase58To32(parts[1])
 	if err != nil {
-		return Recipient{}, fmt.Errorf("recipient: decode gateway: %w", err)
+		return Recipient{}, fmt.Errorf("%w: %w", ErrRecipientBadGateway, err)
 	}
 
 	return Recipient{
@@ -88,7 +173,7 @@ func decodeBase58To32(s string) ([32]byte, error) {
 		return [32]byte{}, err
 	}
 	if len(decoded) != 32 {
-		return [32]byte{}, fmt.Errorf("expected 32 decoded bytes, got %d", len(decoded))
+		return [32]byte{}, fmt.Errorf("%w: got %d", ErrRecipientKeyLength, len(decoded))
 	}
 	var out [32]byte
 	copy(out[:], decoded)
@@ -1,6 +1,8 @@
 package message
 
 import (
+	"encoding/hex"
+	"errors"
 	"strings"
 	"testing"
 )
@@ -9,63 +11,72 @@ func TestParseRecipient(t *testing.T) {
 	tests := []struct {
 		name    string
 		input   string
-		wantErr bool
+		wantErr []error
 	}{
 		{
-			name:    "ValidRecipient",
-			input:   "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f",
-			wantErr: false,
+			name:  "ValidRecipient",
+			input: "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f",
 		},
 		{
 			name:    "MissingDot",
 			input:   "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f",
-			wantErr: true,
+			wantErr: []error{ErrRecipientMissingDot},
 		},
 		{
 			name:    "MissingAt",
 			input:   "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f",
-			wantErr: true,
+			wantErr: []error{ErrRecipientMissingAt},
 		},
 		{
 			name:    "EmptyString",
 			input:   "",
-			wantErr: true,
+			wantErr: []error{ErrRecipientMissingAt},
 		},
 		{
 			name:    "OnlyDot",
 			input:   ".",
-			wantErr: true,
+			wantErr: []error{ErrRecipientMissingAt},
 		},
 		{
 			name:    "OnlyAt",
 			input:   "@",
-			wantErr: true,
+			wantErr: []error{ErrRecipientMissingDot},
 		},
 		{
 			name:    "InvalidBase58Identity",
 			input:   "0OIl.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f",
-			wantErr: true,
+			wantErr: []error{ErrRecipientBadIdentity},
 		},
 		{
 			name:    "InvalidBase58Encryption",
 			input:   "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.0OIl@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f",
-			wantErr: true,
+			wantErr: []error{ErrRecipientBadEncryptionKey},
 		},
 		{
 			name:    "InvalidBase58Gateway",
 			input:   "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@0OIl",
-			wantErr: true,
+			wantErr: []error{ErrRecipientBadGateway},
+		},
+		{
+			name:    "ShortGateway",
+			input:   "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vt",
+			wantErr: []error{ErrRecipientBadGateway, ErrRecipientKeyLength},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			recipient, err := ParseRecipient(tt.input)
-			if (err != nil) != tt.wantErr {
+			if (err != nil) != (len(tt.wantErr) > 0) {
 				t.Errorf("ParseRecipient() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !tt.wantErr {
+			for _, want := range tt.wantErr {
+				if !errors.Is(err, want) {
+					t.Errorf("ParseRecipient() error = %v, want errors.Is %v", err, want)
+				}
+			}
+			if len(tt.wantErr) == 0 {
 				// Just verify we got a valid recipient
 				// The fields are fixed-size arrays, so they can't be empty
 				_ = recipient.String()
@@ -132,9 +143,20 @@ func TestRecipientEqual(t *testing.T) {
 	}
 
 	// Check that the two recipients are equal
-	if r1.String() != r2.String() {
+	if !r1.Equal(r2) || r1.String() != r2.String() {
 		t.Error("Two recipients parsed from the same string are not equal")
 	}
+	for i, mutate := range []func(*Recipient){
+		func(r *Recipient) { r.ClientIdentity[31] ^= 1 },
+		func(r *Recipient) { r.ClientEncryptionKey[0] ^= 1 },
+		func(r *Recipient) { r.Gateway[16] ^= 1 },
+	} {
+		r3 := r1
+		mutate(&r3)
+		if r1.Equal(r3) || r3.Equal(r1) {
+			t.Errorf("recipients differing in key %d compare equal", i)
+		}
+	}
 
 	// Check that the byte representations are equal
 	if r1.Bytes()[0] != r2.Bytes()[0] {
@@ -142,6 +164,17 @@ func TestRecipientEqual(t *testing.T) {
 	}
 }
 
+func TestRecipientIsZero(t *testing.T) {
+	var r Recipient
+	if !r.IsZero() {
+		t.Fatal("zero recipient not reported as zero")
+	}
+	r.Gateway[31] = 1
+	if r.IsZero() {
+		t.Fatal("recipient with a gateway key reported as zero")
+	}
+}
+
 func TestRecipientParts(t *testing.T) {
 	input := "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f"
 
@@ -182,6 +215,73 @@ func TestRecipientParts(t *testing.T) {
 	}
 }
 
+func TestRecipientPartStrings(t *testing.T) {
+	input := "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f"
+
+	recipient, err := ParseRecipient(input)
+	if err != nil {
+		t.Fatalf("ParseRecipient() failed: %v", err)
+	}
+
+	client, gateway, _ := strings.Cut(recipient.String(), "@")
+	identity, encryption, _ := strings.Cut(client, ".")
+	if got := recipient.GatewayString(); got != gateway {
+		t.Errorf("GatewayString() = %s, want %s", got, gateway)
+	}
+	if got := recipient.IdentityString(); got != identity {
+		t.Errorf("IdentityString() = %s, want %s", got, identity)
+	}
+	if got := recipient.EncryptionKeyString(); got != encryption {
+		t.Errorf("EncryptionKeyString() = %s, want %s", got, encryption)
+	}
+}
+
+// hexCodec is a stand-in for an alternative address format.
+type hexCodec struct{}
+
+func (hexCodec) Encode(r Recipient) string {
+	return "hex:" + hex.EncodeToString(r.Bytes())
+}
+
+func (hexCodec) Decode(s string) (Recipient, error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(s, "hex:"))
+	if err != nil {
+		return Recipient{}, err
+	}
+	return RecipientFromBytes(raw)
+}
+
+func TestCustomRecipientCodec(t *testing.T) {
+	input := "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f"
+	recipient, err := ParseRecipient(input)
+	if err != nil {
+		t.Fatalf("ParseRecipient() error = %v", err)
+	}
+
+	SetRecipientCodec(hexCodec{})
+	t.Cleanup(func() { SetRecipientCodec(nil) })
+
+	encoded := recipient.String()
+	if !strings.HasPrefix(encoded, "hex:") {
+		t.Fatalf("String() = %q, want custom codec output", encoded)
+	}
+	decoded, err := ParseRecipient(encoded)
+	if err != nil {
+		t.Fatalf("ParseRecipient() with custom codec error = %v", err)
+	}
+	if decoded != recipient {
+		t.Errorf("custom codec round trip mismatch")
+	}
+	if _, err := ParseRecipient(input); err == nil {
+		t.Errorf("base58 address parsed while custom codec installed")
+	}
+
+	SetRecipientCodec(nil)
+	if got := recipient.String(); got != input {
+		t.Errorf("String() after reset = %q, want %q", got, input)
+	}
+}
+
 func BenchmarkParseRecipient(b *testing.B) {
 	input := "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f"
 
@@ -203,3 +303,26 @@ func BenchmarkRecipientString(b *testing.B) {
 		_ = recipient.String()
 	}
 }
+
+func BenchmarkRecipientEqual(b *testing.B) {
+	input := "CytBseW6yFXUMzz4SGAKdNLGR7q3sJLLYxyBGvutNEQV.4QXYyEVc5fUDjmmi8PrHN9tdUFV4PCvSJE1278cHyvoe@4sBbL1ngf1vtNqykydQKTFh26sQCw888GpUqvPvyNB4f"
+	r1, _ := ParseRecipient(input)
+	r2, _ := ParseRecipient(input)
+
+	b.Run("Equal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !r1.Equal(r2) {
+				b.Fatal("not equal")
+			}
+		}
+	})
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if r1.String() != r2.String() {
+				b.Fatal("not equal")
+			}
+		}
+	})
+}
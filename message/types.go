@@ -2,6 +2,7 @@ package message
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -14,6 +15,11 @@ const (
 	SubstreamIDLength  = 32
 )
 
+// TransportOverhead is the number of bytes Encode adds around the data of a
+// transport message: the message type, nonce, connection id, substream id and
+// substream type. The versioned layouts add more; see TransportOverheadFor.
+const TransportOverhead = 1 + 8 + ConnectionIDLength + SubstreamIDLength + 1
+
 // MessageType mirrors the Rust enum discriminants.
 type MessageType byte
 
@@ -21,6 +27,28 @@ const (
 	MessageTypeConnectionRequest MessageType = iota
 	MessageTypeConnectionResponse
 	MessageTypeTransport
+	// MessageTypeConnectionReject answers a connection request the listener
+	// declined. It carries a ConnectionMessage without a recipient.
+	MessageTypeConnectionReject
+	// MessageTypeConnectionAck is the dialer's acknowledgement of a
+	// connection response, completing the handshake. It carries a
+	// ConnectionMessage without a recipient.
+	MessageTypeConnectionAck
+	// MessageTypePing and MessageTypePong probe whether a recipient is
+	// reachable outside of any connection. Both carry a ConnectionMessage
+	// whose ID matches the pong to its ping; the ping carries the sender's
+	// recipient unless it was sent with reply SURBs.
+	MessageTypePing
+	MessageTypePong
+	// MessageTypeConnectionClose tells the remote that a connection was
+	// closed. It carries a ConnectionMessage without a recipient.
+	MessageTypeConnectionClose
+	// MessageTypeConnectionPing and MessageTypeConnectionPong check that the
+	// remote still has a connection. Both carry a ConnectionMessage with the
+	// connection's ID and no recipient; only an end that still knows the
+	// connection answers.
+	MessageTypeConnectionPing
+	MessageTypeConnectionPong
 )
 
 // ConnectionID uniquely identifies a logical connection.
@@ -47,6 +75,16 @@ func (c ConnectionID) Bytes() []byte {
 	return b
 }
 
+// MarshalText implements encoding.TextMarshaler using the hex form.
+func (c ConnectionID) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (c *ConnectionID) UnmarshalText(text []byte) error {
+	return decodeHexID(c[:], text)
+}
+
 // SubstreamID uniquely identifies a substream on a connection.
 type SubstreamID [SubstreamIDLength]byte
 
@@ -69,11 +107,43 @@ func (s SubstreamID) Bytes() []byte {
 	return b
 }
 
+// MarshalText implements encoding.TextMarshaler using the hex form.
+func (s SubstreamID) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *SubstreamID) UnmarshalText(text []byte) error {
+	return decodeHexID(s[:], text)
+}
+
+func decodeHexID(dst []byte, text []byte) error {
+	if hex.DecodedLen(len(text)) != len(dst) {
+		return fmt.Errorf("message: invalid id length %d", len(text))
+	}
+	if _, err := hex.Decode(dst, text); err != nil {
+		return fmt.Errorf("message: decode id: %w", err)
+	}
+	return nil
+}
+
 // ConnectionMessage is exchanged during handshake.
 type ConnectionMessage struct {
 	PeerID    peer.ID
 	Recipient *Recipient
 	ID        ConnectionID
+	// PublicKey is the sender's marshalled libp2p public key. It is only
+	// needed when PeerID does not embed the key, as for RSA identities, and
+	// is not understood by rust-libp2p-nym.
+	PublicKey []byte
+	// StreamWindow is the per-stream receive window the sender offers in a
+	// connection request or response, in bytes. Zero means the sender does
+	// not do flow control, as with rust-libp2p-nym.
+	StreamWindow uint32
+	// CloseControl tells the remote that the sender understands the
+	// SubstreamMessageCloseAck and SubstreamMessageCloseWrite control
+	// messages, which rust-libp2p-nym does not.
+	CloseControl bool
 }
 
 // TransportMessage carries substream payloads with ordering information.
@@ -98,8 +168,39 @@ const (
 	SubstreamMessageOpenResponse
 	SubstreamMessageClose
 	SubstreamMessageData
+	// SubstreamMessageCloseAck acknowledges a SubstreamMessageClose once all
+	// data sent before it has been delivered.
+	SubstreamMessageCloseAck
+	// SubstreamMessageCloseWrite ends the sender's direction of a substream
+	// only: the receiver's reader sees EOF while its writes still go through.
+	// SubstreamMessageClose keeps meaning that both directions are done.
+	SubstreamMessageCloseWrite
+	// SubstreamMessageWindowUpdate grants the receiver's peer more send
+	// credit on a substream. Data holds the credit in bytes as a big-endian
+	// uint32; see NewWindowUpdate.
+	SubstreamMessageWindowUpdate
 )
 
+// WindowUpdateLength is the payload size of a SubstreamMessageWindowUpdate.
+const WindowUpdateLength = 4
+
+// NewWindowUpdate returns a message granting credit more bytes of send window
+// on substream id.
+func NewWindowUpdate(id SubstreamID, credit uint32) SubstreamMessage {
+	data := make([]byte, WindowUpdateLength)
+	binary.BigEndian.PutUint32(data, credit)
+	return SubstreamMessage{ID: id, Type: SubstreamMessageWindowUpdate, Data: data}
+}
+
+// WindowCredit returns the credit granted by a SubstreamMessageWindowUpdate,
+// or 0 for any other message.
+func (sm SubstreamMessage) WindowCredit() uint32 {
+	if sm.Type != SubstreamMessageWindowUpdate || len(sm.Data) != WindowUpdateLength {
+		return 0
+	}
+	return binary.BigEndian.Uint32(sm.Data)
+}
+
 // SubstreamMessage is sent over a logical substream.
 type SubstreamMessage struct {
 	ID   SubstreamID
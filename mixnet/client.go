@@ -2,8 +2,10 @@ package mixnet
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
@@ -14,50 +16,116 @@ import (
 // forwarded to the libp2p transport.
 type InboundMessage struct {
 	Message *message.Message
+	// SenderTag is set when the sender attached reply SURBs, allowing an
+	// anonymous reply via OutboundMessage.SenderTag.
+	SenderTag *SenderTag
+	// Sender is the address the message was sent from, when known. The Nym
+	// client does not report senders, so Initialize only sets it for
+	// connection requests, from the address they ask replies to go to; the
+	// sender chose that address and nothing vouches for it. Other mixnet
+	// backends may set it for any message that was not sent anonymously.
+	Sender *message.Recipient
 }
 
 // OutboundMessage represents a message destined for the mixnet.
 type OutboundMessage struct {
 	Recipient message.Recipient
 	Message   *message.Message
+	// SenderTag, when set, replies to an anonymous sender using its stored
+	// reply SURBs. Recipient is ignored in that case.
+	SenderTag *SenderTag
+	// ReplySURBs, when non-zero, sends the message anonymously and attaches
+	// that many reply SURBs so the receiver can answer without learning our
+	// address.
+	ReplySURBs uint32
+}
+
+// client owns the websocket session(s) behind the channels returned by
+// Initialize. The channels outlive individual websockets when reconnecting is
+// enabled; inbound is only closed once the client gives up for good.
+type client struct {
+	uri           string
+	opts          options
+	self          message.Recipient
+	inbound       chan InboundMessage
+	outbound      chan OutboundMessage
+	notifyInbound chan<- struct{}
+
+	// writeFrame writes one request to the websocket; tests replace it.
+	writeFrame func(conn *websocket.Conn, frame []byte) error
+	// retry holds a message whose write failed when the websocket broke. It
+	// is written before anything else on the next session so that messages
+	// keep their order. Only the writer goroutine touches it.
+	retry *OutboundMessage
+	// early holds messages received during the self address handshake until
+	// the reader delivers them; see WithPreHandshakeBuffer.
+	early []InboundMessage
 }
 
 // Initialize establishes a websocket connection to the Nym client mixnet gateway,
 // returning the local recipient address alongside inbound/outbound channels.
 // If notifyInbound is non-nil, it will receive a signal every time an inbound
 // message is delivered.
-func Initialize(ctx context.Context, uri string, notifyInbound chan<- struct{}) (message.Recipient, <-chan InboundMessage, chan<- OutboundMessage, error) {
-	dialer := websocket.Dialer{}
-	conn, _, err := dialer.DialContext(ctx, uri, nil)
+//
+// The inbound channel is closed once the websocket is gone for good: right
+// away by default, or after reconnecting fails when WithReconnect is set.
+func Initialize(ctx context.Context, uri string, notifyInbound chan<- struct{}, opts ...Option) (message.Recipient, <-chan InboundMessage, chan<- OutboundMessage, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c := &client{
+		uri:           uri,
+		opts:          o,
+		inbound:       make(chan InboundMessage, o.inboundBufferSize),
+		outbound:      make(chan OutboundMessage, o.outboundBufferSize),
+		notifyInbound: notifyInbound,
+	}
+	c.writeFrame = c.writeWithDeadline
+
+	conn, self, err := c.connect(ctx)
 	if err != nil {
 		return message.Recipient{}, nil, nil, err
 	}
+	c.self = self
+
+	go c.run(ctx, conn)
+
+	return self, c.inbound, c.outbound, nil
+}
+
+// connect dials the websocket and performs the self address handshake.
+func (c *client) connect(ctx context.Context) (*websocket.Conn, message.Recipient, error) {
+	dialer := websocket.Dialer{}
+	conn, _, err := dialer.DialContext(ctx, c.uri, nil)
+	if err != nil {
+		return nil, message.Recipient{}, err
+	}
+	conn.SetReadLimit(int64(c.opts.maxMessageSize) + maxReceivedOverhead)
 
 	if err := conn.WriteMessage(websocket.BinaryMessage, serializeSelfAddressRequest()); err != nil {
 		conn.Close()
-		return message.Recipient{}, nil, nil, err
+		return nil, message.Recipient{}, err
 	}
 
-	inbound := make(chan InboundMessage, 32)
-	outbound := make(chan OutboundMessage, 32)
-
 	var self message.Recipient
 	// Fetch self address synchronously before launching the workers.
 	for {
 		if isContextDone(ctx) {
 			conn.Close()
-			return message.Recipient{}, nil, nil, context.Canceled
+			return nil, message.Recipient{}, context.Canceled
 		}
 
 		msgType, data, err := conn.ReadMessage()
 		if err != nil {
 			conn.Close()
-			return message.Recipient{}, nil, nil, err
+			return nil, message.Recipient{}, err
 		}
 		if msgType != websocket.BinaryMessage {
 			continue
 		}
-		resp, err := decodeServerResponse(data)
+		resp, err := decodeServerResponse(data, c.opts.maxMessageSize)
 		if err != nil {
 			log.Printf("mixnet: failed to decode handshake response: %v", err)
 			continue
@@ -66,54 +134,165 @@ func Initialize(ctx context.Context, uri string, notifyInbound chan<- struct{})
 		case responseTagSelfAddress:
 			self = resp.payload.(message.Recipient)
 		case responseTagReceived:
-			payload := resp.payload.([]byte)
-			m, err := decodeMessagePayload(payload)
+			received := resp.payload.(receivedMessage)
+			m, err := c.decodeInbound(received.data)
 			if err != nil {
 				log.Printf("mixnet: failed to decode pre-handshake message: %v", err)
 				continue
 			}
-			select {
-			case inbound <- InboundMessage{Message: m}:
-			default:
-				log.Printf("mixnet: dropping pre-handshake message due to full queue")
-			}
+			c.bufferEarly(newInboundMessage(m, received))
 		case responseTagError:
 			log.Printf("mixnet: gateway error during handshake: %v", resp.payload)
 		default:
 			log.Printf("mixnet: ignoring unexpected handshake response tag %d", resp.kind)
 		}
-		if self != (message.Recipient{}) {
-			break
+		if !self.IsZero() {
+			return conn, self, nil
+		}
+	}
+}
+
+// newInboundMessage wraps m, decoded from received, for the consumer.
+func newInboundMessage(m *message.Message, received receivedMessage) InboundMessage {
+	in := InboundMessage{Message: m, SenderTag: received.senderTag}
+	if m.Type == message.MessageTypeConnectionRequest && m.Connection != nil {
+		in.Sender = m.Connection.Recipient
+	}
+	return in
+}
+
+// decodeInbound decodes a received payload, refusing oversized handshake
+// messages without parsing them; see WithMaxHandshakeSize.
+func (c *client) decodeInbound(data []byte) (*message.Message, error) {
+	if len(data) <= c.opts.maxHandshakeSize {
+		return decodeMessagePayload(data, c.opts.maxMessageSize)
+	}
+	typ, err := message.PeekType(data)
+	if err != nil {
+		return nil, err
+	}
+	if typ != message.MessageTypeTransport {
+		return nil, fmt.Errorf("mixnet: %d byte handshake message exceeds limit of %d", len(data), c.opts.maxHandshakeSize)
+	}
+	return decodeMessagePayload(data, c.opts.maxMessageSize)
+}
+
+func (c *client) writeWithDeadline(conn *websocket.Conn, frame []byte) error {
+	if c.opts.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.opts.writeTimeout))
+	}
+	return conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// write sends msg over conn. A message that fails because the websocket broke
+// is kept for the next session when reconnecting is enabled.
+func (c *client) write(conn *websocket.Conn, msg OutboundMessage) error {
+	frame, err := encodeOutboundFrame(msg, c.opts.wireVersion, c.opts.checksum)
+	if err != nil {
+		log.Printf("mixnet: encode outbound message: %v", err)
+		return nil
+	}
+	if err := c.writeFrame(conn, frame); err != nil {
+		if c.opts.reconnectRetries > 0 {
+			c.retry = &msg
+		}
+		return err
+	}
+	return nil
+}
+
+// run serves websocket sessions until the client shuts down for good.
+func (c *client) run(ctx context.Context, conn *websocket.Conn) {
+	defer close(c.inbound)
+	for {
+		if !c.serve(ctx, conn) {
+			return
+		}
+		if ctx.Err() != nil || c.opts.reconnectRetries == 0 {
+			return
+		}
+		if conn = c.reconnect(ctx); conn == nil {
+			return
+		}
+	}
+}
+
+// reconnect redials with exponential backoff, returning nil once retries are
+// exhausted or the gateway hands out a different address.
+func (c *client) reconnect(ctx context.Context) *websocket.Conn {
+	delay := c.opts.reconnectDelay
+	for attempt := 1; attempt <= c.opts.reconnectRetries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+
+		conn, self, err := c.connect(ctx)
+		if err != nil {
+			log.Printf("mixnet: reconnect attempt %d/%d failed: %v", attempt, c.opts.reconnectRetries, err)
+			continue
 		}
+		if !self.Equal(c.self) {
+			// Peers know us by the old address, so carrying on would silently
+			// strand every connection.
+			log.Printf("mixnet: self address changed on reconnect from %s to %s, giving up", c.self, self)
+			conn.Close()
+			return nil
+		}
+		log.Printf("mixnet: reconnected after %d attempt(s)", attempt)
+		return conn
 	}
+	return nil
+}
 
+// serve pumps messages over conn until the websocket fails or the client is
+// stopped. It reports whether the session ended because of the websocket, in
+// which case a reconnect may be attempted.
+func (c *client) serve(ctx context.Context, conn *websocket.Conn) bool {
 	var (
-		writeOnce sync.Once
+		closeOnce sync.Once
 		closer    = func() {
-			writeOnce.Do(func() {
+			closeOnce.Do(func() {
 				conn.Close()
 			})
 		}
+		readerDone = make(chan struct{})
+		writerDone = make(chan struct{})
+		// stopped is set by the writer when the client is shutting down
+		// rather than the websocket failing.
+		stopped bool
 	)
 
 	// Writer goroutine.
 	go func() {
+		defer close(writerDone)
 		defer closer()
+		if msg := c.retry; msg != nil {
+			c.retry = nil
+			if err := c.write(conn, *msg); err != nil {
+				log.Printf("mixnet: failed to resend message: %v", err)
+				return
+			}
+		}
 		for {
 			select {
 			case <-ctx.Done():
+				stopped = true
+				return
+			case <-readerDone:
 				return
-			case outboundMsg, ok := <-outbound:
+			case outboundMsg, ok := <-c.outbound:
 				if !ok {
+					stopped = true
 					return
 				}
-				payload, err := encodeMessagePayload(outboundMsg.Message)
-				if err != nil {
-					log.Printf("mixnet: encode outbound message: %v", err)
-					continue
-				}
-				req := serializeSendRequest(outboundMsg.Recipient, payload)
-				if err := conn.WriteMessage(websocket.BinaryMessage, req); err != nil {
+				if err := c.write(conn, outboundMsg); err != nil {
+					// Returning closes the websocket, which also stops the
+					// reader and ends the session.
 					log.Printf("mixnet: failed to write message: %v", err)
 					return
 				}
@@ -121,61 +300,122 @@ func Initialize(ctx context.Context, uri string, notifyInbound chan<- struct{})
 		}
 	}()
 
-	// Reader goroutine.
-	go func() {
-		defer func() {
-			closer()
-			close(inbound)
-		}()
-		for {
-			if isContextDone(ctx) {
-				return
-			}
-			msgType, data, err := conn.ReadMessage()
-			if err != nil {
-				log.Printf("mixnet: read error: %v", err)
-				return
-			}
-			if msgType != websocket.BinaryMessage {
-				continue
-			}
+	c.read(ctx, conn)
+	close(readerDone)
+	closer()
+	<-writerDone
+	return !stopped && ctx.Err() == nil
+}
+
+// bufferEarly holds a message received during the handshake, applying the
+// pre-handshake limit and policy.
+func (c *client) bufferEarly(msg InboundMessage) {
+	if len(c.early) >= c.opts.preHandshakeLimit {
+		c.dropped(DropPreHandshake)
+		if c.opts.preHandshakePolicy != PreHandshakeDropOldest || len(c.early) == 0 {
+			log.Printf("mixnet: dropping pre-handshake message, buffer full")
+			return
+		}
+		log.Printf("mixnet: dropping oldest pre-handshake message, buffer full")
+		c.early = c.early[1:]
+	}
+	c.early = append(c.early, msg)
+}
+
+// deliver queues msg for the consumer, waiting for room unless WithDropOnFull
+// is set. It reports false if ctx ended while waiting.
+func (c *client) deliver(ctx context.Context, msg InboundMessage) bool {
+	if c.opts.dropOnFull {
+		select {
+		case c.inbound <- msg:
+		default:
+			log.Printf("mixnet: inbound queue full, dropping message")
+			c.dropped(DropInboundFull)
+			return true
+		}
+	} else {
+		select {
+		case <-ctx.Done():
+			return false
+		case c.inbound <- msg:
+		}
+	}
+	if c.notifyInbound != nil {
+		select {
+		case c.notifyInbound <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// dropped reports a discarded message to the drop handler, if any.
+func (c *client) dropped(reason DropReason) {
+	if fn := c.opts.dropHandler; fn != nil {
+		fn(reason)
+	}
+}
+
+// read delivers inbound messages until the websocket fails.
+func (c *client) read(ctx context.Context, conn *websocket.Conn) {
+	// Hand over what arrived during the handshake first, waiting for room
+	// since the consumer has only just been given the channel.
+	for _, msg := range c.early {
+		select {
+		case <-ctx.Done():
+			return
+		case c.inbound <- msg:
+		}
+	}
+	c.early = nil
 
-			resp, err := decodeServerResponse(data)
+	for {
+		if isContextDone(ctx) {
+			return
+		}
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("mixnet: read error: %v", err)
+			return
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+
+		resp, err := decodeServerResponse(data, c.opts.maxMessageSize)
+		if err != nil {
+			log.Printf("mixnet: failed to decode response: %v", err)
+			continue
+		}
+
+		switch resp.kind {
+		case responseTagReceived:
+			received := resp.payload.(receivedMessage)
+			m, err := c.decodeInbound(received.data)
 			if err != nil {
-				log.Printf("mixnet: failed to decode response: %v", err)
+				log.Printf("mixnet: failed to decode message payload: %v", err)
 				continue
 			}
-
-			switch resp.kind {
-			case responseTagReceived:
-				payload := resp.payload.([]byte)
-				m, err := decodeMessagePayload(payload)
-				if err != nil {
-					log.Printf("mixnet: failed to decode message payload: %v", err)
-					continue
-				}
-				select {
-				case inbound <- InboundMessage{Message: m}:
-					if notifyInbound != nil {
-						select {
-						case notifyInbound <- struct{}{}:
-						default:
-						}
-					}
-				default:
-					log.Printf("mixnet: inbound queue full, dropping message")
-				}
-			case responseTagSelfAddress:
-				// Additional self address responses are unexpected but harmless.
+			if !c.deliver(ctx, newInboundMessage(m, received)) {
+				return
+			}
+		case responseTagSelfAddress:
+			self := resp.payload.(message.Recipient)
+			if self.Equal(c.self) {
 				log.Printf("mixnet: received duplicate self address response")
-			case responseTagError:
-				log.Printf("mixnet: gateway error: %v", resp.payload)
-			default:
-				log.Printf("mixnet: unknown response tag %d", resp.kind)
+				continue
 			}
+			// The Nym client re-registered. Later reconnects expect the
+			// new address.
+			log.Printf("mixnet: self address changed from %s to %s", c.self, self)
+			c.self = self
+			if fn := c.opts.selfHandler; fn != nil {
+				fn(self)
+			}
+		case responseTagError:
+			log.Printf("mixnet: gateway error: %v", resp.payload)
+		default:
+			log.Printf("mixnet: unknown response tag %d", resp.kind)
 		}
-	}()
-
-	return self, inbound, outbound, nil
+	}
 }
-
@@ -0,0 +1,231 @@
+package mixnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"banyan/transports/nym/message"
+)
+
+// newSendRecorder starts a minimal Nym client websocket that answers self
+// address requests and forwards every send request frame to sends.
+func newSendRecorder(t *testing.T, self message.Recipient) (string, <-chan []byte) {
+	t.Helper()
+	sends := make(chan []byte, 16)
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil || len(data) == 0 {
+				return
+			}
+			switch data[0] {
+			case requestTagSelfAddress:
+				resp := append([]byte{responseTagSelfAddress}, self.Bytes()...)
+				if err := ws.WriteMessage(websocket.BinaryMessage, resp); err != nil {
+					return
+				}
+			case requestTagSend:
+				sends <- data
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), sends
+}
+
+func TestWriterResendsMessageAfterReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var self message.Recipient
+	self.ClientIdentity[0] = 1
+	uri, sends := newSendRecorder(t, self)
+
+	o := defaultOptions()
+	WithReconnect(3, 10*time.Millisecond)(&o)
+	c := &client{
+		uri:      uri,
+		opts:     o,
+		inbound:  make(chan InboundMessage, 32),
+		outbound: make(chan OutboundMessage, o.outboundBufferSize),
+	}
+	// The first write dies with the socket, as if it broke mid-write.
+	var writes atomic.Int32
+	c.writeFrame = func(conn *websocket.Conn, frame []byte) error {
+		if writes.Add(1) == 1 {
+			conn.Close()
+			return errors.New("broken pipe")
+		}
+		return c.writeWithDeadline(conn, frame)
+	}
+
+	conn, got, err := c.connect(ctx)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	c.self = got
+	go c.run(ctx, conn)
+
+	msg := &message.Message{
+		Type: message.MessageTypeTransport,
+		Transport: &message.TransportMessage{
+			Nonce:   1,
+			Message: message.SubstreamMessage{Type: message.SubstreamMessageData, Data: []byte("survivor")},
+		},
+	}
+	c.outbound <- OutboundMessage{Recipient: self, Message: msg}
+
+	select {
+	case frame := <-sends:
+		if !strings.Contains(string(frame), "survivor") {
+			t.Fatalf("unexpected frame after reconnect")
+		}
+	case <-ctx.Done():
+		t.Fatalf("message lost across reconnect")
+	}
+	if n := writes.Load(); n != 2 {
+		t.Fatalf("expected one failed and one successful write, got %d writes", n)
+	}
+}
+
+// newEarlyFlooder starts a Nym client websocket that sends n received messages,
+// with nonces 1..n, before answering the self address request.
+func newEarlyFlooder(t *testing.T, self message.Recipient, n int) string {
+	t.Helper()
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+		for nonce := 1; nonce <= n; nonce++ {
+			payload, err := message.Encode(&message.Message{
+				Type:      message.MessageTypeTransport,
+				Transport: &message.TransportMessage{Nonce: uint64(nonce), Message: message.SubstreamMessage{Type: message.SubstreamMessageData}},
+			})
+			if err != nil {
+				return
+			}
+			frame := binary.BigEndian.AppendUint64([]byte{responseTagReceived, 0}, uint64(len(payload)))
+			if err := ws.WriteMessage(websocket.BinaryMessage, append(frame, payload...)); err != nil {
+				return
+			}
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{responseTagSelfAddress}, self.Bytes()...)); err != nil {
+			return
+		}
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestPreHandshakeBufferCap(t *testing.T) {
+	var self message.Recipient
+	self.ClientIdentity[0] = 1
+
+	tests := []struct {
+		name       string
+		policy     PreHandshakePolicy
+		wantNonces []uint64
+	}{
+		{"DropNewest", PreHandshakeDropNewest, []uint64{1, 2, 3, 4}},
+		{"DropOldest", PreHandshakeDropOldest, []uint64{97, 98, 99, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var drops atomic.Int32
+			countDrop := func(reason DropReason) {
+				if reason == DropPreHandshake {
+					drops.Add(1)
+				}
+			}
+			uri := newEarlyFlooder(t, self, 100)
+			_, inbound, _, err := Initialize(ctx, uri, nil, WithPreHandshakeBuffer(4, tt.policy), WithDropHandler(countDrop))
+			if err != nil {
+				t.Fatalf("initialize: %v", err)
+			}
+
+			var got []uint64
+			for len(got) < len(tt.wantNonces) {
+				select {
+				case msg := <-inbound:
+					got = append(got, msg.Message.Transport.Nonce)
+				case <-ctx.Done():
+					t.Fatalf("received only %v", got)
+				}
+			}
+			select {
+			case msg := <-inbound:
+				t.Fatalf("received message beyond the cap: nonce %d", msg.Message.Transport.Nonce)
+			case <-time.After(50 * time.Millisecond):
+			}
+			for i := range got {
+				if got[i] != tt.wantNonces[i] {
+					t.Fatalf("kept nonces %v, want %v", got, tt.wantNonces)
+				}
+			}
+			if n := drops.Load(); n != 96 {
+				t.Fatalf("reported %d drops, want 96", n)
+			}
+		})
+	}
+}
+
+func TestPreHandshakeMessagesAreNotLost(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var self message.Recipient
+	self.ClientIdentity[0] = 1
+	var drops atomic.Int32
+	uri := newEarlyFlooder(t, self, 10)
+	_, inbound, _, err := Initialize(ctx, uri, nil, WithInboundBufferSize(2), WithDropHandler(func(DropReason) {
+		drops.Add(1)
+	}))
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+
+	// More messages arrive early than the inbound channel holds; the reader
+	// waits for room rather than discarding them.
+	for want := uint64(1); want <= 10; want++ {
+		select {
+		case msg := <-inbound:
+			if got := msg.Message.Transport.Nonce; got != want {
+				t.Fatalf("received nonce %d, want %d", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("nonce %d not delivered", want)
+		}
+	}
+	if n := drops.Load(); n != 0 {
+		t.Fatalf("reported %d drops, want none", n)
+	}
+}
@@ -0,0 +1,347 @@
+package mixnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"banyan/transports/nym/internal/testutil"
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+func testTransportMessage(data []byte) *message.Message {
+	return &message.Message{
+		Type: message.MessageTypeTransport,
+		Transport: &message.TransportMessage{
+			Nonce: 1,
+			Message: message.SubstreamMessage{
+				Type: message.SubstreamMessageData,
+				Data: data,
+			},
+		},
+	}
+}
+
+func TestInitializeRoutesMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	selfA, _, outboundA, err := mixnet.Initialize(ctx, srv.URL("a"), nil)
+	if err != nil {
+		t.Fatalf("initialize a: %v", err)
+	}
+	if selfA != srv.Recipient("a") {
+		t.Fatalf("unexpected self address %s", selfA)
+	}
+	selfB, inboundB, _, err := mixnet.Initialize(ctx, srv.URL("b"), nil)
+	if err != nil {
+		t.Fatalf("initialize b: %v", err)
+	}
+
+	outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: testTransportMessage([]byte("hello"))}
+
+	select {
+	case in := <-inboundB:
+		if got := string(in.Message.Transport.Message.Data); got != "hello" {
+			t.Fatalf("unexpected payload %q", got)
+		}
+	case <-ctx.Done():
+		t.Fatalf("message not delivered")
+	}
+}
+
+func TestReconnectResumesDelivery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	_, _, outboundA, err := mixnet.Initialize(ctx, srv.URL("a"), nil)
+	if err != nil {
+		t.Fatalf("initialize a: %v", err)
+	}
+	selfB, inboundB, _, err := mixnet.Initialize(ctx, srv.URL("b"), nil, mixnet.WithReconnect(5, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("initialize b: %v", err)
+	}
+
+	srv.Disconnect("b")
+	for srv.Connects("b") < 2 {
+		if ctx.Err() != nil {
+			t.Fatalf("client did not reconnect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Until the server has registered the new session, sends to b are
+	// dropped, so keep sending until one gets through.
+	for {
+		outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: testTransportMessage([]byte("after"))}
+		select {
+		case in, ok := <-inboundB:
+			if !ok {
+				t.Fatalf("inbound closed despite reconnecting")
+			}
+			if got := string(in.Message.Transport.Message.Data); got != "after" {
+				t.Fatalf("unexpected payload %q", got)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("delivery did not resume after reconnect")
+		}
+	}
+}
+
+func TestReconnectGivesUpOnAddressChange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	_, inbound, _, err := mixnet.Initialize(ctx, srv.URL("a"), nil, mixnet.WithReconnect(5, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	srv.SetRecipient("a", srv.Recipient("elsewhere"))
+	srv.Disconnect("a")
+
+	select {
+	case _, ok := <-inbound:
+		if ok {
+			t.Fatalf("unexpected inbound message")
+		}
+	case <-ctx.Done():
+		t.Fatalf("client kept running under a different address")
+	}
+	if n := srv.Connects("a"); n != 2 {
+		t.Fatalf("client opened %d sessions, want to give up after the first reconnect", n)
+	}
+}
+
+func TestWriteTimeoutDetectsStalledGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	_, inbound, outbound, err := mixnet.Initialize(ctx, srv.URL("stalled"), nil, mixnet.WithWriteTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	srv.StallReads("stalled")
+
+	// Keep writing large payloads until the socket buffers fill and the write
+	// deadline fires, which tears the connection down and closes inbound.
+	payload := make([]byte, 1<<20)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case outbound <- mixnet.OutboundMessage{Recipient: srv.Recipient("nobody"), Message: testTransportMessage(payload)}:
+			}
+		}
+	}()
+
+	for {
+		select {
+		case _, ok := <-inbound:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatalf("stalled writer was not detected")
+		}
+	}
+}
+
+func TestOversizedHandshakeMessageIsDropped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	_, _, outboundA, err := mixnet.Initialize(ctx, srv.URL("a"), nil)
+	if err != nil {
+		t.Fatalf("initialize a: %v", err)
+	}
+	selfB, inboundB, _, err := mixnet.Initialize(ctx, srv.URL("b"), nil, mixnet.WithMaxHandshakeSize(256))
+	if err != nil {
+		t.Fatalf("initialize b: %v", err)
+	}
+
+	// An identity multihash decodes as a peer ID of any length.
+	digest := make([]byte, 300)
+	oversized := peer.ID(append([]byte{0x00, 0xac, 0x02}, digest...))
+	outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: &message.Message{
+		Type:       message.MessageTypeConnectionRequest,
+		Connection: &message.ConnectionMessage{PeerID: oversized, ID: message.ConnectionID{1}},
+	}}
+	outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: testTransportMessage(make([]byte, 512))}
+
+	select {
+	case in := <-inboundB:
+		if in.Message.Type != message.MessageTypeTransport {
+			t.Fatalf("received %d byte peer ID in a type %d message; the handshake limit was not applied", len(in.Message.Connection.PeerID), in.Message.Type)
+		}
+	case <-ctx.Done():
+		t.Fatalf("message not delivered")
+	}
+}
+
+func TestVersionedSenderReachesDefaultClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	_, _, outboundA, err := mixnet.Initialize(ctx, srv.URL("a"), nil, mixnet.WithWireVersion(message.WireV1))
+	if err != nil {
+		t.Fatalf("initialize a: %v", err)
+	}
+	selfB, inboundB, _, err := mixnet.Initialize(ctx, srv.URL("b"), nil, mixnet.WithMaxHandshakeSize(256))
+	if err != nil {
+		t.Fatalf("initialize b: %v", err)
+	}
+
+	// The larger message also takes the handshake size check, which must
+	// see past the version byte.
+	for _, size := range []int{5, 512} {
+		outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: testTransportMessage(make([]byte, size))}
+		select {
+		case in := <-inboundB:
+			if got := len(in.Message.Transport.Message.Data); got != size {
+				t.Fatalf("received %d bytes, want %d", got, size)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%d byte versioned message not delivered", size)
+		}
+	}
+}
+
+func TestChecksummedMessagesAreDelivered(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	_, _, outboundA, err := mixnet.Initialize(ctx, srv.URL("a"), nil, mixnet.WithChecksum(true))
+	if err != nil {
+		t.Fatalf("initialize a: %v", err)
+	}
+	selfB, inboundB, _, err := mixnet.Initialize(ctx, srv.URL("b"), nil)
+	if err != nil {
+		t.Fatalf("initialize b: %v", err)
+	}
+
+	outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: testTransportMessage([]byte("intact"))}
+	select {
+	case in := <-inboundB:
+		if got := string(in.Message.Transport.Message.Data); got != "intact" {
+			t.Fatalf("unexpected payload %q", got)
+		}
+	case <-ctx.Done():
+		t.Fatalf("checksummed message not delivered")
+	}
+}
+
+func TestFullInboundQueue(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		dropOnFull bool
+		want       []string
+	}{
+		{"Block", false, []string{"0", "1", "2", "3", "4", "marker"}},
+		{"Drop", true, []string{"0", "1", "marker"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			srv := testutil.NewNymServer()
+			defer srv.Close()
+
+			_, _, outboundA, err := mixnet.Initialize(ctx, srv.URL("a"), nil)
+			if err != nil {
+				t.Fatalf("initialize a: %v", err)
+			}
+			selfB, inboundB, _, err := mixnet.Initialize(ctx, srv.URL("b"), nil,
+				mixnet.WithInboundBufferSize(2), mixnet.WithDropOnFull(tc.dropOnFull))
+			if err != nil {
+				t.Fatalf("initialize b: %v", err)
+			}
+
+			for i := 0; i < 5; i++ {
+				outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: testTransportMessage([]byte{'0' + byte(i)})}
+			}
+			// Let the reader hit the full queue before anything is taken.
+			time.Sleep(200 * time.Millisecond)
+			outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: testTransportMessage([]byte("marker"))}
+
+			for _, want := range tc.want {
+				select {
+				case in := <-inboundB:
+					if got := string(in.Message.Transport.Message.Data); got != want {
+						t.Fatalf("received %q, want %q", got, want)
+					}
+				case <-ctx.Done():
+					t.Fatalf("%q not delivered", want)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectionRequestNamesSender(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	selfA, _, outboundA, err := mixnet.Initialize(ctx, srv.URL("a"), nil)
+	if err != nil {
+		t.Fatalf("initialize a: %v", err)
+	}
+	selfB, inboundB, _, err := mixnet.Initialize(ctx, srv.URL("b"), nil)
+	if err != nil {
+		t.Fatalf("initialize b: %v", err)
+	}
+
+	peerID, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("decode peer id: %v", err)
+	}
+	outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: &message.Message{
+		Type:       message.MessageTypeConnectionRequest,
+		Connection: &message.ConnectionMessage{PeerID: peerID, Recipient: &selfA, ID: message.ConnectionID{1}},
+	}}
+	outboundA <- mixnet.OutboundMessage{Recipient: selfB, Message: testTransportMessage([]byte("data"))}
+
+	for _, wantSender := range []bool{true, false} {
+		select {
+		case in := <-inboundB:
+			switch {
+			case wantSender && (in.Sender == nil || !in.Sender.Equal(selfA)):
+				t.Fatalf("connection request sender %v, want %s", in.Sender, selfA)
+			case !wantSender && in.Sender != nil:
+				t.Fatalf("transport message sender %s, want none", in.Sender)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message not delivered")
+		}
+	}
+}
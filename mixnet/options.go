@@ -0,0 +1,218 @@
+package mixnet
+
+import (
+	"time"
+
+	"banyan/transports/nym/message"
+)
+
+// Option configures the mixnet client created by Initialize.
+type Option func(*options)
+
+type options struct {
+	writeTimeout       time.Duration
+	inboundBufferSize  int
+	outboundBufferSize int
+	reconnectRetries   int
+	reconnectDelay     time.Duration
+	preHandshakeLimit  int
+	preHandshakePolicy PreHandshakePolicy
+	maxHandshakeSize   int
+	maxMessageSize     int
+	wireVersion        message.WireVersion
+	checksum           bool
+	dropOnFull         bool
+	dropHandler        func(DropReason)
+	selfHandler        func(message.Recipient)
+}
+
+const (
+	// defaultWriteTimeout bounds a single websocket write to the Nym client.
+	defaultWriteTimeout = 30 * time.Second
+	// defaultBufferSize is the capacity of the inbound and outbound channels.
+	defaultBufferSize = 32
+	// maxReconnectDelay caps the exponential backoff between reconnect attempts.
+	maxReconnectDelay = 30 * time.Second
+	// defaultMaxHandshakeSize leaves ample room for a connection message,
+	// which is about 170 bytes with an Ed25519 peer ID.
+	defaultMaxHandshakeSize = 1024
+)
+
+func defaultOptions() options {
+	return options{
+		writeTimeout:       defaultWriteTimeout,
+		inboundBufferSize:  defaultBufferSize,
+		outboundBufferSize: defaultBufferSize,
+		preHandshakeLimit:  defaultBufferSize,
+		maxHandshakeSize:   defaultMaxHandshakeSize,
+		maxMessageSize:     message.DefaultMaxMessageSize,
+	}
+}
+
+// PreHandshakePolicy decides which messages are kept when more arrive before
+// the self address handshake than WithPreHandshakeBuffer allows.
+type PreHandshakePolicy int
+
+const (
+	// PreHandshakeDropNewest rejects messages once the buffer is full.
+	PreHandshakeDropNewest PreHandshakePolicy = iota
+	// PreHandshakeDropOldest evicts the oldest buffered message to make room.
+	PreHandshakeDropOldest
+)
+
+// WithPreHandshakeBuffer caps how many messages received before the self
+// address handshake completes are held for delivery, independently of the
+// steady-state inbound buffer. policy picks which messages survive a flood.
+// A zero limit drops all pre-handshake messages.
+func WithPreHandshakeBuffer(limit int, policy PreHandshakePolicy) Option {
+	return func(o *options) {
+		if limit >= 0 {
+			o.preHandshakeLimit = limit
+		}
+		o.preHandshakePolicy = policy
+	}
+}
+
+// DropReason tells why the client discarded a received message.
+type DropReason int
+
+const (
+	// DropPreHandshake means the message arrived before the self address
+	// handshake completed and the pre-handshake buffer had no room for it.
+	DropPreHandshake DropReason = iota
+	// DropInboundFull means the inbound channel was full; see WithDropOnFull.
+	DropInboundFull
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropPreHandshake:
+		return "pre-handshake buffer full"
+	case DropInboundFull:
+		return "inbound queue full"
+	default:
+		return "unknown"
+	}
+}
+
+// WithDropHandler installs fn to be called, from the reading goroutine, for
+// every received message the client discards for want of buffer space. fn
+// must not block.
+func WithDropHandler(fn func(reason DropReason)) Option {
+	return func(o *options) {
+		o.dropHandler = fn
+	}
+}
+
+// WithSelfAddressHandler installs fn to be called, from the reading
+// goroutine, when the Nym client reports a new self address mid-session, as
+// it does after re-registering with a gateway. Without a handler the new
+// address is only logged. fn must not block.
+func WithSelfAddressHandler(fn func(self message.Recipient)) Option {
+	return func(o *options) {
+		o.selfHandler = fn
+	}
+}
+
+// WithMaxHandshakeSize caps the encoded size of received connection-level
+// messages (requests, responses, pings and the like). Larger ones are dropped
+// before they are decoded. Data messages are not affected.
+func WithMaxHandshakeSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxHandshakeSize = n
+		}
+	}
+}
+
+// WithMaxMessageSize caps the size of received messages, message.
+// DefaultMaxMessageSize by default. A larger length announced by the Nym
+// client is refused before anything is allocated for it, and a websocket frame
+// too large to hold such a message ends the connection to the client.
+func WithMaxMessageSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxMessageSize = n
+		}
+	}
+}
+
+// WithWireVersion sets the wire format version of sent messages. Received
+// messages are accepted in any supported version, so peers can move to a new
+// version one at a time. The default, message.WireUnversioned, is what
+// clients without version support send and expect.
+func WithWireVersion(v message.WireVersion) Option {
+	return func(o *options) {
+		o.wireVersion = v
+	}
+}
+
+// WithChecksum appends a CRC-32C to every sent transport message, costing five
+// bytes per message. Receivers verify checksums whether or not they set this
+// option and drop messages that fail. Checksummed messages carry a version
+// byte, so peers must understand message.WireV1.
+func WithChecksum(enabled bool) Option {
+	return func(o *options) {
+		o.checksum = enabled
+	}
+}
+
+// WithWriteTimeout sets the deadline applied to each websocket write. A write
+// that cannot complete in time (for example because the Nym client stopped
+// reading) closes the connection instead of wedging all outbound traffic.
+// A zero or negative value disables the deadline.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.writeTimeout = d
+	}
+}
+
+// WithInboundBufferSize sets the capacity of the inbound channel. Once it is
+// full the client stops reading from the websocket until there is room, or
+// drops further messages with WithDropOnFull.
+func WithInboundBufferSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.inboundBufferSize = n
+		}
+	}
+}
+
+// WithDropOnFull makes the client drop received messages while the inbound
+// channel is full instead of waiting for the consumer. That keeps the
+// websocket drained under load, but every dropped transport message stalls its
+// connection at the gap it leaves.
+func WithDropOnFull(enabled bool) Option {
+	return func(o *options) {
+		o.dropOnFull = enabled
+	}
+}
+
+// WithOutboundBufferSize sets the capacity of the outbound channel. Senders
+// block once it is full, so larger values smooth bursts at the cost of memory.
+func WithOutboundBufferSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.outboundBufferSize = n
+		}
+	}
+}
+
+// WithReconnect makes the client redial the websocket after it drops, up to
+// maxRetries times per outage with exponential backoff starting at baseDelay.
+// The channels returned by Initialize keep working across reconnects, and a
+// message whose write fails is resent first once the websocket is back;
+// messages already accepted by a dying socket may still be lost. Reconnecting
+// gives up if the Nym client comes back with a different self address.
+func WithReconnect(maxRetries int, baseDelay time.Duration) Option {
+	return func(o *options) {
+		if maxRetries < 0 {
+			maxRetries = 0
+		}
+		if baseDelay <= 0 {
+			baseDelay = 100 * time.Millisecond
+		}
+		o.reconnectRetries = maxRetries
+		o.reconnectDelay = baseDelay
+	}
+}
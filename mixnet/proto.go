@@ -3,15 +3,18 @@ package mixnet
 import (
 	"context"
 	"encoding/binary"
-	"errors"
+	"encoding/hex"
 	"fmt"
+	"sync"
 
 	"banyan/transports/nym/message"
 )
 
 const (
-	requestTagSend        = 0x00
-	requestTagSelfAddress = 0x03
+	requestTagSend          = 0x00
+	requestTagSendAnonymous = 0x01
+	requestTagReply         = 0x02
+	requestTagSelfAddress   = 0x03
 )
 
 const (
@@ -21,11 +24,37 @@ const (
 )
 
 // senderTagSize defines the length of the optional reply SURB sender tag.
-// The current transport doesn't support anonymous replies and will reject frames
-// carrying the tag to avoid mis-parsing the payload.
 const senderTagSize = 32
 
-var errUnsupportedSenderTag = errors.New("mixnet: received message with sender tag is unsupported")
+// maxReceivedOverhead is the framing around a message in the largest received
+// response: the tag, the sender tag marker and tag, and the length.
+const maxReceivedOverhead = 1 + 1 + senderTagSize + 8
+
+// SenderTag identifies an anonymous sender. The Nym client stores the reply
+// SURBs it received from that sender under this tag, so replies can be routed
+// back without ever learning the sender's recipient address.
+type SenderTag [senderTagSize]byte
+
+// String implements fmt.Stringer for debugging.
+func (t SenderTag) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// MarshalText implements encoding.TextMarshaler using the hex form.
+func (t SenderTag) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *SenderTag) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != senderTagSize {
+		return fmt.Errorf("mixnet: invalid sender tag length %d", len(text))
+	}
+	if _, err := hex.Decode(t[:], text); err != nil {
+		return fmt.Errorf("mixnet: decode sender tag: %w", err)
+	}
+	return nil
+}
 
 func serializeSelfAddressRequest() []byte {
 	return []byte{requestTagSelfAddress}
@@ -47,18 +76,66 @@ func serializeSendRequest(recipient message.Recipient, payload []byte) []byte {
 	return buf
 }
 
-func decodeServerResponse(data []byte) (serverResponse, error) {
+// serializeSendAnonymousRequest asks the Nym client to send payload to recipient
+// without revealing our address, attaching replySURBs reply blocks the receiver
+// can use to answer.
+func serializeSendAnonymousRequest(recipient message.Recipient, payload []byte, replySURBs uint32) []byte {
+	size := 1 + message.RecipientLength + 8 + 4 + 8 + len(payload)
+	buf := make([]byte, size)
+	buf[0] = requestTagSendAnonymous
+	copy(buf[1:1+message.RecipientLength], recipient.Bytes())
+	offset := 1 + message.RecipientLength
+	// connection id -> zero (already zeroed by make)
+	offset += 8
+	binary.BigEndian.PutUint32(buf[offset:offset+4], replySURBs)
+	offset += 4
+	binary.BigEndian.PutUint64(buf[offset:offset+8], uint64(len(payload)))
+	offset += 8
+	copy(buf[offset:], payload)
+	return buf
+}
+
+// serializeReplyRequest asks the Nym client to answer an anonymous sender using
+// the reply SURBs stored under tag.
+func serializeReplyRequest(tag SenderTag, payload []byte) []byte {
+	size := 1 + senderTagSize + 8 + 8 + len(payload)
+	buf := make([]byte, size)
+	buf[0] = requestTagReply
+	copy(buf[1:1+senderTagSize], tag[:])
+	offset := 1 + senderTagSize
+	// connection id -> zero (already zeroed by make)
+	offset += 8
+	binary.BigEndian.PutUint64(buf[offset:offset+8], uint64(len(payload)))
+	offset += 8
+	copy(buf[offset:], payload)
+	return buf
+}
+
+func serializeOutbound(out OutboundMessage, payload []byte) []byte {
+	switch {
+	case out.SenderTag != nil:
+		return serializeReplyRequest(*out.SenderTag, payload)
+	case out.ReplySURBs > 0:
+		return serializeSendAnonymousRequest(out.Recipient, payload, out.ReplySURBs)
+	default:
+		return serializeSendRequest(out.Recipient, payload)
+	}
+}
+
+// decodeServerResponse parses a response from the Nym client, refusing
+// received messages larger than maxSize.
+func decodeServerResponse(data []byte, maxSize int) (serverResponse, error) {
 	if len(data) == 0 {
 		return serverResponse{}, fmt.Errorf("mixnet: empty response")
 	}
 
 	switch data[0] {
 	case responseTagReceived:
-		payload, err := decodeReceivedPayload(data)
+		received, err := decodeReceivedPayload(data, maxSize)
 		if err != nil {
 			return serverResponse{}, err
 		}
-		return serverResponse{kind: responseTagReceived, payload: payload}, nil
+		return serverResponse{kind: responseTagReceived, payload: received}, nil
 	case responseTagSelfAddress:
 		if len(data) != 1+message.RecipientLength {
 			return serverResponse{}, fmt.Errorf("mixnet: invalid self address response length %d", len(data))
@@ -74,7 +151,8 @@ func decodeServerResponse(data []byte) (serverResponse, error) {
 		}
 		code := data[1]
 		msgLen := binary.BigEndian.Uint64(data[2 : 2+8])
-		if int(msgLen) != len(data)-(2+8) {
+		// Compare as uint64: converting msgLen to int could wrap.
+		if msgLen != uint64(len(data)-(2+8)) {
 			return serverResponse{}, fmt.Errorf("mixnet: malformed error response length")
 		}
 		return serverResponse{
@@ -91,48 +169,85 @@ type serverResponse struct {
 	payload any
 }
 
-func decodeReceivedPayload(data []byte) ([]byte, error) {
+// receivedMessage is the decoded body of a received response.
+type receivedMessage struct {
+	data []byte
+	// senderTag is set when the sender attached reply SURBs.
+	senderTag *SenderTag
+}
+
+func decodeReceivedPayload(data []byte, maxSize int) (receivedMessage, error) {
 	if len(data) < 2+8 {
-		return nil, fmt.Errorf("mixnet: received response too short")
+		return receivedMessage{}, fmt.Errorf("mixnet: received response too short")
 	}
 
 	hasTag := data[1]
 	offset := 2
+	var tag *SenderTag
 	if hasTag == 1 {
-		// The current transport implementation does not support sender tags.
-		// Bail out explicitly to avoid parsing inconsistent payloads.
 		if len(data) < offset+senderTagSize+8 {
-			return nil, fmt.Errorf("mixnet: received response missing sender tag bytes")
+			return receivedMessage{}, fmt.Errorf("mixnet: received response missing sender tag bytes")
 		}
-		return nil, errUnsupportedSenderTag
+		tag = new(SenderTag)
+		copy(tag[:], data[offset:offset+senderTagSize])
+		offset += senderTagSize
 	} else if hasTag != 0 {
-		return nil, fmt.Errorf("mixnet: invalid sender tag marker %d", hasTag)
+		return receivedMessage{}, fmt.Errorf("mixnet: invalid sender tag marker %d", hasTag)
 	}
 
 	if len(data) < offset+8 {
-		return nil, fmt.Errorf("mixnet: received response missing length")
+		return receivedMessage{}, fmt.Errorf("mixnet: received response missing length")
 	}
 
 	length := binary.BigEndian.Uint64(data[offset : offset+8])
 	offset += 8
-	if int(length) != len(data)-offset {
-		return nil, fmt.Errorf("mixnet: received response malformed length expected %d got %d", length, len(data)-offset)
+	if length > uint64(maxSize) {
+		return receivedMessage{}, fmt.Errorf("%w: received length %d exceeds %d", message.ErrMessageTooLarge, length, maxSize)
+	}
+	if length != uint64(len(data)-offset) {
+		return receivedMessage{}, fmt.Errorf("mixnet: received response malformed length expected %d got %d", length, len(data)-offset)
 	}
 
 	msg := make([]byte, length)
 	copy(msg, data[offset:])
-	return msg, nil
+	return receivedMessage{data: msg, senderTag: tag}, nil
 }
 
-func encodeMessagePayload(msg *message.Message) ([]byte, error) {
-	if msg == nil {
+// payloadPool holds scratch buffers for encoding outbound messages. The
+// encoding is copied into the request frame, so the buffer can be reused as
+// soon as the frame is built.
+var payloadPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 2048)
+		return &b
+	},
+}
+
+// encodeOutboundFrame encodes out's message and wraps it in the matching Nym
+// client request, using wire format version and appending a checksum to
+// transport messages when checksum is set.
+func encodeOutboundFrame(out OutboundMessage, version message.WireVersion, checksum bool) ([]byte, error) {
+	if out.Message == nil {
 		return nil, fmt.Errorf("mixnet: nil message")
 	}
-	return message.Encode(msg)
+	buf := payloadPool.Get().(*[]byte)
+	defer payloadPool.Put(buf)
+
+	encode := message.AppendEncodeVersion
+	if checksum {
+		encode = message.AppendEncodeChecksum
+	}
+	payload, err := encode((*buf)[:0], out.Message, version)
+	if err != nil {
+		return nil, err
+	}
+	*buf = payload[:0]
+	return serializeOutbound(out, payload), nil
 }
 
-func decodeMessagePayload(data []byte) (*message.Message, error) {
-	return message.Decode(data)
+func decodeMessagePayload(data []byte, maxSize int) (*message.Message, error) {
+	msg, _, err := message.DecodeLimit(data, maxSize)
+	return msg, err
 }
 
 // isContextDone returns true if the context has been cancelled.
@@ -0,0 +1,108 @@
+package mixnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"banyan/transports/nym/message"
+)
+
+func receivedFrame(payload []byte, tag *SenderTag) []byte {
+	frame := []byte{responseTagReceived, 0}
+	if tag != nil {
+		frame[1] = 1
+		frame = append(frame, tag[:]...)
+	}
+	frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestDecodeReceivedRejectsWrappingLength(t *testing.T) {
+	frame := receivedFrame([]byte("abc"), nil)
+	// A length that only matches the payload once truncated to 32 bits.
+	binary.BigEndian.PutUint64(frame[2:10], 1<<32|3)
+	if _, err := decodeServerResponse(frame, message.DefaultMaxMessageSize); err == nil {
+		t.Fatal("decodeServerResponse accepted a length that does not match the payload")
+	}
+}
+
+func FuzzDecodeServerResponse(f *testing.F) {
+	f.Add(receivedFrame([]byte("hello"), nil))
+	f.Add(receivedFrame([]byte("hello"), &SenderTag{1}))
+	f.Add(append([]byte{responseTagSelfAddress}, make([]byte, message.RecipientLength)...))
+	f.Add(binary.BigEndian.AppendUint64([]byte{responseTagError, 7}, 0))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp, err := decodeServerResponse(data, message.DefaultMaxMessageSize)
+		if err != nil {
+			return
+		}
+		if received, ok := resp.payload.(receivedMessage); ok && len(received.data) > len(data) {
+			t.Fatalf("decoded a %d byte payload from a %d byte frame", len(received.data), len(data))
+		}
+	})
+}
+
+func TestDecodeReceivedWithSenderTag(t *testing.T) {
+	tag := SenderTag{1, 2, 3}
+	resp, err := decodeServerResponse(receivedFrame([]byte("hello"), &tag), message.DefaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	received := resp.payload.(receivedMessage)
+	if received.senderTag == nil || *received.senderTag != tag {
+		t.Fatalf("sender tag %v, want %v", received.senderTag, tag)
+	}
+	if string(received.data) != "hello" {
+		t.Fatalf("payload %q, want %q", received.data, "hello")
+	}
+
+	// A tag marker without the tag bytes is malformed.
+	if _, err := decodeServerResponse([]byte{responseTagReceived, 1, 0, 0}, message.DefaultMaxMessageSize); err == nil {
+		t.Fatal("decodeServerResponse accepted a truncated sender tag")
+	}
+}
+
+func TestSerializeOutboundRepliesWithSenderTag(t *testing.T) {
+	tag := SenderTag{9, 8, 7}
+	payload := []byte("reply")
+	frame := serializeOutbound(OutboundMessage{Recipient: message.Recipient{}, SenderTag: &tag}, payload)
+
+	if frame[0] != requestTagReply {
+		t.Fatalf("request tag %d, want reply %d", frame[0], requestTagReply)
+	}
+	if got := SenderTag(frame[1 : 1+senderTagSize]); got != tag {
+		t.Fatalf("sender tag %v, want %v", got, tag)
+	}
+	offset := 1 + senderTagSize + 8
+	if n := binary.BigEndian.Uint64(frame[offset : offset+8]); n != uint64(len(payload)) {
+		t.Fatalf("payload length %d, want %d", n, len(payload))
+	}
+	if got := string(frame[offset+8:]); got != string(payload) {
+		t.Fatalf("payload %q, want %q", got, payload)
+	}
+
+	if frame := serializeOutbound(OutboundMessage{ReplySURBs: 5}, payload); frame[0] != requestTagSendAnonymous {
+		t.Fatalf("request tag %d, want anonymous send %d", frame[0], requestTagSendAnonymous)
+	}
+}
+
+func TestDecodeReceivedRejectsOversizedLength(t *testing.T) {
+	// A frame announcing 4GiB is refused on its length alone.
+	frame := receivedFrame([]byte("abc"), nil)
+	binary.BigEndian.PutUint64(frame[2:10], 4<<30)
+	if _, err := decodeServerResponse(frame, message.DefaultMaxMessageSize); !errors.Is(err, message.ErrMessageTooLarge) {
+		t.Fatalf("decode of 4GiB length returned %v, want ErrMessageTooLarge", err)
+	}
+
+	// So is a complete message over the limit.
+	frame = receivedFrame(make([]byte, 64), nil)
+	if _, err := decodeServerResponse(frame, 32); !errors.Is(err, message.ErrMessageTooLarge) {
+		t.Fatalf("decode over the limit returned %v, want ErrMessageTooLarge", err)
+	}
+	if _, err := decodeServerResponse(frame, 64); err != nil {
+		t.Fatalf("decode at the limit: %v", err)
+	}
+}
@@ -3,25 +3,105 @@ package queue
 import (
 	"sort"
 	"sync"
+	"time"
 
 	"banyan/transports/nym/message"
 )
 
+// OverflowPolicy selects which message a full queue discards.
+type OverflowPolicy int
+
+const (
+	// OverflowReject discards the incoming message.
+	OverflowReject OverflowPolicy = iota
+	// OverflowEvictHighest discards the buffered message with the highest
+	// nonce, which is the furthest from being deliverable. An incoming message
+	// with a higher nonce than everything buffered is discarded instead.
+	OverflowEvictHighest
+)
+
 // MessageQueue reorders transport messages by nonce for a connection.
 type MessageQueue struct {
 	mu                sync.Mutex
 	nextExpectedNonce uint64
 	pending           map[uint64]message.TransportMessage
 	nonces            []uint64
+	// bufferedBytes is the substream payload size of all pending messages.
+	bufferedBytes int
+
+	// maxDepth caps len(nonces); zero means unbounded.
+	maxDepth int
+	overflow OverflowPolicy
+	// window caps how far ahead of nextExpectedNonce a buffered nonce may
+	// be; zero means unbounded.
+	window     uint64
+	evictions  uint64
+	duplicates uint64
+
+	// gapSince is when the queue started waiting for nextExpectedNonce
+	// with later messages buffered; zero while there is no gap.
+	gapSince time.Time
 }
 
-// New returns an empty queue.
+// New returns an empty, unbounded queue.
 func New() *MessageQueue {
 	return &MessageQueue{
 		pending: make(map[uint64]message.TransportMessage),
 	}
 }
 
+// NewWithWindow returns an empty queue that refuses messages more than
+// maxPending nonces ahead of the next expected one, so a peer withholding a
+// nonce cannot make it buffer arbitrarily far ahead. Refused messages count as
+// evictions. SetMaxDepth additionally caps how many messages are buffered
+// within the window. A maxPending of zero or less is unbounded, like New.
+func NewWithWindow(maxPending int) *MessageQueue {
+	mq := New()
+	if maxPending > 0 {
+		mq.window = uint64(maxPending)
+	}
+	return mq
+}
+
+// SetMaxDepth caps how many out-of-order messages the queue buffers, with
+// policy choosing what to discard once the cap is reached. Zero removes the
+// cap. Messages already buffered beyond a lowered cap are kept.
+func (mq *MessageQueue) SetMaxDepth(n int, policy OverflowPolicy) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	mq.maxDepth = n
+	mq.overflow = policy
+}
+
+// Evictions returns how many messages the queue discarded because they were
+// outside its window or it was at its maximum depth. Reset does not clear it.
+func (mq *MessageQueue) Evictions() uint64 {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return mq.evictions
+}
+
+// DuplicatesSeen returns how many pushed messages carried a nonce that was
+// already released or is already buffered, as when the mixnet delivers a
+// packet twice. Reset does not clear it.
+func (mq *MessageQueue) DuplicatesSeen() uint64 {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return mq.duplicates
+}
+
+// GapSince returns when the queue started holding messages back behind a
+// missing nonce, or the zero time if nothing is waiting. A gap that fills
+// only to reveal another one restarts the clock.
+func (mq *MessageQueue) GapSince() time.Time {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return mq.gapSince
+}
+
 // SetConnectionMessageReceived initialises the queue once the handshake completed.
 func (mq *MessageQueue) SetConnectionMessageReceived() {
 	mq.mu.Lock()
@@ -50,15 +130,48 @@ func (mq *MessageQueue) TryPush(msg message.TransportMessage) (*message.Transpor
 		return &msg, true
 	}
 	if nonce < mq.nextExpectedNonce {
+		mq.duplicates++
 		return nil, false
 	}
 
-	if _, exists := mq.pending[nonce]; !exists {
+	if _, exists := mq.pending[nonce]; exists {
+		mq.duplicates++
+	} else {
 		mq.insertLocked(msg)
 	}
 	return nil, false
 }
 
+// makeRoomLocked enforces maxDepth before nonce is inserted, reporting whether
+// it may be stored.
+func (mq *MessageQueue) makeRoomLocked(nonce uint64) bool {
+	if mq.maxDepth == 0 || len(mq.nonces) < mq.maxDepth {
+		return true
+	}
+	if _, exists := mq.pending[nonce]; exists {
+		return true
+	}
+	mq.evictions++
+	highest := mq.nonces[len(mq.nonces)-1]
+	if mq.overflow != OverflowEvictHighest || nonce > highest {
+		return false
+	}
+	mq.bufferedBytes -= len(mq.pending[highest].Message.Data)
+	delete(mq.pending, highest)
+	mq.nonces = mq.nonces[:len(mq.nonces)-1]
+	return true
+}
+
+// inWindowLocked reports whether nonce is close enough to the next expected
+// nonce to be buffered. Before the handshake, the window starts at nonce 1.
+func (mq *MessageQueue) inWindowLocked(nonce uint64) bool {
+	if mq.window == 0 {
+		return true
+	}
+	next := max(mq.nextExpectedNonce, 1)
+	return nonce-next <= mq.window
+}
+
 // Pop returns queued messages in order if available.
 func (mq *MessageQueue) Pop() (*message.TransportMessage, bool) {
 	mq.mu.Lock()
@@ -80,10 +193,64 @@ func (mq *MessageQueue) Pop() (*message.TransportMessage, bool) {
 	msg := mq.pending[smallest]
 	delete(mq.pending, smallest)
 	mq.nonces = mq.nonces[1:]
+	mq.bufferedBytes -= len(msg.Message.Data)
 	mq.nextExpectedNonce++
+	switch {
+	case len(mq.nonces) == 0:
+		mq.gapSince = time.Time{}
+	case mq.nonces[0] != mq.nextExpectedNonce:
+		mq.gapSince = time.Now()
+	}
 	return &msg, true
 }
 
+// NextExpectedNonce returns the nonce that will be released next, or zero if the
+// handshake has not completed yet.
+func (mq *MessageQueue) NextExpectedNonce() uint64 {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return mq.nextExpectedNonce
+}
+
+// PendingMessages returns copies of the buffered out-of-order messages in nonce order.
+func (mq *MessageQueue) PendingMessages() []message.TransportMessage {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	out := make([]message.TransportMessage, 0, len(mq.nonces))
+	for _, nonce := range mq.nonces {
+		out = append(out, mq.pending[nonce])
+	}
+	return out
+}
+
+// Resume initialises the queue to continue releasing messages from
+// nextExpected, as when restoring a connection from a snapshot.
+func (mq *MessageQueue) Resume(nextExpected uint64) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if mq.nextExpectedNonce != 0 {
+		panic("queue: resume on an active queue")
+	}
+	if nextExpected == 0 {
+		nextExpected = 1
+	}
+	mq.nextExpectedNonce = nextExpected
+}
+
+// Len returns how many messages are buffered waiting for an earlier nonce.
+func (mq *MessageQueue) Len() int {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return len(mq.nonces)
+}
+
+// BufferedBytes returns the total substream payload size held in the queue.
+func (mq *MessageQueue) BufferedBytes() int {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return mq.bufferedBytes
+}
+
 // PendingNonces returns a snapshot of queued nonces (useful for debugging).
 func (mq *MessageQueue) PendingNonces() []uint64 {
 	mq.mu.Lock()
@@ -95,7 +262,23 @@ func (mq *MessageQueue) PendingNonces() []uint64 {
 
 func (mq *MessageQueue) insertLocked(msg message.TransportMessage) {
 	nonce := msg.Nonce
+	if !mq.inWindowLocked(nonce) {
+		mq.evictions++
+		return
+	}
+	if !mq.makeRoomLocked(nonce) {
+		return
+	}
+	if old, exists := mq.pending[nonce]; exists {
+		// Only reached before the handshake, where the latest copy wins.
+		mq.duplicates++
+		mq.bufferedBytes -= len(old.Message.Data)
+	}
+	if len(mq.nonces) == 0 {
+		mq.gapSince = time.Now()
+	}
 	mq.pending[nonce] = msg
+	mq.bufferedBytes += len(msg.Message.Data)
 	idx := sort.Search(len(mq.nonces), func(i int) bool {
 		return mq.nonces[i] >= nonce
 	})
@@ -110,11 +293,41 @@ func (mq *MessageQueue) insertLocked(msg message.TransportMessage) {
 	}
 }
 
-// Reset clears the queue (used when tearing down connections).
-func (mq *MessageQueue) Reset() {
+// ResetSummary describes the buffered messages discarded by Reset.
+type ResetSummary struct {
+	// NextExpectedNonce is the nonce the queue was waiting for; buffered
+	// messages after it could not be released because it never arrived.
+	NextExpectedNonce uint64
+	// DroppedNonces lists the discarded messages in nonce order.
+	DroppedNonces []uint64
+	// DroppedBytes is the total substream payload size of the discarded messages.
+	DroppedBytes int
+}
+
+// Dropped returns the number of discarded messages.
+func (s ResetSummary) Dropped() int {
+	return len(s.DroppedNonces)
+}
+
+// Reset clears the queue (used when tearing down connections) and reports what
+// was still buffered.
+func (mq *MessageQueue) Reset() ResetSummary {
 	mq.mu.Lock()
 	defer mq.mu.Unlock()
+
+	summary := ResetSummary{NextExpectedNonce: mq.nextExpectedNonce}
+	if len(mq.nonces) > 0 {
+		summary.DroppedNonces = make([]uint64, len(mq.nonces))
+		copy(summary.DroppedNonces, mq.nonces)
+		for _, msg := range mq.pending {
+			summary.DroppedBytes += len(msg.Message.Data)
+		}
+	}
+
 	mq.nextExpectedNonce = 0
 	mq.pending = make(map[uint64]message.TransportMessage)
 	mq.nonces = mq.nonces[:0]
+	mq.bufferedBytes = 0
+	mq.gapSince = time.Time{}
+	return summary
 }
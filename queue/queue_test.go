@@ -254,6 +254,59 @@ func TestQueueReset(t *testing.T) {
 	}
 }
 
+func TestQueueResetReportsDroppedMessages(t *testing.T) {
+	q := New()
+	q.SetConnectionMessageReceived()
+
+	// Nonce 1 is released, 2 never arrives, so 3, 4 and 6 stay buffered.
+	for _, nonce := range []uint64{1, 3, 4, 6} {
+		q.TryPush(createTestMessage(nonce, []byte("abc")))
+	}
+
+	summary := q.Reset()
+	if summary.Dropped() != 3 {
+		t.Fatalf("Reset() dropped %d messages, want 3", summary.Dropped())
+	}
+	if summary.NextExpectedNonce != 2 {
+		t.Errorf("NextExpectedNonce = %d, want 2", summary.NextExpectedNonce)
+	}
+	for i, want := range []uint64{3, 4, 6} {
+		if summary.DroppedNonces[i] != want {
+			t.Errorf("DroppedNonces[%d] = %d, want %d", i, summary.DroppedNonces[i], want)
+		}
+	}
+	if summary.DroppedBytes != 9 {
+		t.Errorf("DroppedBytes = %d, want 9", summary.DroppedBytes)
+	}
+
+	if empty := q.Reset(); empty.Dropped() != 0 {
+		t.Errorf("second Reset() dropped %d messages, want 0", empty.Dropped())
+	}
+}
+
+func TestQueueBufferedBytes(t *testing.T) {
+	q := New()
+	q.SetConnectionMessageReceived()
+
+	q.TryPush(createTestMessage(2, []byte("hello")))
+	q.TryPush(createTestMessage(3, []byte("hi")))
+	q.TryPush(createTestMessage(3, []byte("hi")))
+	if got := q.BufferedBytes(); got != 7 {
+		t.Fatalf("BufferedBytes() = %d, want 7", got)
+	}
+
+	q.TryPush(createTestMessage(1, nil))
+	q.Pop()
+	if got := q.BufferedBytes(); got != 2 {
+		t.Fatalf("BufferedBytes() after pop = %d, want 2", got)
+	}
+
+	q.Reset()
+	if got := q.BufferedBytes(); got != 0 {
+		t.Fatalf("BufferedBytes() after reset = %d, want 0", got)
+	}
+}
+
 func TestQueuePendingNonces(t *testing.T) {
 	q := New()
 	q.SetConnectionMessageReceived()
@@ -311,3 +364,270 @@ func BenchmarkQueuePushOutOfOrder(b *testing.B) {
 		q.TryPush(msg)
 	}
 }
+
+func TestQueueResume(t *testing.T) {
+	q := New()
+	q.SetConnectionMessageReceived()
+	for _, nonce := range []uint64{1, 2, 5} {
+		q.TryPush(createTestMessage(nonce, []byte{byte(nonce)}))
+	}
+
+	if next := q.NextExpectedNonce(); next != 3 {
+		t.Fatalf("NextExpectedNonce() = %d, want 3", next)
+	}
+	pending := q.PendingMessages()
+	if len(pending) != 1 || pending[0].Nonce != 5 {
+		t.Fatalf("PendingMessages() = %v, want nonce 5", pending)
+	}
+
+	restored := New()
+	restored.Resume(q.NextExpectedNonce())
+	for _, msg := range pending {
+		restored.TryPush(msg)
+	}
+
+	if _, ok := restored.TryPush(createTestMessage(2, []byte{2})); ok {
+		t.Error("TryPush(2) accepted an already delivered nonce")
+	}
+	if msg, ok := restored.TryPush(createTestMessage(3, []byte{3})); !ok || msg.Nonce != 3 {
+		t.Fatal("TryPush(3) should have been released")
+	}
+	if _, ok := restored.Pop(); ok {
+		t.Error("Pop() succeeded despite gap at nonce 4")
+	}
+	restored.TryPush(createTestMessage(4, []byte{4}))
+	if msg, ok := restored.Pop(); !ok || msg.Nonce != 5 {
+		t.Fatal("Pop() should have released restored nonce 5")
+	}
+}
+
+func TestQueueMaxDepth(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        OverflowPolicy
+		push          []uint64
+		wantNonces    []uint64
+		wantEvictions uint64
+	}{
+		{
+			name:          "Reject",
+			policy:        OverflowReject,
+			push:          []uint64{5, 9, 7, 3, 8},
+			wantNonces:    []uint64{5, 7, 9},
+			wantEvictions: 2,
+		},
+		{
+			name:          "EvictHighest",
+			policy:        OverflowEvictHighest,
+			push:          []uint64{5, 9, 7, 3, 8},
+			wantNonces:    []uint64{3, 5, 7},
+			wantEvictions: 2,
+		},
+		{
+			name:          "EvictHighestDropsIncomingHighest",
+			policy:        OverflowEvictHighest,
+			push:          []uint64{2, 3, 4, 10},
+			wantNonces:    []uint64{2, 3, 4},
+			wantEvictions: 1,
+		},
+		{
+			name:          "DuplicateIsNotEviction",
+			policy:        OverflowEvictHighest,
+			push:          []uint64{2, 3, 4, 3},
+			wantNonces:    []uint64{2, 3, 4},
+			wantEvictions: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New()
+			q.SetConnectionMessageReceived()
+			q.SetMaxDepth(3, tt.policy)
+			for _, nonce := range tt.push {
+				q.TryPush(createTestMessage(nonce, []byte{byte(nonce)}))
+			}
+
+			got := q.PendingNonces()
+			if len(got) != len(tt.wantNonces) {
+				t.Fatalf("pending nonces = %v, want %v", got, tt.wantNonces)
+			}
+			for i := range got {
+				if got[i] != tt.wantNonces[i] {
+					t.Fatalf("pending nonces = %v, want %v", got, tt.wantNonces)
+				}
+			}
+			if q.BufferedBytes() != len(tt.wantNonces) {
+				t.Errorf("BufferedBytes = %d, want %d", q.BufferedBytes(), len(tt.wantNonces))
+			}
+			if q.Evictions() != tt.wantEvictions {
+				t.Errorf("Evictions = %d, want %d", q.Evictions(), tt.wantEvictions)
+			}
+		})
+	}
+}
+
+func TestQueueWindowBoundary(t *testing.T) {
+	q := NewWithWindow(4)
+	q.SetConnectionMessageReceived()
+
+	// With nonce 1 outstanding, 5 is the furthest that may be buffered.
+	for _, nonce := range []uint64{5, 6, 1000000, 2} {
+		q.TryPush(createTestMessage(nonce, []byte{1}))
+	}
+	if got := q.PendingNonces(); len(got) != 2 || got[0] != 2 || got[1] != 5 {
+		t.Fatalf("pending nonces = %v, want [2 5]", got)
+	}
+	if q.Evictions() != 2 {
+		t.Errorf("Evictions = %d, want 2", q.Evictions())
+	}
+	if q.BufferedBytes() != 2 {
+		t.Errorf("BufferedBytes = %d, want 2", q.BufferedBytes())
+	}
+
+	// Releasing nonces moves the window along.
+	if ready, ok := q.TryPush(createTestMessage(1, nil)); !ok || ready.Nonce != 1 {
+		t.Fatalf("expected nonce 1 to be released")
+	}
+	if next, ok := q.Pop(); !ok || next.Nonce != 2 {
+		t.Fatalf("expected nonce 2 to be released")
+	}
+	q.TryPush(createTestMessage(7, nil))
+	q.TryPush(createTestMessage(8, nil))
+	if got := q.PendingNonces(); len(got) != 2 || got[1] != 7 {
+		t.Fatalf("pending nonces = %v, want [5 7]", got)
+	}
+}
+
+func TestQueueWindowBeforeHandshake(t *testing.T) {
+	q := NewWithWindow(2)
+	for _, nonce := range []uint64{2, 3, 4} {
+		q.TryPush(createTestMessage(nonce, nil))
+	}
+	if got := q.PendingNonces(); len(got) != 2 || got[1] != 3 {
+		t.Fatalf("pending nonces = %v, want [2 3]", got)
+	}
+}
+
+func TestQueueWindowWithEviction(t *testing.T) {
+	q := NewWithWindow(10)
+	q.SetConnectionMessageReceived()
+	q.SetMaxDepth(2, OverflowEvictHighest)
+
+	for _, nonce := range []uint64{9, 5, 3, 20} {
+		q.TryPush(createTestMessage(nonce, []byte{1}))
+	}
+	// 3 evicts 9 once the queue is full; 20 is outside the window.
+	if got := q.PendingNonces(); len(got) != 2 || got[0] != 3 || got[1] != 5 {
+		t.Fatalf("pending nonces = %v, want [3 5]", got)
+	}
+	if q.Evictions() != 2 {
+		t.Errorf("Evictions = %d, want 2", q.Evictions())
+	}
+	if q.BufferedBytes() != 2 {
+		t.Errorf("BufferedBytes = %d, want 2", q.BufferedBytes())
+	}
+}
+
+func TestQueueDuplicatesSeen(t *testing.T) {
+	q := New()
+	q.SetConnectionMessageReceived()
+
+	// Re-pushing a buffered nonce.
+	q.TryPush(createTestMessage(3, []byte{1}))
+	q.TryPush(createTestMessage(3, []byte{1}))
+	if got := q.DuplicatesSeen(); got != 1 {
+		t.Fatalf("DuplicatesSeen after re-pushing a pending nonce = %d, want 1", got)
+	}
+	if q.BufferedBytes() != 1 {
+		t.Errorf("duplicate was buffered twice: BufferedBytes = %d", q.BufferedBytes())
+	}
+
+	// Re-pushing nonces that were already released, directly and via Pop.
+	q.TryPush(createTestMessage(1, nil))
+	q.TryPush(createTestMessage(2, nil))
+	q.Pop()
+	for _, nonce := range []uint64{1, 3} {
+		if _, ok := q.TryPush(createTestMessage(nonce, nil)); ok {
+			t.Fatalf("consumed nonce %d released again", nonce)
+		}
+	}
+	if got := q.DuplicatesSeen(); got != 3 {
+		t.Fatalf("DuplicatesSeen after re-pushing consumed nonces = %d, want 3", got)
+	}
+
+	q.Reset()
+	if got := q.DuplicatesSeen(); got != 3 {
+		t.Errorf("Reset cleared DuplicatesSeen: %d", got)
+	}
+}
+
+func TestQueueDuplicatesBeforeHandshake(t *testing.T) {
+	q := New()
+	q.TryPush(createTestMessage(2, []byte{1}))
+	q.TryPush(createTestMessage(2, []byte{1, 2}))
+	if got := q.DuplicatesSeen(); got != 1 {
+		t.Fatalf("DuplicatesSeen = %d, want 1", got)
+	}
+	if q.BufferedBytes() != 2 {
+		t.Errorf("BufferedBytes = %d, want 2", q.BufferedBytes())
+	}
+}
+
+func TestQueueGapSince(t *testing.T) {
+	q := New()
+	q.SetConnectionMessageReceived()
+	if !q.GapSince().IsZero() {
+		t.Fatalf("empty queue reports a gap")
+	}
+
+	q.TryPush(createTestMessage(2, nil))
+	q.TryPush(createTestMessage(4, nil))
+	first := q.GapSince()
+	if first.IsZero() {
+		t.Fatalf("no gap reported while waiting for nonce 1")
+	}
+	q.TryPush(createTestMessage(5, nil))
+	if got := q.GapSince(); !got.Equal(first) {
+		t.Fatalf("buffering more restarted the gap clock")
+	}
+
+	// Filling the gap reveals the one at nonce 3.
+	q.TryPush(createTestMessage(1, nil))
+	q.Pop()
+	if got := q.GapSince(); got.IsZero() || got.Before(first) {
+		t.Fatalf("GapSince = %v after the first gap filled, want a new gap", got)
+	}
+
+	q.TryPush(createTestMessage(3, nil))
+	for {
+		if _, ok := q.Pop(); !ok {
+			break
+		}
+	}
+	if !q.GapSince().IsZero() {
+		t.Fatalf("drained queue still reports a gap")
+	}
+}
+
+func TestQueueLen(t *testing.T) {
+	mq := New()
+	mq.SetConnectionMessageReceived()
+	for _, nonce := range []uint64{3, 4} {
+		mq.TryPush(message.TransportMessage{Nonce: nonce})
+	}
+	if got := mq.Len(); got != 2 {
+		t.Fatalf("Len = %d with two messages behind a gap, want 2", got)
+	}
+	for _, nonce := range []uint64{1, 2} {
+		mq.TryPush(message.TransportMessage{Nonce: nonce})
+	}
+	for {
+		if _, ok := mq.Pop(); !ok {
+			break
+		}
+	}
+	if got := mq.Len(); got != 0 {
+		t.Fatalf("Len = %d after draining, want 0", got)
+	}
+}
@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+// ErrConnectionRejected is returned by Dial when the listener declined the
+// connection.
+var ErrConnectionRejected = errors.New("nym transport: connection rejected")
+
+// AcceptInterceptor decides whether to accept an inbound connection request.
+// The returned scope is assigned to the connection; a nil scope keeps the
+// default. Returning an error rejects the connection, failing the remote's
+// Dial with ErrConnectionRejected.
+type AcceptInterceptor func(req *message.ConnectionMessage) (network.ConnScope, error)
+
+// WithAcceptInterceptor runs fn on every inbound connection request before a
+// Conn is created, so resource limits can be applied at accept time. If the
+// scope is a network.ConnManagementScope, Done is called when the connection
+// closes.
+func WithAcceptInterceptor(fn AcceptInterceptor) Option {
+	return func(c *config) {
+		c.acceptInterceptor = fn
+	}
+}
+
+// rejectConnection tells the dialer of req that it was declined, replying the
+// same way an accepted connection would.
+func (t *Transport) rejectConnection(req *message.ConnectionMessage, tag *mixnet.SenderTag) {
+	t.mu.RLock()
+	useTag := tag != nil && (req.Recipient == nil || t.anonymousListenerLocked())
+	t.mu.RUnlock()
+
+	out := mixnet.OutboundMessage{
+		Message: &message.Message{
+			Type: message.MessageTypeConnectionReject,
+			Connection: &message.ConnectionMessage{
+				PeerID: t.LocalPeer(),
+				ID:     req.ID,
+			},
+		},
+	}
+	if useTag {
+		out.SenderTag = tag
+	} else {
+		out.Recipient = *req.Recipient
+	}
+	if err := t.sendOutbound(out); err != nil {
+		log.Printf("nym transport: send connection reject: %v", err)
+	}
+}
+
+func (t *Transport) handleConnectionReject(connMsg *message.ConnectionMessage) error {
+	key := connKey(connMsg.ID)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, ok := t.pendingDials[key]
+	if !ok {
+		return fmt.Errorf("no pending dial for reject")
+	}
+	delete(t.pendingDials, key)
+	state.rejected = true
+	close(state.resultCh)
+	return nil
+}
+
+// releaseScope ends scope if it is one the transport is responsible for.
+func releaseScope(scope network.ConnScope) {
+	if s, ok := scope.(network.ConnManagementScope); ok {
+		s.Done()
+	}
+}
@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"banyan/transports/nym/message"
+)
+
+type countingScope struct {
+	network.NullScope
+	done atomic.Int32
+}
+
+func (s *countingScope) Done() { s.done.Add(1) }
+
+func TestAcceptInterceptorRejectsUnderPressure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		pressure atomic.Bool
+		scope    countingScope
+	)
+	intercept := func(req *message.ConnectionMessage) (network.ConnScope, error) {
+		if pressure.Load() {
+			return nil, errors.New("out of connection slots")
+		}
+		return &scope, nil
+	}
+	handler, failures := recordFailures()
+	transportA, transportB := newTestTransports(t, ctx, WithAcceptInterceptor(intercept), WithHandshakeFailureHandler(handler))
+
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	pressure.Store(true)
+	if _, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer); !errors.Is(err, ErrConnectionRejected) {
+		t.Fatalf("dial under pressure returned %v, want ErrConnectionRejected", err)
+	}
+	assertHandshakeFailure(t, transportA, failures(), transportB.selfRecipient, HandshakeRejected)
+
+	pressure.Store(false)
+	if _, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer); err != nil {
+		t.Fatalf("dial after pressure eased: %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if accepted.Scope() != &scope {
+		t.Fatalf("accepted connection does not use the interceptor's scope")
+	}
+	accepted.Close()
+	if n := scope.done.Load(); n != 1 {
+		t.Fatalf("scope released %d times on close, want 1", n)
+	}
+}
@@ -1,9 +1,12 @@
 package transport
 
 import (
+	"fmt"
 	"sync"
 
 	ma "github.com/multiformats/go-multiaddr"
+
+	"banyan/transports/nym/message"
 )
 
 const (
@@ -43,7 +46,11 @@ func bytesToString(b []byte) (string, error) {
 	return string(b), nil
 }
 
+// validateBytes rejects values that are not a recipient, so malformed /nym
+// multiaddrs fail when they are constructed rather than when dialed.
 func validateBytes(b []byte) error {
-	// No additional validation for now; recipient parsing happens later.
+	if _, err := message.ParseRecipient(string(b)); err != nil {
+		return fmt.Errorf("nym transport: invalid recipient: %w", err)
+	}
 	return nil
 }
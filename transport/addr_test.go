@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestNymMultiaddrValidation(t *testing.T) {
+	r := testRecipient(0x31)
+	addr, err := ma.NewMultiaddr("/nym/" + r.String())
+	if err != nil {
+		t.Fatalf("valid recipient rejected: %v", err)
+	}
+	got, err := parseRecipientFromMultiaddr(addr)
+	if err != nil || got != r {
+		t.Fatalf("parsed recipient %s, %v; want %s", got, err, r)
+	}
+	if _, err := ma.NewMultiaddrBytes(addr.Bytes()); err != nil {
+		t.Fatalf("valid binary multiaddr rejected: %v", err)
+	}
+
+	s := r.String()
+	for _, value := range []string{
+		"not-a-recipient",
+		s[:len(s)-4],
+		s[:len(s)/2],
+		"@" + s,
+	} {
+		if _, err := ma.NewMultiaddr("/nym/" + value); err == nil {
+			t.Fatalf("/nym/%s accepted", value)
+		}
+	}
+
+	garbage := []byte("not-a-recipient")
+	raw := append(ma.CodeToVarint(nymProtocolCode), byte(len(garbage)))
+	if _, err := ma.NewMultiaddrBytes(append(raw, garbage...)); err == nil {
+		t.Fatal("binary multiaddr with an invalid recipient accepted")
+	}
+}
@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"context"
+
+	lptransport "github.com/libp2p/go-libp2p/core/transport"
+)
+
+type anonymityKey struct{}
+
+// anonymousTransportName is the ConnState transport of anonymous connections.
+const anonymousTransportName = nymProtocolName + "-anonymous"
+
+// WithAnonymity returns a context that makes Dial perform an anonymous
+// handshake: our recipient address is omitted from the connection request and
+// every message carries reply SURBs, so the remote can only answer through the
+// sender tag the Nym client assigns to us.
+func WithAnonymity(ctx context.Context) context.Context {
+	return context.WithValue(ctx, anonymityKey{}, true)
+}
+
+// WithAnonymousReplies makes every Dial anonymous, as if its context came from
+// WithAnonymity. Remotes then answer only through reply SURBs and never learn
+// our recipient address.
+func WithAnonymousReplies(enabled bool) Option {
+	return func(c *config) {
+		c.anonymousReplies = enabled
+	}
+}
+
+func isAnonymousDial(ctx context.Context) bool {
+	anonymous, _ := ctx.Value(anonymityKey{}).(bool)
+	return anonymous
+}
+
+// ListenAnonymous listens for connections carrying a sender tag. Every
+// connection accepted through the returned listener replies exclusively via the
+// stored reply SURBs, even if the dialer also disclosed its recipient address.
+func (t *Transport) ListenAnonymous() (lptransport.Listener, error) {
+	if t.mixnetClosed() {
+		return nil, ErrMixnetDisconnected
+	}
+	l := newListener(t)
+	l.anonymous = true
+	t.mu.Lock()
+	t.listeners[l] = struct{}{}
+	t.mu.Unlock()
+	return l, nil
+}
+
+// anonymousListenerLocked reports whether any anonymous listener is active.
+// Callers must hold t.mu.
+func (t *Transport) anonymousListenerLocked() bool {
+	for l := range t.listeners {
+		if l.anonymous {
+			return true
+		}
+	}
+	return false
+}
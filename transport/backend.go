@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+// MixnetClient is the mixnet endpoint a Transport sends and receives through.
+// New connects to a Nym client websocket; NewWithMixnet accepts any other
+// implementation, such as an in-memory network for tests.
+type MixnetClient interface {
+	// Self returns the address other clients reach this one at.
+	Self() message.Recipient
+	// Inbound delivers received messages. Closing it tells the transport
+	// that the mixnet is gone for good.
+	Inbound() <-chan mixnet.InboundMessage
+	// Outbound accepts messages to send.
+	Outbound() chan<- mixnet.OutboundMessage
+	// Close shuts the client down. Transport.Close calls it once the
+	// transport's own final messages were handed over.
+	Close() error
+}
+
+// NewWithMixnet creates a transport on top of client, taking ownership of it.
+// Options that configure the Nym client New connects to, such as
+// WithReconnect, WithChecksum or WithOutboundBufferSize, have no effect on
+// client and are refused; configure client itself instead.
+func NewWithMixnet(ctx context.Context, client MixnetClient, privKey crypto.PrivKey, opts ...Option) (*Transport, error) {
+	cfg := applyOptions(opts)
+	if len(cfg.mixnetOpts()) > 0 {
+		return nil, fmt.Errorf("nym transport: mixnet client options only apply to New")
+	}
+	return newWithClient(ctx, client, privKey, opts...)
+}
+
+// newWithClient is NewWithMixnet without the check for mixnet client options,
+// which New has already passed to client.
+func newWithClient(ctx context.Context, client MixnetClient, privKey crypto.PrivKey, opts ...Option) (*Transport, error) {
+	t, err := newWithMixnet(ctx, privKey, client.Self(), client.Inbound(), client.Outbound(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	t.backend = client
+	if c, ok := client.(*websocketClient); ok {
+		c.notifySelf(t.setSelfAddress)
+		// Catch a change that happened before fn was installed.
+		t.setSelfAddress(c.Self())
+	}
+	return t, nil
+}
+
+// websocketClient is the MixnetClient backed by mixnet.Initialize.
+type websocketClient struct {
+	// mu guards self, which changes when the Nym client re-registers, and
+	// onSelf, which is told about it.
+	mu       sync.Mutex
+	self     message.Recipient
+	onSelf   func(message.Recipient)
+	inbound  <-chan mixnet.InboundMessage
+	outbound chan<- mixnet.OutboundMessage
+	cancel   context.CancelFunc
+	// drops counts received messages the mixnet client discarded.
+	drops atomic.Uint64
+}
+
+func dialWebsocketClient(ctx context.Context, uri string, opts []mixnet.Option) (*websocketClient, error) {
+	c := &websocketClient{}
+	opts = append(opts, mixnet.WithDropHandler(func(mixnet.DropReason) {
+		c.drops.Add(1)
+	}), mixnet.WithSelfAddressHandler(c.selfChanged))
+	ctx, cancel := context.WithCancel(ctx)
+	self, inbound, outbound, err := mixnet.Initialize(ctx, uri, nil, opts...)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("nym transport: initialize mixnet: %w", err)
+	}
+	c.mu.Lock()
+	c.self = self
+	c.mu.Unlock()
+	c.inbound, c.outbound, c.cancel = inbound, outbound, cancel
+	return c, nil
+}
+
+// selfChanged records a new self address and passes it on; see notifySelf.
+func (c *websocketClient) selfChanged(self message.Recipient) {
+	c.mu.Lock()
+	c.self = self
+	fn := c.onSelf
+	c.mu.Unlock()
+	if fn != nil {
+		fn(self)
+	}
+}
+
+// notifySelf makes fn receive the self addresses the client changes to.
+func (c *websocketClient) notifySelf(fn func(message.Recipient)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onSelf = fn
+}
+
+func (c *websocketClient) Self() message.Recipient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.self
+}
+
+func (c *websocketClient) Inbound() <-chan mixnet.InboundMessage   { return c.inbound }
+func (c *websocketClient) Outbound() chan<- mixnet.OutboundMessage { return c.outbound }
+
+func (c *websocketClient) Close() error {
+	c.cancel()
+	return nil
+}
+
+// closeBackend closes the mixnet client once the outbound queue has drained,
+// waiting at most the shutdown timeout so close notices get written.
+func (t *Transport) closeBackend() {
+	if t.backend == nil {
+		return
+	}
+	t.backendOnce.Do(func() {
+		deadline := time.Now().Add(t.cfg.shutdownTimeout)
+		for len(t.mixnetOutbound) > 0 && !t.mixnetClosed() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.backend.Close()
+	})
+}
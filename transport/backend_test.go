@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"banyan/transports/nym/internal/testutil"
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+// pipeClient is a MixnetClient over one end of a pipe network.
+type pipeClient struct {
+	testutil.PipeEndpoint
+	closed atomic.Int32
+}
+
+func (c *pipeClient) Self() message.Recipient                 { return c.Recipient }
+func (c *pipeClient) Inbound() <-chan mixnet.InboundMessage   { return c.PipeEndpoint.Inbound }
+func (c *pipeClient) Outbound() chan<- mixnet.OutboundMessage { return c.PipeEndpoint.Outbound }
+
+func (c *pipeClient) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+func TestNewWithMixnetUsesCustomBackend(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	endpoints, err := testutil.PipeNetworkN(ctx, testRecipient(0x11), testRecipient(0x22))
+	if err != nil {
+		t.Fatalf("pipe network: %v", err)
+	}
+	var transports [2]*Transport
+	clients := [2]*pipeClient{{PipeEndpoint: endpoints[0]}, {PipeEndpoint: endpoints[1]}}
+	for i, client := range clients {
+		priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		if transports[i], err = NewWithMixnet(ctx, client, priv); err != nil {
+			t.Fatalf("create transport %d: %v", i, err)
+		}
+		if transports[i].selfRecipient != client.Recipient {
+			t.Fatalf("transport %d listens on %s, want the backend's %s", i, transports[i].selfRecipient, client.Recipient)
+		}
+	}
+
+	if _, err := transports[0].Ping(ctx, transports[1].selfRecipient); err != nil {
+		t.Fatalf("ping through custom backend: %v", err)
+	}
+
+	transports[0].Close()
+	transports[0].Close()
+	if n := clients[0].closed.Load(); n != 1 {
+		t.Fatalf("backend closed %d times, want once", n)
+	}
+	transports[1].Close()
+}
+
+func TestNewWithMixnetRefusesMixnetOptions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	endpoints, err := testutil.PipeNetworkN(ctx, testRecipient(0x11))
+	if err != nil {
+		t.Fatalf("pipe network: %v", err)
+	}
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	for name, opt := range map[string]Option{
+		"write timeout":   WithWebsocketWriteTimeout(time.Second),
+		"reconnect":       WithReconnect(3, time.Second),
+		"handshake size":  WithMaxHandshakeMessageSize(1 << 10),
+		"message size":    WithMaxMessageSize(1 << 20),
+		"wire version":    WithWireVersion(message.WireV1),
+		"checksum":        WithChecksum(true),
+		"drop on full":    WithDropOnFull(true),
+		"outbound buffer": WithOutboundBufferSize(8),
+		"inbound buffer":  WithMixnetInboundBufferSize(8),
+	} {
+		client := &pipeClient{PipeEndpoint: endpoints[0]}
+		if tpt, err := NewWithMixnet(ctx, client, priv, opt); err == nil {
+			tpt.Close()
+			t.Errorf("%s: NewWithMixnet accepted a mixnet client option", name)
+		}
+	}
+}
@@ -3,8 +3,13 @@ package transport
 import (
 	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -13,6 +18,7 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 
 	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
 	"banyan/transports/nym/queue"
 )
 
@@ -20,32 +26,82 @@ type Conn struct {
 	transport *Transport
 	id        message.ConnectionID
 
-	localPeer  peer.ID
-	remotePeer peer.ID
+	localPeer peer.ID
+
+	// peerMu guards the remote identity, which SetVerifiedPeer may replace.
+	peerMu       sync.RWMutex
+	remotePeer   peer.ID
+	remotePubKey crypto.PubKey
+	peerVerified bool
 
 	localAddr  ma.Multiaddr
 	remoteAddr ma.Multiaddr
 
 	remoteRecipient message.Recipient
+	// replyTag is set on accepted anonymous connections; all messages are then
+	// routed through the remote's reply SURBs instead of remoteRecipient.
+	replyTag atomic.Pointer[mixnet.SenderTag]
+	// anonymous is set on dialed connections that withhold our recipient and
+	// attach reply SURBs to every message.
+	anonymous bool
 
 	queue *queue.MessageQueue
 
+	// sendWindow and recvWindow are the stream windows offered by the remote
+	// and by us, both zero unless both ends offered one; see
+	// WithStreamWindow. They are set before the connection is published.
+	sendWindow int
+	recvWindow int
+	// closeControl is set if both ends advertised close control; see
+	// WithCloseControl. It is set before the connection is published.
+	closeControl bool
+
 	inboundSubstreams chan *Substream
 	closeCh           chan struct{}
 	closed            atomic.Bool
+	// ready is closed once both ends know the handshake completed; see Ready.
+	ready     chan struct{}
+	readyOnce sync.Once
 
 	streamsMu       sync.Mutex
 	streams         map[string]*Substream
 	pendingOutbound map[string]*pendingSubstream
+	// closeWaiters holds the CloseWait calls waiting for a close ack.
+	closeWaiters map[string]chan struct{}
+
+	// sendMu serialises nonce assignment with queueing on the mixnet so that
+	// nonces are only consumed by messages that were actually sent.
+	sendMu sync.Mutex
+	nonce  uint64
 
-	nonce uint64
+	// Buffered payload accounting; see WithMaxBufferedBytes. queueBytes is
+	// only touched by the inbound dispatch goroutine.
+	bufMu       sync.Mutex
+	buffered    int64
+	bufReleased bool
+	queueBytes  int
 
 	scope network.ConnScope
+
+	// Payload bytes read from and written to the connection's substreams.
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+
+	// lastActive is when stream traffic last went either way, in Unix
+	// nanoseconds; see WithIdleTimeout.
+	lastActive atomic.Int64
+
+	// Keepalive state; see WithKeepalive.
+	pingOutstanding atomic.Bool
+	missedPings     atomic.Int32
 }
 
 type pendingSubstream struct {
 	stream *Substream
 	ready  chan struct{}
+	// accepted is set before ready is closed if the remote took the stream;
+	// otherwise the open was refused or the connection went away.
+	accepted bool
 }
 
 func newConn(t *Transport, connID message.ConnectionID, remotePeer peer.ID, remoteRecipient message.Recipient, q *queue.MessageQueue) (*Conn, error) {
@@ -57,24 +113,36 @@ func newConn(t *Transport, connID message.ConnectionID, remotePeer peer.ID, remo
 	conn := &Conn{
 		transport:         t,
 		id:                connID,
-		localPeer:         t.localPeer,
+		localPeer:         t.LocalPeer(),
 		remotePeer:        remotePeer,
-		localAddr:         t.listenAddr,
+		localAddr:         t.listenAddress(),
 		remoteAddr:        remoteAddr,
 		remoteRecipient:   remoteRecipient,
 		queue:             q,
-		inboundSubstreams: make(chan *Substream, 8),
+		inboundSubstreams: make(chan *Substream, t.cfg.AcceptBacklog),
 		closeCh:           make(chan struct{}),
+		ready:             make(chan struct{}),
 		streams:           make(map[string]*Substream),
 		pendingOutbound:   make(map[string]*pendingSubstream),
+		closeWaiters:      make(map[string]chan struct{}),
 		scope:             &network.NullScope{},
 	}
+	conn.touch()
 
 	return conn, nil
 }
 
 func (c *Conn) handleTransportMessage(msg message.TransportMessage) {
-	if ready, ok := c.queue.TryPush(msg); ok && ready != nil {
+	if c.closed.Load() {
+		return
+	}
+	// Traffic from the dialer also proves it has the connection, should its
+	// ack have been lost.
+	c.markReady()
+	c.touch()
+	ready, ok := c.queue.TryPush(msg)
+	c.transport.cfg.metrics.ReorderQueueDepth(c.queue.Len())
+	if ok && ready != nil {
 		c.processOrderedMessage(*ready)
 	}
 	for {
@@ -84,33 +152,96 @@ func (c *Conn) handleTransportMessage(msg message.TransportMessage) {
 		}
 		c.processOrderedMessage(*next)
 	}
+	if !c.accountQueue() {
+		log.Printf("nym transport: closing connection %s: buffered data limit exceeded", c.id)
+		c.Close()
+	}
 }
 
 func (c *Conn) processOrderedMessage(msg message.TransportMessage) {
 	subMsg := msg.Message
 	switch subMsg.Type {
 	case message.SubstreamMessageOpenRequest:
-		c.handleOpenRequest(subMsg.ID)
+		c.handleOpenRequest(subMsg.ID, subMsg.Data)
 	case message.SubstreamMessageOpenResponse:
 		c.handleOpenResponse(subMsg.ID)
 	case message.SubstreamMessageData:
 		c.handleData(subMsg.ID, subMsg.Data)
 	case message.SubstreamMessageClose:
 		c.handleClose(subMsg.ID)
+	case message.SubstreamMessageCloseAck:
+		c.handleCloseAck(subMsg.ID)
+	case message.SubstreamMessageCloseWrite:
+		c.handleCloseWrite(subMsg.ID)
+	case message.SubstreamMessageWindowUpdate:
+		c.handleWindowUpdate(subMsg.ID, subMsg.WindowCredit())
 	}
 }
 
-func (c *Conn) handleOpenRequest(id message.SubstreamID) {
-	stream := newSubstream(c, id)
+// handleOpenRequest accepts a stream opened by the remote. initial is data
+// piggybacked on the request by OpenStreamWithData; it is queued for the
+// reader before the stream is answered or handed to AcceptStream.
+func (c *Conn) handleOpenRequest(id message.SubstreamID, initial []byte) {
+	key := substreamKey(id)
 
 	c.streamsMu.Lock()
-	c.streams[substreamKey(id)] = stream
+	if _, exists := c.streams[key]; exists {
+		// Duplicate open for an established stream.
+		c.streamsMu.Unlock()
+		return
+	}
+	if pending, ok := c.pendingOutbound[key]; ok {
+		// Both sides opened the same ID at once. The peer with the lower
+		// peer ID keeps its open request and waits for the response; the
+		// other side yields by answering it and adopting its own pending
+		// stream, so both ends end up with a single opener-side stream.
+		if c.winsSimultaneousOpen() {
+			c.streamsMu.Unlock()
+			c.deliverData(pending.stream, initial)
+			return
+		}
+		delete(c.pendingOutbound, key)
+		c.streams[key] = pending.stream
+		pending.accepted = true
+		close(pending.ready)
+		c.streamsMu.Unlock()
+		c.deliverData(pending.stream, initial)
+		_ = c.sendControl(id, message.SubstreamMessageOpenResponse)
+		return
+	}
+	// Only this goroutine adds to the backlog, so a free slot seen here is
+	// still free when the stream is enqueued below.
+	if len(c.inboundSubstreams) == cap(c.inboundSubstreams) {
+		c.streamsMu.Unlock()
+		// Refuse the stream; the opener sees its OpenStream reset.
+		_ = c.sendControl(id, message.SubstreamMessageClose)
+		return
+	}
+	scope, err := c.openStreamScope(network.DirInbound)
+	if err != nil {
+		c.streamsMu.Unlock()
+		log.Printf("nym transport: refusing stream on connection %s: %v", c.id, err)
+		_ = c.sendControl(id, message.SubstreamMessageClose)
+		return
+	}
+	stream := newSubstream(c, id)
+	stream.scope = scope
+	c.streams[key] = stream
 	c.streamsMu.Unlock()
 
+	c.deliverData(stream, initial)
+	// The response must go out before the stream is handed to AcceptStream so
+	// that none of our data can overtake it.
 	_ = c.sendControl(id, message.SubstreamMessageOpenResponse)
 	c.enqueueInboundStream(stream)
 }
 
+// winsSimultaneousOpen reports whether our open request takes precedence when
+// both sides open the same substream ID concurrently.
+func (c *Conn) winsSimultaneousOpen() bool {
+	return c.localPeer < c.RemotePeer()
+}
+
 func (c *Conn) handleOpenResponse(id message.SubstreamID) {
 	key := substreamKey(id)
 
@@ -123,6 +254,7 @@ func (c *Conn) handleOpenResponse(id message.SubstreamID) {
 	}
 	delete(c.pendingOutbound, key)
 	c.streams[key] = pending.stream
+	pending.accepted = true
 	close(pending.ready)
 }
 
@@ -131,28 +263,86 @@ func (c *Conn) handleData(id message.SubstreamID, data []byte) {
 	if stream == nil {
 		return
 	}
-	stream.pushData(data)
+	c.deliverData(stream, data)
+}
+
+// deliverData queues data for stream's reader, closing the connection if the
+// buffered data limit refuses it and resetting the stream if its reader has
+// fallen too far behind.
+func (c *Conn) deliverData(stream *Substream, data []byte) {
+	// Zero-length data is legal on the wire but carries nothing for the reader.
+	if len(data) == 0 {
+		return
+	}
+	if stream.readClosed.Load() {
+		// Discarded data still frees the remote's send window.
+		stream.consumed(len(data))
+		return
+	}
+	if stream.heldOverflows(len(data)) {
+		log.Printf("nym transport: resetting substream %s: reader fell too far behind", stream.id)
+		stream.Reset()
+		return
+	}
+	if !stream.chargeBuffered(len(data)) {
+		log.Printf("nym transport: closing connection %s: buffered data limit exceeded", c.id)
+		c.Close()
+		return
+	}
+	if !stream.pushData(data) {
+		stream.releaseBuffered(len(data))
+	}
 }
 
 func (c *Conn) handleClose(id message.SubstreamID) {
 	stream := c.removeStream(id)
 	if stream != nil {
 		stream.remoteClose()
+		stream.openWindow()
+	}
+	// Everything the remote sent before the close has been delivered by now,
+	// since the reorder queue releases messages in nonce order.
+	if c.closeControl {
+		_ = c.sendControl(id, message.SubstreamMessageCloseAck)
 	}
 }
 
+// handleCloseWrite ends the remote's direction of the stream: the reader sees
+// EOF after the data before it, while writes keep working. The stream is
+// dropped once our side has stopped writing too.
+func (c *Conn) handleCloseWrite(id message.SubstreamID) {
+	stream := c.getStream(id)
+	if stream == nil {
+		return
+	}
+	stream.remoteClose()
+	if stream.writeClosed.Load() {
+		c.removeStream(id)
+	}
+}
+
+// negotiateCloseControl enables close control on c if the remote advertised
+// it in its handshake message and we do too.
+func (c *Conn) negotiateCloseControl(remote bool) {
+	c.closeControl = remote && c.transport.cfg.closeControl
+}
+
+func (c *Conn) handleCloseAck(id message.SubstreamID) {
+	key := substreamKey(id)
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if ack, ok := c.closeWaiters[key]; ok {
+		delete(c.closeWaiters, key)
+		close(ack)
+	}
+}
+
+// enqueueInboundStream hands stream to AcceptStream. handleOpenRequest
+// reserves backlog capacity beforehand, so this never blocks.
 func (c *Conn) enqueueInboundStream(stream *Substream) {
 	select {
 	case <-c.closeCh:
-		return
 	case c.inboundSubstreams <- stream:
-	default:
-		go func() {
-			select {
-			case <-c.closeCh:
-			case c.inboundSubstreams <- stream:
-			}
-		}()
 	}
 }
 
@@ -168,13 +358,50 @@ func (c *Conn) removeStream(id message.SubstreamID) *Substream {
 	defer c.streamsMu.Unlock()
 	stream := c.streams[key]
 	delete(c.streams, key)
+	if stream != nil {
+		stream.scope.release()
+	}
 	if pending, ok := c.pendingOutbound[key]; ok {
 		delete(c.pendingOutbound, key)
+		pending.stream.scope.release()
 		close(pending.ready)
 	}
 	return stream
 }
 
+// ID returns the connection identifier shared by both ends, as seen in
+// traces and on the wire.
+func (c *Conn) ID() message.ConnectionID {
+	return c.id
+}
+
+// IsAnonymous reports whether the connection runs over reply SURBs. On an
+// accepted connection this means the remote's recipient is unknown and
+// RemoteMultiaddr carries no usable address; on a dialed one our own
+// recipient was withheld from the remote.
+func (c *Conn) IsAnonymous() bool {
+	return c.anonymous || c.replyTag.Load() != nil
+}
+
+// MaxPayloadSize returns how many bytes of stream data fit in one mixnet
+// message. Larger writes are fragmented, so sizing writes to a multiple of it
+// avoids a short trailing message.
+func (c *Conn) MaxPayloadSize() int {
+	return c.transport.cfg.maxFragmentSize - c.transport.cfg.transportOverhead()
+}
+
+// Ready is closed once the handshake has completed on both ends: on the
+// dialer when it acknowledges the listener's response, and on the listener
+// when that acknowledgement (or any later message) arrives. Protocols that
+// need a synchronised start can wait on it.
+func (c *Conn) Ready() <-chan struct{} {
+	return c.ready
+}
+
+func (c *Conn) markReady() {
+	c.readyOnce.Do(func() { close(c.ready) })
+}
+
 // network.ConnMultiaddrs
 
 func (c *Conn) LocalMultiaddr() ma.Multiaddr {
@@ -192,16 +419,54 @@ func (c *Conn) LocalPeer() peer.ID {
 }
 
 func (c *Conn) RemotePeer() peer.ID {
+	c.peerMu.RLock()
+	defer c.peerMu.RUnlock()
 	return c.remotePeer
 }
 
+// RemotePublicKey returns the key the remote announced in the handshake, or
+// the one set by SetVerifiedPeer. Like the announced peer ID, an announced key
+// is not authenticated. It is nil if a remote whose peer ID does not embed its
+// key did not send one.
 func (c *Conn) RemotePublicKey() crypto.PubKey {
+	c.peerMu.RLock()
+	defer c.peerMu.RUnlock()
+	return c.remotePubKey
+}
+
+// SetVerifiedPeer records the outcome of authentication performed outside the
+// transport. The peer ID announced in the handshake is not authenticated, so
+// applications that verify the remote themselves can pin the result here; pub
+// must belong to p.
+func (c *Conn) SetVerifiedPeer(p peer.ID, pub crypto.PubKey) error {
+	if !p.MatchesPublicKey(pub) {
+		return fmt.Errorf("nym transport: public key does not match peer %s", p)
+	}
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	c.remotePeer = p
+	c.remotePubKey = pub
+	c.peerVerified = true
 	return nil
 }
 
+// PeerVerified reports whether SetVerifiedPeer has confirmed the remote peer.
+func (c *Conn) PeerVerified() bool {
+	c.peerMu.RLock()
+	defer c.peerMu.RUnlock()
+	return c.peerVerified
+}
+
+// ConnState names the transport "nym", or "nym-anonymous" on connections that
+// run over reply SURBs; see IsAnonymous. Code that only holds the swarm's
+// network.Conn, such as a network.Notifiee, can tell them apart this way.
 func (c *Conn) ConnState() network.ConnectionState {
+	transport := nymProtocolName
+	if c.IsAnonymous() {
+		transport = anonymousTransportName
+	}
 	return network.ConnectionState{
-		Transport: nymProtocolName,
+		Transport: transport,
 	}
 }
 
@@ -214,16 +479,40 @@ func (c *Conn) Scope() network.ConnScope {
 // network.MuxedConn
 
 func (c *Conn) OpenStream(ctx context.Context) (network.MuxedStream, error) {
+	return c.openStream(ctx, nil)
+}
+
+// OpenStreamWithData opens a stream whose open request already carries
+// initial, saving the round trip of a separate first write. The remote reader
+// sees initial as the first bytes of the stream. initial must fit in a single
+// message; see MaxPayloadSize.
+func (c *Conn) OpenStreamWithData(ctx context.Context, initial []byte) (network.MuxedStream, error) {
+	if len(initial) > c.MaxPayloadSize() {
+		return nil, fmt.Errorf("nym transport: initial data of %d bytes exceeds max payload size %d", len(initial), c.MaxPayloadSize())
+	}
+	return c.openStream(ctx, initial)
+}
+
+func (c *Conn) openStream(ctx context.Context, initial []byte) (network.MuxedStream, error) {
 	if c.closed.Load() {
 		return nil, network.ErrReset
 	}
 
-	id, err := message.GenerateSubstreamID()
+	start := time.Now()
+	id, err := c.transport.newSubstreamID()
+	if err != nil {
+		return nil, err
+	}
+	scope, err := c.openStreamScope(network.DirOutbound)
 	if err != nil {
 		return nil, err
 	}
 
 	stream := newSubstream(c, id)
+	stream.scope = scope
+	// Initial data spends send credit like a write; it fits a single
+	// message, so it is sent without waiting for a window update.
+	stream.sendCredit -= int64(len(initial))
 	key := substreamKey(id)
 	pending := &pendingSubstream{
 		stream: stream,
@@ -231,65 +520,178 @@ func (c *Conn) OpenStream(ctx context.Context) (network.MuxedStream, error) {
 	}
 
 	c.streamsMu.Lock()
+	_, inUse := c.streams[key]
+	if _, opening := c.pendingOutbound[key]; inUse || opening {
+		c.streamsMu.Unlock()
+		scope.release()
+		return nil, fmt.Errorf("nym transport: substream id %s already in use", id)
+	}
 	c.pendingOutbound[key] = pending
 	c.streamsMu.Unlock()
 
-	if err := c.sendControl(id, message.SubstreamMessageOpenRequest); err != nil {
+	openReq := message.SubstreamMessage{
+		ID:   id,
+		Type: message.SubstreamMessageOpenRequest,
+	}
+	if len(initial) > 0 {
+		openReq.Data = make([]byte, len(initial))
+		copy(openReq.Data, initial)
+	}
+	if err := c.sendTransport(openReq, c.transport.cfg.failFastOnCongestion, time.Time{}); err != nil {
 		c.streamsMu.Lock()
 		delete(c.pendingOutbound, key)
 		c.streamsMu.Unlock()
+		scope.release()
 		return nil, err
 	}
 
 	select {
 	case <-pending.ready:
+		if !pending.accepted {
+			return nil, network.ErrReset
+		}
+		c.transport.cfg.metrics.StreamOpened(time.Since(start))
 		return stream, nil
 	case <-ctx.Done():
-		c.streamsMu.Lock()
-		delete(c.pendingOutbound, key)
-		c.streamsMu.Unlock()
+		// The remote may already have created the stream, and the response
+		// may even have raced in; reset it on both ends. The reset waits
+		// for outbound capacity like any send, so don't hold the caller.
+		go stream.Reset()
 		return nil, ctx.Err()
 	case <-c.closeCh:
 		return nil, network.ErrReset
+	case <-c.transport.mixnetDone:
+		c.streamsMu.Lock()
+		delete(c.pendingOutbound, key)
+		c.streamsMu.Unlock()
+		scope.release()
+		return nil, ErrMixnetDisconnected
 	}
 }
 
+// RoundTrip performs a single request/response exchange on a fresh stream: it
+// writes req, half-closes the write side and reads the response until the
+// remote closes its side.
+func (c *Conn) RoundTrip(ctx context.Context, req []byte) ([]byte, error) {
+	raw, err := c.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream := raw.(*Substream)
+	defer stream.Close()
+
+	// Unblock the read below if the caller gives up.
+	stop := context.AfterFunc(ctx, func() {
+		stream.Reset()
+	})
+	defer stop()
+
+	if _, err := stream.Write(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return nil, err
+	}
+
+	resp, err := io.ReadAll(stream)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// AcceptStream waits for the next stream opened by the remote; see
+// AcceptStreamContext.
 func (c *Conn) AcceptStream() (network.MuxedStream, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+// AcceptStreamContext waits for the next stream opened by the remote, failing
+// with ctx.Err() once ctx is done or network.ErrReset once the connection
+// closes. A stream arriving as ctx ends is either returned or left queued for
+// the next call, never lost.
+func (c *Conn) AcceptStreamContext(ctx context.Context) (network.MuxedStream, error) {
 	select {
 	case <-c.closeCh:
 		return nil, network.ErrReset
-	case stream, ok := <-c.inboundSubstreams:
-		if !ok {
-			return nil, network.ErrReset
-		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case stream := <-c.inboundSubstreams:
 		return stream, nil
 	}
 }
 
+// Close tears the connection down and tells the remote, whose streams then
+// end as if reset. The notice travels outside the stream ordering, so data
+// still in flight may be discarded; close streams first to avoid that.
 func (c *Conn) Close() error {
+	return c.close(true)
+}
+
+// close tears the connection down, notifying the remote unless it is the one
+// that closed it.
+func (c *Conn) close(notify bool) error {
 	if !c.closed.CompareAndSwap(false, true) {
 		return nil
 	}
+	if notify {
+		c.sendClose()
+	}
 
+	// inboundSubstreams stays open for a concurrent enqueueInboundStream;
+	// AcceptStream observes closeCh instead.
 	close(c.closeCh)
-	close(c.inboundSubstreams)
 
 	c.transport.removeConnection(c)
+	releaseScope(c.scope)
+
+	c.releaseAllBuffered()
+	c.transport.reorderEvictions.Add(c.queue.Evictions())
+	c.transport.duplicateMessages.Add(c.queue.DuplicatesSeen())
+	if summary := c.queue.Reset(); summary.Dropped() > 0 {
+		log.Printf("nym transport: connection %s closed with %d undelivered messages (waiting for nonce %d, buffered %v)",
+			c.id, summary.Dropped(), summary.NextExpectedNonce, summary.DroppedNonces)
+	}
 
 	c.streamsMu.Lock()
 	for key, pending := range c.pendingOutbound {
+		pending.stream.scope.release()
 		close(pending.ready)
 		delete(c.pendingOutbound, key)
 	}
 	for key, stream := range c.streams {
 		delete(c.streams, key)
-		stream.remoteClose()
+		stream.scope.release()
+		stream.connReset()
 	}
 	c.streamsMu.Unlock()
 
 	return nil
 }
 
+// sendClose tells the remote the connection is gone. It is best-effort: once
+// the transport or mixnet is down there is nobody to tell.
+func (c *Conn) sendClose() {
+	err := c.transport.sendOutbound(c.closeNotice())
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrMixnetDisconnected) {
+		log.Printf("nym transport: send connection close for %s: %v", c.id, err)
+	}
+}
+
+// closeNotice builds the ConnectionClose message for this connection.
+func (c *Conn) closeNotice() mixnet.OutboundMessage {
+	return c.outbound(&message.Message{
+		Type: message.MessageTypeConnectionClose,
+		Connection: &message.ConnectionMessage{
+			PeerID: c.localPeer,
+			ID:     c.id,
+		},
+	})
+}
+
 func (c *Conn) IsClosed() bool {
 	return c.closed.Load()
 }
@@ -311,16 +713,34 @@ func (c *Conn) sendControl(id message.SubstreamID, typ message.SubstreamMessageT
 	})
 }
 
-func (c *Conn) sendData(id message.SubstreamID, data []byte) error {
-	return c.sendSubstreamMessage(message.SubstreamMessage{
+// sendData queues a data message, failing with os.ErrDeadlineExceeded if it
+// could not be queued before deadline. The zero deadline waits indefinitely.
+func (c *Conn) sendData(id message.SubstreamID, data []byte, deadline time.Time) error {
+	return c.sendTransport(message.SubstreamMessage{
 		ID:   id,
 		Type: message.SubstreamMessageData,
 		Data: data,
-	})
+	}, false, deadline)
 }
 
 func (c *Conn) sendSubstreamMessage(sub message.SubstreamMessage) error {
-	nonce := atomic.AddUint64(&c.nonce, 1)
+	return c.sendTransport(sub, false, time.Time{})
+}
+
+// sendTransport assigns the next nonce to sub and queues it on the mixnet. The
+// nonce is only consumed once the message is queued, so a failed send never
+// leaves a gap in the remote's reorder queue. With failFast set, ErrCongested
+// is returned instead of waiting for outbound capacity; otherwise a non-zero
+// deadline bounds that wait.
+//
+// sendMu leaves at most one sender per connection waiting on the shared
+// outbound queue, and waiting senders are admitted in arrival order, so a busy
+// connection gets one slot per turn rather than starving the others.
+func (c *Conn) sendTransport(sub message.SubstreamMessage, failFast bool, deadline time.Time) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	nonce := c.nonce + 1
 	msg := &message.Message{
 		Type: message.MessageTypeTransport,
 		Transport: &message.TransportMessage{
@@ -329,7 +749,33 @@ func (c *Conn) sendSubstreamMessage(sub message.SubstreamMessage) error {
 			ID:      c.id,
 		},
 	}
-	return c.transport.sendMixnetMessage(c.remoteRecipient, msg)
+
+	var err error
+	if failFast {
+		err = c.transport.trySendOutbound(c.outbound(msg))
+	} else {
+		err = c.transport.sendOutboundBy(c.outbound(msg), deadline)
+	}
+	if err != nil {
+		return err
+	}
+	c.nonce = nonce
+	c.touch()
+	return nil
+}
+
+// outbound wraps msg with the route to the remote side of the connection.
+func (c *Conn) outbound(msg *message.Message) mixnet.OutboundMessage {
+	out := mixnet.OutboundMessage{
+		Recipient: c.remoteRecipient,
+		Message:   msg,
+	}
+	if tag := c.replyTag.Load(); tag != nil {
+		out.SenderTag = tag
+	} else if c.anonymous {
+		out.ReplySURBs = c.transport.cfg.replySURBs
+	}
+	return out
 }
 
 func (c *Conn) closeLocalStream(stream *Substream) {
@@ -0,0 +1,24 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	lptransport "github.com/libp2p/go-libp2p/core/transport"
+)
+
+// NewConstructor returns a transport constructor for libp2p.Transport, which
+// connects to the Nym client at uri with the host's identity:
+//
+//	h, err := libp2p.New(libp2p.Transport(transport.NewConstructor(ctx, uri)))
+//
+// The transport secures and multiplexes connections itself, so the upgrader
+// is not used; connections are accounted with the host's resource manager,
+// while streams are left to the swarm, which accounts them itself. The host
+// closes the transport when it shuts down.
+func NewConstructor(ctx context.Context, uri string, opts ...Option) func(upgrader lptransport.Upgrader, key crypto.PrivKey, rcmgr network.ResourceManager) (*Transport, error) {
+	return func(_ lptransport.Upgrader, key crypto.PrivKey, rcmgr network.ResourceManager) (*Transport, error) {
+		return New(ctx, uri, key, append([]Option{WithResourceManager(rcmgr), withSwarmStreamScopes()}, opts...)...)
+	}
+}
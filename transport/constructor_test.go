@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"banyan/transports/nym/internal/testutil"
+)
+
+func TestNewConstructorBuildsHost(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	h, err := libp2p.New(
+		libp2p.NoListenAddrs,
+		libp2p.Transport(NewConstructor(ctx, srv.URL("host"))),
+	)
+	if err != nil {
+		t.Fatalf("libp2p.New: %v", err)
+	}
+	defer h.Close()
+
+	addr, err := multiaddrFromRecipient(srv.Recipient("host"))
+	if err != nil {
+		t.Fatalf("multiaddr: %v", err)
+	}
+	tpt, ok := h.Network().(*swarm.Swarm).TransportForListening(addr).(*Transport)
+	if !ok {
+		t.Fatalf("host has no nym transport for %s", addr)
+	}
+	if tpt.LocalPeer() != h.ID() {
+		t.Fatalf("transport identity %s differs from host %s", tpt.LocalPeer(), h.ID())
+	}
+	if err := h.Network().Listen(addr); err != nil {
+		t.Fatalf("listen on %s: %v", addr, err)
+	}
+}
+
+func TestNewConstructorCountsStreamsOnce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	const streams = 4
+	limits := rcmgr.PartialLimitConfig{
+		System: rcmgr.ResourceLimits{StreamsOutbound: streams},
+	}.Build(rcmgr.InfiniteLimits)
+	mgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits))
+	if err != nil {
+		t.Fatalf("new resource manager: %v", err)
+	}
+
+	hostA, err := libp2p.New(
+		libp2p.NoListenAddrs,
+		libp2p.ResourceManager(mgr),
+		libp2p.Transport(NewConstructor(ctx, srv.URL("a"))),
+	)
+	if err != nil {
+		t.Fatalf("libp2p.New: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := libp2p.New(
+		libp2p.NoListenAddrs,
+		libp2p.Transport(NewConstructor(ctx, srv.URL("b"))),
+	)
+	if err != nil {
+		t.Fatalf("libp2p.New: %v", err)
+	}
+	defer hostB.Close()
+
+	addrB, err := multiaddrFromRecipient(srv.Recipient("b"))
+	if err != nil {
+		t.Fatalf("multiaddr: %v", err)
+	}
+	if err := hostB.Network().Listen(addrB); err != nil {
+		t.Fatalf("listen on %s: %v", addrB, err)
+	}
+	const proto = protocol.ID("/nym-test/hold/1.0.0")
+	hostB.SetStreamHandler(proto, func(s network.Stream) {
+		io.Copy(io.Discard, s)
+		s.Close()
+	})
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: []ma.Multiaddr{addrB}}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	// Start from no outbound streams, once identify is done with its own.
+	outbound := func() int {
+		var n int
+		mgr.ViewSystem(func(s network.ResourceScope) error {
+			n = s.Stat().NumStreamsOutbound
+			return nil
+		})
+		return n
+	}
+	waitFor(t, ctx, "identify streams closed", func() bool {
+		return outbound() == 0
+	})
+
+	for i := 0; i < streams; i++ {
+		s, err := hostA.NewStream(ctx, hostB.ID(), proto)
+		if err != nil {
+			t.Fatalf("open stream %d of %d: %v", i+1, streams, err)
+		}
+		defer s.Reset()
+	}
+	if n := outbound(); n != streams {
+		t.Fatalf("%d streams use %d outbound stream slots", streams, n)
+	}
+}
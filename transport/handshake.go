@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"banyan/transports/nym/message"
+)
+
+// HandshakeFailureReason classifies why an outbound connection handshake failed.
+type HandshakeFailureReason int
+
+const (
+	// HandshakeTimeout means no connection response arrived in time.
+	HandshakeTimeout HandshakeFailureReason = iota
+	// HandshakePeerMismatch means the handshake timed out after responses
+	// arrived only from peers other than the one dialed.
+	HandshakePeerMismatch
+	// HandshakeMixnetDisconnected means the mixnet client went away mid-dial.
+	HandshakeMixnetDisconnected
+	// HandshakeRejected means the listener declined the connection.
+	HandshakeRejected
+
+	numHandshakeFailureReasons
+)
+
+func (r HandshakeFailureReason) String() string {
+	switch r {
+	case HandshakeTimeout:
+		return "timeout"
+	case HandshakePeerMismatch:
+		return "peer mismatch"
+	case HandshakeMixnetDisconnected:
+		return "mixnet disconnected"
+	case HandshakeRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// HandshakeFailureHandler is called with the dialed recipient whenever an
+// outbound handshake fails.
+type HandshakeFailureHandler func(recipient message.Recipient, reason HandshakeFailureReason)
+
+// WithHandshakeFailureHandler installs fn to be told about every failed dial
+// handshake. Failures are also counted in Stats regardless of a handler.
+func WithHandshakeFailureHandler(fn HandshakeFailureHandler) Option {
+	return func(c *config) {
+		c.handshakeFailureHandler = fn
+	}
+}
+
+// WithHandshakeRetransmit makes listeners resend the connection response every
+// interval until the dialer acknowledges it, recovering from a lost response.
+// A connection the dialer has not acknowledged within halfOpenTimeout is
+// closed.
+func WithHandshakeRetransmit(interval, halfOpenTimeout time.Duration) Option {
+	return func(c *config) {
+		if interval > 0 && halfOpenTimeout > 0 {
+			c.responseRetransmit = interval
+			c.halfOpenTimeout = halfOpenTimeout
+		}
+	}
+}
+
+// WithDialRetries makes Dial resend its connection request up to n times,
+// every interval, until the listener answers or the handshake times out. The
+// mixnet may lose any single request; the listener answers repeats of a
+// request it already accepted with the same connection.
+func WithDialRetries(n int, interval time.Duration) Option {
+	return func(c *config) {
+		if n > 0 && interval > 0 {
+			c.dialRetries = n
+			c.dialRetryInterval = interval
+		}
+	}
+}
+
+// answerRepeatedRequest handles a connection request for a connection that
+// already exists, as sent by a dialer retrying after a lost response; see
+// WithDialRetries.
+func (t *Transport) answerRepeatedRequest(conn *Conn, connMsg *message.ConnectionMessage) error {
+	if conn.RemotePeer() != connMsg.PeerID {
+		return fmt.Errorf("connection already exists")
+	}
+	select {
+	case <-conn.ready:
+		// The dialer has the connection; the request was a late copy.
+		return nil
+	default:
+	}
+	return t.sendOutbound(conn.outbound(t.connectionResponse(conn)))
+}
+
+// awaitDialer retransmits resp on an accepted connection until it is ready,
+// and reaps the connection if it never becomes so.
+func (t *Transport) awaitDialer(conn *Conn, resp *message.Message) {
+	retransmit := time.NewTicker(t.cfg.responseRetransmit)
+	defer retransmit.Stop()
+	halfOpen := time.NewTimer(t.cfg.halfOpenTimeout)
+	defer halfOpen.Stop()
+
+	for {
+		select {
+		case <-conn.ready:
+			return
+		case <-conn.closeCh:
+			return
+		case <-t.ctx.Done():
+			return
+		case <-retransmit.C:
+			if err := t.sendOutbound(conn.outbound(resp)); err != nil {
+				log.Printf("nym transport: retransmit connection response: %v", err)
+			}
+		case <-halfOpen.C:
+			log.Printf("nym transport: closing half-open connection %s: dialer never sent", conn.id)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// handshakeFailed records a failed dial to recipient.
+func (t *Transport) handshakeFailed(recipient message.Recipient, reason HandshakeFailureReason) {
+	t.handshakeFailures[reason].Add(1)
+	t.cfg.metrics.DialFailed(reason)
+	if fn := t.cfg.handshakeFailureHandler; fn != nil {
+		fn(recipient, reason)
+	}
+}
+
+// announcedPublicKey returns the public key the remote announced in cm: the one
+// embedded in its peer ID, or else the one sent alongside it. It returns nil
+// if neither is available, as with rust-libp2p-nym peers whose keys are too
+// large to inline.
+func announcedPublicKey(cm *message.ConnectionMessage) (crypto.PubKey, error) {
+	pub, err := cm.PeerID.ExtractPublicKey()
+	if err == nil {
+		return pub, nil
+	}
+	if !errors.Is(err, peer.ErrNoPublicKey) {
+		return nil, fmt.Errorf("extract public key: %w", err)
+	}
+	if len(cm.PublicKey) == 0 {
+		return nil, nil
+	}
+	if pub, err = crypto.UnmarshalPublicKey(cm.PublicKey); err != nil {
+		return nil, fmt.Errorf("unmarshal public key: %w", err)
+	}
+	if !cm.PeerID.MatchesPublicKey(pub) {
+		return nil, fmt.Errorf("public key does not match peer %s", cm.PeerID)
+	}
+	return pub, nil
+}
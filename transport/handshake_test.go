@@ -0,0 +1,448 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"banyan/transports/nym/internal/testutil"
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+type recordedFailure struct {
+	recipient message.Recipient
+	reason    HandshakeFailureReason
+}
+
+func recordFailures() (HandshakeFailureHandler, func() []recordedFailure) {
+	var (
+		mu       sync.Mutex
+		failures []recordedFailure
+	)
+	handler := func(r message.Recipient, reason HandshakeFailureReason) {
+		mu.Lock()
+		failures = append(failures, recordedFailure{r, reason})
+		mu.Unlock()
+	}
+	return handler, func() []recordedFailure {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]recordedFailure(nil), failures...)
+	}
+}
+
+func assertHandshakeFailure(t *testing.T, tpt *Transport, got []recordedFailure, recipient message.Recipient, reason HandshakeFailureReason) {
+	t.Helper()
+	if len(got) != 1 || got[0].recipient != recipient || got[0].reason != reason {
+		t.Fatalf("handler saw %+v, want a single %s failure", got, reason)
+	}
+	stats := tpt.Stats().HandshakeFailures
+	if len(stats) != 1 || stats[reason] != 1 {
+		t.Fatalf("stats report %v, want one %s failure", stats, reason)
+	}
+}
+
+func TestHandshakeFailureTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	handler, failures := recordFailures()
+	transportA, _ := newTestTransports(t, ctx, WithHandshakeFailureHandler(handler))
+	transportA.handshakeTimeout = 50 * time.Millisecond
+
+	// Nobody owns this recipient, so the connection request goes unanswered.
+	remote, err := multiaddrFromRecipient(testRecipient(0x33))
+	if err != nil {
+		t.Fatalf("build remote addr: %v", err)
+	}
+	if _, err := transportA.Dial(ctx, remote, ""); err == nil {
+		t.Fatalf("dial to unreachable recipient succeeded")
+	}
+	assertHandshakeFailure(t, transportA, failures(), testRecipient(0x33), HandshakeTimeout)
+}
+
+func TestHandshakeFailurePeerMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	handler, failures := recordFailures()
+	transportA, transportB := newTestTransports(t, ctx, WithHandshakeFailureHandler(handler))
+	// The mismatched response is ignored, so the dial fails at its timeout.
+	transportA.handshakeTimeout = 50 * time.Millisecond
+
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	otherKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	other, err := peer.IDFromPrivateKey(otherKey)
+	if err != nil {
+		t.Fatalf("derive peer id: %v", err)
+	}
+	if _, err := transportA.Dial(ctx, transportB.listenAddr, other); err == nil {
+		t.Fatalf("dial with wrong peer id succeeded")
+	}
+	assertHandshakeFailure(t, transportA, failures(), testRecipient(0x22), HandshakePeerMismatch)
+}
+
+func TestHandshakeFailureMixnetDisconnected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	handler, failures := recordFailures()
+	inbound := make(chan mixnet.InboundMessage)
+	outbound := make(chan mixnet.OutboundMessage, 32)
+	tpt, err := newWithMixnet(ctx, priv, testRecipient(0x11), inbound, outbound, WithHandshakeFailureHandler(handler))
+	if err != nil {
+		t.Fatalf("create transport: %v", err)
+	}
+	defer tpt.Close()
+
+	close(inbound)
+	<-tpt.mixnetDone
+
+	remote, err := multiaddrFromRecipient(testRecipient(0x22))
+	if err != nil {
+		t.Fatalf("build remote addr: %v", err)
+	}
+	if _, err := tpt.Dial(ctx, remote, ""); err == nil {
+		t.Fatalf("dial over dead mixnet succeeded")
+	}
+	assertHandshakeFailure(t, tpt, failures(), testRecipient(0x22), HandshakeMixnetDisconnected)
+}
+
+func TestHandshakeCancellationIsNotAFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	handler, failures := recordFailures()
+	transportA, _ := newTestTransports(t, ctx, WithHandshakeFailureHandler(handler))
+
+	remote, err := multiaddrFromRecipient(testRecipient(0x33))
+	if err != nil {
+		t.Fatalf("build remote addr: %v", err)
+	}
+	dialCtx, dialCancel := context.WithCancel(ctx)
+	time.AfterFunc(20*time.Millisecond, dialCancel)
+	if _, err := transportA.Dial(dialCtx, remote, ""); err == nil {
+		t.Fatalf("cancelled dial succeeded")
+	}
+	if got := failures(); len(got) != 0 {
+		t.Fatalf("caller cancellation reported as failure: %+v", got)
+	}
+}
+
+func TestListenerRetransmitsLostResponse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var responses atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if msg.Message.Type == message.MessageTypeConnectionResponse {
+			// Lose the first response in the mixnet.
+			return responses.Add(1) > 1
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithHandshakeRetransmit(50*time.Millisecond, 5*time.Second))
+
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+	if responses.Load() < 2 {
+		t.Fatalf("dial succeeded without a retransmitted response")
+	}
+	if _, err := streamAB.Write([]byte("hi")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(streamBA, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	// Once the dialer has acknowledged, retransmissions stop.
+	sent := responses.Load()
+	time.Sleep(200 * time.Millisecond)
+	if n := responses.Load(); n != sent {
+		t.Fatalf("listener kept retransmitting after hearing the dialer: %d -> %d", sent, n)
+	}
+	if connAB.IsClosed() || connBA.IsClosed() {
+		t.Fatalf("established connection was closed")
+	}
+}
+
+func TestListenerReapsSilentDialer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The dialer's acks never arrive and it sends nothing else.
+	var responses atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		switch msg.Message.Type {
+		case message.MessageTypeConnectionResponse:
+			responses.Add(1)
+		case message.MessageTypeConnectionAck:
+			return false
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithHandshakeRetransmit(50*time.Millisecond, 300*time.Millisecond))
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	if _, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	// The listener keeps retransmitting, then gives up on the connection.
+	deadline := time.Now().Add(2 * time.Second)
+	for !accepted.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("half-open connection was not reaped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := responses.Load(); n < 2 {
+		t.Fatalf("listener sent %d responses, want retransmissions", n)
+	}
+	select {
+	case <-accepted.(*Conn).Ready():
+		t.Fatalf("unacknowledged connection reported ready")
+	default:
+	}
+}
+
+func TestDialRetriesLostHandshake(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		lost message.MessageType
+	}{
+		{"LostRequest", message.MessageTypeConnectionRequest},
+		{"LostResponse", message.MessageTypeConnectionResponse},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var requests, dropped atomic.Int32
+			intercept := func(msg mixnet.OutboundMessage) bool {
+				if msg.Message.Type == message.MessageTypeConnectionRequest {
+					requests.Add(1)
+				}
+				// Lose the first message of the given type in the mixnet.
+				return msg.Message.Type != tc.lost || dropped.Add(1) > 1
+			}
+			transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithDialRetries(3, 50*time.Millisecond))
+
+			openTestStreams(t, ctx, transportA, transportB)
+			if requests.Load() < 2 {
+				t.Fatalf("dial succeeded without a resent request")
+			}
+			// Give any late copy of the request time to arrive.
+			time.Sleep(200 * time.Millisecond)
+			if a, b := transportA.Stats().ActiveConnections, transportB.Stats().ActiveConnections; a != 1 || b != 1 {
+				t.Fatalf("retried dial left %d dialer and %d listener connections, want 1 each", a, b)
+			}
+		})
+	}
+}
+
+func TestDialRedrawsCollidingConnectionID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	// The next dial first draws the ID of the established connection.
+	var draws atomic.Int32
+	transportA.newConnectionID = func() (message.ConnectionID, error) {
+		if draws.Add(1) == 1 {
+			return connAB.id, nil
+		}
+		return message.GenerateConnectionID()
+	}
+	second, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if second.(*Conn).id == connAB.id {
+		t.Fatalf("dial reused the ID of an established connection")
+	}
+
+	transportA.mu.RLock()
+	kept := transportA.connections[connKey(connAB.id)]
+	transportA.mu.RUnlock()
+	if kept != connAB {
+		t.Fatalf("established connection was replaced")
+	}
+	if _, err := streamAB.Write([]byte("still here")); err != nil {
+		t.Fatalf("write on established connection: %v", err)
+	}
+	buf := make([]byte, len("still here"))
+	if _, err := io.ReadFull(streamBA, buf); err != nil {
+		t.Fatalf("read on established connection: %v", err)
+	}
+}
+
+func TestConnectionRequestCollidingWithPendingDialIsRejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	listener, err := transportA.Listen(transportA.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	// A dials an address nobody answers, keeping the dial pending.
+	id, err := message.GenerateConnectionID()
+	if err != nil {
+		t.Fatalf("generate connection id: %v", err)
+	}
+	fixed := func() (message.ConnectionID, error) { return id, nil }
+	transportA.newConnectionID = fixed
+	go transportA.dial(ctx, testRecipient(0x33), "", false)
+	waitFor(t, ctx, "pending dial", func() bool {
+		transportA.mu.RLock()
+		defer transportA.mu.RUnlock()
+		return transportA.pendingDials[connKey(id)] != nil
+	})
+
+	// B dials A with the same ID, which A must not accept.
+	transportB.newConnectionID = fixed
+	if _, err := transportB.Dial(ctx, transportA.listenAddr, transportA.localPeer); !errors.Is(err, ErrConnectionRejected) {
+		t.Fatalf("colliding dial returned %v, want ErrConnectionRejected", err)
+	}
+	transportA.mu.RLock()
+	_, accepted := transportA.connections[connKey(id)]
+	pending := transportA.pendingDials[connKey(id)] != nil
+	transportA.mu.RUnlock()
+	if accepted || !pending {
+		t.Fatalf("colliding request disturbed the pending dial (accepted %v, pending %v)", accepted, pending)
+	}
+}
+
+func TestConnectionResponseFromOtherPeerIsIgnored(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Messages travel through real mixnet clients, which cannot tell who
+	// sent a response. A third client that learned the connection ID answers
+	// first, under its own peer ID.
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	privA, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	transportA, err := New(ctx, srv.URL("a"), privA)
+	if err != nil {
+		t.Fatalf("create transportA: %v", err)
+	}
+	defer transportA.Close()
+	listener, listenerIn, listenerOut, err := mixnet.Initialize(ctx, srv.URL("listener"), nil)
+	if err != nil {
+		t.Fatalf("initialize listener: %v", err)
+	}
+	spoofer, _, spooferOut, err := mixnet.Initialize(ctx, srv.URL("spoofer"), nil)
+	if err != nil {
+		t.Fatalf("initialize spoofer: %v", err)
+	}
+
+	privListener, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	listenerPeer, err := peer.IDFromPrivateKey(privListener)
+	if err != nil {
+		t.Fatalf("derive peer id: %v", err)
+	}
+	raddr, err := multiaddrFromRecipient(listener)
+	if err != nil {
+		t.Fatalf("multiaddr: %v", err)
+	}
+	type dialResult struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := transportA.Dial(ctx, raddr, listenerPeer)
+		c, _ := conn.(*Conn)
+		done <- dialResult{c, err}
+	}()
+
+	var req mixnet.InboundMessage
+	select {
+	case req = <-listenerIn:
+	case <-ctx.Done():
+		t.Fatalf("connection request not received")
+	}
+	// Both responses ask A to send to their own address.
+	respond := func(out chan<- mixnet.OutboundMessage, self message.Recipient, p peer.ID) {
+		out <- mixnet.OutboundMessage{
+			Recipient: srv.Recipient("a"),
+			Message: &message.Message{
+				Type: message.MessageTypeConnectionResponse,
+				Connection: &message.ConnectionMessage{
+					PeerID:    p,
+					Recipient: &self,
+					ID:        req.Message.Connection.ID,
+				},
+			},
+		}
+	}
+
+	privSpoofer, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	spooferPeer, err := peer.IDFromPrivateKey(privSpoofer)
+	if err != nil {
+		t.Fatalf("derive peer id: %v", err)
+	}
+	respond(spooferOut, spoofer, spooferPeer)
+	waitFor(t, ctx, "spoofed response handled", func() bool {
+		return transportA.Stats().MessagesReceived >= 1
+	})
+	select {
+	case res := <-done:
+		t.Fatalf("spoofed response ended the dial: %v", res.err)
+	default:
+	}
+
+	respond(listenerOut, listener, listenerPeer)
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("dial: %v", res.err)
+	}
+	if !res.conn.RemoteMultiaddr().Equal(raddr) {
+		t.Fatalf("dialed connection bound to %s, want %s", res.conn.RemoteMultiaddr(), raddr)
+	}
+}
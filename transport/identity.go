@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// LocalPeer returns the peer ID new connections are established with.
+func (t *Transport) LocalPeer() peer.ID {
+	t.idMu.RLock()
+	defer t.idMu.RUnlock()
+	return t.localPeer
+}
+
+// RotateIdentity switches the transport to priv for connections dialed or
+// accepted from now on. Existing connections keep the identity they were
+// established with until they close. The recipient address is unchanged.
+func (t *Transport) RotateIdentity(priv crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("nym transport: derive peer id: %w", err)
+	}
+	t.idMu.Lock()
+	defer t.idMu.Unlock()
+	t.privKey = priv
+	t.localPeer = id
+	return nil
+}
+
+// publicKeyFor returns the marshalled public key to announce alongside the
+// local peer id, or nil when id embeds its key.
+func (t *Transport) publicKeyFor(id peer.ID) []byte {
+	if _, err := id.ExtractPublicKey(); err == nil {
+		return nil
+	}
+	t.idMu.RLock()
+	pub := t.privKey.GetPublic()
+	t.idMu.RUnlock()
+	// The identity may have been rotated since id was chosen.
+	if !id.MatchesPublicKey(pub) {
+		return nil
+	}
+	data, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	return data
+}
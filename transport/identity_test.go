@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestRotateIdentity(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	oldPeer := transportB.LocalPeer()
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	newPeer, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("derive peer id: %v", err)
+	}
+	if err := transportB.RotateIdentity(priv); err != nil {
+		t.Fatalf("RotateIdentity: %v", err)
+	}
+	if transportB.LocalPeer() != newPeer {
+		t.Fatalf("LocalPeer = %s after rotation, want %s", transportB.LocalPeer(), newPeer)
+	}
+
+	// A new dial sees the new identity.
+	dialed, err := transportA.Dial(ctx, transportB.listenAddr, newPeer)
+	if err != nil {
+		t.Fatalf("dial after rotation: %v", err)
+	}
+	if dialed.RemotePeer() != newPeer {
+		t.Fatalf("new connection has remote peer %s, want %s", dialed.RemotePeer(), newPeer)
+	}
+
+	// The existing connection keeps the old one and still works.
+	if connAB.RemotePeer() != oldPeer || connBA.LocalPeer() != oldPeer {
+		t.Fatalf("existing connection changed identity: remote %s local %s, want %s", connAB.RemotePeer(), connBA.LocalPeer(), oldPeer)
+	}
+	if _, err := streamAB.Write([]byte("still here")); err != nil {
+		t.Fatalf("write on existing stream: %v", err)
+	}
+	buf := make([]byte, len("still here"))
+	if _, err := io.ReadFull(streamBA, buf); err != nil || string(buf) != "still here" {
+		t.Fatalf("read on existing stream: %q %v", buf, err)
+	}
+}
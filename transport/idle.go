@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"log"
+	"time"
+)
+
+// WithIdleTimeout closes a connection once it has had no open streams and
+// carried no stream traffic for d, reclaiming connections whose peers went
+// away without closing them. Keepalive pings do not count as traffic. Closed
+// connections are counted in Stats.IdleTimeouts. Zero, the default, keeps idle
+// connections open.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d >= 0 {
+			c.idleTimeout = d
+		}
+	}
+}
+
+// watchIdle periodically closes connections idle for longer than the idle
+// timeout.
+func (t *Transport) watchIdle() {
+	interval := max(t.cfg.idleTimeout/4, minReorderCheckInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, conn := range t.idleConns(now) {
+				log.Printf("nym transport: closing connection %s: idle for over %s", conn.id, t.cfg.idleTimeout)
+				t.idleTimeouts.Add(1)
+				conn.Close()
+			}
+		}
+	}
+}
+
+// idleConns returns the connections idle since more than the idle timeout
+// before now.
+func (t *Transport) idleConns(now time.Time) []*Conn {
+	t.mu.RLock()
+	conns := make([]*Conn, 0, len(t.connections))
+	for _, conn := range t.connections {
+		conns = append(conns, conn)
+	}
+	t.mu.RUnlock()
+
+	var idle []*Conn
+	for _, conn := range conns {
+		if conn.idleSince(now) > t.cfg.idleTimeout {
+			idle = append(idle, conn)
+		}
+	}
+	return idle
+}
+
+// idleSince returns how long the connection has been idle at now, or zero
+// while it has streams open.
+func (c *Conn) idleSince(now time.Time) time.Duration {
+	c.streamsMu.Lock()
+	open := len(c.streams) + len(c.pendingOutbound)
+	c.streamsMu.Unlock()
+	if open > 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, c.lastActive.Load()))
+}
+
+// touch records stream traffic on the connection.
+func (c *Conn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
@@ -0,0 +1,34 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutClosesUnusedConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const idle = 100 * time.Millisecond
+	transportA, transportB := newTestTransports(t, ctx, WithIdleTimeout(idle))
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	// An open stream keeps the connection alive however quiet it is.
+	time.Sleep(3 * idle)
+	if connAB.IsClosed() || connBA.IsClosed() {
+		t.Fatalf("connection with an open stream was closed")
+	}
+
+	streamAB.Close()
+	streamBA.Close()
+	start := time.Now()
+	waitFor(t, ctx, "idle connection to close", connAB.IsClosed)
+	if elapsed := time.Since(start); elapsed < idle {
+		t.Fatalf("connection closed after %s, before the idle timeout", elapsed)
+	}
+	waitFor(t, ctx, "remote end to close", connBA.IsClosed)
+	if got := transportA.Stats().IdleTimeouts + transportB.Stats().IdleTimeouts; got == 0 {
+		t.Fatalf("idle close not counted in Stats")
+	}
+}
@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"banyan/transports/nym/message"
+)
+
+// WithKeepalive makes every connection ping its remote each interval and
+// closes it once maxMissed pings in a row went unanswered, so a peer that
+// vanished without closing is noticed. Both ends must support connection
+// pings: other implementations never answer, and their connections would be
+// closed. Closed connections are counted in Stats.KeepaliveTimeouts. It is off
+// by default.
+func WithKeepalive(interval time.Duration, maxMissed int) Option {
+	return func(c *config) {
+		if interval > 0 && maxMissed > 0 {
+			c.keepaliveInterval = interval
+			c.keepaliveMaxMissed = maxMissed
+		}
+	}
+}
+
+// runKeepalive pings every connection each keepalive interval.
+func (t *Transport) runKeepalive() {
+	ticker := time.NewTicker(t.cfg.keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			t.mu.RLock()
+			conns := make([]*Conn, 0, len(t.connections))
+			for _, conn := range t.connections {
+				conns = append(conns, conn)
+			}
+			t.mu.RUnlock()
+			for _, conn := range conns {
+				if !conn.keepalive() {
+					log.Printf("nym transport: closing connection %s: %d keepalive pings unanswered", conn.id, t.cfg.keepaliveMaxMissed)
+					t.keepaliveTimeouts.Add(1)
+					conn.Close()
+				}
+			}
+		}
+	}
+}
+
+// keepalive counts the previous ping as missed if it is still unanswered and
+// sends the next one. It reports false once too many were missed.
+func (c *Conn) keepalive() bool {
+	if c.pingOutstanding.Swap(true) {
+		if int(c.missedPings.Add(1)) >= c.transport.cfg.keepaliveMaxMissed {
+			return false
+		}
+	}
+	// A full outbound queue says nothing about the remote, so skip the
+	// ping rather than wait or count it as missed.
+	if err := c.transport.trySendOutbound(c.outbound(c.keepaliveMessage(message.MessageTypeConnectionPing))); err != nil {
+		c.pingOutstanding.Store(false)
+	}
+	return true
+}
+
+func (c *Conn) keepaliveMessage(typ message.MessageType) *message.Message {
+	return &message.Message{
+		Type: typ,
+		Connection: &message.ConnectionMessage{
+			PeerID: c.localPeer,
+			ID:     c.id,
+		},
+	}
+}
+
+func (t *Transport) handleConnectionPing(connMsg *message.ConnectionMessage) error {
+	t.mu.RLock()
+	conn, ok := t.connections[connKey(connMsg.ID)]
+	t.mu.RUnlock()
+	if !ok {
+		// Staying silent lets the remote's keepalive close its end.
+		return fmt.Errorf("no connection for keepalive ping")
+	}
+	return t.sendOutbound(conn.outbound(conn.keepaliveMessage(message.MessageTypeConnectionPong)))
+}
+
+func (t *Transport) handleConnectionPong(connMsg *message.ConnectionMessage) error {
+	t.mu.RLock()
+	conn, ok := t.connections[connKey(connMsg.ID)]
+	t.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no connection for keepalive pong")
+	}
+	conn.pingOutstanding.Store(false)
+	conn.missedPings.Store(0)
+	return nil
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+func TestKeepaliveClosesConnToSilentPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const (
+		interval  = 20 * time.Millisecond
+		maxMissed = 3
+	)
+	var silent atomic.Bool
+	var pings, pongs atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		switch msg.Message.Type {
+		case message.MessageTypeConnectionPing:
+			pings.Add(1)
+		case message.MessageTypeConnectionPong:
+			pongs.Add(1)
+			// Once silent, B stops answering A.
+			return !silent.Load() || msg.Recipient != testRecipient(0x11)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithKeepalive(interval, maxMissed))
+	connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	// Answered pings keep the connection open well past maxMissed intervals.
+	time.Sleep(3 * maxMissed * interval)
+	if connAB.IsClosed() || connBA.IsClosed() {
+		t.Fatalf("connection with a responsive peer was closed")
+	}
+	if pings.Load() == 0 || pongs.Load() == 0 {
+		t.Fatalf("no keepalive traffic: %d pings, %d pongs", pings.Load(), pongs.Load())
+	}
+
+	silent.Store(true)
+	start := time.Now()
+	waitFor(t, ctx, "keepalive to close the connection", connAB.IsClosed)
+	if elapsed := time.Since(start); elapsed < (maxMissed-1)*interval {
+		t.Fatalf("connection closed after %s, before %d pings could be missed", elapsed, maxMissed)
+	}
+	if got := transportA.Stats().KeepaliveTimeouts; got != 1 {
+		t.Fatalf("KeepaliveTimeouts = %d, want 1", got)
+	}
+	// A's close notice reaches B, whose own pings were still answered.
+	waitFor(t, ctx, "remote end to close", connBA.IsClosed)
+	if got := transportB.Stats().KeepaliveTimeouts; got != 0 {
+		t.Fatalf("responsive side counted %d keepalive timeouts", got)
+	}
+}
+
+func TestKeepaliveOffByDefault(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var pings atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if msg.Message.Type == message.MessageTypeConnectionPing {
+			pings.Add(1)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+	openTestStreams(t, ctx, transportA, transportB)
+	time.Sleep(50 * time.Millisecond)
+	if n := pings.Load(); n != 0 {
+		t.Fatalf("sent %d keepalive pings without WithKeepalive", n)
+	}
+}
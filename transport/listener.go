@@ -14,14 +14,26 @@ type listener struct {
 	incoming chan *Conn
 	closed   chan struct{}
 	once     sync.Once
+
+	// overflow holds connections that did not fit in incoming, oldest first,
+	// until deliver moves them over. wake tells deliver it grew.
+	overflowMu sync.Mutex
+	overflow   []*Conn
+	wake       chan struct{}
+
+	// anonymous listeners only accept connections that reply via sender tags.
+	anonymous bool
 }
 
 func newListener(t *Transport) *listener {
-	return &listener{
+	l := &listener{
 		t:        t,
-		incoming: make(chan *Conn, 16),
+		incoming: make(chan *Conn, t.cfg.ListenerBacklog),
 		closed:   make(chan struct{}),
+		wake:     make(chan struct{}, 1),
 	}
+	go l.deliver()
+	return l
 }
 
 func (l *listener) Accept() (lptransport.CapableConn, error) {
@@ -30,10 +42,9 @@ func (l *listener) Accept() (lptransport.CapableConn, error) {
 		return nil, lptransport.ErrListenerClosed
 	case <-l.t.ctx.Done():
 		return nil, context.Canceled
-	case conn, ok := <-l.incoming:
-		if !ok {
-			return nil, lptransport.ErrListenerClosed
-		}
+	case <-l.t.mixnetDone:
+		return nil, ErrMixnetDisconnected
+	case conn := <-l.incoming:
 		return conn, nil
 	}
 }
@@ -46,33 +57,116 @@ func (l *listener) Close() error {
 	return nil
 }
 
+// shutdown stops the listener and closes the connections still waiting for
+// Accept, telling their dialers.
 func (l *listener) shutdown() {
+	// incoming is left open: enqueue may still be sending to it concurrently,
+	// and Accept observes closed instead.
+	l.overflowMu.Lock()
 	l.once.Do(func() {
 		close(l.closed)
-		close(l.incoming)
 	})
+	l.overflowMu.Unlock()
+	l.drain()
+}
+
+// drain closes the connections queued on a closed listener.
+func (l *listener) drain() {
+	for {
+		select {
+		case conn := <-l.incoming:
+			conn.Close()
+		default:
+			return
+		}
+	}
 }
 
 func (l *listener) Addr() net.Addr {
-	return maNetAddr{ma: l.t.listenAddr}
+	return maNetAddr{ma: l.t.listenAddress()}
 }
 
 func (l *listener) Multiaddr() ma.Multiaddr {
-	return l.t.listenAddr
+	return l.t.listenAddress()
 }
 
+// enqueue queues conn for Accept. It runs under t.mu, which closing a
+// connection takes, so connections refused by a closed listener are closed on
+// another goroutine. It never blocks: once incoming is full, connections wait
+// in overflow for deliver.
 func (l *listener) enqueue(conn *Conn) {
-	select {
-	case <-l.closed:
+	l.overflowMu.Lock()
+	defer l.overflowMu.Unlock()
+	if l.isClosed() {
+		go conn.Close()
 		return
-	case l.incoming <- conn:
+	}
+	if len(l.overflow) == 0 {
+		select {
+		case l.incoming <- conn:
+			return
+		default:
+		}
+	}
+	l.overflow = append(l.overflow, conn)
+	select {
+	case l.wake <- struct{}{}:
 	default:
-		go func() {
+	}
+}
+
+// deliver moves overflowed connections into incoming as Accept makes room,
+// closing whatever is left once the listener closes.
+func (l *listener) deliver() {
+	for {
+		select {
+		case <-l.closed:
+			l.overflowMu.Lock()
+			left := l.overflow
+			l.overflow = nil
+			l.overflowMu.Unlock()
+			for _, conn := range left {
+				conn.Close()
+			}
+			return
+		case <-l.wake:
+		}
+		for {
+			// The head stays in overflow until it is handed over, so enqueue
+			// cannot overtake it.
+			l.overflowMu.Lock()
+			if len(l.overflow) == 0 {
+				l.overflowMu.Unlock()
+				break
+			}
+			next := l.overflow[0]
+			l.overflowMu.Unlock()
+
 			select {
 			case <-l.closed:
-			case l.incoming <- conn:
+			case l.incoming <- next:
+				l.overflowMu.Lock()
+				l.overflow[0] = nil
+				l.overflow = l.overflow[1:]
+				l.overflowMu.Unlock()
+				if l.isClosed() {
+					// shutdown may have drained before next landed.
+					l.drain()
+				}
+				continue
 			}
-		}()
+			break
+		}
+	}
+}
+
+// isClosed reports whether the listener was shut down.
+func (l *listener) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -87,4 +181,3 @@ func (a maNetAddr) Network() string {
 func (a maNetAddr) String() string {
 	return a.ma.String()
 }
-
@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"banyan/transports/nym/message"
+)
+
+func TestListenerCloseClosesQueuedConnections(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const queued = 5
+	transportA, transportB := newTestTransports(t, ctx, WithListenerBacklog(2))
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	// More connections than the backlog, none of them accepted.
+	var conns []*Conn
+	for i := 0; i < queued; i++ {
+		conn, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conns = append(conns, conn.(*Conn))
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Fatalf("close listener: %v", err)
+	}
+	for i, conn := range conns {
+		for !conn.IsClosed() {
+			if ctx.Err() != nil {
+				t.Fatalf("dialed connection %d still open after the listener closed", i)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if n := transportB.Stats().ActiveConnections; n != 0 {
+		t.Fatalf("listener side kept %d connections", n)
+	}
+}
+
+func TestListenerBackpressureDoesNotSpawnGoroutines(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tpt, _ := newTestTransports(t, ctx, WithListenerBacklog(4))
+	l := newListener(tpt)
+	defer l.Close()
+
+	const flood = 1000
+	before := runtime.NumGoroutine()
+	conns := make([]*Conn, flood)
+	for i := range conns {
+		conn, err := newConn(tpt, message.ConnectionID{byte(i), byte(i >> 8)}, tpt.localPeer, tpt.selfRecipient, tpt.newQueue())
+		if err != nil {
+			t.Fatalf("new conn: %v", err)
+		}
+		conns[i] = conn
+		l.enqueue(conn)
+	}
+	if growth := runtime.NumGoroutine() - before; growth > 10 {
+		t.Fatalf("goroutines grew by %d while %d connections went unaccepted", growth, flood)
+	}
+
+	for i, want := range conns {
+		got, err := l.Accept()
+		if err != nil {
+			t.Fatalf("accept %d: %v", i, err)
+		}
+		if got != want {
+			t.Fatalf("accepted connection %d out of order", i)
+		}
+	}
+}
+
+func TestListenerCloseSparesOtherListenersConnections(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	plain, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	anonymous, err := transportB.ListenAnonymous()
+	if err != nil {
+		t.Fatalf("listen anonymous: %v", err)
+	}
+	defer anonymous.Close()
+
+	// An anonymous dial suits both listeners but is queued on one.
+	if _, err := transportA.Dial(WithAnonymity(ctx), transportB.listenAddr, transportB.localPeer); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := plain.Close(); err != nil {
+		t.Fatalf("close listener: %v", err)
+	}
+	conn, err := anonymous.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if conn.IsClosed() {
+		t.Fatalf("closing the other listener closed the queued connection")
+	}
+}
@@ -0,0 +1,170 @@
+package transport
+
+import "github.com/libp2p/go-libp2p/core/network"
+
+// WithMaxBufferedBytes caps the total payload buffered across all connections,
+// counting out-of-order messages in the reorder queues and data not yet read
+// from substreams. When a connection would push the total over the limit, the
+// connection buffering the most is closed to make room; if that is the
+// connection itself, it is closed instead. Zero disables the limit.
+func WithMaxBufferedBytes(n int64) Option {
+	return func(c *config) {
+		if n >= 0 {
+			c.maxBufferedBytes = n
+		}
+	}
+}
+
+// reserveBuffered accounts n more buffered bytes on behalf of c, evicting the
+// largest other consumers if needed. It reports false if c must be closed.
+func (t *Transport) reserveBuffered(c *Conn, n int64) bool {
+	limit := t.cfg.maxBufferedBytes
+	for {
+		if total := t.bufferedBytes.Add(n); limit <= 0 || total <= limit {
+			return true
+		}
+		t.bufferedBytes.Add(-n)
+
+		victim := t.largestBufferedConn()
+		if victim == nil || victim == c {
+			return false
+		}
+		victim.Close()
+	}
+}
+
+// largestBufferedConn returns the open connection holding the most buffered data.
+func (t *Transport) largestBufferedConn() *Conn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var largest *Conn
+	var most int64
+	for _, conn := range t.connections {
+		if n := conn.bufferedBytes(); n > most {
+			largest, most = conn, n
+		}
+	}
+	return largest
+}
+
+// chargeBuffered accounts n buffered bytes to the connection, reserving them
+// globally and with the connection's resource scope. It reports false if the
+// data must not be buffered, in which case the connection should be closed.
+func (c *Conn) chargeBuffered(n int) bool {
+	if n == 0 {
+		return true
+	}
+	if !c.transport.reserveBuffered(c, int64(n)) {
+		return false
+	}
+	if err := c.scope.ReserveMemory(n, network.ReservationPriorityMedium); err != nil {
+		c.transport.bufferedBytes.Add(-int64(n))
+		return false
+	}
+
+	c.bufMu.Lock()
+	defer c.bufMu.Unlock()
+	if c.bufReleased {
+		c.transport.bufferedBytes.Add(-int64(n))
+		c.scope.ReleaseMemory(n)
+		return false
+	}
+	c.buffered += int64(n)
+	return true
+}
+
+// releaseBuffered returns n previously charged bytes.
+func (c *Conn) releaseBuffered(n int) {
+	if n <= 0 {
+		return
+	}
+	c.bufMu.Lock()
+	defer c.bufMu.Unlock()
+	if c.bufReleased {
+		return
+	}
+	c.buffered -= int64(n)
+	c.transport.bufferedBytes.Add(-int64(n))
+	c.scope.ReleaseMemory(n)
+}
+
+// releaseAllBuffered returns everything charged to the connection and refuses
+// further charges; called when the connection closes.
+func (c *Conn) releaseAllBuffered() {
+	c.bufMu.Lock()
+	defer c.bufMu.Unlock()
+	if c.bufReleased {
+		return
+	}
+	c.bufReleased = true
+	c.transport.bufferedBytes.Add(-c.buffered)
+	c.scope.ReleaseMemory(int(c.buffered))
+	c.buffered = 0
+}
+
+func (c *Conn) bufferedBytes() int64 {
+	c.bufMu.Lock()
+	defer c.bufMu.Unlock()
+	return c.buffered
+}
+
+// accountQueue charges or releases the change in reorder queue size since the
+// last call. It reports false if the queue growth was refused.
+func (c *Conn) accountQueue() bool {
+	now := c.queue.BufferedBytes()
+	delta := now - c.queueBytes
+	c.queueBytes = now
+	if delta < 0 {
+		c.releaseBuffered(-delta)
+		return true
+	}
+	return c.chargeBuffered(delta)
+}
+
+// chargeBuffered accounts n bytes about to be queued for the reader.
+func (s *Substream) chargeBuffered(n int) bool {
+	if !s.conn.chargeBuffered(n) {
+		return false
+	}
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	if s.bufReleased {
+		s.conn.releaseBuffered(n)
+		return false
+	}
+	s.buffered += n
+	return true
+}
+
+// releaseBuffered returns n bytes handed to the reader or dropped.
+func (s *Substream) releaseBuffered(n int) {
+	s.bufMu.Lock()
+	if s.bufReleased {
+		s.bufMu.Unlock()
+		return
+	}
+	if n > s.buffered {
+		n = s.buffered
+	}
+	s.buffered -= n
+	s.bufMu.Unlock()
+	s.conn.releaseBuffered(n)
+}
+
+// releaseAllBuffered returns everything the stream still holds and reports
+// how many bytes that was; unread data is discarded once the stream is closed
+// locally.
+func (s *Substream) releaseAllBuffered() int {
+	s.bufMu.Lock()
+	if s.bufReleased {
+		s.bufMu.Unlock()
+		return 0
+	}
+	s.bufReleased = true
+	n := s.buffered
+	s.buffered = 0
+	s.bufMu.Unlock()
+	s.conn.releaseBuffered(n)
+	return n
+}
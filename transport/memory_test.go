@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMaxBufferedBytesEvictsLargestConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const limit = 4096
+	transportA, transportB := newTestTransports(t, ctx, WithMaxBufferedBytes(limit))
+
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	type pair struct {
+		remote *Conn
+		write  *Substream
+		read   *Substream
+	}
+	pairs := make([]pair, 3)
+	for i := range pairs {
+		raw, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("accept %d: %v", i, err)
+		}
+		stream, err := raw.(*Conn).OpenStream(ctx)
+		if err != nil {
+			t.Fatalf("open stream %d: %v", i, err)
+		}
+		remote, err := accepted.(*Conn).AcceptStream()
+		if err != nil {
+			t.Fatalf("accept stream %d: %v", i, err)
+		}
+		pairs[i] = pair{remote: accepted.(*Conn), write: stream.(*Substream), read: remote.(*Substream)}
+	}
+
+	// Nobody reads on B, so everything written stays buffered there.
+	waitBuffered := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for transportB.Stats().BufferedBytes != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("buffered bytes = %d, want %d", transportB.Stats().BufferedBytes, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, err := pairs[0].write.Write(bytes.Repeat([]byte{1}, 3000)); err != nil {
+		t.Fatalf("write 0: %v", err)
+	}
+	waitBuffered(3000)
+	if _, err := pairs[1].write.Write(bytes.Repeat([]byte{2}, 1000)); err != nil {
+		t.Fatalf("write 1: %v", err)
+	}
+	waitBuffered(4000)
+
+	// Going over the limit evicts the largest consumer, connection 0.
+	if _, err := pairs[2].write.Write(bytes.Repeat([]byte{3}, 2000)); err != nil {
+		t.Fatalf("write 2: %v", err)
+	}
+	waitBuffered(3000)
+	if !pairs[0].remote.IsClosed() {
+		t.Fatalf("largest connection was not evicted")
+	}
+	if pairs[1].remote.IsClosed() || pairs[2].remote.IsClosed() {
+		t.Fatalf("smaller connections were evicted")
+	}
+
+	// Reading releases the accounted bytes.
+	buf := make([]byte, 2000)
+	if _, err := io.ReadFull(pairs[2].read, buf); err != nil {
+		t.Fatalf("read 2: %v", err)
+	}
+	waitBuffered(1000)
+
+	// A single connection exceeding the limit on its own is closed.
+	if _, err := pairs[1].write.Write(bytes.Repeat([]byte{2}, limit)); err != nil {
+		t.Fatalf("write 1: %v", err)
+	}
+	waitBuffered(0)
+	if !pairs[1].remote.IsClosed() {
+		t.Fatalf("connection exceeding the limit alone was not closed")
+	}
+}
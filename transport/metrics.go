@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"time"
+
+	"banyan/transports/nym/message"
+)
+
+// Metrics receives measurements from the transport, to be exported to a
+// monitoring system such as Prometheus without this module depending on it.
+// Each method maps onto a counter, gauge or histogram. Methods are called on
+// the send, dispatch and dial paths, possibly concurrently, and must not
+// block.
+type Metrics interface {
+	// MessageSent and MessageReceived count mixnet messages by type.
+	MessageSent(typ message.MessageType)
+	MessageReceived(typ message.MessageType)
+	// DialSucceeded counts dials that established a connection.
+	DialSucceeded()
+	// DialFailed counts failed dial handshakes; timeouts are reported with
+	// HandshakeTimeout.
+	DialFailed(reason HandshakeFailureReason)
+	// ActiveConnections reports the number of open connections whenever it
+	// changes.
+	ActiveConnections(n int)
+	// ReorderQueueDepth observes the depth of a connection's reorder queue
+	// each time a transport message is received.
+	ReorderQueueDepth(depth int)
+	// StreamOpened observes how long OpenStream took to have a substream
+	// accepted by the remote.
+	StreamOpened(latency time.Duration)
+}
+
+// WithMetrics reports transport measurements to m. Without it they are
+// discarded.
+func WithMetrics(m Metrics) Option {
+	return func(c *config) {
+		if m != nil {
+			c.metrics = m
+		}
+	}
+}
+
+// noopMetrics is the default Metrics, discarding everything.
+type noopMetrics struct{}
+
+func (noopMetrics) MessageSent(message.MessageType)     {}
+func (noopMetrics) MessageReceived(message.MessageType) {}
+func (noopMetrics) DialSucceeded()                      {}
+func (noopMetrics) DialFailed(HandshakeFailureReason)   {}
+func (noopMetrics) ActiveConnections(int)               {}
+func (noopMetrics) ReorderQueueDepth(int)               {}
+func (noopMetrics) StreamOpened(time.Duration)          {}
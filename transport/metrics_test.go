@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"banyan/transports/nym/message"
+)
+
+// fakeMetrics records what the transport reports.
+type fakeMetrics struct {
+	mu           sync.Mutex
+	sent         map[message.MessageType]int
+	received     map[message.MessageType]int
+	dials        int
+	failures     map[HandshakeFailureReason]int
+	active       int
+	depths       int
+	streamOpened int
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		sent:     make(map[message.MessageType]int),
+		received: make(map[message.MessageType]int),
+		failures: make(map[HandshakeFailureReason]int),
+	}
+}
+
+func (m *fakeMetrics) MessageSent(typ message.MessageType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent[typ]++
+}
+
+func (m *fakeMetrics) MessageReceived(typ message.MessageType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received[typ]++
+}
+
+func (m *fakeMetrics) DialSucceeded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dials++
+}
+
+func (m *fakeMetrics) DialFailed(reason HandshakeFailureReason) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[reason]++
+}
+
+func (m *fakeMetrics) ActiveConnections(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active = n
+}
+
+func (m *fakeMetrics) ReorderQueueDepth(int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depths++
+}
+
+func (m *fakeMetrics) StreamOpened(time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streamOpened++
+}
+
+func TestMetricsDialAndStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dialer, listener := newFakeMetrics(), newFakeMetrics()
+	transportA, transportB := newTestTransports(t, ctx)
+	transportA.cfg.metrics = dialer
+	transportB.cfg.metrics = listener
+
+	connAB, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+	if _, err := streamAB.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(streamBA, make([]byte, 5)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	dialer.mu.Lock()
+	if dialer.dials != 1 || dialer.streamOpened != 1 || dialer.active != 1 {
+		t.Errorf("dialer reported %d dials, %d opened streams and %d active connections, want 1 each", dialer.dials, dialer.streamOpened, dialer.active)
+	}
+	if dialer.sent[message.MessageTypeConnectionRequest] != 1 || dialer.received[message.MessageTypeConnectionResponse] != 1 {
+		t.Errorf("dialer handshake messages: sent %v, received %v", dialer.sent, dialer.received)
+	}
+	// The open request and the data.
+	if n := dialer.sent[message.MessageTypeTransport]; n < 2 {
+		t.Errorf("dialer sent %d transport messages, want at least 2", n)
+	}
+	dialer.mu.Unlock()
+
+	listener.mu.Lock()
+	if listener.received[message.MessageTypeConnectionRequest] != 1 || listener.sent[message.MessageTypeConnectionResponse] != 1 {
+		t.Errorf("listener handshake messages: sent %v, received %v", listener.sent, listener.received)
+	}
+	if listener.active != 1 || listener.dials != 0 {
+		t.Errorf("listener reported %d active connections and %d dials", listener.active, listener.dials)
+	}
+	if listener.depths < 2 {
+		t.Errorf("listener observed %d reorder queue depths, want at least 2", listener.depths)
+	}
+	listener.mu.Unlock()
+
+	connAB.Close()
+	waitFor(t, ctx, "connection count drop", func() bool {
+		dialer.mu.Lock()
+		defer dialer.mu.Unlock()
+		return dialer.active == 0
+	})
+
+	// A dial nobody answers fails with a timeout.
+	transportA.handshakeTimeout = 50 * time.Millisecond
+	if _, err := transportA.dial(ctx, testRecipient(0x33), "", false); err == nil {
+		t.Fatalf("dial to an unknown recipient succeeded")
+	}
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if n := dialer.failures[HandshakeTimeout]; n != 1 {
+		t.Fatalf("dialer reported %d handshake timeouts, want 1", n)
+	}
+}
+
+func TestMetricsCountEverySend(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Fail-fast opens and shutdown notices take their own paths to the
+	// mixnet; the metrics must see them like any other send.
+	dialer := newFakeMetrics()
+	transportA, transportB := newTestTransports(t, ctx, WithFailFastOnCongestion(true))
+	transportA.cfg.metrics = dialer
+	openTestStreams(t, ctx, transportA, transportB)
+	transportA.Close()
+
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	total := 0
+	for _, n := range dialer.sent {
+		total += n
+	}
+	if want := transportA.Stats().MessagesSent; uint64(total) != want {
+		t.Errorf("metrics counted %d sent messages, stats %d", total, want)
+	}
+	if dialer.sent[message.MessageTypeConnectionClose] != 1 {
+		t.Errorf("metrics counted %d connection closes, want 1", dialer.sent[message.MessageTypeConnectionClose])
+	}
+}
@@ -0,0 +1,372 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+	"banyan/transports/nym/queue"
+)
+
+// Option configures optional Transport behaviour.
+type Option func(*config)
+
+// Config gathers the transport's buffer sizes in one place; see NewWithConfig.
+// Zero fields keep their defaults. The matching options, such as
+// WithAcceptBacklog, set the same fields.
+type Config struct {
+	// MixnetInboundBuffer is how many received mixnet messages wait for the
+	// transport before the mixnet client stops reading; see WithDropOnFull.
+	// Default 32.
+	MixnetInboundBuffer int
+	// MixnetOutboundBuffer is how many messages wait to be written to the
+	// Nym client before senders block. Default 32.
+	MixnetOutboundBuffer int
+	// ListenerBacklog is how many established connections wait for
+	// Listener.Accept. Default 16.
+	ListenerBacklog int
+	// AcceptBacklog is how many inbound streams per connection wait for
+	// AcceptStream before further opens are refused. Default 8.
+	AcceptBacklog int
+	// StreamReadChunks is how many received data messages per stream wait
+	// for Read before further ones are held back. Default 32.
+	StreamReadChunks int
+	// StreamReadBuffer is how many received bytes per stream wait for Read
+	// before further data is held back. Default 64KiB.
+	StreamReadBuffer int
+}
+
+// WithConfig applies the non-zero fields of cfg.
+func WithConfig(cfg Config) Option {
+	return func(c *config) {
+		WithMixnetInboundBufferSize(cfg.MixnetInboundBuffer)(c)
+		WithOutboundBufferSize(cfg.MixnetOutboundBuffer)(c)
+		WithListenerBacklog(cfg.ListenerBacklog)(c)
+		WithAcceptBacklog(cfg.AcceptBacklog)(c)
+		WithStreamReadChunks(cfg.StreamReadChunks)(c)
+		WithStreamReadBuffer(cfg.StreamReadBuffer)(c)
+	}
+}
+
+type config struct {
+	Config
+
+	replySURBs           uint32
+	failFastOnCongestion bool
+	anonymousReplies     bool
+	maxBufferedBytes     int64
+	maxFragmentSize      int
+	wireVersion          message.WireVersion
+	checksum             bool
+	streamWindow         int
+	closeControl         bool
+	replyRecipient       *message.Recipient
+	trace                TraceFunc
+
+	handshakeFailureHandler HandshakeFailureHandler
+	acceptInterceptor       AcceptInterceptor
+	resourceManager         network.ResourceManager
+	swarmStreamScopes       bool
+	selfAddressChanged      func(ma.Multiaddr)
+	metrics                 Metrics
+	responseRetransmit      time.Duration
+	halfOpenTimeout         time.Duration
+	dialRetries             int
+	dialRetryInterval       time.Duration
+	shutdownTimeout         time.Duration
+	responseBurst           int
+	responseInterval        time.Duration
+	reorderQueueDepth       int
+	reorderOverflow         queue.OverflowPolicy
+	reorderTimeout          time.Duration
+	keepaliveInterval       time.Duration
+	idleTimeout             time.Duration
+	keepaliveMaxMissed      int
+
+	// mixnetOptions are forwarded to mixnet.Initialize by New and
+	// RestoreTransport; NewWithMixnet refuses them.
+	mixnetOptions []mixnet.Option
+}
+
+func defaultConfig() config {
+	return config{
+		Config: Config{
+			ListenerBacklog:  defaultListenerBacklog,
+			AcceptBacklog:    defaultAcceptBacklog,
+			StreamReadChunks: defaultStreamReadChunks,
+			StreamReadBuffer: defaultStreamReadBuffer,
+		},
+		replySURBs:      defaultReplySURBs,
+		shutdownTimeout: defaultShutdownTimeout,
+		metrics:         noopMetrics{},
+	}
+}
+
+// mixnetOpts returns the options New passes to mixnet.Initialize.
+func (c *config) mixnetOpts() []mixnet.Option {
+	opts := c.mixnetOptions
+	if c.MixnetInboundBuffer > 0 {
+		opts = append(opts, mixnet.WithInboundBufferSize(c.MixnetInboundBuffer))
+	}
+	if c.MixnetOutboundBuffer > 0 {
+		opts = append(opts, mixnet.WithOutboundBufferSize(c.MixnetOutboundBuffer))
+	}
+	return opts
+}
+
+func applyOptions(opts []Option) config {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	// The fragment size depends on the wire layout, which any option may set.
+	if cfg.maxFragmentSize <= cfg.transportOverhead() {
+		cfg.maxFragmentSize = defaultFragmentPayload + cfg.transportOverhead()
+	}
+	return cfg
+}
+
+// transportOverhead is the encoding overhead of a transport message in the
+// configured wire layout.
+func (c *config) transportOverhead() int {
+	return message.TransportOverheadFor(c.wireVersion, c.checksum)
+}
+
+// defaultReplySURBs is the number of reply SURBs attached to each anonymous send.
+const defaultReplySURBs = 10
+
+// WithReplySURBs sets how many reply SURBs are attached to every message sent on
+// an anonymous connection. Each message replenishes the remote's supply, so the
+// value bounds how many replies the remote can send between our messages.
+func WithReplySURBs(n uint32) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.replySURBs = n
+		}
+	}
+}
+
+// defaultAcceptBacklog is the number of inbound streams a connection buffers
+// for AcceptStream.
+const defaultAcceptBacklog = 8
+
+// WithAcceptBacklog sets how many inbound streams each connection buffers while
+// waiting for AcceptStream. Open requests beyond the backlog are refused, which
+// resets the remote's OpenStream.
+func WithAcceptBacklog(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.AcceptBacklog = n
+		}
+	}
+}
+
+// defaultShutdownTimeout bounds how long Close spends notifying peers.
+const defaultShutdownTimeout = time.Second
+
+// WithShutdownTimeout bounds how long Transport.Close spends queueing close
+// notifications for open connections. Peers not notified in time find out
+// through their own timeouts. Zero skips the notifications.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d >= 0 {
+			c.shutdownTimeout = d
+		}
+	}
+}
+
+// defaultListenerBacklog is the number of established connections a listener
+// buffers for Accept.
+const defaultListenerBacklog = 16
+
+// WithListenerBacklog sets how many established connections each listener
+// buffers while waiting for Accept.
+func WithListenerBacklog(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.ListenerBacklog = n
+		}
+	}
+}
+
+// defaultStreamReadChunks is the number of data messages a stream buffers for
+// Read.
+const defaultStreamReadChunks = 32
+
+// WithStreamReadChunks sets how many received data messages each stream
+// buffers for Read. Once a stream's buffer is full, further data for it is
+// held back until the reader catches up; see WithStreamReadBuffer.
+func WithStreamReadChunks(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.StreamReadChunks = n
+		}
+	}
+}
+
+// defaultStreamReadBuffer is the number of bytes a stream buffers for Read.
+const defaultStreamReadBuffer = 64 << 10
+
+// WithStreamReadBuffer sets how many received bytes each stream buffers for
+// Read. Data beyond that is held back on the stream rather than stalling the
+// connection, so a slow reader never delays its connection's other streams.
+// A stream holding more than eight times n bytes for its reader is reset.
+// Held data also counts towards WithMaxBufferedBytes and the connection's
+// resource scope.
+func WithStreamReadBuffer(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.StreamReadBuffer = n
+		}
+	}
+}
+
+// defaultFragmentPayload is the application data in each message unless
+// WithMaxFragmentSize says otherwise.
+const defaultFragmentPayload = 1024
+
+// WithMaxFragmentSize bounds the encoded size of each data message, including
+// the version byte and checksum added by WithWireVersion and WithChecksum.
+// Writes larger than Conn.MaxPayloadSize are split across several messages.
+// Sizes that leave no room for data are ignored.
+func WithMaxFragmentSize(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.maxFragmentSize = n
+		}
+	}
+}
+
+// WithReorderQueueLimit caps how many out-of-order messages each connection
+// buffers while waiting for a missing nonce. Once the cap is reached, policy
+// decides whether the incoming message or the buffered one furthest from
+// delivery is discarded; either way the stream it belonged to will stall at
+// the gap. Discards are counted in Stats.ReorderEvictions.
+func WithReorderQueueLimit(n int, policy queue.OverflowPolicy) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.reorderQueueDepth = n
+			c.reorderOverflow = policy
+		}
+	}
+}
+
+// WithReplyRecipient sets the recipient advertised in connection responses.
+// Dialers send all further traffic for the connection there instead of to the
+// address they dialed, e.g. to steer replies to another gateway.
+func WithReplyRecipient(r message.Recipient) Option {
+	return func(c *config) {
+		c.replyRecipient = &r
+	}
+}
+
+// WithCloseControl advertises support for close acks and half-closes in
+// connection handshakes. On connections where both ends advertised it, a
+// received close is acknowledged once everything sent before it has been
+// delivered, which Substream.CloseWait and SetLinger wait for, and
+// Substream.CloseWrite leaves the remote able to write back. Peers without
+// it, such as rust-libp2p-nym, would drop these messages and stall the
+// connection, so they are only sent to peers that advertised it. Disabled by
+// default.
+func WithCloseControl(enabled bool) Option {
+	return func(c *config) {
+		c.closeControl = enabled
+	}
+}
+
+// WithFailFastOnCongestion makes OpenStream return ErrCongested instead of
+// blocking when the mixnet outbound queue is full, so callers can pick another
+// connection rather than wait behind the backlog.
+func WithFailFastOnCongestion(enabled bool) Option {
+	return func(c *config) {
+		c.failFastOnCongestion = enabled
+	}
+}
+
+// WithWebsocketWriteTimeout bounds each write to the Nym client websocket. A
+// stalled write closes the mixnet connection rather than blocking all
+// outbound traffic; see mixnet.WithWriteTimeout.
+func WithWebsocketWriteTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.mixnetOptions = append(c.mixnetOptions, mixnet.WithWriteTimeout(d))
+	}
+}
+
+// WithReconnect keeps the transport alive across Nym client websocket drops by
+// redialing up to maxRetries times with exponential backoff from baseDelay; see
+// mixnet.WithReconnect. Listeners and established connections carry on once
+// the websocket is back.
+func WithReconnect(maxRetries int, baseDelay time.Duration) Option {
+	return func(c *config) {
+		c.mixnetOptions = append(c.mixnetOptions, mixnet.WithReconnect(maxRetries, baseDelay))
+	}
+}
+
+// WithMaxHandshakeMessageSize caps the encoded size of received connection
+// requests, responses and other connection-level messages, which are dropped
+// before decoding when larger; see mixnet.WithMaxHandshakeSize.
+func WithMaxHandshakeMessageSize(n int) Option {
+	return func(c *config) {
+		c.mixnetOptions = append(c.mixnetOptions, mixnet.WithMaxHandshakeSize(n))
+	}
+}
+
+// WithMaxMessageSize caps the size of received messages, which are refused
+// before anything is allocated for them when larger; see
+// mixnet.WithMaxMessageSize.
+func WithMaxMessageSize(n int) Option {
+	return func(c *config) {
+		c.mixnetOptions = append(c.mixnetOptions, mixnet.WithMaxMessageSize(n))
+	}
+}
+
+// WithWireVersion sets the wire format version of messages sent to the mixnet;
+// see mixnet.WithWireVersion. A version byte counts towards
+// WithMaxFragmentSize.
+func WithWireVersion(v message.WireVersion) Option {
+	return func(c *config) {
+		c.wireVersion = v
+		c.mixnetOptions = append(c.mixnetOptions, mixnet.WithWireVersion(v))
+	}
+}
+
+// WithChecksum adds an integrity check to sent transport messages; see
+// mixnet.WithChecksum.
+func WithChecksum(enabled bool) Option {
+	return func(c *config) {
+		c.checksum = enabled
+		c.mixnetOptions = append(c.mixnetOptions, mixnet.WithChecksum(enabled))
+	}
+}
+
+// WithDropOnFull drops received mixnet messages while the inbound queue is full
+// rather than pausing reads from the Nym client; see mixnet.WithDropOnFull.
+func WithDropOnFull(enabled bool) Option {
+	return func(c *config) {
+		c.mixnetOptions = append(c.mixnetOptions, mixnet.WithDropOnFull(enabled))
+	}
+}
+
+// WithOutboundBufferSize sets the capacity of the mixnet outbound queue shared
+// by all connections; see mixnet.WithOutboundBufferSize. The current depth is
+// reported by Transport.Stats.
+func WithOutboundBufferSize(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.MixnetOutboundBuffer = n
+		}
+	}
+}
+
+// WithMixnetInboundBufferSize sets the capacity of the mixnet inbound queue;
+// see mixnet.WithInboundBufferSize.
+func WithMixnetInboundBufferSize(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.MixnetInboundBuffer = n
+		}
+	}
+}
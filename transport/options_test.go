@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"banyan/transports/nym/internal/testutil"
+)
+
+func TestNewWithConfigAppliesBufferSizes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	cfg := Config{
+		MixnetInboundBuffer:  11,
+		MixnetOutboundBuffer: 12,
+		ListenerBacklog:      13,
+		AcceptBacklog:        14,
+		StreamReadChunks:     15,
+		StreamReadBuffer:     16,
+	}
+	var transports [2]*Transport
+	for i, name := range []string{"a", "b"} {
+		priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		if transports[i], err = NewWithConfig(ctx, srv.URL(name), priv, cfg); err != nil {
+			t.Fatalf("create transport %s: %v", name, err)
+		}
+		defer transports[i].Close()
+	}
+
+	if got := cap(transports[0].mixnetInbound); got != cfg.MixnetInboundBuffer {
+		t.Errorf("mixnet inbound buffer = %d, want %d", got, cfg.MixnetInboundBuffer)
+	}
+	if got := cap(transports[0].mixnetOutbound); got != cfg.MixnetOutboundBuffer {
+		t.Errorf("mixnet outbound buffer = %d, want %d", got, cfg.MixnetOutboundBuffer)
+	}
+
+	if got := cap(newListener(transports[1]).incoming); got != cfg.ListenerBacklog {
+		t.Errorf("listener backlog = %d, want %d", got, cfg.ListenerBacklog)
+	}
+	_, connBA, _, streamBA := openTestStreams(t, ctx, transports[0], transports[1])
+	if got := cap(connBA.inboundSubstreams); got != cfg.AcceptBacklog {
+		t.Errorf("accept backlog = %d, want %d", got, cfg.AcceptBacklog)
+	}
+	if got := cap(streamBA.inbound); got != cfg.StreamReadChunks {
+		t.Errorf("stream read chunks = %d, want %d", got, cfg.StreamReadChunks)
+	}
+	if got := transports[1].cfg.StreamReadBuffer; got != cfg.StreamReadBuffer {
+		t.Errorf("stream read buffer = %d, want %d", got, cfg.StreamReadBuffer)
+	}
+}
+
+func TestOptionsOverrideConfig(t *testing.T) {
+	cfg := applyOptions([]Option{WithConfig(Config{AcceptBacklog: 3}), WithAcceptBacklog(5)})
+	if cfg.AcceptBacklog != 5 {
+		t.Fatalf("AcceptBacklog = %d, want the later option's 5", cfg.AcceptBacklog)
+	}
+	if cfg.ListenerBacklog != defaultListenerBacklog {
+		t.Fatalf("zero ListenerBacklog replaced the default with %d", cfg.ListenerBacklog)
+	}
+}
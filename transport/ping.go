@@ -0,0 +1,138 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+// Ping sends a probe to recipient and returns the round-trip time once its
+// transport answers. No connection is set up on either side. Without a
+// deadline on ctx, Ping gives up after the handshake timeout. Like Dial, a ctx
+// from WithAnonymity or a transport with WithAnonymousReplies withholds our
+// recipient address, and the pong comes back through reply SURBs.
+func (t *Transport) Ping(ctx context.Context, recipient message.Recipient) (time.Duration, error) {
+	id, err := message.GenerateConnectionID()
+	if err != nil {
+		return 0, fmt.Errorf("nym transport: generate ping id: %w", err)
+	}
+	key := connKey(id)
+	pong := make(chan struct{})
+
+	t.mu.Lock()
+	t.pendingPings[key] = pong
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pendingPings, key)
+		t.mu.Unlock()
+	}()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.handshakeTimeout)
+		defer cancel()
+	}
+
+	ping := &message.ConnectionMessage{
+		PeerID: t.LocalPeer(),
+		ID:     id,
+	}
+	out := mixnet.OutboundMessage{
+		Recipient: recipient,
+		Message: &message.Message{
+			Type:       message.MessageTypePing,
+			Connection: ping,
+		},
+	}
+	if isAnonymousDial(ctx) || t.cfg.anonymousReplies {
+		out.ReplySURBs = t.cfg.replySURBs
+	} else {
+		self := t.selfAddress()
+		ping.Recipient = &self
+	}
+	start := time.Now()
+	if err := t.sendOutbound(out); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-t.mixnetDone:
+		return 0, ErrMixnetDisconnected
+	case <-t.ctx.Done():
+		return 0, context.Canceled
+	}
+}
+
+// Probe reports whether the transport at addr accepts connections. It sends a
+// connection request through the regular dial path, returns the time until
+// the response arrives and closes the connection straight away, without
+// handing it out or securing it. Unlike Ping, it works with any peer that
+// answers connection requests, though the remote briefly sees an inbound
+// connection. Without a deadline on ctx, Probe gives up after the handshake
+// timeout.
+func (t *Transport) Probe(ctx context.Context, addr ma.Multiaddr) (time.Duration, error) {
+	if !hasNymProtocol(addr) {
+		return 0, fmt.Errorf("nym transport: unsupported address")
+	}
+	recipient, err := parseRecipientFromMultiaddr(addr)
+	if err != nil {
+		return 0, fmt.Errorf("nym transport: parse recipient: %w", err)
+	}
+
+	start := time.Now()
+	conn, err := t.dial(ctx, recipient, "", isAnonymousDial(ctx) || t.cfg.anonymousReplies)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
+
+func (t *Transport) handlePing(ping *message.ConnectionMessage, tag *mixnet.SenderTag) error {
+	out := mixnet.OutboundMessage{
+		Message: &message.Message{
+			Type: message.MessageTypePong,
+			Connection: &message.ConnectionMessage{
+				PeerID: t.LocalPeer(),
+				ID:     ping.ID,
+			},
+		},
+	}
+	switch {
+	case ping.Recipient != nil:
+		if !t.allowReply(ping.Recipient) {
+			return nil
+		}
+		out.Recipient = *ping.Recipient
+	case tag != nil:
+		out.SenderTag = tag
+	default:
+		return errors.New("ping carries no reply address")
+	}
+	return t.sendOutbound(out)
+}
+
+func (t *Transport) handlePong(pong *message.ConnectionMessage) error {
+	key := connKey(pong.ID)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch, ok := t.pendingPings[key]
+	if !ok {
+		return fmt.Errorf("no pending ping for pong")
+	}
+	delete(t.pendingPings, key)
+	close(ch)
+	return nil
+}
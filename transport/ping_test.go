@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+func TestPingReachableRecipient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	rtt, err := transportA.Ping(ctx, transportB.selfRecipient)
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("ping returned rtt %v, want a positive duration", rtt)
+	}
+	if conns := len(transportA.Conns()) + len(transportB.Conns()); conns != 0 {
+		t.Fatalf("ping left %d connections behind", conns)
+	}
+}
+
+func TestAnonymousPingWithholdsRecipient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var disclosed atomic.Bool
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if msg.Message.Type == message.MessageTypePing && (msg.Message.Connection.Recipient != nil || msg.ReplySURBs == 0) {
+			disclosed.Store(true)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+	if _, err := transportA.Ping(WithAnonymity(ctx), transportB.selfRecipient); err != nil {
+		t.Fatalf("ping with WithAnonymity: %v", err)
+	}
+	transportA, transportB = newInterceptedTestTransports(t, ctx, intercept, WithAnonymousReplies(true))
+	if _, err := transportA.Ping(ctx, transportB.selfRecipient); err != nil {
+		t.Fatalf("ping with WithAnonymousReplies: %v", err)
+	}
+	if disclosed.Load() {
+		t.Fatalf("anonymous ping disclosed our recipient")
+	}
+}
+
+func TestPingUnreachableRecipientTimesOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, _ := newTestTransports(t, ctx)
+	pingCtx, pingCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer pingCancel()
+	// Nobody owns this recipient, so the ping goes unanswered.
+	if _, err := transportA.Ping(pingCtx, testRecipient(0x33)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ping to unreachable recipient returned %v, want deadline exceeded", err)
+	}
+}
+
+func TestProbeReachableAddress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	rtt, err := transportA.Probe(ctx, transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("probe returned rtt %v, want a positive duration", rtt)
+	}
+	if conns := len(transportA.Conns()); conns != 0 {
+		t.Fatalf("probe left %d connections behind", conns)
+	}
+	// The remote drops its side once the close arrives.
+	waitFor(t, ctx, "the probed side to drop the connection", func() bool {
+		return len(transportB.Conns()) == 0
+	})
+}
+
+func TestProbeUnreachableAddressTimesOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, _ := newTestTransports(t, ctx)
+	addr, err := multiaddrFromRecipient(testRecipient(0x33))
+	if err != nil {
+		t.Fatalf("multiaddr: %v", err)
+	}
+	probeCtx, probeCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer probeCancel()
+	if _, err := transportA.Probe(probeCtx, addr); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("probe of unreachable address returned %v, want deadline exceeded", err)
+	}
+	if conns := len(transportA.Conns()); conns != 0 {
+		t.Fatalf("failed probe left %d connections behind", conns)
+	}
+}
@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"banyan/transports/nym/message"
+)
+
+// maxLimiterEntries bounds how many recipients the response limiter tracks
+// before it forgets those whose budget has fully recovered.
+const maxLimiterEntries = 4096
+
+// WithResponseRateLimit caps the unsolicited replies (connection responses,
+// rejects and pongs) sent to any one recipient: up to burst at once, then one
+// per interval. Requests beyond the cap are dropped without a reply, so a
+// forged source address cannot turn a listener into a traffic reflector.
+// Requests that only carry a sender tag are not limited, since their replies
+// can only reach the real sender.
+func WithResponseRateLimit(burst int, interval time.Duration) Option {
+	return func(c *config) {
+		if burst > 0 && interval > 0 {
+			c.responseBurst = burst
+			c.responseInterval = interval
+		}
+	}
+}
+
+// responseLimiter is a token bucket per reply recipient.
+type responseLimiter struct {
+	burst    float64
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	buckets map[message.Recipient]*responseBucket
+}
+
+type responseBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newResponseLimiter(burst int, interval time.Duration) *responseLimiter {
+	return &responseLimiter{
+		burst:    float64(burst),
+		interval: interval,
+		now:      time.Now,
+		buckets:  make(map[message.Recipient]*responseBucket),
+	}
+}
+
+// allow reports whether a reply may be sent to r, consuming a token if so.
+func (l *responseLimiter) allow(r message.Recipient) bool {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[r]
+	if !ok {
+		if len(l.buckets) >= maxLimiterEntries {
+			l.pruneLocked(now)
+		}
+		b = &responseBucket{tokens: l.burst, last: now}
+		l.buckets[r] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *responseLimiter) refill(b *responseBucket, now time.Time) float64 {
+	tokens := b.tokens + float64(now.Sub(b.last))/float64(l.interval)
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// pruneLocked forgets recipients whose bucket has refilled, as a fresh bucket
+// would behave the same.
+func (l *responseLimiter) pruneLocked(now time.Time) {
+	for r, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, r)
+		}
+	}
+}
+
+// allowReply reports whether an unsolicited reply may be sent to r. It always
+// allows replies when no limit is configured.
+func (t *Transport) allowReply(r *message.Recipient) bool {
+	if t.responseLimiter == nil || r == nil {
+		return true
+	}
+	if t.responseLimiter.allow(*r) {
+		return true
+	}
+	t.rateLimitedRequests.Add(1)
+	return false
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+func TestForgedConnectionRequestsAreRateLimited(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const burst, flood = 3, 50
+	victim := testRecipient(0x44)
+	var responses atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if msg.Recipient == victim && msg.Message.Type == message.MessageTypeConnectionResponse {
+			responses.Add(1)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithResponseRateLimit(burst, time.Hour))
+
+	forgedPeer, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("decode peer: %v", err)
+	}
+	for i := 0; i < flood; i++ {
+		req := &message.Message{
+			Type: message.MessageTypeConnectionRequest,
+			Connection: &message.ConnectionMessage{
+				PeerID:    forgedPeer,
+				Recipient: &victim,
+				ID:        message.ConnectionID{byte(i), 0x44},
+			},
+		}
+		if err := transportB.handleInboundMessage(mixnet.InboundMessage{Message: req}); err != nil {
+			t.Fatalf("forged request %d: %v", i, err)
+		}
+	}
+
+	// The pipe routes in order, so once the pong is back every response
+	// sent during the flood has passed the interceptor. Other recipients
+	// keep their own budget.
+	if _, err := transportA.Ping(ctx, transportB.selfRecipient); err != nil {
+		t.Fatalf("ping from unrelated recipient: %v", err)
+	}
+	if got := responses.Load(); got != burst {
+		t.Fatalf("victim received %d connection responses, want %d", got, burst)
+	}
+	if got := transportB.Stats().RateLimitedRequests; got != flood-burst {
+		t.Fatalf("RateLimitedRequests = %d, want %d", got, flood-burst)
+	}
+	if got := len(transportB.Conns()); got != burst {
+		t.Fatalf("listener holds %d connections, want %d", got, burst)
+	}
+}
+
+func TestResponseLimiterRefills(t *testing.T) {
+	l := newResponseLimiter(2, time.Second)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	r := testRecipient(0x55)
+
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow(r); got != want {
+			t.Fatalf("allow #%d = %v, want %v", i, got, want)
+		}
+	}
+	now = now.Add(time.Second)
+	if !l.allow(r) {
+		t.Fatal("no reply allowed after one interval")
+	}
+	if l.allow(r) {
+		t.Fatal("more than one reply allowed after one interval")
+	}
+	if !l.allow(testRecipient(0x56)) {
+		t.Fatal("another recipient shares the exhausted budget")
+	}
+}
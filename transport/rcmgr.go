@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// WithResourceManager accounts connections and substreams with rcmgr. Each
+// dialed or accepted connection opens a connection scope, and each substream a
+// stream scope, released when they close. A connection or stream the manager
+// refuses is not established: Dial and OpenStream fail, and inbound requests
+// are declined. NewConstructor passes the host's resource manager for
+// connections only, since the swarm opens the stream scopes itself.
+func WithResourceManager(rcmgr network.ResourceManager) Option {
+	return func(c *config) {
+		c.resourceManager = rcmgr
+	}
+}
+
+// withSwarmStreamScopes leaves substream accounting to the go-libp2p swarm,
+// which opens a stream scope for every stream it opens or accepts; opening
+// another here would count each stream twice against the same limits.
+func withSwarmStreamScopes() Option {
+	return func(c *config) {
+		c.swarmStreamScopes = true
+	}
+}
+
+// openConnScope opens a connection scope with the resource manager for the
+// remote at raddr, attributed to p unless it is empty. It returns nil if there
+// is no resource manager.
+func (t *Transport) openConnScope(dir network.Direction, p peer.ID, raddr ma.Multiaddr) (network.ConnManagementScope, error) {
+	rcmgr := t.cfg.resourceManager
+	if rcmgr == nil {
+		return nil, nil
+	}
+	scope, err := rcmgr.OpenConnection(dir, false, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("nym transport: resource manager refused connection: %w", err)
+	}
+	if p != "" {
+		if err := scope.SetPeer(p); err != nil {
+			scope.Done()
+			return nil, fmt.Errorf("nym transport: resource manager refused peer %s: %w", p, err)
+		}
+	}
+	return scope, nil
+}
+
+// streamScope is the resource manager scope of a substream.
+type streamScope struct {
+	scope network.StreamManagementScope
+	once  sync.Once
+}
+
+// openStreamScope opens a stream scope on c with the resource manager, or
+// returns nil if there is none or the swarm accounts streams itself.
+func (c *Conn) openStreamScope(dir network.Direction) (*streamScope, error) {
+	rcmgr := c.transport.cfg.resourceManager
+	if rcmgr == nil || c.transport.cfg.swarmStreamScopes {
+		return nil, nil
+	}
+	scope, err := rcmgr.OpenStream(c.RemotePeer(), dir)
+	if err != nil {
+		return nil, fmt.Errorf("nym transport: resource manager refused stream: %w", err)
+	}
+	return &streamScope{scope: scope}, nil
+}
+
+// release ends the scope; it is safe to call more than once and on nil.
+func (s *streamScope) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(s.scope.Done)
+}
@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+func TestResourceManagerCapsStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	limits := rcmgr.PartialLimitConfig{
+		System: rcmgr.ResourceLimits{StreamsOutbound: 2},
+	}.Build(rcmgr.InfiniteLimits)
+	mgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits))
+	if err != nil {
+		t.Fatalf("new resource manager: %v", err)
+	}
+	defer mgr.Close()
+
+	transportA, transportB := newTestTransports(t, ctx, WithResourceManager(mgr))
+	// openTestStreams takes the first of the two outbound streams.
+	connAB, _, first, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	if _, ok := connAB.Scope().(network.ConnManagementScope); !ok {
+		t.Fatalf("dialed connection has scope %T, want a resource manager scope", connAB.Scope())
+	}
+	if _, err := connAB.OpenStream(ctx); err != nil {
+		t.Fatalf("open second stream: %v", err)
+	}
+	if _, err := connAB.OpenStream(ctx); err == nil {
+		t.Fatalf("open stream beyond the limit succeeded")
+	}
+
+	// Closing a stream returns its slot.
+	first.Reset()
+	if _, err := connAB.OpenStream(ctx); err != nil {
+		t.Fatalf("open stream after reset: %v", err)
+	}
+
+	connAB.Close()
+	mgr.ViewSystem(func(s network.ResourceScope) error {
+		if stat := s.Stat(); stat.NumConnsOutbound != 0 || stat.NumStreamsOutbound != 0 {
+			t.Fatalf("scopes not released on close: %+v", stat)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"log"
+	"time"
+)
+
+// minReorderCheckInterval bounds how often connections are checked for gaps.
+const minReorderCheckInterval = 10 * time.Millisecond
+
+// WithReorderTimeout closes a connection once its reorder queue has been
+// stuck behind a missing nonce for d. Without it, a lost message stalls the
+// connection's streams until they are closed. Closed connections are counted
+// in Stats.ReorderTimeouts. Zero, the default, waits indefinitely.
+func WithReorderTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d >= 0 {
+			c.reorderTimeout = d
+		}
+	}
+}
+
+// watchReorderGaps periodically closes connections stuck behind a gap for
+// longer than the reorder timeout.
+func (t *Transport) watchReorderGaps() {
+	interval := max(t.cfg.reorderTimeout/4, minReorderCheckInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, conn := range t.stuckConns(now) {
+				log.Printf("nym transport: closing connection %s: nonce %d missing for over %s",
+					conn.id, conn.queue.NextExpectedNonce(), t.cfg.reorderTimeout)
+				t.reorderTimeouts.Add(1)
+				conn.Close()
+			}
+		}
+	}
+}
+
+// stuckConns returns the connections whose gap opened more than the reorder
+// timeout before now.
+func (t *Transport) stuckConns(now time.Time) []*Conn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var stuck []*Conn
+	for _, conn := range t.connections {
+		if since := conn.queue.GapSince(); !since.IsZero() && now.Sub(since) > t.cfg.reorderTimeout {
+			stuck = append(stuck, conn)
+		}
+	}
+	return stuck
+}
@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"banyan/transports/nym/message"
+)
+
+func TestReorderTimeoutClosesStuckConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const timeout = 100 * time.Millisecond
+	transportA, transportB := newTestTransports(t, ctx, WithReorderTimeout(timeout))
+	connAB, connBA, streamAB, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	// A nonce far ahead of anything sent opens a gap that never fills.
+	start := time.Now()
+	out := connAB.outbound(&message.Message{
+		Type: message.MessageTypeTransport,
+		Transport: &message.TransportMessage{
+			ID:      connAB.id,
+			Nonce:   1000,
+			Message: message.SubstreamMessage{ID: streamAB.id, Type: message.SubstreamMessageData, Data: []byte("lost")},
+		},
+	})
+	if err := transportA.sendOutbound(out); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	waitFor(t, ctx, "stuck connection to close", connBA.IsClosed)
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("connection closed after %s, before the %s timeout", elapsed, timeout)
+	}
+	if got := transportB.Stats().ReorderTimeouts; got != 1 {
+		t.Fatalf("ReorderTimeouts = %d, want 1", got)
+	}
+
+	// The dialer is told, so its reads end instead of hanging.
+	streamAB.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := streamAB.Read(make([]byte, 1)); !errors.Is(err, network.ErrReset) {
+		t.Fatalf("read on the remote end: %v, want %v", err, network.ErrReset)
+	}
+}
+
+func TestReorderTimeoutSparesHealthyConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx, WithReorderTimeout(50*time.Millisecond))
+	_, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	for i := 0; i < 5; i++ {
+		if _, err := streamAB.Write([]byte("x")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := io.ReadFull(streamBA, make([]byte, 1)); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	if connBA.IsClosed() {
+		t.Fatalf("connection without a gap was closed")
+	}
+}
@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"log"
+
+	ma "github.com/multiformats/go-multiaddr"
+
+	"banyan/transports/nym/message"
+)
+
+// WithSelfAddressChanged installs fn to be called with the new listen address
+// when the Nym client re-registers with a gateway and is assigned a different
+// recipient address, so the host can advertise it. Listeners report the new
+// address from then on and connection requests carry it; established
+// connections are unaffected. Only transports created by New learn of such
+// changes. fn runs on the mixnet reader and must not block.
+func WithSelfAddressChanged(fn func(ma.Multiaddr)) Option {
+	return func(c *config) {
+		c.selfAddressChanged = fn
+	}
+}
+
+// selfAddress returns the recipient address the transport is reached at.
+func (t *Transport) selfAddress() message.Recipient {
+	t.idMu.RLock()
+	defer t.idMu.RUnlock()
+	return t.selfRecipient
+}
+
+// listenAddress returns the multiaddr of selfAddress.
+func (t *Transport) listenAddress() ma.Multiaddr {
+	t.idMu.RLock()
+	defer t.idMu.RUnlock()
+	return t.listenAddr
+}
+
+// setSelfAddress switches the transport to the recipient address self and
+// reports the change; see WithSelfAddressChanged.
+func (t *Transport) setSelfAddress(self message.Recipient) {
+	addr, err := multiaddrFromRecipient(self)
+	if err != nil {
+		log.Printf("nym transport: ignoring new self address %s: %v", self, err)
+		return
+	}
+	t.idMu.Lock()
+	if self.Equal(t.selfRecipient) {
+		t.idMu.Unlock()
+		return
+	}
+	t.selfRecipient = self
+	t.listenAddr = addr
+	t.idMu.Unlock()
+
+	if fn := t.cfg.selfAddressChanged; fn != nil {
+		fn(addr)
+	}
+}
@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"banyan/transports/nym/internal/testutil"
+	"banyan/transports/nym/message"
+)
+
+func TestSelfAddressChangeUpdatesListenAddr(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	newTransport := func(name string, opts ...Option) *Transport {
+		priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		tpt, err := New(ctx, srv.URL(name), priv, opts...)
+		if err != nil {
+			t.Fatalf("create transport %s: %v", name, err)
+		}
+		t.Cleanup(func() { tpt.Close() })
+		return tpt
+	}
+	changed := make(chan ma.Multiaddr, 1)
+	transportA := newTransport("a")
+	transportB := newTransport("b", WithSelfAddressChanged(func(addr ma.Multiaddr) {
+		changed <- addr
+	}))
+
+	listener, err := transportB.Listen(transportB.listenAddress())
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	self := message.Recipient{ClientIdentity: [32]byte{1}, ClientEncryptionKey: [32]byte{2}, Gateway: [32]byte{3}}
+	want, err := multiaddrFromRecipient(self)
+	if err != nil {
+		t.Fatalf("build multiaddr: %v", err)
+	}
+	if err := srv.Reregister("b", self); err != nil {
+		t.Fatalf("reregister: %v", err)
+	}
+
+	select {
+	case addr := <-changed:
+		if !addr.Equal(want) {
+			t.Fatalf("changed to %s, want %s", addr, want)
+		}
+	case <-ctx.Done():
+		t.Fatalf("self address change was not reported")
+	}
+	if got := listener.Multiaddr(); !got.Equal(want) {
+		t.Fatalf("listener address %s, want %s", got, want)
+	}
+
+	// Peers reach the transport at the new address.
+	if _, err := transportA.Dial(ctx, want, transportB.LocalPeer()); err != nil {
+		t.Fatalf("dial new address: %v", err)
+	}
+	if _, err := listener.Accept(); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+}
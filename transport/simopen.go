@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"bytes"
+	"log"
+	"time"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+// crossedDialLocked returns the pending dial to the peer that sent connMsg,
+// meaning both peers are dialing each other at once. The request must come
+// from the recipient we are dialing, and from the peer too if the dial named
+// one; peer IDs are not authenticated, so a request from elsewhere that
+// merely claims our target's peer ID is treated as an ordinary connection.
+//
+// Both sides then keep the connection with the lower ID, compared bytewise:
+// the side whose own request carries the higher ID answers the other's
+// request and returns that connection from its Dial, while the side whose
+// request carries the lower ID drops the other's request and completes its
+// dial as usual. Neither listener sees the connection. The yielding side also
+// closes its own connection ID at the remote: on a mixnet that reorders
+// messages, the remote may have finished its dial before the losing request
+// arrived and briefly accepted it as a separate connection.
+//
+// Anonymous dials never cross, since the remote cannot know who is dialing.
+func (t *Transport) crossedDialLocked(connMsg *message.ConnectionMessage) *dialState {
+	if connMsg.Recipient == nil {
+		return nil
+	}
+	for _, state := range t.pendingDials {
+		if state.anonymous {
+			continue
+		}
+		if !state.remoteRecipient.Equal(*connMsg.Recipient) {
+			continue
+		}
+		if state.remotePeer == "" || state.remotePeer == connMsg.PeerID {
+			return state
+		}
+	}
+	return nil
+}
+
+// winsCrossing reports whether our dial state should be kept over the
+// crossing request connMsg.
+func winsCrossing(state *dialState, connMsg *message.ConnectionMessage) bool {
+	return bytes.Compare(state.id[:], connMsg.ID[:]) < 0
+}
+
+// completeCrossedDial hands conn, created for the remote's winning request,
+// to the dial it crossed and withdraws that dial's own request.
+func (t *Transport) completeCrossedDial(state *dialState, conn *Conn) {
+	select {
+	case state.resultCh <- conn:
+	default:
+		conn.Close()
+	}
+	withdraw := mixnet.OutboundMessage{
+		Recipient: state.remoteRecipient,
+		Message: &message.Message{
+			Type: message.MessageTypeConnectionClose,
+			Connection: &message.ConnectionMessage{
+				PeerID: state.localPeer,
+				ID:     state.id,
+			},
+		},
+	}
+	// Without the withdrawal the remote keeps a half-open connection until
+	// its timeouts fire, so wait for room like the handshake does.
+	if err := t.sendOutboundBy(withdraw, time.Now().Add(t.handshakeTimeout)); err != nil {
+		log.Printf("nym transport: withdraw crossed dial %s: %v", state.id, err)
+	}
+}
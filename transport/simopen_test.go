@@ -0,0 +1,262 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	lptransport "github.com/libp2p/go-libp2p/core/transport"
+
+	"banyan/transports/nym/internal/testutil"
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+func TestSimultaneousDialSharesOneConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Hold the first connection request until both dials are pending, so
+	// each side receives the other's request while its own is in flight.
+	release := make(chan struct{})
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if msg.Message.Type == message.MessageTypeConnectionRequest {
+			<-release
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+
+	var listeners []*listener
+	for _, tpt := range []*Transport{transportA, transportB} {
+		l, err := tpt.Listen(tpt.listenAddr)
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer l.Close()
+		listeners = append(listeners, l.(*listener))
+	}
+
+	var (
+		wg           sync.WaitGroup
+		connA, connB lptransport.CapableConn
+		errA, errB   error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		connA, errA = transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	}()
+	go func() {
+		defer wg.Done()
+		connB, errB = transportB.Dial(ctx, transportA.listenAddr, transportA.localPeer)
+	}()
+	waitFor(t, ctx, "both dials to be pending", func() bool {
+		return transportA.Stats().PendingDials == 1 && transportB.Stats().PendingDials == 1
+	})
+	close(release)
+	wg.Wait()
+	if errA != nil || errB != nil {
+		t.Fatalf("dials failed: %v, %v", errA, errB)
+	}
+
+	a, b := connA.(*Conn), connB.(*Conn)
+	if a.id != b.id {
+		t.Fatalf("dialers ended up on connections %s and %s", a.id, b.id)
+	}
+	stream, err := a.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	if _, err := stream.Write([]byte("shared")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	stream.Close()
+	accepted, err := b.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	if got, err := io.ReadAll(accepted); err != nil || string(got) != "shared" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+
+	for i, tpt := range []*Transport{transportA, transportB} {
+		stats := tpt.Stats()
+		if stats.ActiveConnections != 1 || stats.PendingDials != 0 {
+			t.Fatalf("transport %d holds %d connections and %d dials, want 1 and 0", i, stats.ActiveConnections, stats.PendingDials)
+		}
+		if n := len(listeners[i].incoming); n != 0 {
+			t.Fatalf("listener %d was offered %d connections", i, n)
+		}
+	}
+}
+
+func TestForgedCrossingRequestDoesNotTakeOverDial(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	endpoints, err := testutil.PipeNetworkN(ctx, testRecipient(0x11), testRecipient(0x22), testRecipient(0x33))
+	if err != nil {
+		t.Fatalf("pipe network: %v", err)
+	}
+	a, target, attacker := endpoints[0], endpoints[1], endpoints[2]
+
+	privA, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	transportA, err := newWithMixnet(ctx, privA, a.Recipient, a.Inbound, a.Outbound)
+	if err != nil {
+		t.Fatalf("create transportA: %v", err)
+	}
+	defer transportA.Close()
+
+	privTarget, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	targetPeer, err := peer.IDFromPrivateKey(privTarget)
+	if err != nil {
+		t.Fatalf("derive peer id: %v", err)
+	}
+	raddr, err := multiaddrFromRecipient(target.Recipient)
+	if err != nil {
+		t.Fatalf("multiaddr: %v", err)
+	}
+	type dialResult struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := transportA.Dial(ctx, raddr, targetPeer)
+		c, _ := conn.(*Conn)
+		done <- dialResult{c, err}
+	}()
+
+	var req mixnet.InboundMessage
+	select {
+	case req = <-target.Inbound:
+	case <-ctx.Done():
+		t.Fatalf("connection request not received")
+	}
+
+	// The attacker claims the target's peer ID with an ID that would win
+	// the crossing, but asks for replies at its own address.
+	self := attacker.Recipient
+	attacker.Outbound <- mixnet.OutboundMessage{
+		Recipient: a.Recipient,
+		Message: &message.Message{
+			Type: message.MessageTypeConnectionRequest,
+			Connection: &message.ConnectionMessage{
+				PeerID:    targetPeer,
+				Recipient: &self,
+				ID:        message.ConnectionID{},
+			},
+		},
+	}
+	waitFor(t, ctx, "forged request handled", func() bool {
+		return transportA.Stats().ActiveConnections == 1
+	})
+	select {
+	case res := <-done:
+		t.Fatalf("forged request completed the dial: %v", res.err)
+	default:
+	}
+
+	targetSelf := target.Recipient
+	target.Outbound <- mixnet.OutboundMessage{
+		Recipient: a.Recipient,
+		Message: &message.Message{
+			Type: message.MessageTypeConnectionResponse,
+			Connection: &message.ConnectionMessage{
+				PeerID:    targetPeer,
+				Recipient: &targetSelf,
+				ID:        req.Message.Connection.ID,
+			},
+		},
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("dial: %v", res.err)
+	}
+	if !res.conn.RemoteMultiaddr().Equal(raddr) {
+		t.Fatalf("dialed connection bound to %s, want %s", res.conn.RemoteMultiaddr(), raddr)
+	}
+}
+
+func TestCrossedDialWithdrawalWaitsForQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A drives the mixnet by hand through a single-slot outbound queue.
+	inbound := make(chan mixnet.InboundMessage)
+	outbound := make(chan mixnet.OutboundMessage, 1)
+	privA, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	transportA, err := newWithMixnet(ctx, privA, testRecipient(0x11), inbound, outbound)
+	if err != nil {
+		t.Fatalf("create transportA: %v", err)
+	}
+	defer transportA.Close()
+
+	privB, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	peerB, err := peer.IDFromPrivateKey(privB)
+	if err != nil {
+		t.Fatalf("derive peer id: %v", err)
+	}
+	recipientB := testRecipient(0x22)
+	raddr, err := multiaddrFromRecipient(recipientB)
+	if err != nil {
+		t.Fatalf("multiaddr: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := transportA.Dial(ctx, raddr, peerB)
+		done <- err
+	}()
+	next := func() mixnet.OutboundMessage {
+		t.Helper()
+		select {
+		case out := <-outbound:
+			return out
+		case <-ctx.Done():
+			t.Fatalf("nothing sent")
+			return mixnet.OutboundMessage{}
+		}
+	}
+	req := next()
+
+	// Fill the queue, then cross A's dial with a request whose lower ID
+	// wins, so A answers it and withdraws its own.
+	outbound <- mixnet.OutboundMessage{Recipient: recipientB, Message: &message.Message{Type: message.MessageTypePing}}
+	inbound <- mixnet.InboundMessage{Message: &message.Message{
+		Type: message.MessageTypeConnectionRequest,
+		Connection: &message.ConnectionMessage{
+			PeerID:    peerB,
+			Recipient: &recipientB,
+			ID:        message.ConnectionID{},
+		},
+	}}
+	next()
+	if err := <-done; err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if resp := next(); resp.Message.Type != message.MessageTypeConnectionResponse {
+		t.Fatalf("sent %d, want the connection response", resp.Message.Type)
+	}
+	withdraw := next()
+	if withdraw.Message.Type != message.MessageTypeConnectionClose || withdraw.Message.Connection.ID != req.Message.Connection.ID {
+		t.Fatalf("sent %d, want the withdrawal of the dial", withdraw.Message.Type)
+	}
+}
@@ -0,0 +1,288 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+)
+
+const snapshotVersion = 1
+
+type transportSnapshot struct {
+	Version     int               `json:"version"`
+	LocalPeer   peer.ID           `json:"local_peer"`
+	Self        message.Recipient `json:"self"`
+	Connections []connSnapshot    `json:"connections"`
+}
+
+type connSnapshot struct {
+	ID              message.ConnectionID  `json:"id"`
+	RemotePeer      peer.ID               `json:"remote_peer"`
+	RemotePublicKey []byte                `json:"remote_public_key,omitempty"`
+	RemoteRecipient message.Recipient     `json:"remote_recipient"`
+	ReplyTag        *mixnet.SenderTag     `json:"reply_tag,omitempty"`
+	Anonymous       bool                  `json:"anonymous,omitempty"`
+	SendNonce       uint64                `json:"send_nonce"`
+	RecvNonce       uint64                `json:"recv_nonce"`
+	Pending         [][]byte              `json:"pending,omitempty"`
+	Streams         []message.SubstreamID `json:"streams,omitempty"`
+	// Flow control state, present when the connection negotiated it; see
+	// WithStreamWindow.
+	SendWindow    int                    `json:"send_window,omitempty"`
+	RecvWindow    int                    `json:"recv_window,omitempty"`
+	StreamWindows []streamWindowSnapshot `json:"stream_windows,omitempty"`
+	// CloseControl is set when the connection negotiated close control; see
+	// WithCloseControl.
+	CloseControl bool `json:"close_control,omitempty"`
+}
+
+type streamWindowSnapshot struct {
+	ID         message.SubstreamID `json:"id"`
+	SendCredit int64               `json:"send_credit"`
+	Unacked    int                 `json:"unacked,omitempty"`
+	Open       bool                `json:"open,omitempty"`
+}
+
+// Snapshot captures the state of all established connections so that they can
+// be resumed by RestoreTransport in a new process attached to the same Nym
+// client, e.g. across a binary upgrade.
+//
+// Taking a snapshot stops the transport: inbound processing halts so no message
+// is consumed after the state was captured, and the transport is then closed
+// locally without notifying peers. Pending dials, listeners and half-open
+// streams are not preserved, and stream data that was received but not yet
+// read by the application is lost; messages the mixnet delivers while no
+// process is attached are best-effort.
+func (t *Transport) Snapshot() ([]byte, error) {
+	t.cancel()
+	<-t.inboundDone
+
+	snap := transportSnapshot{
+		Version:   snapshotVersion,
+		LocalPeer: t.LocalPeer(),
+		Self:      t.selfAddress(),
+	}
+
+	t.mu.RLock()
+	conns := make([]*Conn, 0, len(t.connections))
+	for _, conn := range t.connections {
+		conns = append(conns, conn)
+	}
+	t.mu.RUnlock()
+
+	for _, conn := range conns {
+		cs, err := conn.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		snap.Connections = append(snap.Connections, cs)
+	}
+
+	t.Close()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, fmt.Errorf("nym transport: encode snapshot: %w", err)
+	}
+	return data, nil
+}
+
+func (c *Conn) snapshot() (connSnapshot, error) {
+	c.sendMu.Lock()
+	sendNonce := c.nonce
+	c.sendMu.Unlock()
+
+	cs := connSnapshot{
+		ID:              c.id,
+		RemotePeer:      c.RemotePeer(),
+		RemoteRecipient: c.remoteRecipient,
+		ReplyTag:        c.replyTag.Load(),
+		Anonymous:       c.anonymous,
+		SendNonce:       sendNonce,
+		RecvNonce:       c.queue.NextExpectedNonce(),
+		SendWindow:      c.sendWindow,
+		RecvWindow:      c.recvWindow,
+		CloseControl:    c.closeControl,
+	}
+	if pub := c.RemotePublicKey(); pub != nil {
+		data, err := crypto.MarshalPublicKey(pub)
+		if err != nil {
+			return connSnapshot{}, fmt.Errorf("nym transport: encode remote public key: %w", err)
+		}
+		cs.RemotePublicKey = data
+	}
+
+	for _, pending := range c.queue.PendingMessages() {
+		encoded, err := message.Encode(&message.Message{
+			Type:      message.MessageTypeTransport,
+			Transport: &pending,
+		})
+		if err != nil {
+			return connSnapshot{}, fmt.Errorf("nym transport: encode pending message: %w", err)
+		}
+		cs.Pending = append(cs.Pending, encoded)
+	}
+
+	c.streamsMu.Lock()
+	for _, stream := range c.streams {
+		cs.Streams = append(cs.Streams, stream.id)
+		if c.sendWindow > 0 {
+			cs.StreamWindows = append(cs.StreamWindows, stream.windowSnapshot())
+		}
+	}
+	c.streamsMu.Unlock()
+
+	return cs, nil
+}
+
+// RestoreTransport connects to the Nym client at uri and resumes the
+// connections captured by Snapshot. The Nym client must still own the recipient
+// address the snapshot was taken with, and privKey must be the same identity.
+// Restored connections are available through Conns.
+func RestoreTransport(ctx context.Context, uri string, privKey crypto.PrivKey, snapshot []byte, opts ...Option) (*Transport, error) {
+	ensureProtocolRegistered()
+
+	cfg := applyOptions(opts)
+	client, err := dialWebsocketClient(ctx, uri, cfg.mixnetOpts())
+	if err != nil {
+		return nil, err
+	}
+	t, err := restoreWithMixnet(ctx, privKey, client.Self(), client.Inbound(), client.Outbound(), snapshot, opts...)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	t.backend = client
+	return t, nil
+}
+
+func restoreWithMixnet(ctx context.Context, privKey crypto.PrivKey, self message.Recipient, inbound <-chan mixnet.InboundMessage, outbound chan<- mixnet.OutboundMessage, snapshot []byte, opts ...Option) (*Transport, error) {
+	var snap transportSnapshot
+	if err := json.Unmarshal(snapshot, &snap); err != nil {
+		return nil, fmt.Errorf("nym transport: decode snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("nym transport: unsupported snapshot version %d", snap.Version)
+	}
+
+	t, err := buildTransport(ctx, privKey, self, inbound, outbound, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if snap.LocalPeer != t.localPeer {
+		t.Close()
+		return nil, fmt.Errorf("nym transport: snapshot belongs to peer %s", snap.LocalPeer)
+	}
+	if !snap.Self.Equal(self) {
+		t.Close()
+		return nil, fmt.Errorf("nym transport: snapshot taken on recipient %s, mixnet reports %s", snap.Self, self)
+	}
+
+	for _, cs := range snap.Connections {
+		if err := t.restoreConn(cs); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+
+	t.start()
+	return t, nil
+}
+
+func (t *Transport) restoreConn(cs connSnapshot) error {
+	q := t.newQueue()
+	q.Resume(cs.RecvNonce)
+	for _, encoded := range cs.Pending {
+		msg, err := message.Decode(encoded)
+		if err != nil || msg.Transport == nil {
+			return fmt.Errorf("nym transport: decode pending message for %s: %v", cs.ID, err)
+		}
+		q.TryPush(*msg.Transport)
+	}
+
+	conn, err := newConn(t, cs.ID, cs.RemotePeer, cs.RemoteRecipient, q)
+	if err != nil {
+		return err
+	}
+	conn.nonce = cs.SendNonce
+	conn.anonymous = cs.Anonymous
+	conn.sendWindow, conn.recvWindow = cs.SendWindow, cs.RecvWindow
+	conn.closeControl = cs.CloseControl
+	if cs.RemotePublicKey != nil {
+		if conn.remotePubKey, err = crypto.UnmarshalPublicKey(cs.RemotePublicKey); err != nil {
+			return fmt.Errorf("nym transport: decode remote public key for %s: %w", cs.ID, err)
+		}
+	}
+	// The handshake finished before the snapshot was taken.
+	conn.markReady()
+	if cs.ReplyTag != nil {
+		conn.replyTag.Store(cs.ReplyTag)
+	}
+	windows := make(map[message.SubstreamID]streamWindowSnapshot, len(cs.StreamWindows))
+	for _, w := range cs.StreamWindows {
+		windows[w.ID] = w
+	}
+	for _, id := range cs.Streams {
+		stream := newSubstream(conn, id)
+		if w, ok := windows[id]; ok {
+			stream.restoreWindow(w)
+		} else {
+			// Without its window state the stream could wait for credit
+			// that was already granted.
+			stream.windowOpen = true
+		}
+		conn.streams[substreamKey(id)] = stream
+	}
+
+	t.mu.Lock()
+	t.connections[connKey(cs.ID)] = conn
+	t.cfg.metrics.ActiveConnections(len(t.connections))
+	t.mu.Unlock()
+	return nil
+}
+
+func (s *Substream) windowSnapshot() streamWindowSnapshot {
+	s.windowMu.Lock()
+	defer s.windowMu.Unlock()
+	return streamWindowSnapshot{
+		ID:         s.id,
+		SendCredit: s.sendCredit,
+		Unacked:    s.unacked,
+		Open:       s.windowOpen,
+	}
+}
+
+func (s *Substream) restoreWindow(w streamWindowSnapshot) {
+	s.sendCredit = w.SendCredit
+	s.unacked = w.Unacked
+	s.windowOpen = w.Open
+}
+
+// Conns returns the currently established connections, including those
+// resumed by RestoreTransport.
+func (t *Transport) Conns() []*Conn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	conns := make([]*Conn, 0, len(t.connections))
+	for _, conn := range t.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Streams returns the substreams currently open on the connection.
+func (c *Conn) Streams() []*Substream {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	streams := make([]*Substream, 0, len(c.streams))
+	for _, stream := range c.streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
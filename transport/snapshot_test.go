@@ -0,0 +1,212 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"banyan/transports/nym/internal/testutil"
+)
+
+func TestSnapshotRestoreResumesStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	privA, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	privB, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	recipientA, recipientB := testRecipient(0x11), testRecipient(0x22)
+	inA, outA, inB, outB := testutil.PipeNetwork(ctx, recipientA, recipientB)
+
+	transportA, err := newWithMixnet(ctx, privA, recipientA, inA, outA)
+	if err != nil {
+		t.Fatalf("create transportA: %v", err)
+	}
+	transportB, err := newWithMixnet(ctx, privB, recipientB, inB, outB)
+	if err != nil {
+		t.Fatalf("create transportB: %v", err)
+	}
+	defer transportB.Close()
+
+	listenerB, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listenerB.Close()
+
+	connAB, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	rawBA, err := listenerB.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	connBA := rawBA.(*Conn)
+
+	streamAB, err := connAB.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	streamBA, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	if _, err := streamAB.Write([]byte("before")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len("before"))
+	if _, err := io.ReadFull(streamBA, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	snapshot, err := transportA.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	// B keeps talking while A is being upgraded.
+	if _, err := streamBA.Write([]byte("during")); err != nil {
+		t.Fatalf("write during restart: %v", err)
+	}
+
+	restored, err := restoreWithMixnet(ctx, privA, recipientA, inA, outA, snapshot)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	defer restored.Close()
+
+	conns := restored.Conns()
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 restored connection, got %d", len(conns))
+	}
+	restoredConn := conns[0]
+	if restoredConn.RemotePeer() != transportB.localPeer {
+		t.Fatalf("restored connection has remote peer %s", restoredConn.RemotePeer())
+	}
+	if pub := restoredConn.RemotePublicKey(); pub == nil || !pub.Equals(privB.GetPublic()) {
+		t.Fatalf("restored connection lost the remote public key")
+	}
+	streams := restoredConn.Streams()
+	if len(streams) != 1 {
+		t.Fatalf("expected 1 restored stream, got %d", len(streams))
+	}
+	restoredStream := streams[0]
+
+	buf = make([]byte, len("during"))
+	if _, err := io.ReadFull(restoredStream, buf); err != nil {
+		t.Fatalf("read after restore: %v", err)
+	}
+	if string(buf) != "during" {
+		t.Fatalf("unexpected payload %q", buf)
+	}
+
+	if _, err := restoredStream.Write([]byte("after")); err != nil {
+		t.Fatalf("write after restore: %v", err)
+	}
+	buf = make([]byte, len("after"))
+	if _, err := io.ReadFull(streamBA, buf); err != nil {
+		t.Fatalf("read on remote after restore: %v", err)
+	}
+	if string(buf) != "after" {
+		t.Fatalf("unexpected payload %q", buf)
+	}
+}
+
+func TestRestoreRejectsDifferentRecipient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	inA, outA, _, _ := testutil.PipeNetwork(ctx, testRecipient(0x11), testRecipient(0x22))
+
+	tpt, err := newWithMixnet(ctx, priv, testRecipient(0x11), inA, outA)
+	if err != nil {
+		t.Fatalf("create transport: %v", err)
+	}
+	snapshot, err := tpt.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	if _, err := restoreWithMixnet(ctx, priv, testRecipient(0x33), inA, outA, snapshot); err == nil {
+		t.Fatalf("restore onto a different recipient should fail")
+	}
+}
+
+func TestSnapshotRestoreKeepsStreamWindow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const window = 2048
+	privA, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	privB, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	recipientA, recipientB := testRecipient(0x11), testRecipient(0x22)
+	inA, outA, inB, outB := testutil.PipeNetwork(ctx, recipientA, recipientB)
+
+	transportA, err := newWithMixnet(ctx, privA, recipientA, inA, outA, WithStreamWindow(window))
+	if err != nil {
+		t.Fatalf("create transportA: %v", err)
+	}
+	transportB, err := newWithMixnet(ctx, privB, recipientB, inB, outB, WithStreamWindow(window))
+	if err != nil {
+		t.Fatalf("create transportB: %v", err)
+	}
+	defer transportB.Close()
+	_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	// Spend the whole window; B has not read any of it yet.
+	if _, err := streamAB.Write(make([]byte, window)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	snapshot, err := transportA.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	restored, err := restoreWithMixnet(ctx, privA, recipientA, inA, outA, snapshot, WithStreamWindow(window))
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	defer restored.Close()
+
+	conn := restored.Conns()[0]
+	if conn.sendWindow != window || conn.recvWindow != window {
+		t.Fatalf("restored windows %d/%d, want %d", conn.sendWindow, conn.recvWindow, window)
+	}
+	stream := conn.Streams()[0]
+	stream.windowMu.Lock()
+	credit := stream.sendCredit
+	stream.windowMu.Unlock()
+	if credit != 0 {
+		t.Fatalf("restored stream has %d bytes of credit, want the 0 left", credit)
+	}
+
+	// The credit B grants as it reads reaches the restored stream.
+	if _, err := io.ReadFull(streamBA, make([]byte, window)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stream.Write(make([]byte, window)); err != nil {
+		t.Fatalf("write after restore: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+//go:build soak
+// +build soak
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Run with: go test -tags soak -race -run TestSoak ./transport -soak.duration=5m
+var soakDuration = flag.Duration("soak.duration", 30*time.Second, "how long TestSoak keeps churning connections")
+
+const (
+	soakWorkers           = 4
+	soakStreamsPerConn    = 8
+	soakPayloadSize       = 4096
+	soakGoroutineSlack    = 5
+	soakHeapGrowthAllowed = 8 << 20
+)
+
+// TestSoak churns connections and streams over the pipe network for
+// soak.duration, then checks that goroutines and heap returned to their
+// starting levels.
+func TestSoak(t *testing.T) {
+	baseGoroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *soakDuration+time.Minute)
+	transportA, transportB := newTestTransports(t, ctx)
+
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	var serverWG sync.WaitGroup
+	serverWG.Add(1)
+	go func() {
+		defer serverWG.Done()
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serverWG.Add(1)
+			go func() {
+				defer serverWG.Done()
+				soakServe(c.(*Conn))
+			}()
+		}
+	}()
+
+	var (
+		warmHeap uint64
+		warmOnce sync.Once
+		rounds   [soakWorkers]int
+		errs     = make(chan error, soakWorkers)
+		// Concurrent dials to the same peer share one connection, which
+		// would let one worker close another's; dial one at a time instead.
+		dialMu   sync.Mutex
+		deadline = time.Now().Add(*soakDuration)
+		warmAt   = time.Now().Add(*soakDuration / 10)
+	)
+	var workerWG sync.WaitGroup
+	for w := 0; w < soakWorkers; w++ {
+		workerWG.Add(1)
+		go func(w int) {
+			defer workerWG.Done()
+			for time.Now().Before(deadline) {
+				dialMu.Lock()
+				raw, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+				dialMu.Unlock()
+				if err != nil {
+					errs <- fmt.Errorf("worker %d: dial: %w", w, err)
+					return
+				}
+				if err := soakRound(ctx, raw.(*Conn)); err != nil {
+					errs <- fmt.Errorf("worker %d round %d: %w", w, rounds[w], err)
+					return
+				}
+				rounds[w]++
+				if time.Now().After(warmAt) {
+					warmOnce.Do(func() { warmHeap = heapInUse() })
+				}
+			}
+		}(w)
+	}
+	workerWG.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		cancel()
+		return
+	}
+
+	endHeap := heapInUse()
+	if endHeap > warmHeap+soakHeapGrowthAllowed {
+		t.Errorf("heap grew from %d to %d bytes during the soak", warmHeap, endHeap)
+	}
+	t.Logf("rounds per worker: %v, heap %d -> %d bytes", rounds, warmHeap, endHeap)
+
+	listener.Close()
+	transportA.Close()
+	transportB.Close()
+	cancel()
+	serverWG.Wait()
+
+	var leaked int
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		if leaked = runtime.NumGoroutine() - baseGoroutines; leaked <= soakGoroutineSlack {
+			return
+		}
+	}
+	buf := make([]byte, 1<<20)
+	t.Fatalf("%d goroutines leaked:\n%s", leaked, buf[:runtime.Stack(buf, true)])
+}
+
+// soakRound opens soakStreamsPerConn streams on conn in parallel, checks that
+// each echoes a random payload, and closes the connection.
+func soakRound(ctx context.Context, conn *Conn) error {
+	defer conn.Close()
+
+	errs := make(chan error, soakStreamsPerConn)
+	for i := 0; i < soakStreamsPerConn; i++ {
+		go func() {
+			errs <- soakStream(ctx, conn)
+		}()
+	}
+	var first error
+	for i := 0; i < soakStreamsPerConn; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func soakStream(ctx context.Context, conn *Conn) error {
+	stream, err := conn.OpenStream(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	defer stream.Close()
+
+	payload := make([]byte, soakPayloadSize)
+	rand.Read(payload)
+	if _, err := stream.Write(payload); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return fmt.Errorf("close write: %w", err)
+	}
+	echo, err := io.ReadAll(stream)
+	if err != nil {
+		return fmt.Errorf("read echo: %w", err)
+	}
+	if !bytes.Equal(echo, payload) {
+		return fmt.Errorf("echo mismatch: got %d bytes, want %d", len(echo), len(payload))
+	}
+	return nil
+}
+
+// soakServe echoes soakStreamsPerConn streams and then closes conn, so
+// neither end relies on the other to tear the connection down.
+func soakServe(conn *Conn) {
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < soakStreamsPerConn; i++ {
+		stream, err := conn.AcceptStream()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func(s network.MuxedStream) {
+			defer wg.Done()
+			defer s.Close()
+			io.Copy(s, s)
+		}(stream)
+	}
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"banyan/transports/nym/message"
+)
+
+// Stats is a point-in-time view of transport state.
+type Stats struct {
+	// ActiveConnections, ActiveListeners and PendingDials count what the
+	// transport currently holds open or is waiting on.
+	ActiveConnections int
+	ActiveListeners   int
+	PendingDials      int
+	// MessagesSent and MessagesReceived count mixnet messages of any kind
+	// since the transport was created.
+	MessagesSent     uint64
+	MessagesReceived uint64
+	// OutboundQueueDepth is the number of messages waiting to be written to
+	// the mixnet.
+	OutboundQueueDepth int
+	// OutboundQueueCapacity is the size of the mixnet outbound queue; senders
+	// block once OutboundQueueDepth reaches it.
+	OutboundQueueCapacity int
+	// BufferedBytes is the payload held across all connections in reorder
+	// queues and unread substream data; see WithMaxBufferedBytes.
+	BufferedBytes int64
+	// HandshakeFailures counts failed dial handshakes by reason since the
+	// transport was created. Reasons that never occurred are omitted.
+	HandshakeFailures map[HandshakeFailureReason]uint64
+	// RateLimitedRequests counts connection requests and pings dropped by
+	// WithResponseRateLimit.
+	RateLimitedRequests uint64
+	// ReorderEvictions counts messages discarded by full reorder queues
+	// since the transport was created; see WithReorderQueueLimit.
+	ReorderEvictions uint64
+	// DuplicateMessages counts transport messages received again after an
+	// earlier copy, as happens when the mixnet retransmits, since the
+	// transport was created. Duplicates are discarded.
+	DuplicateMessages uint64
+	// ReorderTimeouts counts connections closed because a missing nonce
+	// never arrived; see WithReorderTimeout.
+	ReorderTimeouts uint64
+	// KeepaliveTimeouts counts connections closed because their remote
+	// stopped answering keepalive pings; see WithKeepalive.
+	KeepaliveTimeouts uint64
+	// MixnetDrops counts received messages the Nym client connection
+	// discarded for lack of buffer space, whether before its handshake or
+	// with WithDropOnFull. It is only tracked for transports created by New.
+	MixnetDrops uint64
+	// IdleTimeouts counts connections closed for being idle; see
+	// WithIdleTimeout.
+	IdleTimeouts uint64
+}
+
+// Stats returns current transport statistics.
+func (t *Transport) Stats() Stats {
+	stats := Stats{
+		OutboundQueueDepth:    len(t.mixnetOutbound),
+		OutboundQueueCapacity: cap(t.mixnetOutbound),
+		BufferedBytes:         t.bufferedBytes.Load(),
+		HandshakeFailures:     make(map[HandshakeFailureReason]uint64),
+		RateLimitedRequests:   t.rateLimitedRequests.Load(),
+		ReorderEvictions:      t.reorderEvictions.Load(),
+		DuplicateMessages:     t.duplicateMessages.Load(),
+		ReorderTimeouts:       t.reorderTimeouts.Load(),
+		KeepaliveTimeouts:     t.keepaliveTimeouts.Load(),
+		IdleTimeouts:          t.idleTimeouts.Load(),
+		MessagesSent:          t.messagesSent.Load(),
+		MessagesReceived:      t.messagesReceived.Load(),
+	}
+	if c, ok := t.backend.(*websocketClient); ok {
+		stats.MixnetDrops = c.drops.Load()
+	}
+	t.mu.RLock()
+	stats.ActiveConnections = len(t.connections)
+	stats.ActiveListeners = len(t.listeners)
+	stats.PendingDials = len(t.pendingDials)
+	for _, conn := range t.connections {
+		stats.ReorderEvictions += conn.queue.Evictions()
+		stats.DuplicateMessages += conn.queue.DuplicatesSeen()
+	}
+	t.mu.RUnlock()
+	for reason := range t.handshakeFailures {
+		if n := t.handshakeFailures[reason].Load(); n > 0 {
+			stats.HandshakeFailures[HandshakeFailureReason(reason)] = n
+		}
+	}
+	return stats
+}
+
+// ConnStats is a point-in-time view of one connection; see Conn.Stats.
+type ConnStats struct {
+	// BytesRead and BytesWritten count stream payload read by the
+	// application and handed to the mixnet, over all streams ever opened.
+	BytesRead    uint64
+	BytesWritten uint64
+	// ReorderQueueDepth is the number of received messages held back
+	// behind a missing nonce.
+	ReorderQueueDepth int
+	// Streams is the number of open substreams.
+	Streams int
+}
+
+// Stats returns current connection statistics.
+func (c *Conn) Stats() ConnStats {
+	c.streamsMu.Lock()
+	streams := len(c.streams)
+	c.streamsMu.Unlock()
+	return ConnStats{
+		BytesRead:         c.bytesRead.Load(),
+		BytesWritten:      c.bytesWritten.Load(),
+		ReorderQueueDepth: c.queue.Len(),
+		Streams:           streams,
+	}
+}
+
+// StreamStat describes one open substream; see Conn.StreamStats.
+type StreamStat struct {
+	ID message.SubstreamID
+	// BufferedBytes is data received on the stream but not yet read.
+	BufferedBytes int
+	// BytesRead and BytesWritten count payload read and written so far.
+	BytesRead    uint64
+	BytesWritten uint64
+	// Idle is the time since data was last read, written or received.
+	Idle time.Duration
+	// WriteClosed and RemoteClosed report each direction's half-close.
+	WriteClosed  bool
+	RemoteClosed bool
+}
+
+// StreamStats returns the connection's open substreams, longest idle first.
+func (c *Conn) StreamStats() []StreamStat {
+	now := time.Now()
+	c.streamsMu.Lock()
+	stats := make([]StreamStat, 0, len(c.streams))
+	for _, s := range c.streams {
+		s.bufMu.Lock()
+		buffered := s.buffered
+		s.bufMu.Unlock()
+		stats = append(stats, StreamStat{
+			ID:            s.id,
+			BufferedBytes: buffered,
+			BytesRead:     s.bytesRead.Load(),
+			BytesWritten:  s.bytesWritten.Load(),
+			Idle:          now.Sub(time.Unix(0, s.lastActive.Load())),
+			WriteClosed:   s.writeClosed.Load(),
+			RemoteClosed:  s.remoteClosed.Load(),
+		})
+	}
+	c.streamsMu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Idle > stats[j].Idle })
+	return stats
+}
+
+// ResetStream resets the substream id, discarding its unread data, without
+// affecting the rest of the connection.
+func (c *Conn) ResetStream(id message.SubstreamID) error {
+	c.streamsMu.Lock()
+	s, ok := c.streams[substreamKey(id)]
+	c.streamsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("nym transport: no open substream %s", id)
+	}
+	return s.Reset()
+}
@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"banyan/transports/nym/internal/testutil"
+	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
+	"banyan/transports/nym/queue"
+)
+
+func TestStatsReportsOutboundQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	inbound := make(chan mixnet.InboundMessage)
+	outbound := make(chan mixnet.OutboundMessage, 5)
+	tpt, err := newWithMixnet(ctx, priv, testRecipient(0x11), inbound, outbound)
+	if err != nil {
+		t.Fatalf("create transport: %v", err)
+	}
+	defer tpt.Close()
+
+	for i := 0; i < 3; i++ {
+		outbound <- mixnet.OutboundMessage{}
+	}
+
+	stats := tpt.Stats()
+	if stats.OutboundQueueDepth != 3 {
+		t.Fatalf("OutboundQueueDepth = %d, want 3", stats.OutboundQueueDepth)
+	}
+	if stats.OutboundQueueCapacity != 5 {
+		t.Fatalf("OutboundQueueCapacity = %d, want 5", stats.OutboundQueueCapacity)
+	}
+}
+
+func TestWithOutboundBufferSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tpt, err := New(ctx, srv.URL("a"), priv, WithOutboundBufferSize(7))
+	if err != nil {
+		t.Fatalf("create transport: %v", err)
+	}
+	defer tpt.Close()
+
+	if got := tpt.Stats().OutboundQueueCapacity; got != 7 {
+		t.Fatalf("OutboundQueueCapacity = %d, want 7", got)
+	}
+}
+
+func TestResetStuckStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, connBA, stuckAB, stuckBA := openTestStreams(t, ctx, transportA, transportB)
+
+	// Nobody reads the stuck stream, so its data stays buffered.
+	if _, err := stuckAB.Write([]byte("stuck")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var stat StreamStat
+	deadline := time.Now().Add(2 * time.Second)
+	for stat.BufferedBytes != len("stuck") {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream stats never showed buffered data: %+v", connBA.StreamStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+		for _, s := range connBA.StreamStats() {
+			if s.ID == stuckBA.ID() {
+				stat = s
+			}
+		}
+	}
+
+	rawAB, err := connAB.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open second stream: %v", err)
+	}
+	liveBA, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept second stream: %v", err)
+	}
+
+	if err := connBA.ResetStream(stuckBA.ID()); err != nil {
+		t.Fatalf("ResetStream: %v", err)
+	}
+	if err := connBA.ResetStream(stuckBA.ID()); err == nil {
+		t.Fatalf("second ResetStream of the same stream succeeded")
+	}
+	for _, s := range connBA.StreamStats() {
+		if s.ID == stuckBA.ID() {
+			t.Fatalf("reset stream still listed: %+v", s)
+		}
+	}
+	if _, err := stuckAB.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("remote end of reset stream read %v, want EOF", err)
+	}
+
+	// The rest of the connection is unaffected.
+	if _, err := rawAB.Write([]byte("live")); err != nil {
+		t.Fatalf("write on live stream: %v", err)
+	}
+	buf := make([]byte, len("live"))
+	if _, err := io.ReadFull(liveBA, buf); err != nil || string(buf) != "live" {
+		t.Fatalf("read on live stream: %q %v", buf, err)
+	}
+}
+
+func TestStatsCountReorderEvictions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx, WithReorderQueueLimit(2, queue.OverflowEvictHighest))
+	connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	// Nonces far past anything sent, so they wait behind a gap that never
+	// fills.
+	for _, nonce := range []uint64{1000, 1002, 1001} {
+		out := connAB.outbound(&message.Message{
+			Type: message.MessageTypeTransport,
+			Transport: &message.TransportMessage{
+				ID:      connAB.id,
+				Nonce:   nonce,
+				Message: message.SubstreamMessage{Type: message.SubstreamMessageData, Data: []byte{1}},
+			},
+		})
+		if err := transportA.sendOutbound(out); err != nil {
+			t.Fatalf("send nonce %d: %v", nonce, err)
+		}
+	}
+	// The listener handles inbound messages in order, so the pong proves
+	// the transport messages were processed.
+	if _, err := transportA.Ping(ctx, transportB.selfRecipient); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if got := connBA.queue.PendingNonces(); len(got) != 2 || got[0] != 1000 || got[1] != 1001 {
+		t.Fatalf("pending nonces = %v, want [1000 1001]", got)
+	}
+	if got := transportB.Stats().ReorderEvictions; got != 1 {
+		t.Fatalf("ReorderEvictions = %d, want 1", got)
+	}
+	connBA.Close()
+	if got := transportB.Stats().ReorderEvictions; got != 1 {
+		t.Fatalf("ReorderEvictions after close = %d, want 1", got)
+	}
+}
+
+func TestStatsCountDuplicateMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	// Replay the open request, as a mixnet retransmission would.
+	replay := connAB.outbound(&message.Message{
+		Type: message.MessageTypeTransport,
+		Transport: &message.TransportMessage{
+			ID:      connAB.id,
+			Nonce:   1,
+			Message: message.SubstreamMessage{Type: message.SubstreamMessageOpenRequest},
+		},
+	})
+	for i := 0; i < 2; i++ {
+		if err := transportA.sendOutbound(replay); err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+	}
+	if _, err := transportA.Ping(ctx, transportB.selfRecipient); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if got := transportB.Stats().DuplicateMessages; got != 2 {
+		t.Fatalf("DuplicateMessages = %d, want 2", got)
+	}
+	if n := len(connBA.Streams()); n != 1 {
+		t.Fatalf("replayed open request created %d streams", n)
+	}
+	connBA.Close()
+	if got := transportB.Stats().DuplicateMessages; got != 2 {
+		t.Fatalf("DuplicateMessages after close = %d, want 2", got)
+	}
+}
+
+func TestStatsCountStreamBytes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	payload := make([]byte, 5000)
+	rand.Read(payload)
+	if _, err := streamAB.Write(payload); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(streamBA, make([]byte, len(payload))); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if got := connAB.Stats(); got.BytesWritten != 5000 || got.BytesRead != 0 || got.Streams != 1 {
+		t.Fatalf("dialer stats = %+v, want 5000 bytes written on 1 stream", got)
+	}
+	if got := connBA.Stats(); got.BytesRead != 5000 || got.BytesWritten != 0 || got.ReorderQueueDepth != 0 {
+		t.Fatalf("listener stats = %+v, want 5000 bytes read and an empty queue", got)
+	}
+	if got := connBA.StreamStats(); len(got) != 1 || got[0].BytesRead != 5000 {
+		t.Fatalf("listener stream stats = %+v, want 5000 bytes read", got)
+	}
+
+	stats := transportB.Stats()
+	if stats.ActiveConnections != 1 || stats.ActiveListeners != 1 || stats.PendingDials != 0 {
+		t.Fatalf("listener holds %d connections, %d listeners and %d dials, want 1, 1 and 0",
+			stats.ActiveConnections, stats.ActiveListeners, stats.PendingDials)
+	}
+	// The request, the stream open and five fragments arrived; the response
+	// and the open response went back.
+	if stats.MessagesReceived < 7 || stats.MessagesSent < 2 {
+		t.Fatalf("listener sent %d and received %d messages", stats.MessagesSent, stats.MessagesReceived)
+	}
+	if sent := transportA.Stats().MessagesSent; sent < 7 {
+		t.Fatalf("dialer sent %d messages, want at least 7", sent)
+	}
+}
@@ -1,8 +1,10 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"io"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,69 +22,303 @@ type Substream struct {
 	buffer  []byte
 
 	localClosed  atomic.Bool
+	writeClosed  atomic.Bool
+	readClosed   atomic.Bool
 	remoteClosed atomic.Bool
+	// reset is set when the stream ended abnormally, by Reset or by its
+	// connection closing; Read then fails with network.ErrReset instead of
+	// returning io.EOF.
+	reset atomic.Bool
 
-	channelOnce sync.Once
+	// Received data is passed to the reader through inbound while it stays
+	// within the stream's read buffer; the rest waits in held, so that
+	// delivery never blocks the connection. inboundBytes and heldBytes count
+	// the data in each. A remote close is deferred until held drains.
+	holdMu         sync.Mutex
+	held           [][]byte
+	heldBytes      int
+	inboundBytes   int
+	inboundClosed  bool
+	remoteCloseSet bool
+
+	// Unread bytes charged to the connection; see WithMaxBufferedBytes.
+	bufMu       sync.Mutex
+	buffered    int
+	bufReleased bool
+
+	// lastActive is when data was last read, written or received, in Unix
+	// nanoseconds; see Conn.StreamStats.
+	lastActive atomic.Int64
+	// Payload bytes read and written; see StreamStat.
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
 
 	readDeadline  atomic.Pointer[time.Time]
 	writeDeadline atomic.Pointer[time.Time]
+	// readDeadlineSet wakes a blocked Read to pick up a new read deadline.
+	readDeadlineSet chan struct{}
+
+	// linger is the time.Duration Close waits for the close ack; see SetLinger.
+	linger atomic.Int64
+
+	// Send credit and unacknowledged reads; see WithStreamWindow. windowOpen
+	// lifts the limit once the remote stops reading, and windowGrant wakes a
+	// writer waiting for credit.
+	windowMu    sync.Mutex
+	sendCredit  int64
+	unacked     int
+	windowOpen  bool
+	windowGrant chan struct{}
+
+	// scope is nil without a resource manager; see WithResourceManager.
+	scope *streamScope
 }
 
 func newSubstream(conn *Conn, id message.SubstreamID) *Substream {
-	return &Substream{
+	s := &Substream{
 		conn:    conn,
 		id:      id,
-		inbound: make(chan []byte, 32),
+		inbound: make(chan []byte, conn.transport.cfg.StreamReadChunks),
+
+		readDeadlineSet: make(chan struct{}, 1),
 	}
+	s.initWindow()
+	s.touch()
+	return s
+}
+
+// ID returns the substream identifier shared by both ends.
+func (s *Substream) ID() message.SubstreamID {
+	return s.id
 }
 
 func (s *Substream) Read(p []byte) (int, error) {
+	if s.readClosed.Load() {
+		return 0, errors.New("substream closed for reading")
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
 
-	if len(s.buffer) == 0 {
-		data, ok := <-s.inbound
+	// Empty chunks carry no data; keep waiting so Read never returns (0, nil).
+	for len(s.buffer) == 0 {
+		data, ok, err := s.nextChunk()
+		if err != nil {
+			return 0, err
+		}
 		if !ok {
+			if s.reset.Load() {
+				return 0, network.ErrReset
+			}
 			return 0, io.EOF
 		}
-		if len(data) == 0 {
-			return 0, nil
-		}
 		s.buffer = append(s.buffer, data...)
+		s.releaseInbound(len(data))
 	}
 
 	n := copy(p, s.buffer)
 	s.buffer = s.buffer[n:]
+	s.releaseBuffered(n)
+	s.touch()
+	s.bytesRead.Add(uint64(n))
+	s.conn.bytesRead.Add(uint64(n))
+	s.consumed(n)
 	return n, nil
 }
 
 func (s *Substream) Write(p []byte) (int, error) {
-	if s.localClosed.Load() {
-		return 0, errors.New("substream closed")
+	if s.localClosed.Load() || s.writeClosed.Load() {
+		return 0, errStreamClosed
+	}
+	// Zero-length writes are not sent: an empty data message means nothing
+	// to the remote reader.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Each fragment takes its own nonce, so the remote's reorder queue
+	// reassembles them in order.
+	limit := s.conn.MaxPayloadSize()
+	written := 0
+	for written < len(p) {
+		deadline := s.writeDeadlineTime()
+		n, err := s.acquireCredit(min(len(p)-written, limit), deadline)
+		if err != nil {
+			return written, err
+		}
+		buf := make([]byte, n)
+		copy(buf, p[written:written+n])
+		if err := s.conn.sendData(s.id, buf, deadline); err != nil {
+			s.refundCredit(n)
+			return written, err
+		}
+		written += n
+		s.countWritten(n)
+	}
+	return written, nil
+}
+
+// ReadFrom copies r into the stream until EOF, reading each fragment straight
+// into the buffer that is sent, so io.Copy avoids the intermediate buffer and
+// copy of Write. Each Read of r becomes one message; like Write, it blocks
+// while the mixnet outbound queue is full or the stream's send window is
+// spent.
+func (s *Substream) ReadFrom(r io.Reader) (int64, error) {
+	if s.localClosed.Load() || s.writeClosed.Load() {
+		return 0, errStreamClosed
 	}
-	buf := make([]byte, len(p))
-	copy(buf, p)
-	if err := s.conn.sendData(s.id, buf); err != nil {
-		return 0, err
+	limit := s.conn.MaxPayloadSize()
+	var total int64
+	var buf []byte
+	for {
+		deadline := s.writeDeadlineTime()
+		credit, err := s.acquireCredit(limit, deadline)
+		if err != nil {
+			return total, err
+		}
+		if buf == nil {
+			buf = make([]byte, limit)
+		}
+		n, err := r.Read(buf[:credit])
+		s.refundCredit(credit - n)
+		if n > 0 {
+			if sendErr := s.conn.sendData(s.id, buf[:n], deadline); sendErr != nil {
+				s.refundCredit(n)
+				return total, sendErr
+			}
+			// The queued message owns buf now.
+			buf = nil
+			total += int64(n)
+			s.countWritten(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
 	}
-	return len(p), nil
 }
 
+// countWritten records n bytes handed to the mixnet.
+func (s *Substream) countWritten(n int) {
+	s.touch()
+	s.bytesWritten.Add(uint64(n))
+	s.conn.bytesWritten.Add(uint64(n))
+}
+
+// Close closes the stream in both directions. With a linger set, it first
+// waits for the remote to acknowledge the data written so far; see SetLinger.
 func (s *Substream) Close() error {
-	return s.closeWithControl(true)
+	if d := time.Duration(s.linger.Load()); d > 0 && !s.localClosed.Load() && !s.writeClosed.Load() {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+		err := s.CloseWait(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return os.ErrDeadlineExceeded
+		}
+		return err
+	}
+	return s.closeWithControl()
+}
+
+// SetLinger makes Close block for up to d until the remote acknowledges
+// everything written before it, like CloseWait. If the ack does not arrive in
+// time Close returns os.ErrDeadlineExceeded; the stream is closed either way
+// and data still in flight may be lost. Zero or a negative d, the default,
+// makes Close return immediately, as it does on connections without close
+// control.
+func (s *Substream) SetLinger(d time.Duration) {
+	s.linger.Store(int64(d))
+}
+
+// CloseWait closes the stream like Close and then waits until the remote
+// acknowledges the close, which it does only after receiving everything
+// written before it. It fails if the close was already sent. On connections
+// without close control the remote sends no ack, so CloseWait returns once
+// the close is sent; see WithCloseControl.
+func (s *Substream) CloseWait(ctx context.Context) error {
+	if s.localClosed.Load() || s.writeClosed.Load() {
+		return errors.New("substream: close already sent")
+	}
+
+	c := s.conn
+	if !c.closeControl {
+		return s.closeWithControl()
+	}
+	key := substreamKey(s.id)
+	ack := make(chan struct{})
+	// Register before sending so that a fast ack cannot be missed.
+	c.streamsMu.Lock()
+	c.closeWaiters[key] = ack
+	c.streamsMu.Unlock()
+	defer func() {
+		c.streamsMu.Lock()
+		if c.closeWaiters[key] == ack {
+			delete(c.closeWaiters, key)
+		}
+		c.streamsMu.Unlock()
+	}()
+
+	if err := s.closeWithControl(); err != nil {
+		return err
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closeCh:
+		return network.ErrReset
+	}
 }
 
+// CloseWrite half-closes the stream: the remote reader sees EOF after the data
+// written so far, while reads here and writes there keep working until the
+// remote closes its side. On connections without close control the remote is
+// sent a full close instead, which it may treat as the end of the stream; see
+// WithCloseControl.
 func (s *Substream) CloseWrite() error {
-	return s.closeWithControl(true)
+	if s.localClosed.Load() || s.writeClosed.Swap(true) {
+		return nil
+	}
+	s.wakeWriter()
+	typ := message.SubstreamMessageClose
+	if s.conn.closeControl {
+		typ = message.SubstreamMessageCloseWrite
+	}
+	if err := s.conn.sendControl(s.id, typ); err != nil {
+		return err
+	}
+	if s.remoteClosed.Load() || s.readClosed.Load() {
+		s.conn.removeStream(s.id)
+	}
+	return nil
 }
 
+// CloseRead stops reading: data received so far and from now on is discarded
+// and Read fails, while writes keep working. The remote is not told and may
+// keep sending until it closes its side.
 func (s *Substream) CloseRead() error {
-	return s.closeWithControl(false)
+	if s.localClosed.Load() || s.readClosed.Swap(true) {
+		return nil
+	}
+	s.holdMu.Lock()
+	s.held, s.heldBytes = nil, 0
+	s.closeInboundLocked()
+	s.holdMu.Unlock()
+	// The remote may keep writing; the discarded data frees its window.
+	s.consumed(s.releaseAllBuffered())
+	if s.writeClosed.Load() {
+		s.conn.removeStream(s.id)
+	}
+	return nil
 }
 
+// Reset closes the stream in both directions, failing further reads with
+// network.ErrReset. The remote cannot tell a reset from Close.
 func (s *Substream) Reset() error {
-	return s.closeWithControl(true)
+	s.reset.Store(true)
+	return s.closeWithControl()
 }
 
 func (s *Substream) ResetWithError(errCode network.StreamErrorCode) error {
@@ -90,59 +326,204 @@ func (s *Substream) ResetWithError(errCode network.StreamErrorCode) error {
 	return s.Reset()
 }
 
-func (s *Substream) SetDeadline(time.Time) error {
-	return nil
+// SetDeadline sets both the read and write deadlines.
+func (s *Substream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
 }
 
-func (s *Substream) SetReadDeadline(time.Time) error {
+// SetReadDeadline makes Read fail with os.ErrDeadlineExceeded once t passes
+// and no data is available. Data already received is still returned. The zero
+// time clears the deadline. A Read already blocked follows the new deadline.
+func (s *Substream) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		s.readDeadline.Store(nil)
+	} else {
+		s.readDeadline.Store(&t)
+	}
+	select {
+	case s.readDeadlineSet <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
-func (s *Substream) SetWriteDeadline(time.Time) error {
+// SetWriteDeadline makes Write fail with os.ErrDeadlineExceeded once t passes
+// while it is waiting for room on the mixnet outbound queue or for send
+// credit. Fragments queued before then count as written. The zero time clears
+// the deadline. A Write already waiting for credit follows the new deadline.
+func (s *Substream) SetWriteDeadline(t time.Time) error {
+	if t.IsZero() {
+		s.writeDeadline.Store(nil)
+	} else {
+		s.writeDeadline.Store(&t)
+	}
+	s.wakeWriter()
 	return nil
 }
 
-func (s *Substream) closeWithControl(sendControl bool) error {
+func (s *Substream) writeDeadlineTime() time.Time {
+	if d := s.writeDeadline.Load(); d != nil {
+		return *d
+	}
+	return time.Time{}
+}
+
+// nextChunk receives the next chunk for Read. Queued data is taken without
+// consulting the read deadline; only an empty queue waits for it.
+func (s *Substream) nextChunk() ([]byte, bool, error) {
+	select {
+	case data, ok := <-s.inbound:
+		return data, ok, nil
+	default:
+	}
+
+	for {
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if d := s.readDeadline.Load(); d != nil {
+			wait := time.Until(*d)
+			if wait <= 0 {
+				return nil, false, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case data, ok := <-s.inbound:
+			stopTimer(timer)
+			return data, ok, nil
+		case <-expired:
+			return nil, false, os.ErrDeadlineExceeded
+		case <-s.readDeadlineSet:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// closeWithControl closes the stream in both directions, telling the remote
+// unless CloseWrite already did.
+func (s *Substream) closeWithControl() error {
 	if s.localClosed.Swap(true) {
 		return nil
 	}
-	if sendControl {
+	s.wakeWriter()
+	if s.writeClosed.Swap(true) && (s.remoteClosed.Load() || !s.conn.closeControl) {
+		// Both directions already ended with CloseWrite, or CloseWrite
+		// already sent a full close.
+		s.conn.removeStream(s.id)
+	} else {
 		s.conn.closeLocalStream(s)
 	}
 	s.remoteClosed.Store(true)
-	s.channelOnce.Do(func() {
-		close(s.inbound)
-	})
+	s.holdMu.Lock()
+	s.held, s.heldBytes = nil, 0
+	s.closeInboundLocked()
+	s.holdMu.Unlock()
+	s.releaseAllBuffered()
 	return nil
 }
 
-func (s *Substream) pushData(data []byte) {
+// maxHeldBuffers is how many read buffers' worth of data a stream holds back
+// for a stalled reader before it is reset.
+const maxHeldBuffers = 8
+
+// heldOverflows reports whether holding n more bytes would put the stream past
+// maxHeldBuffers read buffers of held data.
+func (s *Substream) heldOverflows(n int) bool {
+	s.holdMu.Lock()
+	defer s.holdMu.Unlock()
+	return len(s.held) > 0 && s.heldBytes+n > maxHeldBuffers*s.conn.transport.cfg.StreamReadBuffer
+}
+
+// pushData queues data for the reader and reports whether it was queued. It
+// never waits for the reader.
+func (s *Substream) pushData(data []byte) (queued bool) {
 	if s.remoteClosed.Load() || s.localClosed.Load() {
-		return
+		return false
 	}
 
 	buf := make([]byte, len(data))
 	copy(buf, data)
 
-	defer func() {
-		if r := recover(); r != nil {
-			// channel closed concurrently; ignore
+	s.holdMu.Lock()
+	defer s.holdMu.Unlock()
+	if s.inboundClosed {
+		return false
+	}
+	s.held = append(s.held, buf)
+	s.heldBytes += len(buf)
+	s.flushHeldLocked()
+	s.touch()
+	return true
+}
+
+// releaseInbound accounts n bytes taken from inbound by the reader, making
+// room for held data.
+func (s *Substream) releaseInbound(n int) {
+	s.holdMu.Lock()
+	defer s.holdMu.Unlock()
+	s.inboundBytes -= n
+	s.flushHeldLocked()
+}
+
+// flushHeldLocked moves held data into inbound while it fits the read buffer.
+// A chunk always fits an empty buffer, however large.
+func (s *Substream) flushHeldLocked() {
+	limit := s.conn.transport.cfg.StreamReadBuffer
+	for len(s.held) > 0 && !s.inboundClosed {
+		next := s.held[0]
+		if s.inboundBytes > 0 && s.inboundBytes+len(next) > limit {
+			return
 		}
-	}()
+		select {
+		case s.inbound <- next:
+		default:
+			return
+		}
+		s.inboundBytes += len(next)
+		s.heldBytes -= len(next)
+		s.held[0] = nil
+		s.held = s.held[1:]
+	}
+	if len(s.held) == 0 && s.remoteCloseSet {
+		s.closeInboundLocked()
+	}
+}
 
-	select {
-	case <-s.conn.closeCh:
-	case s.inbound <- buf:
+func (s *Substream) closeInboundLocked() {
+	if !s.inboundClosed {
+		s.inboundClosed = true
+		close(s.inbound)
 	}
 }
 
+func (s *Substream) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// connReset ends the stream because its connection went away. Data already
+// received is still read before network.ErrReset.
+func (s *Substream) connReset() {
+	s.reset.Store(true)
+	s.remoteClose()
+}
+
 func (s *Substream) remoteClose() {
 	if s.remoteClosed.Swap(true) {
 		return
 	}
-	s.channelOnce.Do(func() {
-		close(s.inbound)
-	})
+	// The reader sees EOF only after the data held back for it.
+	s.holdMu.Lock()
+	s.remoteCloseSet = true
+	s.flushHeldLocked()
+	s.holdMu.Unlock()
 }
 
 var _ network.MuxedStream = (*Substream)(nil)
@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"banyan/transports/nym/message"
+)
+
+// TraceDirection tells whether a traced message was sent or received.
+type TraceDirection int
+
+const (
+	TraceOutbound TraceDirection = iota
+	TraceInbound
+)
+
+func (d TraceDirection) String() string {
+	if d == TraceInbound {
+		return "recv"
+	}
+	return "send"
+}
+
+// TraceEvent describes a single message crossing the mixnet boundary.
+type TraceEvent struct {
+	Direction TraceDirection
+	Message   *message.Message
+	// Encoded is Message in the wire layout this transport sends, as set by
+	// WithWireVersion and WithChecksum. A received message may have arrived
+	// in another layout the mixnet client accepts.
+	Encoded []byte
+}
+
+// TraceFunc receives every message sent or received by the transport. It runs
+// on the send or dispatch path, so it should not block.
+type TraceFunc func(TraceEvent)
+
+// WithMessageTrace installs fn to observe every encoded message, which is
+// mainly useful when debugging interop with other implementations. Tracing is
+// skipped entirely when no function is installed.
+func WithMessageTrace(fn TraceFunc) Option {
+	return func(c *config) {
+		c.trace = fn
+	}
+}
+
+// LogTrace returns a TraceFunc that writes a summary line and a hexdump of the
+// encoded message for every event through logf, e.g. log.Printf.
+func LogTrace(logf func(format string, args ...any)) TraceFunc {
+	return func(ev TraceEvent) {
+		logf("nym transport: %s\n%s", ev, strings.TrimRight(hex.Dump(ev.Encoded), "\n"))
+	}
+}
+
+// String summarises the event without the payload.
+func (ev TraceEvent) String() string {
+	msg := ev.Message
+	switch {
+	case msg == nil:
+		return fmt.Sprintf("%s <nil>", ev.Direction)
+	case msg.Connection != nil:
+		return fmt.Sprintf("%s type=%d conn=%s len=%d", ev.Direction, msg.Type, msg.Connection.ID, len(ev.Encoded))
+	case msg.Transport != nil:
+		tm := msg.Transport
+		return fmt.Sprintf("%s type=%d conn=%s nonce=%d substream=%s op=%d len=%d",
+			ev.Direction, msg.Type, tm.ID, tm.Nonce, tm.Message.ID, tm.Message.Type, len(ev.Encoded))
+	default:
+		return fmt.Sprintf("%s type=%d len=%d", ev.Direction, msg.Type, len(ev.Encoded))
+	}
+}
+
+// traceMessage reports msg to the configured trace function, if any.
+func (t *Transport) traceMessage(dir TraceDirection, msg *message.Message) {
+	if t.cfg.trace == nil {
+		return
+	}
+	var (
+		encoded []byte
+		err     error
+	)
+	if t.cfg.checksum {
+		encoded, err = message.AppendEncodeChecksum(nil, msg, t.cfg.wireVersion)
+	} else {
+		encoded, err = message.AppendEncodeVersion(nil, msg, t.cfg.wireVersion)
+	}
+	if err != nil {
+		encoded = nil
+	}
+	t.cfg.trace(TraceEvent{Direction: dir, Message: msg, Encoded: encoded})
+}
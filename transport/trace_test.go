@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"banyan/transports/nym/message"
+)
+
+func TestMessageTraceReceivesMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		events []TraceEvent
+	)
+	trace := func(ev TraceEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}
+	transportA, transportB := newTestTransports(t, ctx, WithMessageTrace(trace))
+	_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if _, err := streamAB.Write([]byte("traced")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len("traced"))
+	if _, err := io.ReadFull(streamBA, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	find := func(dir TraceDirection, match func(*message.Message) bool) *TraceEvent {
+		for i := range events {
+			if events[i].Direction == dir && match(events[i].Message) {
+				return &events[i]
+			}
+		}
+		return nil
+	}
+	isType := func(typ message.MessageType) func(*message.Message) bool {
+		return func(m *message.Message) bool { return m.Type == typ }
+	}
+	for _, want := range []struct {
+		dir TraceDirection
+		typ message.MessageType
+	}{
+		{TraceOutbound, message.MessageTypeConnectionRequest},
+		{TraceInbound, message.MessageTypeConnectionRequest},
+		{TraceOutbound, message.MessageTypeConnectionResponse},
+		{TraceInbound, message.MessageTypeConnectionResponse},
+	} {
+		if find(want.dir, isType(want.typ)) == nil {
+			t.Fatalf("no %s trace for message type %d", want.dir, want.typ)
+		}
+	}
+
+	isData := func(m *message.Message) bool {
+		return m.Transport != nil && m.Transport.Message.Type == message.SubstreamMessageData
+	}
+	for _, dir := range []TraceDirection{TraceOutbound, TraceInbound} {
+		ev := find(dir, isData)
+		if ev == nil {
+			t.Fatalf("no %s trace for data message", dir)
+		}
+		if ev.Message.Transport.Nonce != 2 {
+			t.Fatalf("%s data nonce = %d, want 2", dir, ev.Message.Transport.Nonce)
+		}
+		decoded, err := message.Decode(ev.Encoded)
+		if err != nil {
+			t.Fatalf("decode traced bytes: %v", err)
+		}
+		if !bytes.Equal(decoded.Transport.Message.Data, []byte("traced")) {
+			t.Fatalf("traced payload = %q", decoded.Transport.Message.Data)
+		}
+		if !strings.Contains(ev.String(), "nonce=2") {
+			t.Fatalf("trace summary missing nonce: %s", ev)
+		}
+	}
+}
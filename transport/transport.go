@@ -3,12 +3,16 @@ package transport
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	lptransport "github.com/libp2p/go-libp2p/core/transport"
 	ma "github.com/multiformats/go-multiaddr"
@@ -18,11 +22,26 @@ import (
 	"banyan/transports/nym/queue"
 )
 
+var (
+	// ErrMixnetDisconnected is returned when the underlying mixnet client has
+	// gone away (for example because the websocket to the Nym client died) and
+	// messages can no longer be delivered.
+	ErrMixnetDisconnected = errors.New("nym transport: mixnet disconnected")
+
+	// ErrCongested is returned by OpenStream when WithFailFastOnCongestion is
+	// enabled and the mixnet outbound queue is full.
+	ErrCongested = errors.New("nym transport: outbound queue congested")
+)
+
 // Transport implements the go-libp2p transport interface over the Nym mixnet.
 type Transport struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// idMu guards the identity, which RotateIdentity may replace, and the
+	// self address, which changes when the Nym client re-registers. Each
+	// Conn keeps the peer ID it was established with.
+	idMu      sync.RWMutex
 	privKey   crypto.PrivKey
 	localPeer peer.ID
 
@@ -31,34 +50,120 @@ type Transport struct {
 
 	mixnetInbound  <-chan mixnet.InboundMessage
 	mixnetOutbound chan<- mixnet.OutboundMessage
+	// mixnetDone is closed once the mixnet inbound channel has been closed,
+	// which happens when the websocket reader or writer exits.
+	mixnetDone chan struct{}
+	// inboundDone is closed when processInbound returns.
+	inboundDone chan struct{}
+	// backend, when set, is closed by Close; see NewWithMixnet.
+	backend     MixnetClient
+	backendOnce sync.Once
 
 	handshakeTimeout time.Duration
+	cfg              config
+
+	// newSubstreamID generates outbound substream IDs; tests may replace it.
+	newSubstreamID func() (message.SubstreamID, error)
+	// newConnectionID generates dialed connection IDs; tests may replace it.
+	newConnectionID func() (message.ConnectionID, error)
 
 	mu           sync.RWMutex
 	listeners    map[*listener]struct{}
 	connections  map[string]*Conn
 	pendingDials map[string]*dialState
+	// inflightDials coalesces concurrent dials to the same recipient and peer.
+	inflightDials map[string]*inflightDial
+	// pendingPings maps outstanding ping IDs to the channel closed by the pong.
+	pendingPings map[string]chan struct{}
+
+	handshakeFailures [numHandshakeFailureReasons]atomic.Uint64
+	// bufferedBytes is the payload buffered across all connections; see
+	// WithMaxBufferedBytes.
+	bufferedBytes atomic.Int64
+
+	// responseLimiter is nil unless WithResponseRateLimit is set.
+	responseLimiter     *responseLimiter
+	rateLimitedRequests atomic.Uint64
+	// reorderEvictions totals the queue evictions of closed connections.
+	reorderEvictions atomic.Uint64
+	// duplicateMessages totals the queue duplicates of closed connections.
+	duplicateMessages atomic.Uint64
+	reorderTimeouts   atomic.Uint64
+	keepaliveTimeouts atomic.Uint64
+	idleTimeouts      atomic.Uint64
+	messagesSent      atomic.Uint64
+	messagesReceived  atomic.Uint64
+}
+
+// inflightDial is a handshake shared by every concurrent Dial to the same
+// recipient and peer. conn and err are set before done is closed. waiters
+// counts the Dial calls still waiting, and cancel ends the handshake once the
+// last of them gives up. All but done are guarded by Transport.mu.
+type inflightDial struct {
+	done    chan struct{}
+	conn    *Conn
+	err     error
+	waiters int
+	cancel  context.CancelFunc
 }
 
 type dialState struct {
+	id              message.ConnectionID
 	remoteRecipient message.Recipient
-	resultCh        chan *Conn
+	// remotePeer is the peer being dialed, if the caller named one.
+	remotePeer peer.ID
+	anonymous  bool
+	resultCh   chan *Conn
+	// localPeer is the identity the connection request was sent with.
+	localPeer peer.ID
+	// rejected is set before resultCh is closed when the listener declined.
+	rejected bool
+	// peerMismatch is set when a response named a peer other than
+	// remotePeer. It is guarded by Transport.mu.
+	peerMismatch bool
+	// scope is the dial's resource manager scope, if any. It passes to the
+	// connection handed to resultCh; see WithResourceManager.
+	scope network.ConnManagementScope
 }
 
 // New creates a new transport instance that connects to the provided Nym websocket URI.
-func New(ctx context.Context, uri string, privKey crypto.PrivKey) (*Transport, error) {
+func New(ctx context.Context, uri string, privKey crypto.PrivKey, opts ...Option) (*Transport, error) {
 	ensureProtocolRegistered()
 
-	self, inbound, outbound, err := mixnet.Initialize(ctx, uri, nil)
+	cfg := applyOptions(opts)
+	client, err := dialWebsocketClient(ctx, uri, cfg.mixnetOpts())
 	if err != nil {
-		return nil, fmt.Errorf("nym transport: initialize mixnet: %w", err)
+		return nil, err
 	}
+	t, err := newWithClient(ctx, client, privKey, opts...)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewWithConfig is New with the buffer sizes in cfg applied before opts.
+func NewWithConfig(ctx context.Context, uri string, privKey crypto.PrivKey, cfg Config, opts ...Option) (*Transport, error) {
+	return New(ctx, uri, privKey, append([]Option{WithConfig(cfg)}, opts...)...)
+}
 
-	return newWithMixnet(ctx, privKey, self, inbound, outbound)
+func newWithMixnet(ctx context.Context, privKey crypto.PrivKey, self message.Recipient, inbound <-chan mixnet.InboundMessage, outbound chan<- mixnet.OutboundMessage, opts ...Option) (*Transport, error) {
+	t, err := buildTransport(ctx, privKey, self, inbound, outbound, opts...)
+	if err != nil {
+		return nil, err
+	}
+	t.start()
+	return t, nil
 }
 
-func newWithMixnet(ctx context.Context, privKey crypto.PrivKey, self message.Recipient, inbound <-chan mixnet.InboundMessage, outbound chan<- mixnet.OutboundMessage) (*Transport, error) {
+// buildTransport constructs a transport without starting inbound processing,
+// leaving room to install state (such as restored connections) first.
+func buildTransport(ctx context.Context, privKey crypto.PrivKey, self message.Recipient, inbound <-chan mixnet.InboundMessage, outbound chan<- mixnet.OutboundMessage, opts ...Option) (*Transport, error) {
 	ensureProtocolRegistered()
+
+	cfg := applyOptions(opts)
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	pub := privKey.GetPublic()
@@ -83,17 +188,45 @@ func newWithMixnet(ctx context.Context, privKey crypto.PrivKey, self message.Rec
 		listenAddr:       addr,
 		mixnetInbound:    inbound,
 		mixnetOutbound:   outbound,
+		mixnetDone:       make(chan struct{}),
+		inboundDone:      make(chan struct{}),
 		handshakeTimeout: 5 * time.Second,
+		cfg:              cfg,
+		newSubstreamID:   message.GenerateSubstreamID,
+		newConnectionID:  message.GenerateConnectionID,
 		listeners:        make(map[*listener]struct{}),
 		connections:      make(map[string]*Conn),
 		pendingDials:     make(map[string]*dialState),
+		inflightDials:    make(map[string]*inflightDial),
+		pendingPings:     make(map[string]chan struct{}),
+	}
+	if cfg.responseBurst > 0 {
+		t.responseLimiter = newResponseLimiter(cfg.responseBurst, cfg.responseInterval)
 	}
-
-	go t.processInbound()
 
 	return t, nil
 }
 
+// newQueue returns a reorder queue with the configured depth limit.
+func (t *Transport) newQueue() *queue.MessageQueue {
+	q := queue.New()
+	q.SetMaxDepth(t.cfg.reorderQueueDepth, t.cfg.reorderOverflow)
+	return q
+}
+
+func (t *Transport) start() {
+	go t.processInbound()
+	if t.cfg.reorderTimeout > 0 {
+		go t.watchReorderGaps()
+	}
+	if t.cfg.keepaliveInterval > 0 {
+		go t.runKeepalive()
+	}
+	if t.cfg.idleTimeout > 0 {
+		go t.watchIdle()
+	}
+}
+
 // Proxy indicates whether the transport is a proxy transport.
 func (t *Transport) Proxy() bool {
 	return false
@@ -109,8 +242,10 @@ func (t *Transport) CanDial(addr ma.Multiaddr) bool {
 	return hasNymProtocol(addr)
 }
 
-// Close releases transport resources.
+// Close releases transport resources. Peers of open connections are told the
+// connections are gone, within the limit set by WithShutdownTimeout.
 func (t *Transport) Close() error {
+	t.notifyShutdown()
 	t.cancel()
 
 	// Collect listeners to shutdown
@@ -127,6 +262,9 @@ func (t *Transport) Close() error {
 		connections = append(connections, conn)
 		delete(t.connections, key)
 	}
+	if len(connections) > 0 {
+		t.cfg.metrics.ActiveConnections(0)
+	}
 
 	// Close pending dials
 	for key, dial := range t.pendingDials {
@@ -142,13 +280,52 @@ func (t *Transport) Close() error {
 
 	// Close connections without holding the lock
 	// This prevents deadlock since conn.Close() calls removeConnection()
+	// Peers were notified above, if at all.
 	for _, conn := range connections {
-		conn.Close()
+		conn.close(false)
 	}
 
+	t.closeBackend()
 	return nil
 }
 
+// notifyShutdown queues a ConnectionClose for every open connection, giving up
+// once the shutdown timeout expires. It does nothing on a transport that is
+// already cancelled, such as one being snapshotted.
+func (t *Transport) notifyShutdown() {
+	if t.ctx.Err() != nil || t.cfg.shutdownTimeout <= 0 {
+		return
+	}
+
+	t.mu.RLock()
+	connections := make([]*Conn, 0, len(t.connections))
+	for _, conn := range t.connections {
+		connections = append(connections, conn)
+	}
+	t.mu.RUnlock()
+	if len(connections) == 0 {
+		return
+	}
+
+	timer := time.NewTimer(t.cfg.shutdownTimeout)
+	defer timer.Stop()
+	for i, conn := range connections {
+		if t.mixnetClosed() {
+			return
+		}
+		out := conn.closeNotice()
+		select {
+		case <-timer.C:
+			log.Printf("nym transport: shutdown timeout expired with %d connections not notified", len(connections)-i)
+			return
+		case <-t.mixnetDone:
+			return
+		case t.mixnetOutbound <- out:
+			t.messageSent(out.Message)
+		}
+	}
+}
+
 func hasNymProtocol(addr ma.Multiaddr) bool {
 	found := false
 	ma.ForEach(addr, func(c ma.Component) bool {
@@ -161,10 +338,15 @@ func hasNymProtocol(addr ma.Multiaddr) bool {
 	return found
 }
 
-// Listen listens on the transport's Nym address.
+// Listen listens on the transport's Nym address. It fails with
+// ErrMixnetDisconnected if the mixnet client is already gone, since such a
+// listener could never answer connection requests.
 func (t *Transport) Listen(laddr ma.Multiaddr) (lptransport.Listener, error) {
-	if !laddr.Equal(t.listenAddr) {
-		return nil, fmt.Errorf("nym transport: can only listen on %s", t.listenAddr)
+	if addr := t.listenAddress(); !laddr.Equal(addr) {
+		return nil, fmt.Errorf("nym transport: can only listen on %s", addr)
+	}
+	if t.mixnetClosed() {
+		return nil, ErrMixnetDisconnected
 	}
 
 	l := newListener(t)
@@ -174,7 +356,15 @@ func (t *Transport) Listen(laddr ma.Multiaddr) (lptransport.Listener, error) {
 	return l, nil
 }
 
-// Dial dials a remote peer via the mixnet.
+// Dial dials a remote peer via the mixnet. Dialing with a context derived from
+// WithAnonymity, or on a transport with WithAnonymousReplies, hides our
+// recipient address from the remote.
+//
+// Concurrent dials to the same recipient and peer share a single handshake and
+// all receive the resulting connection. The handshake outlives any one
+// caller's ctx and is only abandoned once every caller has given up. If the
+// remote dials us at the same time, both ends settle on one connection; see
+// crossedDialLocked.
 func (t *Transport) Dial(ctx context.Context, addr ma.Multiaddr, p peer.ID) (lptransport.CapableConn, error) {
 	if !hasNymProtocol(addr) {
 		return nil, fmt.Errorf("nym transport: unsupported address")
@@ -185,185 +375,610 @@ func (t *Transport) Dial(ctx context.Context, addr ma.Multiaddr, p peer.ID) (lpt
 		return nil, fmt.Errorf("nym transport: parse recipient: %w", err)
 	}
 
-	connID, err := message.GenerateConnectionID()
+	anonymous := isAnonymousDial(ctx) || t.cfg.anonymousReplies
+	key := fmt.Sprintf("%s/%s/%t", recipient, p, anonymous)
+
+	t.mu.Lock()
+	inflight, ok := t.inflightDials[key]
+	if !ok {
+		// The handshake keeps ctx's values but not its cancellation, which
+		// belongs to this caller alone.
+		dialCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		inflight = &inflightDial{done: make(chan struct{}), cancel: cancel}
+		t.inflightDials[key] = inflight
+		go t.runInflightDial(dialCtx, key, inflight, recipient, p, anonymous)
+	}
+	inflight.waiters++
+	t.mu.Unlock()
+
+	select {
+	case <-inflight.done:
+		return inflight.result()
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-inflight.done:
+		// The handshake finished first; its connection is ours to take.
+		return inflight.result()
+	default:
+	}
+	if inflight.waiters--; inflight.waiters == 0 {
+		// Later dials start afresh rather than join an abandoned handshake.
+		if t.inflightDials[key] == inflight {
+			delete(t.inflightDials, key)
+		}
+		inflight.cancel()
+	}
+	return nil, ctx.Err()
+}
+
+// runInflightDial performs the handshake shared through inflight and hands
+// its outcome to the callers still waiting. A connection nobody waits for any
+// more is closed.
+func (t *Transport) runInflightDial(ctx context.Context, key string, inflight *inflightDial, recipient message.Recipient, p peer.ID, anonymous bool) {
+	conn, err := t.dial(ctx, recipient, p, anonymous)
+	inflight.cancel()
+
+	t.mu.Lock()
+	inflight.conn, inflight.err = conn, err
+	orphaned := inflight.waiters == 0
+	if t.inflightDials[key] == inflight {
+		delete(t.inflightDials, key)
+	}
+	close(inflight.done)
+	t.mu.Unlock()
+
+	if orphaned && conn != nil {
+		conn.Close()
+	}
+}
+
+// result returns the outcome of a finished handshake.
+func (d *inflightDial) result() (lptransport.CapableConn, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.conn, nil
+}
+
+// dial performs a single connection handshake with recipient.
+func (t *Transport) dial(ctx context.Context, recipient message.Recipient, p peer.ID, anonymous bool) (*Conn, error) {
+	raddr, err := multiaddrFromRecipient(recipient)
 	if err != nil {
-		return nil, fmt.Errorf("nym transport: generate connection id: %w", err)
+		return nil, err
+	}
+	scope, err := t.openConnScope(network.DirOutbound, p, raddr)
+	if err != nil {
+		return nil, err
 	}
 
 	resultCh := make(chan *Conn, 1)
 	state := &dialState{
 		remoteRecipient: recipient,
+		remotePeer:      p,
+		anonymous:       anonymous,
+		localPeer:       t.LocalPeer(),
 		resultCh:        resultCh,
+		scope:           scope,
 	}
-	key := connKey(connID)
 
 	t.mu.Lock()
-	if _, exists := t.pendingDials[key]; exists {
-		t.mu.Unlock()
-		return nil, fmt.Errorf("nym transport: connection id collision")
-	}
-	t.pendingDials[key] = state
+	key, err := t.registerDialLocked(state)
 	t.mu.Unlock()
+	if err != nil {
+		releaseScope(scope)
+		return nil, err
+	}
 
-	self := t.selfRecipient
-	msg := &message.Message{
-		Type: message.MessageTypeConnectionRequest,
-		Connection: &message.ConnectionMessage{
-			PeerID:    t.localPeer,
-			Recipient: &self,
-			ID:        connID,
+	if t.mixnetClosed() {
+		t.abortDial(key, state)
+		t.handshakeFailed(recipient, HandshakeMixnetDisconnected)
+		return nil, ErrMixnetDisconnected
+	}
+
+	connMsg := &message.ConnectionMessage{
+		PeerID:       state.localPeer,
+		ID:           state.id,
+		PublicKey:    t.publicKeyFor(state.localPeer),
+		StreamWindow: t.streamWindowOffer(),
+		CloseControl: t.cfg.closeControl,
+	}
+	out := mixnet.OutboundMessage{
+		Recipient: recipient,
+		Message: &message.Message{
+			Type:       message.MessageTypeConnectionRequest,
+			Connection: connMsg,
 		},
 	}
+	if anonymous {
+		out.ReplySURBs = t.cfg.replySURBs
+	} else {
+		self := t.selfAddress()
+		connMsg.Recipient = &self
+	}
 
-	if err := t.sendMixnetMessage(recipient, msg); err != nil {
-		t.removePendingDial(key)
+	if err := t.sendOutbound(out); err != nil {
+		t.abortDial(key, state)
+		if errors.Is(err, ErrMixnetDisconnected) {
+			t.handshakeFailed(recipient, HandshakeMixnetDisconnected)
+		}
 		return nil, err
 	}
 
 	handshakeCtx, cancel := context.WithTimeout(ctx, t.handshakeTimeout)
 	defer cancel()
 
-	select {
-	case conn, ok := <-resultCh:
-		if !ok || conn == nil {
-			return nil, fmt.Errorf("nym transport: dial aborted")
-		}
-		if p != "" && conn.remotePeer != p {
-			conn.Close()
-			return nil, fmt.Errorf("nym transport: remote peer mismatch")
+	var retry <-chan time.Time
+	if t.cfg.dialRetries > 0 {
+		ticker := time.NewTicker(t.cfg.dialRetryInterval)
+		defer ticker.Stop()
+		retry = ticker.C
+	}
+	retries := 0
+
+	for {
+		select {
+		case <-retry:
+			// Resend the same request; a response to any copy completes
+			// the dial.
+			if err := t.sendOutbound(out); err != nil {
+				log.Printf("nym transport: resend connection request: %v", err)
+			}
+			if retries++; retries == t.cfg.dialRetries {
+				retry = nil
+			}
+		case conn, ok := <-resultCh:
+			if !ok || conn == nil {
+				// Whoever ended the dial did not hand its scope to a connection.
+				releaseScope(scope)
+				t.mu.RLock()
+				rejected := state.rejected
+				t.mu.RUnlock()
+				if rejected {
+					t.handshakeFailed(recipient, HandshakeRejected)
+					return nil, ErrConnectionRejected
+				}
+				return nil, fmt.Errorf("nym transport: dial aborted")
+			}
+			if p != "" && conn.RemotePeer() != p {
+				conn.Close()
+				t.handshakeFailed(recipient, HandshakePeerMismatch)
+				return nil, fmt.Errorf("nym transport: remote peer mismatch")
+			}
+			if scope != nil && p == "" {
+				if err := scope.SetPeer(conn.RemotePeer()); err != nil {
+					conn.Close()
+					return nil, fmt.Errorf("nym transport: resource manager refused peer %s: %w", conn.RemotePeer(), err)
+				}
+			}
+			t.cfg.metrics.DialSucceeded()
+			return conn, nil
+		case <-handshakeCtx.Done():
+			t.abortDial(key, state)
+			// Cancellation by the caller is not a handshake failure.
+			if !errors.Is(handshakeCtx.Err(), context.DeadlineExceeded) {
+				return nil, handshakeCtx.Err()
+			}
+			t.mu.RLock()
+			mismatch := state.peerMismatch
+			t.mu.RUnlock()
+			if mismatch {
+				// Only a response from another peer came back.
+				t.handshakeFailed(recipient, HandshakePeerMismatch)
+				return nil, fmt.Errorf("nym transport: remote peer mismatch")
+			}
+			t.handshakeFailed(recipient, HandshakeTimeout)
+			return nil, handshakeCtx.Err()
+		case <-t.mixnetDone:
+			t.abortDial(key, state)
+			t.handshakeFailed(recipient, HandshakeMixnetDisconnected)
+			return nil, ErrMixnetDisconnected
+		case <-t.ctx.Done():
+			t.abortDial(key, state)
+			return nil, context.Canceled
 		}
-		return conn, nil
-	case <-handshakeCtx.Done():
-		t.removePendingDial(key)
-		return nil, handshakeCtx.Err()
-	case <-t.ctx.Done():
-		t.removePendingDial(key)
-		return nil, context.Canceled
 	}
 }
 
-func (t *Transport) removePendingDial(key string) {
+// abortDial removes the pending dial under key and releases its scope, unless
+// a connection already took the scope over.
+func (t *Transport) abortDial(key string, state *dialState) {
+	if t.removePendingDial(key) {
+		releaseScope(state.scope)
+	}
+}
+
+// removePendingDial ends the pending dial under key, reporting whether it was
+// still pending.
+func (t *Transport) removePendingDial(key string) bool {
 	t.mu.Lock()
-	if state, ok := t.pendingDials[key]; ok {
+	defer t.mu.Unlock()
+	state, ok := t.pendingDials[key]
+	if ok {
 		delete(t.pendingDials, key)
 		close(state.resultCh)
 	}
-	t.mu.Unlock()
+	return ok
 }
 
 func (t *Transport) processInbound() {
+	defer close(t.inboundDone)
 	for {
 		select {
 		case <-t.ctx.Done():
 			return
 		case inbound, ok := <-t.mixnetInbound:
 			if !ok {
+				// The mixnet reader only closes inbound once the websocket is
+				// gone, at which point the writer can no longer deliver either.
+				close(t.mixnetDone)
 				return
 			}
 			if inbound.Message == nil {
 				continue
 			}
-			if err := t.handleInboundMessage(inbound.Message); err != nil {
+			t.messagesReceived.Add(1)
+			t.cfg.metrics.MessageReceived(inbound.Message.Type)
+			t.traceMessage(TraceInbound, inbound.Message)
+			if err := t.handleInboundMessage(inbound); err != nil {
 				log.Printf("nym transport: inbound message error: %v", err)
 			}
 		}
 	}
 }
 
-func (t *Transport) handleInboundMessage(msg *message.Message) error {
+func (t *Transport) handleInboundMessage(inbound mixnet.InboundMessage) error {
+	msg, tag := inbound.Message, inbound.SenderTag
 	switch msg.Type {
 	case message.MessageTypeConnectionRequest:
 		if msg.Connection == nil {
 			return fmt.Errorf("missing connection request payload")
 		}
-		return t.handleConnectionRequest(msg.Connection)
+		return t.handleConnectionRequest(msg.Connection, tag)
 	case message.MessageTypeConnectionResponse:
 		if msg.Connection == nil {
 			return fmt.Errorf("missing connection response payload")
 		}
 		return t.handleConnectionResponse(msg.Connection)
+	case message.MessageTypePing:
+		if msg.Connection == nil {
+			return fmt.Errorf("missing ping payload")
+		}
+		return t.handlePing(msg.Connection, tag)
+	case message.MessageTypePong:
+		if msg.Connection == nil {
+			return fmt.Errorf("missing pong payload")
+		}
+		return t.handlePong(msg.Connection)
+	case message.MessageTypeConnectionClose:
+		if msg.Connection == nil {
+			return fmt.Errorf("missing connection close payload")
+		}
+		return t.handleConnectionClose(msg.Connection)
+	case message.MessageTypeConnectionPing:
+		if msg.Connection == nil {
+			return fmt.Errorf("missing keepalive ping payload")
+		}
+		return t.handleConnectionPing(msg.Connection)
+	case message.MessageTypeConnectionPong:
+		if msg.Connection == nil {
+			return fmt.Errorf("missing keepalive pong payload")
+		}
+		return t.handleConnectionPong(msg.Connection)
+	case message.MessageTypeConnectionAck:
+		if msg.Connection == nil {
+			return fmt.Errorf("missing connection ack payload")
+		}
+		return t.handleConnectionAck(msg.Connection)
+	case message.MessageTypeConnectionReject:
+		if msg.Connection == nil {
+			return fmt.Errorf("missing connection reject payload")
+		}
+		return t.handleConnectionReject(msg.Connection)
 	case message.MessageTypeTransport:
 		if msg.Transport == nil {
 			return fmt.Errorf("missing transport payload")
 		}
-		return t.handleTransportMessage(msg.Transport)
+		return t.handleTransportMessage(msg.Transport, tag)
 	default:
 		return fmt.Errorf("unknown message type %d", msg.Type)
 	}
 }
 
-func (t *Transport) handleConnectionRequest(connMsg *message.ConnectionMessage) error {
-	if connMsg.Recipient == nil {
+// maxConnectionIDAttempts bounds how many connection IDs a dial draws before
+// giving up on finding one that is not in use.
+const maxConnectionIDAttempts = 3
+
+// registerDialLocked records state as a pending dial under a freshly drawn
+// connection ID that no pending dial or connection uses, and returns its key.
+func (t *Transport) registerDialLocked(state *dialState) (string, error) {
+	for attempt := 0; attempt < maxConnectionIDAttempts; attempt++ {
+		id, err := t.newConnectionID()
+		if err != nil {
+			return "", fmt.Errorf("nym transport: generate connection id: %w", err)
+		}
+		key := connKey(id)
+		if t.connectionIDInUseLocked(key) {
+			continue
+		}
+		state.id = id
+		t.pendingDials[key] = state
+		return key, nil
+	}
+	return "", fmt.Errorf("nym transport: connection id collision")
+}
+
+// connectionIDInUseLocked reports whether a pending dial or a connection has
+// the connection ID with key.
+func (t *Transport) connectionIDInUseLocked(key string) bool {
+	_, dialing := t.pendingDials[key]
+	_, connected := t.connections[key]
+	return dialing || connected
+}
+
+func (t *Transport) handleConnectionRequest(connMsg *message.ConnectionMessage, tag *mixnet.SenderTag) error {
+	if connMsg.Recipient == nil && tag == nil {
 		return fmt.Errorf("connection request missing recipient")
 	}
+	remotePubKey, err := announcedPublicKey(connMsg)
+	if err != nil {
+		return fmt.Errorf("connection request: %w", err)
+	}
+	if !t.allowReply(connMsg.Recipient) {
+		// Dropped quietly: logging every forged request would be a flood of
+		// its own. Drops are counted in Stats.
+		return nil
+	}
+
+	// A request crossing our own pending dial to the same peer either
+	// completes that dial or is dropped in its favour.
+	t.mu.RLock()
+	existing := t.connections[connKey(connMsg.ID)]
+	crossed := t.crossedDialLocked(connMsg)
+	t.mu.RUnlock()
+	if existing != nil {
+		return t.answerRepeatedRequest(existing, connMsg)
+	}
+	if crossed != nil && winsCrossing(crossed, connMsg) {
+		return nil
+	}
+
+	var scope network.ConnScope
+	if fn := t.cfg.acceptInterceptor; fn != nil && crossed == nil {
+		s, err := fn(connMsg)
+		if err != nil {
+			t.rejectConnection(connMsg, tag)
+			return fmt.Errorf("connection rejected: %w", err)
+		}
+		scope = s
+	}
+	if scope == nil && crossed == nil {
+		var remote message.Recipient
+		if connMsg.Recipient != nil {
+			remote = *connMsg.Recipient
+		}
+		raddr, err := multiaddrFromRecipient(remote)
+		if err != nil {
+			return err
+		}
+		s, err := t.openConnScope(network.DirInbound, connMsg.PeerID, raddr)
+		if err != nil {
+			t.rejectConnection(connMsg, tag)
+			return fmt.Errorf("connection rejected: %w", err)
+		}
+		if s != nil {
+			scope = s
+		}
+	}
 
 	key := connKey(connMsg.ID)
 
 	t.mu.Lock()
 	if _, exists := t.connections[key]; exists {
 		t.mu.Unlock()
+		releaseScope(scope)
 		return fmt.Errorf("connection already exists")
 	}
+	if dial, exists := t.pendingDials[key]; exists && dial != crossed {
+		// The ID belongs to one of our dials, whose response would
+		// otherwise replace this connection.
+		t.mu.Unlock()
+		releaseScope(scope)
+		t.rejectConnection(connMsg, tag)
+		return fmt.Errorf("connection id collides with a pending dial")
+	}
+	if crossed != nil {
+		if t.pendingDials[connKey(crossed.id)] != crossed {
+			t.mu.Unlock()
+			return fmt.Errorf("crossed dial already ended")
+		}
+		delete(t.pendingDials, connKey(crossed.id))
+	}
 
-	queue := queue.New()
+	// Reply through the sender tag when the dialer withheld its address, or
+	// when an anonymous listener requires SURB-only replies.
+	useTag := tag != nil && (connMsg.Recipient == nil || t.anonymousListenerLocked())
+	var remoteRecipient message.Recipient
+	if !useTag {
+		remoteRecipient = *connMsg.Recipient
+	}
+
+	queue := t.newQueue()
 	queue.SetConnectionMessageReceived()
 
-	conn, err := newConn(t, connMsg.ID, connMsg.PeerID, *connMsg.Recipient, queue)
+	conn, err := newConn(t, connMsg.ID, connMsg.PeerID, remoteRecipient, queue)
 	if err != nil {
 		t.mu.Unlock()
+		releaseScope(scope)
+		if crossed != nil {
+			close(crossed.resultCh)
+		}
 		return err
 	}
+	conn.remotePubKey = remotePubKey
+	conn.negotiateWindow(connMsg.StreamWindow)
+	conn.negotiateCloseControl(connMsg.CloseControl)
+	if scope != nil {
+		conn.scope = scope
+	} else if crossed != nil && crossed.scope != nil {
+		// The connection stands in for our dial, whose scope it takes.
+		conn.scope = crossed.scope
+	}
+	if useTag {
+		conn.replyTag.Store(tag)
+	}
 	t.connections[key] = conn
+	t.cfg.metrics.ActiveConnections(len(t.connections))
 	t.mu.Unlock()
 
-	resp := &message.Message{
-		Type: message.MessageTypeConnectionResponse,
-		Connection: &message.ConnectionMessage{
-			PeerID: t.localPeer,
-			ID:     connMsg.ID,
-		},
-	}
-
-	if err := t.sendMixnetMessage(*connMsg.Recipient, resp); err != nil {
+	resp := t.connectionResponse(conn)
+	if err := t.sendOutbound(conn.outbound(resp)); err != nil {
 		conn.Close()
+		if crossed != nil {
+			close(crossed.resultCh)
+		}
 		return err
 	}
+	if t.cfg.responseRetransmit > 0 {
+		go t.awaitDialer(conn, resp)
+	}
 
+	if crossed != nil {
+		t.completeCrossedDial(crossed, conn)
+		return nil
+	}
 	t.notifyListeners(conn)
 	return nil
 }
 
+// connectionResponse builds the response accepting conn.
+func (t *Transport) connectionResponse(conn *Conn) *message.Message {
+	reply := t.selfAddress()
+	if t.cfg.replyRecipient != nil {
+		reply = *t.cfg.replyRecipient
+	}
+	return &message.Message{
+		Type: message.MessageTypeConnectionResponse,
+		Connection: &message.ConnectionMessage{
+			PeerID:       conn.localPeer,
+			Recipient:    &reply,
+			ID:           conn.id,
+			PublicKey:    t.publicKeyFor(conn.localPeer),
+			StreamWindow: t.streamWindowOffer(),
+			CloseControl: t.cfg.closeControl,
+		},
+	}
+}
+
+// handleConnectionResponse completes the pending dial connMsg answers. The Nym
+// client does not authenticate senders, so the response is bound to the dial
+// by its connection ID, which the mixnet delivers to the dialed recipient
+// alone, and by the peer ID the dial named, if any. A response naming another
+// peer is ignored without ending the dial, so the real one can still complete
+// it. Anyone who learns a pending connection ID and claims the dialed peer ID
+// can still answer in the listener's place.
 func (t *Transport) handleConnectionResponse(connMsg *message.ConnectionMessage) error {
+	// A response with a bad key is ignored rather than failing the dial, so
+	// a forged one cannot abort it.
+	remotePubKey, err := announcedPublicKey(connMsg)
+	if err != nil {
+		return fmt.Errorf("connection response: %w", err)
+	}
 	key := connKey(connMsg.ID)
 
 	t.mu.Lock()
 	state, ok := t.pendingDials[key]
 	if !ok {
+		conn, established := t.connections[key]
 		t.mu.Unlock()
+		if established {
+			// A retransmitted response means our ack was lost; see
+			// WithHandshakeRetransmit.
+			return t.sendConnectionAck(conn)
+		}
 		return fmt.Errorf("no pending dial for response")
 	}
+	if state.remotePeer != "" && connMsg.PeerID != state.remotePeer {
+		state.peerMismatch = true
+		t.mu.Unlock()
+		return fmt.Errorf("connection response from peer %s for a dial to %s", connMsg.PeerID, state.remotePeer)
+	}
 	delete(t.pendingDials, key)
 
-	queue := queue.New()
+	// Follow the listener to the recipient it asked replies to go to.
+	remoteRecipient := state.remoteRecipient
+	if connMsg.Recipient != nil {
+		remoteRecipient = *connMsg.Recipient
+	}
+
+	queue := t.newQueue()
 	queue.SetConnectionMessageReceived()
 
-	conn, err := newConn(t, connMsg.ID, connMsg.PeerID, state.remoteRecipient, queue)
+	conn, err := newConn(t, connMsg.ID, connMsg.PeerID, remoteRecipient, queue)
 	if err != nil {
 		t.mu.Unlock()
 		return err
 	}
+	conn.anonymous = state.anonymous
+	conn.localPeer = state.localPeer
+	conn.remotePubKey = remotePubKey
+	conn.negotiateWindow(connMsg.StreamWindow)
+	conn.negotiateCloseControl(connMsg.CloseControl)
+	if state.scope != nil {
+		conn.scope = state.scope
+	}
 	t.connections[key] = conn
+	t.cfg.metrics.ActiveConnections(len(t.connections))
 	t.mu.Unlock()
 
 	select {
 	case state.resultCh <- conn:
 	default:
 		conn.Close()
+		return nil
+	}
+	err = t.sendConnectionAck(conn)
+	conn.markReady()
+	return err
+}
+
+// sendConnectionAck completes the handshake of a dialed connection.
+func (t *Transport) sendConnectionAck(conn *Conn) error {
+	return t.sendOutbound(conn.outbound(&message.Message{
+		Type: message.MessageTypeConnectionAck,
+		Connection: &message.ConnectionMessage{
+			PeerID: conn.localPeer,
+			ID:     conn.id,
+		},
+	}))
+}
+
+func (t *Transport) handleConnectionClose(connMsg *message.ConnectionMessage) error {
+	t.mu.RLock()
+	conn, ok := t.connections[connKey(connMsg.ID)]
+	t.mu.RUnlock()
+	if !ok {
+		// Both ends closing at once is routine.
+		return nil
 	}
+	return conn.close(false)
+}
+
+func (t *Transport) handleConnectionAck(connMsg *message.ConnectionMessage) error {
+	t.mu.RLock()
+	conn, ok := t.connections[connKey(connMsg.ID)]
+	t.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no connection for ack")
+	}
+	conn.markReady()
 	return nil
 }
 
-func (t *Transport) handleTransportMessage(transportMsg *message.TransportMessage) error {
+func (t *Transport) handleTransportMessage(transportMsg *message.TransportMessage, tag *mixnet.SenderTag) error {
 	key := connKey(transportMsg.ID)
 	t.mu.RLock()
 	conn, ok := t.connections[key]
@@ -372,37 +987,120 @@ func (t *Transport) handleTransportMessage(transportMsg *message.TransportMessag
 		return fmt.Errorf("no connection for transport message")
 	}
 
+	// Anonymous dialers attach fresh SURBs to every message; follow the
+	// latest tag in case the Nym client rotated it.
+	if tag != nil && conn.replyTag.Load() != nil {
+		conn.replyTag.Store(tag)
+	}
+
 	conn.handleTransportMessage(*transportMsg)
 	return nil
 }
 
+// notifyListeners queues conn on a single listener, so that it is accepted
+// once and closing one listener leaves the others' connections alone. A
+// connection replying via a sender tag prefers an anonymous listener.
 func (t *Transport) notifyListeners(conn *Conn) {
+	anonymous := conn.replyTag.Load() != nil
 	t.mu.RLock()
 	defer t.mu.RUnlock()
+	var target *listener
 	for l := range t.listeners {
-		l.enqueue(conn)
+		if l.isClosed() || (l.anonymous && !anonymous) {
+			continue
+		}
+		if target == nil || (l.anonymous && !target.anonymous) {
+			target = l
+		}
+	}
+	if target != nil {
+		target.enqueue(conn)
 	}
 }
 
 func (t *Transport) removeConnection(conn *Conn) {
 	key := connKey(conn.id)
 	t.mu.Lock()
-	delete(t.connections, key)
+	if _, ok := t.connections[key]; ok {
+		delete(t.connections, key)
+		t.cfg.metrics.ActiveConnections(len(t.connections))
+	}
 	t.mu.Unlock()
 }
 
-func (t *Transport) sendMixnetMessage(recipient message.Recipient, msg *message.Message) error {
+// mixnetClosed reports whether the mixnet client has disconnected.
+func (t *Transport) mixnetClosed() bool {
+	select {
+	case <-t.mixnetDone:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Transport) sendOutbound(out mixnet.OutboundMessage) error {
+	return t.sendOutboundBy(out, time.Time{})
+}
+
+// sendOutboundBy is sendOutbound giving up with os.ErrDeadlineExceeded once
+// deadline passes. The zero deadline waits indefinitely.
+func (t *Transport) sendOutboundBy(out mixnet.OutboundMessage, deadline time.Time) error {
+	// Check for a dead mixnet first so a buffered outbound channel doesn't
+	// silently accept messages nobody will ever write.
+	if t.mixnetClosed() {
+		return ErrMixnetDisconnected
+	}
+	if t.ctx.Err() != nil {
+		return context.Canceled
+	}
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
 	select {
 	case <-t.ctx.Done():
 		return context.Canceled
-	case t.mixnetOutbound <- mixnet.OutboundMessage{
-		Recipient: recipient,
-		Message:   msg,
-	}:
+	case <-t.mixnetDone:
+		return ErrMixnetDisconnected
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case t.mixnetOutbound <- out:
+		t.messageSent(out.Message)
+		return nil
+	}
+}
+
+// trySendOutbound is the non-blocking variant of sendOutbound, returning
+// ErrCongested when the outbound queue has no free capacity.
+func (t *Transport) trySendOutbound(out mixnet.OutboundMessage) error {
+	if t.mixnetClosed() {
+		return ErrMixnetDisconnected
+	}
+	select {
+	case <-t.ctx.Done():
+		return context.Canceled
+	case t.mixnetOutbound <- out:
+		t.messageSent(out.Message)
 		return nil
+	default:
+		return ErrCongested
 	}
 }
 
+// messageSent accounts for msg once it is queued on the mixnet. Every path
+// onto mixnetOutbound goes through it.
+func (t *Transport) messageSent(msg *message.Message) {
+	t.messagesSent.Add(1)
+	t.cfg.metrics.MessageSent(msg.Type)
+	t.traceMessage(TraceOutbound, msg)
+}
+
 func multiaddrFromRecipient(rec message.Recipient) (ma.Multiaddr, error) {
 	return ma.NewMultiaddr(fmt.Sprintf("/%s/%s", nymProtocolName, rec.String()))
 }
@@ -1,17 +1,27 @@
 package transport
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	lptransport "github.com/libp2p/go-libp2p/core/transport"
 	ma "github.com/multiformats/go-multiaddr"
 
 	"banyan/transports/nym/internal/testutil"
 	"banyan/transports/nym/message"
+	"banyan/transports/nym/mixnet"
 )
 
 func TestTransportDialAndStream(t *testing.T) {
@@ -134,3 +144,2155 @@ func testRecipient(seed byte) message.Recipient {
 	}
 	return r
 }
+
+func TestDialFailsFastWhenMixnetDisconnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	inbound := make(chan mixnet.InboundMessage)
+	// Nobody drains outbound, mimicking a writer goroutine that has exited.
+	outbound := make(chan mixnet.OutboundMessage, 32)
+
+	tpt, err := newWithMixnet(ctx, priv, testRecipient(0x11), inbound, outbound)
+	if err != nil {
+		t.Fatalf("create transport: %v", err)
+	}
+	defer tpt.Close()
+
+	remote, err := multiaddrFromRecipient(testRecipient(0x22))
+	if err != nil {
+		t.Fatalf("build remote addr: %v", err)
+	}
+
+	// A dial in flight when the mixnet dies must be aborted promptly.
+	dialErr := make(chan error, 1)
+	go func() {
+		_, err := tpt.Dial(ctx, remote, "")
+		dialErr <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(inbound)
+
+	select {
+	case err := <-dialErr:
+		if !errors.Is(err, ErrMixnetDisconnected) {
+			t.Fatalf("in-flight dial: expected ErrMixnetDisconnected, got %v", err)
+		}
+	case <-time.After(tpt.handshakeTimeout / 2):
+		t.Fatalf("in-flight dial did not fail promptly")
+	}
+
+	// Subsequent dials fail immediately without queueing a request.
+	start := time.Now()
+	if _, err := tpt.Dial(ctx, remote, ""); !errors.Is(err, ErrMixnetDisconnected) {
+		t.Fatalf("expected ErrMixnetDisconnected, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial took %s after mixnet disconnect", elapsed)
+	}
+	if len(outbound) != 1 {
+		t.Fatalf("expected only the first connection request to be queued, got %d", len(outbound))
+	}
+}
+
+// newTestTransports returns two transports wired together through an
+// in-memory pipe network, using recipients testRecipient(0x11) and
+// testRecipient(0x22).
+func newTestTransports(t *testing.T, ctx context.Context, opts ...Option) (*Transport, *Transport) {
+	t.Helper()
+	return newInterceptedTestTransports(t, ctx, nil, opts...)
+}
+
+// newInterceptedTestTransports is newTestTransports with all pipe traffic
+// passed through intercept.
+func newInterceptedTestTransports(t *testing.T, ctx context.Context, intercept testutil.Interceptor, opts ...Option) (*Transport, *Transport) {
+	t.Helper()
+
+	privA, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	privB, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	inA, outA, inB, outB := testutil.PipeNetworkWithInterceptor(ctx, testRecipient(0x11), testRecipient(0x22), intercept)
+
+	transportA, err := newWithMixnet(ctx, privA, testRecipient(0x11), inA, outA, opts...)
+	if err != nil {
+		t.Fatalf("create transportA: %v", err)
+	}
+	t.Cleanup(func() { transportA.Close() })
+
+	transportB, err := newWithMixnet(ctx, privB, testRecipient(0x22), inB, outB, opts...)
+	if err != nil {
+		t.Fatalf("create transportB: %v", err)
+	}
+	t.Cleanup(func() { transportB.Close() })
+
+	return transportA, transportB
+}
+
+func TestAnonymousDialRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+
+	listenerB, err := transportB.ListenAnonymous()
+	if err != nil {
+		t.Fatalf("listen anonymous: %v", err)
+	}
+	defer listenerB.Close()
+
+	acceptCh := make(chan lptransport.CapableConn, 1)
+	go func() {
+		conn, err := listenerB.Accept()
+		if err != nil {
+			return
+		}
+		acceptCh <- conn
+	}()
+
+	connAB, err := transportA.Dial(WithAnonymity(ctx), transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer connAB.Close()
+
+	var connBA *Conn
+	select {
+	case raw := <-acceptCh:
+		connBA = raw.(*Conn)
+	case <-ctx.Done():
+		t.Fatalf("accept timeout")
+	}
+	defer connBA.Close()
+
+	if connBA.replyTag.Load() == nil {
+		t.Fatalf("accepted connection has no reply tag")
+	}
+	if !connBA.IsAnonymous() || !connAB.(*Conn).IsAnonymous() {
+		t.Fatalf("SURB-based connection not reported as anonymous")
+	}
+	for _, conn := range []lptransport.CapableConn{connAB, connBA} {
+		if got := conn.ConnState().Transport; got != anonymousTransportName {
+			t.Fatalf("SURB-based connection state names transport %q", got)
+		}
+	}
+	if connBA.remoteRecipient != (message.Recipient{}) {
+		t.Fatalf("listener learned dialer recipient %s", connBA.remoteRecipient)
+	}
+	if connBA.RemotePeer() != transportA.localPeer {
+		t.Fatalf("unexpected remote peer %s", connBA.RemotePeer())
+	}
+
+	streamAB, err := connAB.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	streamBA, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+
+	request := []byte("anonymous hello")
+	if _, err := streamAB.Write(request); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(request))
+	if _, err := io.ReadFull(streamBA, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != string(request) {
+		t.Fatalf("unexpected request %q", buf)
+	}
+
+	reply := []byte("reply via surb")
+	if _, err := streamBA.Write(reply); err != nil {
+		t.Fatalf("write reply: %v", err)
+	}
+	buf = make([]byte, len(reply))
+	if _, err := io.ReadFull(streamAB, buf); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if string(buf) != string(reply) {
+		t.Fatalf("unexpected reply %q", buf)
+	}
+}
+
+func TestAnonymousRepliesHideDialerRecipient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx, WithAnonymousReplies(true))
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if !connAB.IsAnonymous() || connBA.replyTag.Load() == nil {
+		t.Fatalf("dial without WithAnonymity was not anonymous")
+	}
+	if connBA.remoteRecipient != (message.Recipient{}) {
+		t.Fatalf("listener learned dialer recipient %s", connBA.remoteRecipient)
+	}
+
+	reply := []byte("reply via surb")
+	if _, err := streamBA.Write(reply); err != nil {
+		t.Fatalf("write reply: %v", err)
+	}
+	buf := make([]byte, len(reply))
+	if _, err := io.ReadFull(streamAB, buf); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if string(buf) != string(reply) {
+		t.Fatalf("unexpected reply %q", buf)
+	}
+}
+
+func TestAnonymousListenerIgnoresAddressedDials(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+
+	listenerB, err := transportB.ListenAnonymous()
+	if err != nil {
+		t.Fatalf("listen anonymous: %v", err)
+	}
+	defer listenerB.Close()
+
+	connAB, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer connAB.Close()
+
+	accepted := make(chan struct{})
+	go func() {
+		if _, err := listenerB.Accept(); err == nil {
+			close(accepted)
+		}
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatalf("anonymous listener accepted an addressed connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOpenStreamFailsFastOnCongestion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	outbound := make(chan mixnet.OutboundMessage, 4)
+	_, conn := newUndrainedTestConn(t, ctx, outbound, WithFailFastOnCongestion(true))
+
+	// Saturate the outbound channel; nobody is draining it.
+	for len(outbound) < cap(outbound) {
+		outbound <- mixnet.OutboundMessage{}
+	}
+
+	start := time.Now()
+	if _, err := conn.OpenStream(ctx); !errors.Is(err, ErrCongested) {
+		t.Fatalf("expected ErrCongested, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("OpenStream blocked for %s", elapsed)
+	}
+	if conn.nonce != 0 {
+		t.Fatalf("congested open consumed nonce %d", conn.nonce)
+	}
+	if len(conn.pendingOutbound) != 0 {
+		t.Fatalf("congested open left %d pending streams", len(conn.pendingOutbound))
+	}
+
+	// Once capacity frees up the open request is queued with the first nonce.
+	<-outbound
+	openCtx, openCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer openCancel()
+	if _, err := conn.OpenStream(openCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected open to wait for a response, got %v", err)
+	}
+	// The filler messages come first; the cancelled open's reset may
+	// follow the request.
+	var open mixnet.OutboundMessage
+	for open.Message == nil {
+		open = <-outbound
+	}
+	if tm := open.Message.Transport; tm == nil || tm.Nonce != 1 || tm.Message.Type != message.SubstreamMessageOpenRequest {
+		t.Fatalf("expected open request with nonce 1, got %+v", open.Message)
+	}
+}
+
+func TestFailFastOpenWaitsForConcurrentSender(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	outbound := make(chan mixnet.OutboundMessage, 4)
+	_, conn := newUndrainedTestConn(t, ctx, outbound, WithFailFastOnCongestion(true))
+
+	// Another sender on the connection is not congestion while the queue
+	// has room. Nobody answers, so the open ends at its deadline.
+	conn.sendMu.Lock()
+	openCtx, cancelOpen := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelOpen()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.OpenStream(openCtx)
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.sendMu.Unlock()
+
+	if err := <-errCh; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("OpenStream: %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestWriteDeadlineOnFullOutboundQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	outbound := make(chan mixnet.OutboundMessage, 1)
+	_, conn := newUndrainedTestConn(t, ctx, outbound)
+	stream := newSubstream(conn, message.SubstreamID{0x01})
+
+	if n, err := stream.Write([]byte("queued")); n != 6 || err != nil {
+		t.Fatalf("write into free capacity = %d, %v", n, err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	n, err := stream.Write([]byte("stuck"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 0 {
+		t.Fatalf("write on full queue = %d, %v; want 0, deadline exceeded", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("write blocked for %s past its deadline", elapsed)
+	}
+	if conn.nonce != 1 {
+		t.Fatalf("timed out write consumed a nonce: %d", conn.nonce)
+	}
+
+	// Clearing the deadline lets the write wait for capacity again.
+	stream.SetWriteDeadline(time.Time{})
+	<-outbound
+	if n, err := stream.Write([]byte("again")); n != 5 || err != nil {
+		t.Fatalf("write after clearing deadline = %d, %v", n, err)
+	}
+	if tm := (<-outbound).Message.Transport; tm.Nonce != 2 || string(tm.Message.Data) != "again" {
+		t.Fatalf("expected %q with nonce 2, got %+v", "again", tm)
+	}
+}
+
+// newUndrainedTestConn creates a transport whose mixnet outbound channel is
+// outbound, which the test drains itself, and accepts one connection on it.
+func newUndrainedTestConn(t *testing.T, ctx context.Context, outbound chan mixnet.OutboundMessage, opts ...Option) (*Transport, *Conn) {
+	t.Helper()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	remotePriv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	remotePeer, err := peer.IDFromPrivateKey(remotePriv)
+	if err != nil {
+		t.Fatalf("derive peer id: %v", err)
+	}
+
+	tpt, err := newWithMixnet(ctx, priv, testRecipient(0x11), make(chan mixnet.InboundMessage), outbound, opts...)
+	if err != nil {
+		t.Fatalf("create transport: %v", err)
+	}
+	t.Cleanup(func() { tpt.Close() })
+
+	connID, err := message.GenerateConnectionID()
+	if err != nil {
+		t.Fatalf("generate connection id: %v", err)
+	}
+	remoteRecipient := testRecipient(0x22)
+	if err := tpt.handleConnectionRequest(&message.ConnectionMessage{
+		PeerID:    remotePeer,
+		Recipient: &remoteRecipient,
+		ID:        connID,
+	}, nil); err != nil {
+		t.Fatalf("handle connection request: %v", err)
+	}
+	// Drop the connection response so the channel starts empty.
+	<-outbound
+	return tpt, tpt.connections[connKey(connID)]
+}
+
+// openTestStreams dials b from a and returns a connected stream pair.
+// closeListeners closes every listener of tpt.
+func closeListeners(tpt *Transport) {
+	tpt.mu.RLock()
+	listeners := make([]*listener, 0, len(tpt.listeners))
+	for l := range tpt.listeners {
+		listeners = append(listeners, l)
+	}
+	tpt.mu.RUnlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func openTestStreams(t *testing.T, ctx context.Context, a, b *Transport) (*Conn, *Conn, *Substream, *Substream) {
+	t.Helper()
+
+	listener, err := b.Listen(b.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	connAB, err := a.Dial(ctx, b.listenAddr, b.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	rawBA, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	connBA := rawBA.(*Conn)
+
+	streamAB, err := connAB.(*Conn).OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	streamBA, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	return connAB.(*Conn), connBA, streamAB.(*Substream), streamBA.(*Substream)
+}
+
+func TestZeroLengthDataDoesNotDisruptReader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if n, err := streamAB.Write(nil); n != 0 || err != nil {
+		t.Fatalf("empty write returned (%d, %v)", n, err)
+	}
+	if connAB.nonce != 1 {
+		t.Fatalf("empty write was sent on the wire")
+	}
+
+	// Peers may still send empty data messages on the wire.
+	if err := connAB.sendData(streamAB.id, nil, time.Time{}); err != nil {
+		t.Fatalf("send empty data: %v", err)
+	}
+	if _, err := streamAB.Write([]byte("payload")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := streamBA.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf[:n]) != "payload" {
+		t.Fatalf("unexpected read %q", buf[:n])
+	}
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		stream, err := conn.AcceptStream()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer stream.Close()
+		req, err := io.ReadAll(stream)
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		_, err = stream.Write(append([]byte("echo: "), req...))
+		serverErr <- err
+	}()
+
+	raw, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn := raw.(*Conn)
+	defer conn.Close()
+
+	resp, err := conn.RoundTrip(ctx, []byte("ping"))
+	if err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	if string(resp) != "echo: ping" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+}
+
+func TestCloseWriteKeepsReading(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if _, err := streamAB.Write([]byte("request")); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	if err := streamAB.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	if _, err := streamAB.Write([]byte("more")); err == nil {
+		t.Fatalf("write after CloseWrite succeeded")
+	}
+
+	req, err := io.ReadAll(streamBA)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("read request returned %q, %v", req, err)
+	}
+	if _, err := streamBA.Write([]byte("response")); err != nil {
+		t.Fatalf("write response: %v", err)
+	}
+	streamBA.Close()
+
+	resp, err := io.ReadAll(streamAB)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("read response after CloseWrite returned %q, %v", resp, err)
+	}
+}
+
+func TestHalfCloseBothDirections(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx, WithCloseControl(true))
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if err := streamAB.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	if _, err := io.ReadAll(streamBA); err != nil {
+		t.Fatalf("read to EOF: %v", err)
+	}
+	// The remote half-close leaves the stream open for writing.
+	connBA.streamsMu.Lock()
+	remaining := len(connBA.streams)
+	connBA.streamsMu.Unlock()
+	if remaining != 1 {
+		t.Fatalf("stream dropped after remote CloseWrite")
+	}
+	if _, err := streamBA.Write([]byte("response")); err != nil {
+		t.Fatalf("write after remote CloseWrite: %v", err)
+	}
+	if err := streamBA.CloseWrite(); err != nil {
+		t.Fatalf("close write back: %v", err)
+	}
+
+	resp, err := io.ReadAll(streamAB)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("read response returned %q, %v", resp, err)
+	}
+	// With both directions ended the stream is gone on both sides.
+	waitFor(t, ctx, "streams removed", func() bool {
+		connAB.streamsMu.Lock()
+		defer connAB.streamsMu.Unlock()
+		connBA.streamsMu.Lock()
+		defer connBA.streamsMu.Unlock()
+		return len(connAB.streams) == 0 && len(connBA.streams) == 0
+	})
+}
+
+func TestAcceptStreamContextCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	acceptCtx, acceptCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer acceptCancel()
+	if _, err := connBA.AcceptStreamContext(acceptCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("accept with expired context returned %v, want DeadlineExceeded", err)
+	}
+
+	// The cancelled accept leaves later streams to the next one.
+	if _, err := connAB.OpenStream(ctx); err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	stream, err := connBA.AcceptStreamContext(ctx)
+	if err != nil {
+		t.Fatalf("accept after cancellation: %v", err)
+	}
+	stream.Close()
+}
+
+func TestCloseWriteWithoutCloseControl(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// B lacks close control, so A's half-close must go out as a plain close,
+	// which B understands.
+	var closeWrites atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if tm := msg.Message.Transport; tm != nil && tm.Message.Type == message.SubstreamMessageCloseWrite {
+			closeWrites.Add(1)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+	transportA.cfg.closeControl = true
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if _, err := streamAB.Write([]byte("request")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := streamAB.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	if req, err := io.ReadAll(streamBA); err != nil || string(req) != "request" {
+		t.Fatalf("read request returned %q, %v", req, err)
+	}
+	// A response still reaches the half-closed end.
+	if _, err := streamBA.Write([]byte("response")); err != nil {
+		t.Fatalf("write response: %v", err)
+	}
+	if err := streamBA.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if resp, err := io.ReadAll(streamAB); err != nil || string(resp) != "response" {
+		t.Fatalf("read response returned %q, %v", resp, err)
+	}
+	streamAB.Close()
+	waitFor(t, ctx, "streams removed", func() bool {
+		connAB.streamsMu.Lock()
+		defer connAB.streamsMu.Unlock()
+		connBA.streamsMu.Lock()
+		defer connBA.streamsMu.Unlock()
+		return len(connAB.streams) == 0 && len(connBA.streams) == 0
+	})
+	if n := closeWrites.Load(); n != 0 {
+		t.Fatalf("sent %d close-writes without close control", n)
+	}
+}
+
+func TestCloseReadKeepsWriting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if err := streamAB.CloseRead(); err != nil {
+		t.Fatalf("close read: %v", err)
+	}
+	if _, err := streamAB.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read after CloseRead succeeded")
+	}
+	// Data still sent by the remote is discarded without harming the
+	// connection.
+	if _, err := streamBA.Write([]byte("ignored")); err != nil {
+		t.Fatalf("remote write: %v", err)
+	}
+
+	if _, err := streamAB.Write([]byte("still writing")); err != nil {
+		t.Fatalf("write after CloseRead: %v", err)
+	}
+	streamAB.CloseWrite()
+	data, err := io.ReadAll(streamBA)
+	if err != nil || string(data) != "still writing" {
+		t.Fatalf("remote read returned %q, %v", data, err)
+	}
+	if connAB.IsClosed() {
+		t.Fatalf("data for a read-closed stream closed the connection")
+	}
+}
+
+func TestConnRoundTripHonoursContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	// The server accepts the stream but never answers.
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.AcceptStream()
+	}()
+
+	raw, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer raw.Close()
+
+	rtCtx, rtCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer rtCancel()
+	if _, err := raw.(*Conn).RoundTrip(rtCtx, []byte("ping")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+}
+
+func TestSimultaneousOpenWithCollidingIDs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Hold the first open request in the pipe until both sides have sent theirs.
+	gate := make(chan struct{})
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if tm := msg.Message.Transport; tm != nil && tm.Message.Type == message.SubstreamMessageOpenRequest {
+			<-gate
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+
+	var sharedID message.SubstreamID
+	sharedID[0] = 0x42
+	fixedID := func() (message.SubstreamID, error) { return sharedID, nil }
+	transportA.newSubstreamID = fixedID
+	transportB.newSubstreamID = fixedID
+
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	rawAB, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	rawBA, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	connAB, connBA := rawAB.(*Conn), rawBA.(*Conn)
+
+	type result struct {
+		stream *Substream
+		err    error
+	}
+	open := func(c *Conn, out chan<- result) {
+		s, err := c.OpenStream(ctx)
+		if err != nil {
+			out <- result{err: err}
+			return
+		}
+		out <- result{stream: s.(*Substream)}
+	}
+	resA, resB := make(chan result, 1), make(chan result, 1)
+	go open(connAB, resA)
+	go open(connBA, resB)
+
+	pending := func(c *Conn) int {
+		c.streamsMu.Lock()
+		defer c.streamsMu.Unlock()
+		return len(c.pendingOutbound)
+	}
+	for pending(connAB) == 0 || pending(connBA) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+
+	a, b := <-resA, <-resB
+	if a.err != nil || b.err != nil {
+		t.Fatalf("open stream: a=%v b=%v", a.err, b.err)
+	}
+	if a.stream.id != sharedID || b.stream.id != sharedID {
+		t.Fatalf("streams do not share the colliding id")
+	}
+	if len(connAB.inboundSubstreams) != 0 || len(connBA.inboundSubstreams) != 0 {
+		t.Fatalf("simultaneous open produced an extra inbound stream")
+	}
+	if len(connAB.streams) != 1 || len(connBA.streams) != 1 {
+		t.Fatalf("expected a single stream per side, got %d and %d", len(connAB.streams), len(connBA.streams))
+	}
+
+	if _, err := a.stream.Write([]byte("from a")); err != nil {
+		t.Fatalf("write a: %v", err)
+	}
+	buf := make([]byte, len("from a"))
+	if _, err := io.ReadFull(b.stream, buf); err != nil || string(buf) != "from a" {
+		t.Fatalf("read b: %q %v", buf, err)
+	}
+	if _, err := b.stream.Write([]byte("from b")); err != nil {
+		t.Fatalf("write b: %v", err)
+	}
+	if _, err := io.ReadFull(a.stream, buf); err != nil || string(buf) != "from b" {
+		t.Fatalf("read a: %q %v", buf, err)
+	}
+}
+
+func TestConcurrentDialsShareHandshake(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Hold the first connection request until every dial has started.
+	var requests atomic.Int32
+	gate := make(chan struct{})
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if msg.Message.Type == message.MessageTypeConnectionRequest {
+			requests.Add(1)
+			<-gate
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	const dials = 20
+	var started sync.WaitGroup
+	started.Add(dials)
+	conns := make(chan lptransport.CapableConn, dials)
+	errs := make(chan error, dials)
+	for i := 0; i < dials; i++ {
+		go func() {
+			started.Done()
+			conn, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+			if err != nil {
+				errs <- err
+				return
+			}
+			conns <- conn
+		}()
+	}
+	started.Wait()
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the remaining dials a moment to join the in-flight handshake.
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+
+	var first lptransport.CapableConn
+	for i := 0; i < dials; i++ {
+		select {
+		case err := <-errs:
+			t.Fatalf("dial: %v", err)
+		case conn := <-conns:
+			if first == nil {
+				first = conn
+			} else if conn != first {
+				t.Fatalf("concurrent dials returned distinct connections")
+			}
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("expected a single handshake, saw %d connection requests", n)
+	}
+}
+
+func TestCoalescedDialOutlivesCancelledLeader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Hold the connection request until both dials share the handshake.
+	var requests atomic.Int32
+	gate := make(chan struct{})
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if msg.Message.Type == message.MessageTypeConnectionRequest {
+			requests.Add(1)
+			<-gate
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	leaderCtx, cancelLeader := context.WithCancel(ctx)
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := transportA.Dial(leaderCtx, transportB.listenAddr, transportB.localPeer)
+		leaderErr <- err
+	}()
+	waitFor(t, ctx, "the leader's connection request", func() bool {
+		return requests.Load() == 1
+	})
+
+	followerErr := make(chan error, 1)
+	followerConn := make(chan lptransport.CapableConn, 1)
+	go func() {
+		conn, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+		followerErr <- err
+		followerConn <- conn
+	}()
+	waitFor(t, ctx, "the follower to join the handshake", func() bool {
+		transportA.mu.Lock()
+		defer transportA.mu.Unlock()
+		for _, inflight := range transportA.inflightDials {
+			return inflight.waiters == 2
+		}
+		return false
+	})
+
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("leader dial error = %v, want context.Canceled", err)
+	}
+	close(gate)
+
+	if err := <-followerErr; err != nil {
+		t.Fatalf("follower dial: %v", err)
+	}
+	if conn := <-followerConn; conn == nil || conn.IsClosed() {
+		t.Fatalf("follower did not receive a live connection")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("expected a single handshake, saw %d connection requests", n)
+	}
+}
+
+func TestListenFailsWhenMixnetDisconnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	inbound := make(chan mixnet.InboundMessage)
+	outbound := make(chan mixnet.OutboundMessage, 32)
+	tpt, err := newWithMixnet(ctx, priv, testRecipient(0x11), inbound, outbound)
+	if err != nil {
+		t.Fatalf("create transport: %v", err)
+	}
+	defer tpt.Close()
+
+	live, err := tpt.Listen(tpt.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer live.Close()
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := live.Accept()
+		acceptErr <- err
+	}()
+
+	close(inbound)
+	<-tpt.mixnetDone
+
+	select {
+	case err := <-acceptErr:
+		if !errors.Is(err, ErrMixnetDisconnected) {
+			t.Fatalf("accept: expected ErrMixnetDisconnected, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("accept did not fail after mixnet disconnect")
+	}
+
+	if _, err := tpt.Listen(tpt.listenAddr); !errors.Is(err, ErrMixnetDisconnected) {
+		t.Fatalf("listen: expected ErrMixnetDisconnected, got %v", err)
+	}
+	if _, err := tpt.ListenAnonymous(); !errors.Is(err, ErrMixnetDisconnected) {
+		t.Fatalf("listen anonymous: expected ErrMixnetDisconnected, got %v", err)
+	}
+}
+
+func TestAcceptBacklogBoundsUnacceptedStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const backlog = 4
+	transportA, transportB := newTestTransports(t, ctx, WithAcceptBacklog(backlog))
+	connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	before := runtime.NumGoroutine()
+	refused := 0
+	for i := 0; i < 200; i++ {
+		_, err := connAB.OpenStream(ctx)
+		if errors.Is(err, network.ErrReset) {
+			refused++
+			continue
+		}
+		if err != nil {
+			t.Fatalf("open stream %d: %v", i, err)
+		}
+	}
+	if refused != 200-backlog {
+		t.Fatalf("expected %d refused opens, got %d", 200-backlog, refused)
+	}
+	if growth := runtime.NumGoroutine() - before; growth > 10 {
+		t.Fatalf("goroutines grew by %d while streams went unaccepted", growth)
+	}
+
+	// Accepting frees backlog space for new streams.
+	if _, err := connBA.AcceptStream(); err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	if _, err := connAB.OpenStream(ctx); err != nil {
+		t.Fatalf("open stream after accept: %v", err)
+	}
+}
+
+func TestCloseWaitReturnsAfterRemoteAck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Hold close acks until the test releases them.
+	release := make(chan struct{})
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if tm := msg.Message.Transport; tm != nil && tm.Message.Type == message.SubstreamMessageCloseAck {
+			<-release
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithCloseControl(true))
+	_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if _, err := streamAB.Write([]byte("last words")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- streamAB.CloseWait(ctx)
+	}()
+
+	// The remote has seen the data and the close once it reads EOF.
+	data, err := io.ReadAll(streamBA)
+	if err != nil || string(data) != "last words" {
+		t.Fatalf("remote read: %q %v", data, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("CloseWait returned before the ack was delivered: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("CloseWait: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("CloseWait did not return after the ack")
+	}
+
+	if err := streamAB.CloseWait(ctx); err == nil {
+		t.Fatalf("second CloseWait succeeded")
+	}
+}
+
+func TestLingerCloseWaitsForAck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const hold = 100 * time.Millisecond
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if tm := msg.Message.Transport; tm != nil && tm.Message.Type == message.SubstreamMessageCloseAck {
+			time.Sleep(hold)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithCloseControl(true))
+	_, _, streamAB, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	if _, err := streamAB.Write([]byte("flush me")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	streamAB.SetLinger(5 * time.Second)
+	start := time.Now()
+	if err := streamAB.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < hold {
+		t.Fatalf("close returned after %v, before the ack was delivered", elapsed)
+	}
+}
+
+func TestLingerCloseGivesUpAfterTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		tm := msg.Message.Transport
+		return tm == nil || tm.Message.Type != message.SubstreamMessageCloseAck
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithCloseControl(true))
+	_, _, streamAB, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	if _, err := streamAB.Write([]byte("lost ack")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	const linger = 100 * time.Millisecond
+	streamAB.SetLinger(linger)
+	start := time.Now()
+	if err := streamAB.Close(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("close returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed < linger || elapsed > time.Second {
+		t.Fatalf("close returned after %v, want about %v", elapsed, linger)
+	}
+	if _, err := streamAB.Write([]byte("x")); err == nil {
+		t.Fatal("write succeeded after linger timed out")
+	}
+}
+
+func TestCloseAckNeedsBothEnds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Only A advertises close control, as when talking to a peer that would
+	// drop a close ack; neither end may then send one.
+	var acks atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if tm := msg.Message.Transport; tm != nil && tm.Message.Type == message.SubstreamMessageCloseAck {
+			acks.Add(1)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+	transportA.cfg.closeControl = true
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+	if connAB.closeControl || connBA.closeControl {
+		t.Fatalf("close control enabled with one end advertising it")
+	}
+
+	if _, err := streamAB.Write([]byte("no ack")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := streamAB.CloseWait(ctx); err != nil {
+		t.Fatalf("CloseWait: %v", err)
+	}
+	if data, err := io.ReadAll(streamBA); err != nil || string(data) != "no ack" {
+		t.Fatalf("remote read: %q %v", data, err)
+	}
+	streamBA.Close()
+
+	// The connection still delivers in order after both closes.
+	streamAB2, err := connAB.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	if _, err := streamAB2.Write([]byte("after")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	streamBA2, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	buf := make([]byte, len("after"))
+	if _, err := io.ReadFull(streamBA2, buf); err != nil || string(buf) != "after" {
+		t.Fatalf("read after close: %q %v", buf, err)
+	}
+	if n := acks.Load(); n != 0 {
+		t.Fatalf("sent %d close acks without close control", n)
+	}
+}
+
+func TestConnAndStreamIDsMatchAcrossEnds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	var generated []message.SubstreamID
+	transportA.newSubstreamID = func() (message.SubstreamID, error) {
+		id, err := message.GenerateSubstreamID()
+		generated = append(generated, id)
+		return id, err
+	}
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if connAB.ID() != connBA.ID() {
+		t.Fatalf("connection IDs differ: %s vs %s", connAB.ID(), connBA.ID())
+	}
+	transportA.mu.RLock()
+	registered := transportA.connections[connKey(connAB.ID())]
+	transportA.mu.RUnlock()
+	if registered != connAB {
+		t.Fatalf("Conn.ID does not match the registered connection")
+	}
+	if len(generated) != 1 || streamAB.ID() != generated[0] {
+		t.Fatalf("Substream.ID does not match the generated ID")
+	}
+	if streamBA.ID() != streamAB.ID() {
+		t.Fatalf("substream IDs differ: %s vs %s", streamAB.ID(), streamBA.ID())
+	}
+}
+
+func TestListenerSurvivesMixnetReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := testutil.NewNymServer()
+	defer srv.Close()
+
+	newTransport := func(name string, opts ...Option) *Transport {
+		priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		tpt, err := New(ctx, srv.URL(name), priv, opts...)
+		if err != nil {
+			t.Fatalf("create transport %s: %v", name, err)
+		}
+		t.Cleanup(func() { tpt.Close() })
+		return tpt
+	}
+	transportA := newTransport("a")
+	transportB := newTransport("b", WithReconnect(5, 10*time.Millisecond))
+
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	srv.Disconnect("b")
+	for srv.Connects("b") < 2 {
+		if ctx.Err() != nil {
+			t.Fatalf("transport did not reconnect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer); err != nil {
+		t.Fatalf("dial after reconnect: %v", err)
+	}
+	if _, err := listener.Accept(); err != nil {
+		t.Fatalf("accept after reconnect: %v", err)
+	}
+	if transportB.mixnetClosed() {
+		t.Fatalf("transport reported a disconnect despite reconnecting")
+	}
+}
+
+func TestOpenStreamWithDataPiggybacksInitialWrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var dataMessages atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if tm := msg.Message.Transport; tm != nil && tm.Message.Type == message.SubstreamMessageData {
+			dataMessages.Add(1)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+	connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	raw, err := connAB.OpenStreamWithData(ctx, []byte("GET /"))
+	if err != nil {
+		t.Fatalf("open stream with data: %v", err)
+	}
+	defer raw.Close()
+	accepted, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+
+	buf := make([]byte, len("GET /"))
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "GET /" {
+		t.Fatalf("read initial data: %q %v", buf, err)
+	}
+	if n := dataMessages.Load(); n != 0 {
+		t.Fatalf("initial data needed %d separate data messages", n)
+	}
+
+	// Later writes follow the initial data as usual.
+	if _, err := raw.Write([]byte(" HTTP")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf = make([]byte, len(" HTTP"))
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != " HTTP" {
+		t.Fatalf("read follow-up data: %q %v", buf, err)
+	}
+}
+
+func TestAddressedConnIsNotAnonymous(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+	if connAB.IsAnonymous() || connBA.IsAnonymous() {
+		t.Fatalf("addressed connection reported as anonymous")
+	}
+	if connAB.ConnState().Transport != nymProtocolName || connBA.ConnState().Transport != nymProtocolName {
+		t.Fatalf("addressed connection state names transport %q", connAB.ConnState().Transport)
+	}
+}
+
+func TestRemotePublicKeyMatchesRemotePeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	rsaKey := func() crypto.PrivKey {
+		priv, _, err := crypto.GenerateRSAKeyPair(2048, rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		return priv
+	}
+	for _, tc := range []struct {
+		name string
+		// rotate, if set, returns the identities to switch A and B to.
+		rotate func() (crypto.PrivKey, crypto.PrivKey)
+	}{
+		{name: "ed25519"},
+		{name: "rsa", rotate: func() (crypto.PrivKey, crypto.PrivKey) { return rsaKey(), rsaKey() }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			transportA, transportB := newTestTransports(t, ctx)
+			if tc.rotate != nil {
+				privA, privB := tc.rotate()
+				if err := transportA.RotateIdentity(privA); err != nil {
+					t.Fatalf("rotate A: %v", err)
+				}
+				if err := transportB.RotateIdentity(privB); err != nil {
+					t.Fatalf("rotate B: %v", err)
+				}
+			}
+			connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+
+			for _, conn := range []*Conn{connAB, connBA} {
+				pub := conn.RemotePublicKey()
+				if pub == nil {
+					t.Fatalf("no remote public key")
+				}
+				id, err := peer.IDFromPublicKey(pub)
+				if err != nil {
+					t.Fatalf("derive peer id: %v", err)
+				}
+				if id != conn.RemotePeer() {
+					t.Fatalf("remote public key belongs to %s, remote peer is %s", id, conn.RemotePeer())
+				}
+			}
+		})
+	}
+}
+
+func TestConnectionRequestWithMismatchedKeyIsDropped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, transportB := newTestTransports(t, ctx)
+	priv, _, err := crypto.GenerateRSAKeyPair(2048, rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("derive peer id: %v", err)
+	}
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	wrongKey, err := crypto.MarshalPublicKey(other.GetPublic())
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	recipient := testRecipient(0x33)
+	err = transportB.handleConnectionRequest(&message.ConnectionMessage{
+		PeerID:    id,
+		Recipient: &recipient,
+		ID:        message.ConnectionID{0x33},
+		PublicKey: wrongKey,
+	}, nil)
+	if err == nil {
+		t.Fatalf("request announcing another peer's key was accepted")
+	}
+	if n := len(transportB.Conns()); n != 0 {
+		t.Fatalf("listener holds %d connections", n)
+	}
+}
+
+func TestSetVerifiedPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, _, _, _ := openTestStreams(t, ctx, transportA, transportB)
+
+	if connAB.PeerVerified() {
+		t.Fatalf("fresh connection reported as verified")
+	}
+
+	otherKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	if err := connAB.SetVerifiedPeer(transportB.localPeer, otherKey.GetPublic()); err == nil {
+		t.Fatalf("SetVerifiedPeer accepted a key for a different peer")
+	}
+	if connAB.PeerVerified() {
+		t.Fatalf("failed verification marked the peer verified")
+	}
+
+	pub := transportB.privKey.GetPublic()
+	if err := connAB.SetVerifiedPeer(transportB.localPeer, pub); err != nil {
+		t.Fatalf("SetVerifiedPeer: %v", err)
+	}
+	if !connAB.PeerVerified() {
+		t.Fatalf("peer not marked verified")
+	}
+	if connAB.RemotePeer() != transportB.localPeer || !connAB.RemotePublicKey().Equals(pub) {
+		t.Fatalf("verified identity not reported back")
+	}
+}
+
+func TestMaxPayloadSizeFragmentsWrites(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const fragmentSize = 200
+	var largest atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if tm := msg.Message.Transport; tm != nil {
+			encoded, _ := message.Encode(msg.Message)
+			if n := int32(len(encoded)); n > largest.Load() {
+				largest.Store(n)
+			}
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept, WithMaxFragmentSize(fragmentSize))
+	connAB, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	if got, want := connAB.MaxPayloadSize(), fragmentSize-message.TransportOverhead; got != want {
+		t.Fatalf("MaxPayloadSize = %d, want %d", got, want)
+	}
+
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	if n, err := streamAB.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("write: %d %v", n, err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(streamBA, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("fragmented payload corrupted")
+	}
+	if n := largest.Load(); n > fragmentSize {
+		t.Fatalf("sent a %d byte message, above fragment size %d", n, fragmentSize)
+	}
+
+	if _, err := connAB.OpenStreamWithData(ctx, payload); err == nil {
+		t.Fatalf("open stream with oversized initial data succeeded")
+	}
+}
+
+func TestFragmentSizeCountsWireLayout(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"checksum": WithChecksum(true),
+		"v1":       WithWireVersion(message.WireV1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// Traced encodings use the configured layout, as the mixnet
+			// client does when it sends them.
+			const fragmentSize = 200
+			var largest atomic.Int32
+			trace := func(ev TraceEvent) {
+				if ev.Direction == TraceOutbound && ev.Message.Type == message.MessageTypeTransport {
+					if n := int32(len(ev.Encoded)); n > largest.Load() {
+						largest.Store(n)
+					}
+				}
+			}
+			transportA, transportB := newTestTransports(t, ctx, opt, WithMaxFragmentSize(fragmentSize), WithMessageTrace(trace))
+			_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+			payload := make([]byte, 1000)
+			if _, err := streamAB.Write(payload); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if _, err := io.ReadFull(streamBA, make([]byte, len(payload))); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if n := largest.Load(); n != fragmentSize {
+				t.Fatalf("largest message is %d bytes, want fragment size %d", n, fragmentSize)
+			}
+		})
+	}
+}
+
+func TestWrite64KBUsesDefaultFragments(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var fragments, oversized atomic.Int32
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if tm := msg.Message.Transport; tm != nil && tm.Message.Type == message.SubstreamMessageData {
+			fragments.Add(1)
+			if encoded, _ := message.Encode(msg.Message); len(encoded) > defaultFragmentPayload+message.TransportOverhead {
+				oversized.Add(1)
+			}
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+	connAB, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	payload := make([]byte, 64<<10)
+	rand.Read(payload)
+	go func() {
+		if n, err := streamAB.Write(payload); err != nil || n != len(payload) {
+			t.Errorf("write: %d %v", n, err)
+		}
+	}()
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(streamBA, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("64KB payload corrupted")
+	}
+	want := (len(payload) + connAB.MaxPayloadSize() - 1) / connAB.MaxPayloadSize()
+	if n := fragments.Load(); int(n) != want {
+		t.Fatalf("sent %d data messages, want %d", n, want)
+	}
+	if n := oversized.Load(); n != 0 {
+		t.Fatalf("%d data messages exceeded the default fragment size", n)
+	}
+}
+
+func TestPartialWriteReportsQueuedFragments(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const free = 3
+	outbound := make(chan mixnet.OutboundMessage, free)
+	_, conn := newUndrainedTestConn(t, ctx, outbound)
+	stream := newSubstream(conn, message.SubstreamID{0x01})
+
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := stream.Write(make([]byte, 5*conn.MaxPayloadSize()))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error once the queue filled, got %v", err)
+	}
+	if want := free * conn.MaxPayloadSize(); n != want {
+		t.Fatalf("write reported %d bytes, want the %d queued", n, want)
+	}
+}
+
+func TestStalledReaderDoesNotBlockOtherStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const readBuffer = 4 << 10
+	transportA, transportB := newTestTransports(t, ctx, WithStreamReadBuffer(readBuffer))
+	connAB, connBA, stalledAB, stalledBA := openTestStreams(t, ctx, transportA, transportB)
+	activeAB, err := connAB.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open second stream: %v", err)
+	}
+	activeBA, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept second stream: %v", err)
+	}
+
+	// Several times what the stalled stream buffers, though less than it
+	// holds back before giving up on the reader.
+	payload := make([]byte, maxHeldBuffers/2*readBuffer)
+	rand.Read(payload)
+	if _, err := stalledAB.Write(payload); err != nil {
+		t.Fatalf("write to stalled stream: %v", err)
+	}
+	stalledAB.CloseWrite()
+	if _, err := activeAB.Write([]byte("ping")); err != nil {
+		t.Fatalf("write to active stream: %v", err)
+	}
+	activeBA.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(activeBA, got); err != nil || string(got) != "ping" {
+		t.Fatalf("active stream read %q, %v while the other reader stalled", got, err)
+	}
+
+	stalledBA.holdMu.Lock()
+	inboundBytes, held := stalledBA.inboundBytes, len(stalledBA.held)
+	stalledBA.holdMu.Unlock()
+	if inboundBytes > readBuffer || held == 0 {
+		t.Fatalf("stalled stream buffers %d bytes with %d chunks held, want at most %d buffered", inboundBytes, held, readBuffer)
+	}
+
+	// The held data follows in order, then EOF.
+	all, err := io.ReadAll(stalledBA)
+	if err != nil {
+		t.Fatalf("drain stalled stream: %v", err)
+	}
+	if !bytes.Equal(all, payload) {
+		t.Fatalf("stalled stream read %d bytes, want the %d written", len(all), len(payload))
+	}
+}
+
+func TestStalledReaderTooFarBehindIsReset(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const readBuffer = 4 << 10
+	transportA, transportB := newTestTransports(t, ctx, WithStreamReadBuffer(readBuffer))
+	_, _, stalledAB, stalledBA := openTestStreams(t, ctx, transportA, transportB)
+
+	payload := make([]byte, 2*maxHeldBuffers*readBuffer)
+	if _, err := stalledAB.Write(payload); err != nil {
+		t.Fatalf("write to stalled stream: %v", err)
+	}
+	waitFor(t, ctx, "stalled stream reset", func() bool {
+		return stalledBA.reset.Load()
+	})
+	stalledBA.holdMu.Lock()
+	held := stalledBA.heldBytes
+	stalledBA.holdMu.Unlock()
+	if held != 0 {
+		t.Fatalf("reset stream still holds %d bytes", held)
+	}
+	if _, err := io.ReadAll(stalledBA); !errors.Is(err, network.ErrReset) {
+		t.Fatalf("read from reset stream: %v, want %v", err, network.ErrReset)
+	}
+}
+
+func TestDialerFollowsAdvertisedReplyRecipient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The listener owns two gateway addresses, receives on both, and asks
+	// dialers to use the second.
+	endpoints, err := testutil.PipeNetworkN(ctx, testRecipient(0x11), testRecipient(0x22), testRecipient(0x33))
+	if err != nil {
+		t.Fatalf("pipe network: %v", err)
+	}
+	a, b, alt := endpoints[0], endpoints[1], endpoints[2]
+	merged := make(chan mixnet.InboundMessage, 64)
+	var altReceived atomic.Int32
+	go func() {
+		for msg := range b.Inbound {
+			merged <- msg
+		}
+	}()
+	go func() {
+		for msg := range alt.Inbound {
+			altReceived.Add(1)
+			merged <- msg
+		}
+	}()
+
+	privA, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	privB, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	transportA, err := newWithMixnet(ctx, privA, a.Recipient, a.Inbound, a.Outbound)
+	if err != nil {
+		t.Fatalf("create transportA: %v", err)
+	}
+	defer transportA.Close()
+	transportB, err := newWithMixnet(ctx, privB, b.Recipient, merged, b.Outbound, WithReplyRecipient(alt.Recipient))
+	if err != nil {
+		t.Fatalf("create transportB: %v", err)
+	}
+	defer transportB.Close()
+
+	connAB, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+	wantAddr, err := multiaddrFromRecipient(alt.Recipient)
+	if err != nil {
+		t.Fatalf("multiaddr: %v", err)
+	}
+	if !connAB.RemoteMultiaddr().Equal(wantAddr) {
+		t.Fatalf("dialer remote address %s, want advertised %s", connAB.RemoteMultiaddr(), wantAddr)
+	}
+
+	if _, err := streamAB.Write([]byte("via alt")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len("via alt"))
+	if _, err := io.ReadFull(streamBA, buf); err != nil || string(buf) != "via alt" {
+		t.Fatalf("read: %q %v", buf, err)
+	}
+	// The open request and the data both went to the advertised recipient.
+	if n := altReceived.Load(); n < 2 {
+		t.Fatalf("advertised recipient received %d messages, want at least 2", n)
+	}
+}
+
+func TestReadDeadlineReturnsBufferedDataFirst(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	_, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	waitBuffered := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			for _, s := range connBA.StreamStats() {
+				if s.ID == streamBA.ID() && s.BufferedBytes == n {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("stream never buffered %d bytes", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if _, err := streamAB.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	waitBuffered(len("hello"))
+	buf := make([]byte, 2)
+	if n, err := streamBA.Read(buf); err != nil || string(buf[:n]) != "he" {
+		t.Fatalf("first read: %q %v", buf[:n], err)
+	}
+
+	// The rest of the chunk is buffered, so an expired deadline doesn't hide it.
+	streamBA.SetReadDeadline(time.Now().Add(-time.Second))
+	buf = make([]byte, 16)
+	if n, err := streamBA.Read(buf); err != nil || string(buf[:n]) != "llo" {
+		t.Fatalf("read with expired deadline and buffered data: %q %v", buf[:n], err)
+	}
+	if n, err := streamBA.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) || n != 0 {
+		t.Fatalf("read with expired deadline and no data: %d %v", n, err)
+	}
+
+	// Data that arrived while the deadline was expired is delivered too.
+	if _, err := streamAB.Write([]byte("more")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	waitBuffered(len("more"))
+	if n, err := streamBA.Read(buf); err != nil || string(buf[:n]) != "more" {
+		t.Fatalf("read queued chunk with expired deadline: %q %v", buf[:n], err)
+	}
+
+	// A future deadline times out a read with nothing to deliver.
+	streamBA.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := streamBA.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past future deadline: %v", err)
+	}
+}
+
+func TestSetReadDeadlineWakesBlockedRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	read := func() <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := streamBA.Read(make([]byte, 8))
+			done <- err
+		}()
+		return done
+	}
+
+	// Moving the deadline into the past fails a read blocked on a later one.
+	streamBA.SetReadDeadline(time.Now().Add(time.Minute))
+	done := read()
+	time.Sleep(20 * time.Millisecond)
+	streamBA.SetReadDeadline(time.Now().Add(-time.Second))
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read after deadline moved to the past: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked read ignored the new deadline")
+	}
+
+	// Clearing the deadline lets a read outlive the one it started with.
+	streamBA.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done = read()
+	streamBA.SetReadDeadline(time.Time{})
+	select {
+	case err := <-done:
+		t.Fatalf("read returned %v after its deadline was cleared", err)
+	case <-time.After(150 * time.Millisecond):
+	}
+	if _, err := streamAB.Write([]byte("late")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("read after clearing the deadline: %v", err)
+	}
+}
+
+func TestConnReadyOnBothSidesAfterHandshake(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	dialed, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	// No streams are opened: the listener learns of readiness from the ack.
+	for name, c := range map[string]*Conn{"dialer": dialed.(*Conn), "listener": accepted.(*Conn)} {
+		select {
+		case <-c.Ready():
+		case <-ctx.Done():
+			t.Fatalf("%s never became ready", name)
+		}
+	}
+}
+
+func TestConnManagerTrimClosesRemoteEnd(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, connBA, _, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	// The connection manager trims connections with CloseWithError.
+	if err := connAB.CloseWithError(network.ConnGarbageCollected); err != nil {
+		t.Fatalf("close with error: %v", err)
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := connBA.AcceptStream()
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, network.ErrReset) {
+			t.Fatalf("accept stream after remote close returned %v, want %v", err, network.ErrReset)
+		}
+	case <-ctx.Done():
+		t.Fatal("accept stream kept blocking after the remote closed the connection")
+	}
+	if !connBA.IsClosed() {
+		t.Fatal("listener connection is still open after the remote closed it")
+	}
+	if _, err := streamBA.Read(make([]byte, 1)); !errors.Is(err, network.ErrReset) {
+		t.Fatalf("read on stream of closed connection returned %v, want %v", err, network.ErrReset)
+	}
+	if n := len(transportA.Conns()) + len(transportB.Conns()); n != 0 {
+		t.Fatalf("%d connections still tracked after close", n)
+	}
+}
+
+func TestConnCloseEndsBlockedRemoteRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, connBA, _, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := streamBA.Read(make([]byte, 1))
+		read <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := connAB.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	select {
+	case err := <-read:
+		if !errors.Is(err, network.ErrReset) {
+			t.Fatalf("blocked read returned %v, want %v", err, network.ErrReset)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked read outlived the remote close")
+	}
+	if _, err := connBA.AcceptStream(); !errors.Is(err, network.ErrReset) {
+		t.Fatalf("accept stream returned %v, want %v", err, network.ErrReset)
+	}
+}
+
+func TestStreamReadDistinguishesCloseFromReset(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	// A graceful close ends the remote's reads with EOF after the data.
+	if _, err := streamAB.Write([]byte("bye")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := streamAB.Close(); err != nil {
+		t.Fatalf("close stream: %v", err)
+	}
+	if data, err := io.ReadAll(streamBA); err != nil || string(data) != "bye" {
+		t.Fatalf("read after close returned %q, %v; want %q, nil", data, err, "bye")
+	}
+
+	// A local reset fails further reads.
+	rawAB, err := connAB.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	resetBA, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	rawAB.Reset()
+	if _, err := rawAB.Read(make([]byte, 1)); !errors.Is(err, network.ErrReset) {
+		t.Fatalf("read after reset returned %v, want %v", err, network.ErrReset)
+	}
+	// The wire carries no reset, so the remote sees a close.
+	if _, err := resetBA.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("remote read after reset returned %v, want EOF", err)
+	}
+
+	// Losing the connection resets the streams still open on it.
+	lastAB, err := connAB.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	lastBA, err := connBA.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	connAB.Close()
+	for _, s := range []network.MuxedStream{lastAB, lastBA} {
+		if _, err := s.Read(make([]byte, 1)); !errors.Is(err, network.ErrReset) {
+			t.Fatalf("read after connection close returned %v, want %v", err, network.ErrReset)
+		}
+	}
+}
+
+func TestCloseNotifiesPeersOfOpenConns(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	var accepted []*Conn
+	for i := 0; i < 3; i++ {
+		if _, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer); err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		c, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("accept %d: %v", i, err)
+		}
+		accepted = append(accepted, c.(*Conn))
+	}
+
+	if err := transportA.Close(); err != nil {
+		t.Fatalf("close transport: %v", err)
+	}
+	for i, c := range accepted {
+		if _, err := c.AcceptStream(); !errors.Is(err, network.ErrReset) {
+			t.Fatalf("accept stream on conn %d returned %v, want %v", i, err, network.ErrReset)
+		}
+	}
+	if n := len(transportB.Conns()); n != 0 {
+		t.Fatalf("peer still tracks %d connections after transport close", n)
+	}
+}
+
+func TestIOCopyStreamsLargePayload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	transportA, transportB := newTestTransports(t, ctx)
+	_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	payload := make([]byte, 4<<20)
+	rand.Read(payload)
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(streamBA)
+		received <- data
+	}()
+
+	// A reader without WriterTo, so io.Copy uses the stream's ReadFrom.
+	n, err := io.Copy(streamAB, struct{ io.Reader }{bytes.NewReader(payload)})
+	if err != nil || n != int64(len(payload)) {
+		t.Fatalf("copy: %d bytes, %v", n, err)
+	}
+	if err := streamAB.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, payload) {
+			t.Fatalf("received %d bytes that differ from the %d sent", len(data), len(payload))
+		}
+	case <-ctx.Done():
+		t.Fatal("payload never arrived")
+	}
+}
+
+func TestHeavyConnDoesNotStarveLightConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Throttle the network so the heavy connection keeps the outbound
+	// queue full for the whole test.
+	const perMessage = 2 * time.Millisecond
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		if msg.Message.Type == message.MessageTypeTransport {
+			time.Sleep(perMessage)
+		}
+		return true
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+	_, _, heavy, heavyRemote := openTestStreams(t, ctx, transportA, transportB)
+	// Connections go to a single listener, which could be the first one.
+	closeListeners(transportB)
+	_, _, light, lightRemote := openTestStreams(t, ctx, transportA, transportB)
+	if heavy.conn == light.conn {
+		t.Fatal("both streams share a connection")
+	}
+
+	const heavyMessages = 400
+	heavyDone := make(chan struct{})
+	go io.Copy(io.Discard, heavyRemote)
+	go func() {
+		defer close(heavyDone)
+		heavy.Write(make([]byte, heavyMessages*heavy.conn.MaxPayloadSize()))
+	}()
+
+	// Let the heavy writer fill the outbound queue.
+	time.Sleep(50 * perMessage)
+	start := time.Now()
+	if _, err := light.Write([]byte("ping")); err != nil {
+		t.Fatalf("light write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(lightRemote, buf); err != nil {
+		t.Fatalf("light read: %v", err)
+	}
+	latency := time.Since(start)
+
+	select {
+	case <-heavyDone:
+		t.Fatalf("heavy transfer finished before the light message arrived after %v", latency)
+	default:
+	}
+	// Senders wait for outbound capacity in arrival order and each
+	// connection has at most one sender waiting, so the light message only
+	// queues behind what is already buffered, not the rest of the transfer.
+	if budget := time.Duration(2*cap(transportA.mixnetOutbound)) * perMessage; latency > budget {
+		t.Fatalf("light message took %v behind the heavy connection, want under %v", latency, budget)
+	}
+}
+
+func TestCancelledOpenStreamResetsRemoteStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Drop open responses so OpenStream waits until it is cancelled.
+	intercept := func(msg mixnet.OutboundMessage) bool {
+		tm := msg.Message.Transport
+		return tm == nil || tm.Message.Type != message.SubstreamMessageOpenResponse
+	}
+	transportA, transportB := newInterceptedTestTransports(t, ctx, intercept)
+	listener, err := transportB.Listen(transportB.listenAddr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	dialed, err := transportA.Dial(ctx, transportB.listenAddr, transportB.localPeer)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	connAB, connBA := dialed.(*Conn), accepted.(*Conn)
+
+	openCtx, openCancel := context.WithCancel(ctx)
+	opened := make(chan error, 1)
+	go func() {
+		_, err := connAB.OpenStream(openCtx)
+		opened <- err
+	}()
+	waitFor(t, ctx, "remote to create the stream", func() bool { return len(connBA.StreamStats()) == 1 })
+
+	openCancel()
+	if err := <-opened; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled OpenStream returned %v, want %v", err, context.Canceled)
+	}
+	waitFor(t, ctx, "remote to drop the stream", func() bool { return len(connBA.StreamStats()) == 0 })
+	waitFor(t, ctx, "opener to drop the stream", func() bool { return len(connAB.StreamStats()) == 0 })
+}
+
+// waitFor polls cond until it holds, failing the test once ctx is done.
+func waitFor(t *testing.T, ctx context.Context, what string, cond func() bool) {
+	t.Helper()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", what)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
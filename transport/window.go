@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"errors"
+	"math"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"banyan/transports/nym/message"
+)
+
+// WithStreamWindow enables credit-based flow control with a window of n bytes
+// per stream and direction. A writer may have at most n bytes in flight that
+// the remote reader has not consumed; once that credit is spent, Write and
+// ReadFrom block, within the write deadline, until the reader grants more
+// with a window update. The reader grants credit back in batches of half the
+// window as it reads, so a stalled reader stalls its writer instead of
+// growing the receive buffers.
+//
+// Each end offers its window in the connection handshake, and flow control
+// is only used on connections where both ends offered one; each then limits
+// its writes to the window the other offered. Connections to peers without
+// flow control, such as rust-libp2p-nym, go without. Zero, the default,
+// disables it.
+func WithStreamWindow(n int) Option {
+	return func(c *config) {
+		if n >= 0 {
+			c.streamWindow = n
+		}
+	}
+}
+
+// errStreamClosed is returned by writes on a stream that is closed for writing.
+var errStreamClosed = errors.New("substream closed")
+
+// streamWindowOffer is the window offered in connection handshakes, capped to
+// what the wire can carry.
+func (t *Transport) streamWindowOffer() uint32 {
+	return uint32(min(uint64(t.cfg.streamWindow), math.MaxUint32))
+}
+
+// negotiateWindow enables flow control on c if the remote offered a window
+// in its handshake message and we offer one too.
+func (c *Conn) negotiateWindow(remote uint32) {
+	if local := c.transport.cfg.streamWindow; local > 0 && remote > 0 {
+		c.sendWindow, c.recvWindow = int(remote), local
+	}
+}
+
+// initWindow gives a new stream the initial send credit.
+func (s *Substream) initWindow() {
+	s.sendCredit = int64(s.conn.sendWindow)
+	s.windowGrant = make(chan struct{}, 1)
+}
+
+// acquireCredit waits until some send credit is available and takes up to
+// want bytes of it, returning how many were taken. It fails once deadline
+// passes, the stream stops writing or the connection closes.
+func (s *Substream) acquireCredit(want int, deadline time.Time) (int, error) {
+	if s.conn.sendWindow == 0 {
+		return want, nil
+	}
+	var expired <-chan time.Time
+	for {
+		s.windowMu.Lock()
+		if s.windowOpen {
+			s.windowMu.Unlock()
+			return want, nil
+		}
+		if s.sendCredit > 0 {
+			n := int(min(int64(want), s.sendCredit))
+			s.sendCredit -= int64(n)
+			s.windowMu.Unlock()
+			return n, nil
+		}
+		s.windowMu.Unlock()
+
+		if s.localClosed.Load() || s.writeClosed.Load() {
+			return 0, errStreamClosed
+		}
+		if expired == nil && !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-s.windowGrant:
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-s.conn.closeCh:
+			return 0, network.ErrReset
+		}
+	}
+}
+
+// refundCredit returns n bytes of credit taken for a send that failed.
+func (s *Substream) refundCredit(n int) {
+	if s.conn.sendWindow == 0 {
+		return
+	}
+	s.grantCredit(uint32(n))
+}
+
+// grantCredit adds n bytes of send credit and wakes a blocked writer.
+func (s *Substream) grantCredit(n uint32) {
+	s.windowMu.Lock()
+	s.sendCredit += int64(n)
+	s.windowMu.Unlock()
+	s.wakeWriter()
+}
+
+// openWindow lifts flow control for good once the remote has stopped
+// reading, so writes are not left waiting for credit that never comes.
+func (s *Substream) openWindow() {
+	s.windowMu.Lock()
+	s.windowOpen = true
+	s.windowMu.Unlock()
+	s.wakeWriter()
+}
+
+// wakeWriter makes a writer waiting for credit check again.
+func (s *Substream) wakeWriter() {
+	select {
+	case s.windowGrant <- struct{}{}:
+	default:
+	}
+}
+
+// consumed returns n bytes read or discarded here to the remote's send
+// window, sending a window update once half the window has built up.
+func (s *Substream) consumed(n int) {
+	window := s.conn.recvWindow
+	if window == 0 || n <= 0 {
+		return
+	}
+	s.windowMu.Lock()
+	s.unacked += n
+	grant := 0
+	if s.unacked >= max(window/2, 1) {
+		grant, s.unacked = s.unacked, 0
+	}
+	s.windowMu.Unlock()
+	// Once the remote stopped writing it needs no more credit.
+	if grant == 0 || s.remoteClosed.Load() || s.localClosed.Load() {
+		return
+	}
+	_ = s.conn.sendSubstreamMessage(message.NewWindowUpdate(s.id, uint32(grant)))
+}
+
+// handleWindowUpdate adds the credit granted by the remote to the stream's
+// send window.
+func (c *Conn) handleWindowUpdate(id message.SubstreamID, credit uint32) {
+	if c.sendWindow == 0 {
+		return
+	}
+	stream := c.getStream(id)
+	if stream == nil {
+		return
+	}
+	stream.grantCredit(credit)
+}
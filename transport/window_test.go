@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStalledReaderBlocksWriter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const window = 4096
+	transportA, transportB := newTestTransports(t, ctx, WithStreamWindow(window))
+	_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	done := make(chan error, 1)
+	go func() {
+		_, err := streamAB.Write(payload)
+		done <- err
+	}()
+
+	// Nobody reads on B, so the writer stops once the window is spent.
+	waitFor(t, ctx, "the window to be written", func() bool {
+		return streamAB.bytesWritten.Load() == window
+	})
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("write finished past the window: %v", err)
+	default:
+	}
+	if got := streamAB.bytesWritten.Load(); got != window {
+		t.Fatalf("wrote %d bytes with a stalled reader, want %d", got, window)
+	}
+	if got := transportB.Stats().BufferedBytes; got > window {
+		t.Fatalf("reader buffered %d bytes, more than the window", got)
+	}
+
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(streamBA, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("payload corrupted")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestWriteDeadlineWhileWaitingForCredit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const window = 2048
+	transportA, transportB := newTestTransports(t, ctx, WithStreamWindow(window))
+	_, _, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+
+	streamAB.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := streamAB.Write(make([]byte, 3*window))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write error = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if n != window {
+		t.Fatalf("wrote %d bytes before the deadline, want %d", n, window)
+	}
+
+	// Reading returns the credit, so writing works again.
+	streamAB.SetWriteDeadline(time.Time{})
+	if _, err := io.ReadFull(streamBA, make([]byte, window)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if _, err := streamAB.Write(make([]byte, window)); err != nil {
+		t.Fatalf("write after read: %v", err)
+	}
+}
+
+func TestStreamWindowNeedsBothEnds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Only A offers a window, as when talking to a peer without flow
+	// control; neither direction may then wait for credit.
+	const window = 2048
+	transportA, transportB := newTestTransports(t, ctx)
+	transportA.cfg.streamWindow = window
+	connAB, connBA, streamAB, streamBA := openTestStreams(t, ctx, transportA, transportB)
+	if connAB.sendWindow != 0 || connAB.recvWindow != 0 || connBA.sendWindow != 0 {
+		t.Fatalf("flow control enabled with one end offering a window")
+	}
+
+	payload := make([]byte, 4*window)
+	for _, stream := range []*Substream{streamAB, streamBA} {
+		stream.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		if _, err := stream.Write(payload); err != nil {
+			t.Fatalf("write past the window: %v", err)
+		}
+	}
+}
+
+func TestStreamWindowIsNegotiated(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Each end limits its writes to the window the other offered.
+	transportA, transportB := newTestTransports(t, ctx, WithStreamWindow(4096))
+	transportB.cfg.streamWindow = 1024
+	connAB, connBA, _, _ := openTestStreams(t, ctx, transportA, transportB)
+	if connAB.sendWindow != 1024 || connAB.recvWindow != 4096 {
+		t.Fatalf("dialer windows %d/%d, want 1024/4096", connAB.sendWindow, connAB.recvWindow)
+	}
+	if connBA.sendWindow != 4096 || connBA.recvWindow != 1024 {
+		t.Fatalf("listener windows %d/%d, want 4096/1024", connBA.sendWindow, connBA.recvWindow)
+	}
+}